@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLog writes one JSON object per request.
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// openAccessLog opens the access log file for appending, or standard output
+// for "-".
+func openAccessLog(name string) (*accessLog, error) {
+	if name == "-" {
+		return &accessLog{w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLog{w: f, c: f}, nil
+}
+
+func (l *accessLog) close() {
+	if l.c != nil {
+		l.c.Close()
+	}
+}
+
+func (l *accessLog) write(entry map[string]interface{}) {
+	b, err := json.Marshal(entry)
+
+	if err != nil {
+		return
+	}
+
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	_, _ = l.w.Write(b)
+	l.mu.Unlock()
+}
+
+// logFields are extra access log fields added while serving a request.
+type logFields struct {
+	mu sync.Mutex
+	m  map[string]interface{}
+
+	// sample reports whether to log the request, given its status.
+	sample func(status int) bool
+}
+
+type logFieldsKey struct{}
+
+// setLogField adds a field to the access log entry of req, if logged.
+func setLogField(req *http.Request, key string, value interface{}) {
+	if f, ok := req.Context().Value(logFieldsKey{}).(*logFields); ok {
+		f.mu.Lock()
+		f.m[key] = value
+		f.mu.Unlock()
+	}
+}
+
+// setLogSampling makes logging req depend on sample, unless it is logged at
+// the warn level.
+func setLogSampling(req *http.Request, sample func(status int) bool) {
+	if f, ok := req.Context().Value(logFieldsKey{}).(*logFields); ok {
+		f.mu.Lock()
+		f.sample = sample
+		f.mu.Unlock()
+	}
+}
+
+// responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withAccessLog logs each request once it has been served, or once it has been
+// aborted with http.ErrAbortHandler.
+func withAccessLog(l *accessLog, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		fields := &logFields{m: make(map[string]interface{})}
+		rec := &responseRecorder{ResponseWriter: w}
+
+		ctx := context.WithValue(req.Context(), logFieldsKey{}, fields)
+		r := req.WithContext(ctx)
+
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					setLogField(r, "aborted", true)
+					logRequest(l, req, rec, fields, start)
+				}
+				panic(v)
+			}
+		}()
+
+		h.ServeHTTP(rec, r)
+		logRequest(l, req, rec, fields, start)
+	})
+}
+
+// logRequest writes the entry of req, unless sampled out.
+func logRequest(l *accessLog, req *http.Request, rec *responseRecorder, fields *logFields, start time.Time) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+
+	entry := fields.m
+
+	if fields.sample != nil && entry["level"] != "warn" &&
+		!fields.sample(rec.status) {
+		return
+	}
+	entry["time"] = start.Format(time.RFC3339Nano)
+	entry["client"] = clientIP(req)
+	entry["method"] = req.Method
+	entry["host"] = req.Host
+
+	// Stages may have set the URI with secrets hidden.
+	if _, ok := entry["uri"]; !ok {
+		entry["uri"] = req.RequestURI
+	}
+
+	entry["proto"] = req.Proto
+	entry["status"] = rec.status
+	entry["bytes"] = rec.bytes
+	entry["duration_ms"] = float64(time.Since(start).Microseconds()) / 1000
+	entry["user_agent"] = req.UserAgent()
+	entry["referer"] = req.Referer()
+
+	l.write(entry)
+}
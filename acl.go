@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// ACL describes which client IP addresses may use a route. Entries are
+// CIDR ranges, such as "10.0.0.0/8", or single addresses.
+type ACL struct {
+	// Allow is optional. If specified, only clients within it are
+	// allowed.
+	Allow []string `json:"allow"`
+
+	// Deny is optional. Clients within it are denied, even if allowed.
+	Deny []string `json:"deny"`
+
+	// Body is optional. It replaces the default 403 Forbidden response
+	// body.
+	Body string `json:"body"`
+}
+
+type acl struct {
+	allow, deny []*net.IPNet
+	body        string
+}
+
+func newACL(c *ACL) (*acl, error) {
+	allow, err := parseCIDRs(c.Allow)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parseCIDRs(c.Deny)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body := c.Body
+
+	if body == "" {
+		body = http.StatusText(http.StatusForbidden)
+	}
+
+	return &acl{allow: allow, deny: deny, body: body}, nil
+}
+
+func (a *acl) allowed(ip net.IP) bool {
+	if ip == nil || containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// withACL rejects clients not allowed by a with 403 Forbidden.
+func withACL(a *acl, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.allowed(net.ParseIP(clientIP(req))) {
+			http.Error(w, a.body, http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var adaptiveLimits = newGaugeVec("http_proxy_adaptive_concurrency_limit",
+	"Current adaptive concurrency limit of each backend.", "route", "upstream")
+
+// AdaptiveConcurrency describes limits on the requests in flight to each
+// backend of a route, which adapt to the backend's latency: the limit grows
+// while latency stays near the lowest seen, and shrinks when it rises or the
+// backend fails. Requests beyond the limit are shed with 503 Service
+// Unavailable.
+type AdaptiveConcurrency struct {
+	// InitialLimit is optional, defaulting to 20.
+	InitialLimit int `json:"initial_limit"`
+
+	// MinLimit is optional, defaulting to 1.
+	MinLimit int `json:"min_limit"`
+
+	// MaxLimit is optional, defaulting to 1000.
+	MaxLimit int `json:"max_limit"`
+
+	// Tolerance is optional. Latency above this multiple of the lowest
+	// latency seen shrinks the limit. It defaults to 2.
+	Tolerance float64 `json:"tolerance"`
+}
+
+const (
+	defaultAdaptiveInitial   = 20
+	defaultAdaptiveMax       = 1000
+	defaultAdaptiveTolerance = 2
+	adaptiveBackoff          = 0.9
+
+	// adaptiveRTTWindow is how long the lowest latency is remembered, so
+	// that limits follow lasting changes in backend latency.
+	adaptiveRTTWindow = 30 * time.Second
+
+	// adaptiveIdle is how long the limit of a backend without requests is
+	// kept, such as one no longer discovered.
+	adaptiveIdle = 5 * time.Minute
+)
+
+// errOverloaded is returned for requests shed by the adaptive limit.
+var errOverloaded = errors.New("proxy: backend concurrency limit reached")
+
+// adaptiveLimit is the AIMD controller of one backend.
+type adaptiveLimit struct {
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+
+	minRTT, prevMinRTT time.Duration
+	windowStart        time.Time
+
+	// published is the limit last reported in adaptiveLimits.
+	published int64
+
+	// used is when the limit was last looked up, guarded by the
+	// transport's mu.
+	used time.Time
+}
+
+type adaptiveTransport struct {
+	next      http.RoundTripper
+	route     string
+	initial   float64
+	min, max  float64
+	tolerance float64
+
+	mu     sync.Mutex
+	limits map[string]*adaptiveLimit
+	swept  time.Time
+}
+
+func newAdaptiveTransport(c *AdaptiveConcurrency, route string, next http.RoundTripper) (*adaptiveTransport, error) {
+	t := &adaptiveTransport{
+		next:      next,
+		route:     route,
+		initial:   float64(c.InitialLimit),
+		min:       float64(c.MinLimit),
+		max:       float64(c.MaxLimit),
+		tolerance: c.Tolerance,
+		limits:    make(map[string]*adaptiveLimit),
+		swept:     time.Now(),
+	}
+
+	if t.initial == 0 {
+		t.initial = defaultAdaptiveInitial
+	}
+
+	if t.min == 0 {
+		t.min = 1
+	}
+
+	if t.max == 0 {
+		t.max = defaultAdaptiveMax
+	}
+
+	if t.tolerance == 0 {
+		t.tolerance = defaultAdaptiveTolerance
+	}
+
+	if t.min < 1 || t.max < t.min || t.initial < t.min ||
+		t.initial > t.max || t.tolerance <= 1 {
+		return nil, errors.New("proxy: invalid adaptive concurrency limits")
+	}
+
+	return t, nil
+}
+
+// get returns the limit of upstream, discarding those of backends idle for
+// adaptiveIdle.
+func (t *adaptiveTransport) get(upstream string) *adaptiveLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(t.swept) > sweepInterval {
+		for k, l := range t.limits {
+			l.mu.Lock()
+
+			if l.inflight == 0 && now.Sub(l.used) > adaptiveIdle {
+				delete(t.limits, k)
+				adaptiveLimits.add(-l.published, t.route, k)
+			}
+
+			l.mu.Unlock()
+		}
+
+		t.swept = now
+	}
+
+	l, ok := t.limits[upstream]
+
+	if !ok {
+		l = &adaptiveLimit{limit: t.initial, windowStart: now}
+		t.limits[upstream] = l
+		l.publish(t.route, upstream)
+	}
+
+	l.used = now
+	return l
+}
+
+// publish updates the limit metric. l.mu is held, or l is new.
+func (l *adaptiveLimit) publish(route, upstream string) {
+	n := int64(l.limit)
+
+	if n != l.published {
+		adaptiveLimits.add(n-l.published, route, upstream)
+		l.published = n
+	}
+}
+
+func (t *adaptiveTransport) acquire(l *adaptiveLimit) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(l.inflight) >= l.limit {
+		return false
+	}
+
+	l.inflight++
+	return true
+}
+
+// observe records the latency and outcome of a request, adjusting the limit.
+func (t *adaptiveTransport) observe(l *adaptiveLimit, upstream string, rtt time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.windowStart) >= adaptiveRTTWindow {
+		l.prevMinRTT, l.minRTT = l.minRTT, 0
+		l.windowStart = now
+	}
+
+	if !failed && (l.minRTT == 0 || rtt < l.minRTT) {
+		l.minRTT = rtt
+	}
+
+	least := l.minRTT
+
+	if l.prevMinRTT != 0 && (least == 0 || l.prevMinRTT < least) {
+		least = l.prevMinRTT
+	}
+
+	if failed || float64(rtt) > t.tolerance*float64(least) {
+		l.limit *= adaptiveBackoff
+	} else {
+		l.limit += 1 / l.limit
+	}
+
+	if l.limit < t.min {
+		l.limit = t.min
+	} else if l.limit > t.max {
+		l.limit = t.max
+	}
+
+	l.publish(t.route, upstream)
+}
+
+func (l *adaptiveLimit) done() {
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+}
+
+// doneBody ends the request in flight once its response body is closed.
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	l    *adaptiveLimit
+}
+
+func (b *doneBody) Close() error {
+	b.once.Do(b.l.done)
+	return b.ReadCloser.Close()
+}
+
+func (t *adaptiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstream := req.URL.Host
+	l := t.get(upstream)
+
+	if !t.acquire(l) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errOverloaded
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	// Cancellation by the client says nothing of the backend.
+	if err == nil || req.Context().Err() == nil {
+		failed := err != nil || resp.StatusCode == http.StatusServiceUnavailable
+		t.observe(l, upstream, time.Since(start), failed)
+	}
+
+	// Upgraded connections are no longer counted.
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		l.done()
+		return resp, err
+	}
+
+	resp.Body = &doneBody{ReadCloser: resp.Body, l: l}
+	return resp, nil
+}
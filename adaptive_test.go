@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdaptivePrune(t *testing.T) {
+	at, err := newAdaptiveTransport(&AdaptiveConcurrency{}, "/",
+		http.DefaultTransport)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idle := at.get("idle:80")
+	busy := at.get("busy:80")
+
+	if !at.acquire(busy) {
+		t.Fatal("initial limit reached")
+	}
+
+	at.mu.Lock()
+	old := time.Now().Add(-2 * adaptiveIdle)
+	idle.used, busy.used = old, old
+	at.swept = old
+	at.mu.Unlock()
+
+	at.get("new:80")
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	if _, ok := at.limits["idle:80"]; ok {
+		t.Error("idle backend kept")
+	}
+
+	// Backends with requests in flight are kept.
+	if at.limits["busy:80"] != busy {
+		t.Error("busy backend discarded")
+	}
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Admin describes the administrative API server, which serves:
+//
+//	GET    /metrics      proxy metrics
+//	GET    /bans         list banned clients
+//	POST   /bans         ban a client: {"ip": "...", "duration": "1h"}
+//	DELETE /bans?ip=...  lift a ban
+//	POST   /cache/purge  purge cached responses by exact URL, URL prefix or
+//	                     surrogate key: {"url": "..."}, {"prefix": "..."}
+//	                     or {"tag": "..."}
+//	GET    /capture      list routes with body capture, and whether it is on
+//	POST   /capture      turn body capture on or off for a route, or all
+//	                     routes if omitted: {"route": "/api/", "enabled": true}
+type Admin struct {
+	// Port, in the form ":port" such as ":9090". Binding to a loopback
+	// address such as "127.0.0.1:9090" is recommended.
+	Port string `json:"port"`
+
+	// Token is optional if Port is a loopback address, and otherwise
+	// required. If specified, requests must carry it as
+	// "Authorization: Bearer <token>".
+	Token string `json:"token"`
+}
+
+type adminServer struct {
+	srv  *http.Server
+	done chan struct{}
+}
+
+// startAdmin serves the admin API until close is called.
+func startAdmin(a *Admin, errs chan<- error) *adminServer {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	mux.HandleFunc("/bans", serveBans)
+	mux.HandleFunc("/cache/purge", servePurge)
+	mux.HandleFunc("/capture", serveCapture)
+
+	var handler http.Handler = mux
+
+	if a.Token != "" {
+		handler = withToken(a.Token, mux)
+	}
+
+	as := &adminServer{
+		srv:  &http.Server{Handler: handler},
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(as.done)
+
+		ln, err := net.Listen("tcp", a.Port)
+
+		// Without a token, only local clients may use the API.
+		if err == nil && a.Token == "" &&
+			!ln.Addr().(*net.TCPAddr).IP.IsLoopback() {
+			ln.Close()
+			err = errors.New("proxy: admin token required unless " +
+				"bound to a loopback address")
+		}
+
+		if err == nil {
+			err = as.srv.Serve(ln)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+
+	return as
+}
+
+func (as *adminServer) close() {
+	as.srv.Close()
+	<-as.done
+}
+
+func withToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got := []byte(req.Header.Get("Authorization"))
+
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func serveBans(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, bans.list())
+	case http.MethodPost:
+		var b struct {
+			IP       string   `json:"ip"`
+			Duration Duration `json:"duration"`
+			Reason   string   `json:"reason"`
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if net.ParseIP(b.IP) == nil || b.Duration <= 0 {
+			http.Error(w, "ip and positive duration required",
+				http.StatusBadRequest)
+			return
+		}
+
+		if b.Reason == "" {
+			b.Reason = "admin"
+		}
+
+		ip := net.ParseIP(b.IP).String()
+		bans.add(ip, time.Duration(b.Duration), b.Reason)
+		audit.admin(req, "ban", map[string]interface{}{
+			"ip":       ip,
+			"duration": b.Duration,
+			"reason":   b.Reason,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		parsed := net.ParseIP(req.URL.Query().Get("ip"))
+
+		if parsed == nil {
+			http.Error(w, "ip required", http.StatusBadRequest)
+			return
+		}
+
+		ip := parsed.String()
+
+		if !bans.remove(ip) {
+			http.NotFound(w, req)
+			return
+		}
+
+		audit.admin(req, "unban", map[string]interface{}{"ip": ip})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// purgeKey returns the cache key form, host and request URI, of a URL given
+// with or without scheme.
+func purgeKey(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+
+	if err != nil {
+		return "", err
+	}
+
+	return u.Host + u.RequestURI(), nil
+}
+
+func servePurge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	var p struct {
+		URL    string `json:"url"`
+		Prefix string `json:"prefix"`
+		Tag    string `json:"tag"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var match func(*cachedResponse) bool
+
+	switch {
+	case p.URL != "":
+		key, err := purgeKey(p.URL)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		match = func(r *cachedResponse) bool { return r.Primary == key }
+	case p.Prefix != "":
+		prefix, err := purgeKey(p.Prefix)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Keep a bare host prefix from gaining the path "/".
+		if !strings.HasSuffix(p.Prefix, "/") {
+			prefix = strings.TrimSuffix(prefix, "/")
+		}
+
+		match = func(r *cachedResponse) bool {
+			return strings.HasPrefix(r.Primary, prefix)
+		}
+	case p.Tag != "":
+		match = func(r *cachedResponse) bool {
+			for _, tag := range r.tags() {
+				if tag == p.Tag {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		http.Error(w, "url, prefix or tag required", http.StatusBadRequest)
+		return
+	}
+
+	n := caches.purge(match)
+	audit.admin(req, "purge", map[string]interface{}{
+		"url":    p.URL,
+		"prefix": p.Prefix,
+		"tag":    p.Tag,
+		"purged": n,
+	})
+
+	writeJSON(w, struct {
+		Purged int `json:"purged"`
+	}{n})
+}
+
+func serveCapture(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, captures.list())
+	case http.MethodPost:
+		var c struct {
+			Route   string `json:"route"`
+			Enabled bool   `json:"enabled"`
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if captures.set(c.Route, c.Enabled) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+
+		audit.admin(req, "capture", map[string]interface{}{
+			"route":   c.Route,
+			"enabled": c.Enabled,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	tests := []struct {
+		a  Admin
+		ok bool
+	}{
+		{Admin{Port: "127.0.0.1:0"}, true},
+		{Admin{Port: ":0"}, false},
+		{Admin{Port: ":0", Token: "secret"}, true},
+	}
+
+	for _, tt := range tests {
+		errs := make(chan error, 1)
+		as := startAdmin(&tt.a, errs)
+
+		select {
+		case err := <-errs:
+			if tt.ok {
+				t.Errorf("%+v: %v", tt.a, err)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if !tt.ok {
+				t.Errorf("%+v: served without a token", tt.a)
+			}
+		}
+
+		as.close()
+	}
+}
+
+func TestServeBansDelete(t *testing.T) {
+	bans.add("2001:db8::1", time.Minute, "test")
+	defer bans.remove("2001:db8::1")
+
+	tests := []struct {
+		ip     string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"not-an-ip", http.StatusBadRequest},
+		{"2001:db8::2", http.StatusNotFound},
+		{"2001:0db8:0:0::1", http.StatusNoContent},
+		{"2001:db8::1", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete,
+			"/bans?ip="+url.QueryEscape(tt.ip), nil)
+		serveBans(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.ip, w.Code, tt.status)
+		}
+	}
+}
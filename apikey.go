@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// APIKey describes API key authentication for a route. Keys are read from a
+// header or query parameter and removed before the request is proxied.
+type APIKey struct {
+	// Header is optional, defaulting to "X-API-Key".
+	Header string `json:"header"`
+
+	// Query is optional. If specified, keys are also accepted in this
+	// query parameter.
+	Query string `json:"query"`
+
+	// Keys and File list the accepted keys. File is a JSON array of keys,
+	// in the same form as Keys.
+	Keys []APIKeyEntry `json:"keys"`
+	File string        `json:"file"`
+}
+
+// APIKeyEntry is an accepted API key.
+type APIKeyEntry struct {
+	// ID identifies the key in access logs and is forwarded to the
+	// backend in the X-API-Key-ID header.
+	ID string `json:"id"`
+
+	// Key is the secret value.
+	Key string `json:"key"`
+
+	// RateLimit is optional. It limits requests made with this key.
+	RateLimit *RateLimit `json:"rate_limit"`
+}
+
+type apiKeyAuth struct {
+	header string
+	query  string
+
+	// keys are indexed by the hash of their value, so lookups do not leak
+	// key prefixes through timing.
+	keys     map[[sha256.Size]byte]string
+	limiters map[string]limiter
+}
+
+func newAPIKeyAuth(s *scope, c *APIKey) (*apiKeyAuth, error) {
+	entries := c.Keys
+
+	if c.File != "" {
+		b, err := os.ReadFile(c.File)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var file []APIKeyEntry
+
+		if err = json.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("proxy: %s: %w", c.File, err)
+		}
+
+		entries = append(append([]APIKeyEntry(nil), entries...), file...)
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("proxy: api_key has no keys")
+	}
+
+	a := &apiKeyAuth{
+		header:   c.Header,
+		query:    c.Query,
+		keys:     make(map[[sha256.Size]byte]string),
+		limiters: make(map[string]limiter),
+	}
+
+	if a.header == "" {
+		a.header = "X-API-Key"
+	}
+
+	for _, e := range entries {
+		if e.ID == "" || e.Key == "" {
+			return nil, errors.New("proxy: api key requires id and key")
+		}
+
+		a.keys[sha256.Sum256([]byte(e.Key))] = e.ID
+
+		if e.RateLimit != nil {
+			l, err := newLimiter(s, e.RateLimit, "apikey:"+e.ID)
+
+			if err != nil {
+				return nil, err
+			}
+
+			a.limiters[e.ID] = l
+		}
+	}
+
+	return a, nil
+}
+
+// withAPIKey rejects requests without a valid key with 401 Unauthorized, and
+// requests beyond the key's rate limit with 429 Too Many Requests.
+func withAPIKey(a *apiKeyAuth, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(a.header)
+		req.Header.Del(a.header)
+
+		if a.query != "" {
+			if key == "" {
+				for _, p := range splitQuery(req.URL.RawQuery) {
+					if p.name == a.query {
+						key = p.value()
+						break
+					}
+				}
+			}
+
+			if raw, ok := removeQuery(req.URL.RawQuery, a.query); ok {
+				req.URL.RawQuery = raw
+
+				// Keep the key out of the access log.
+				setLogField(req, "uri", redactURI(req.RequestURI,
+					map[string]bool{a.query: true}))
+			}
+		}
+
+		id, ok := a.keys[sha256.Sum256([]byte(key))]
+
+		if key == "" || !ok {
+			if key != "" {
+				strike(req, "api key")
+			}
+
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		setLogField(req, "api_key", id)
+
+		if l, ok := a.limiters[id]; ok {
+			if ok, wait := l.take(req.Context()); !ok {
+				strike(req, "rate limit")
+				shed(w, req, http.StatusTooManyRequests, wait,
+					"api key rate limit exceeded")
+				return
+			}
+		}
+
+		req.Header.Set("X-API-Key-ID", id)
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := newAPIKeyAuth(&scope{ctx: ctx}, &APIKey{
+		Query: "api_key",
+		Keys:  []APIKeyEntry{{ID: "ci", Key: "s3cret"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	var query, header string
+
+	h := withAccessLog(&accessLog{w: &log}, withAPIKey(a, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, header = req.URL.RawQuery, req.Header.Get("X-API-Key")
+	})))
+
+	tests := []struct {
+		target, header string
+		want           int
+		query          string
+	}{
+		{"/x?b=2&a=1", "s3cret", http.StatusOK, "b=2&a=1"},
+		// Other pairs are passed on as sent.
+		{"/x?z=a+b&api_key=s3cret&y=%20&bad=%zz", "", http.StatusOK,
+			"z=a+b&y=%20&bad=%zz"},
+		{"/x?api_key=wrong-s3cret", "", http.StatusUnauthorized, ""},
+		{"/x?api_key=", "", http.StatusUnauthorized, ""},
+		{"/x", "wrong", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		query, header = "", ""
+		log.Reset()
+
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+
+		if tt.header != "" {
+			req.Header.Set("X-API-Key", tt.header)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.want)
+		}
+
+		if tt.want == http.StatusOK && (query != tt.query || header != "") {
+			t.Errorf("%s: backend query %q, key header %q", tt.target, query,
+				header)
+		}
+
+		// Keys never reach the access log.
+		if strings.Contains(log.String(), "s3cret") {
+			t.Errorf("%s: logged %s", tt.target, log.String())
+		}
+
+		if !strings.Contains(log.String(), `"uri":"/x`) {
+			t.Errorf("%s: logged no URI: %s", tt.target, log.String())
+		}
+	}
+}
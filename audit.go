@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// audit is the audit log of configuration and admin changes, if enabled.
+var audit = &auditLog{}
+
+// auditLog appends one JSON object per change to a file, which it never
+// truncates.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+
+	// last is the configuration last applied, by proxy port and route.
+	last map[string]map[string]string
+}
+
+func (a *auditLog) open(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f != nil {
+		a.f.Close()
+	}
+
+	a.f = f
+	return nil
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+}
+
+// record writes an entry for the event, done by who, with details.
+func (a *auditLog) record(who, event string, details map[string]interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"who":   who,
+		"event": event,
+	}
+
+	for k, v := range details {
+		entry[k] = v
+	}
+
+	b, err := json.Marshal(entry)
+
+	if err != nil {
+		return
+	}
+
+	_, _ = a.f.Write(append(b, '\n'))
+}
+
+// admin records a change made through the admin API.
+func (a *auditLog) admin(req *http.Request, event string, details map[string]interface{}) {
+	a.record("admin "+req.RemoteAddr, event, details)
+}
+
+// auditSecrets hides the values of settings which may be secrets, such as
+// passwords, tokens and keys, from the audit log.
+var auditSecrets = &capture{fields: map[string]bool{
+	"bind_password": true,
+	"client_secret": true,
+	"cookie_secret": true,
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+}}
+
+// auditChange is a proxy or route added, removed or changed, with its
+// settings which differ before and after.
+type auditChange struct {
+	Name   string                 `json:"name"`
+	Before map[string]interface{} `json:"before,omitempty"`
+	After  map[string]interface{} `json:"after,omitempty"`
+}
+
+// diffSettings returns the settings, given as JSON objects, which differ
+// between old and new, either of which may be "". Settings which are null
+// are left out.
+func diffSettings(old, new string) (before, after map[string]interface{}) {
+	decode := func(s string) map[string]interface{} {
+		m := make(map[string]interface{})
+
+		if s != "" {
+			_ = json.Unmarshal([]byte(s), &m)
+		}
+
+		auditSecrets.redact(m)
+		return m
+	}
+
+	o, n := decode(old), decode(new)
+	before = make(map[string]interface{})
+	after = make(map[string]interface{})
+
+	for _, m := range []map[string]interface{}{o, n} {
+		for k := range m {
+			if reflect.DeepEqual(o[k], n[k]) {
+				continue
+			}
+
+			if o[k] != nil {
+				before[k] = o[k]
+			}
+
+			if n[k] != nil {
+				after[k] = n[k]
+			}
+		}
+	}
+
+	return before, after
+}
+
+// snapshotProxy returns the JSON of the proxy's settings, under "", and
+// routes.
+func snapshotProxy(r ReverseProxy) map[string]string {
+	routes := make(map[string]string)
+
+	for _, route := range r.Routes {
+		b, _ := json.Marshal(route)
+		routes[route.From] = string(b)
+	}
+
+	r.Routes = nil
+	b, _ := json.Marshal(r)
+	routes[""] = string(b)
+	return routes
+}
+
+// snapshot returns the JSON of each proxy's settings, under "", and routes,
+// by proxy port and route.
+func snapshot(p *Proxies) map[string]map[string]string {
+	m := make(map[string]map[string]string)
+
+	for _, r := range p.Proxies {
+		m[r.Port] = snapshotProxy(r)
+	}
+
+	return m
+}
+
+// configure records the configuration applied, with the proxies and routes
+// added, removed or changed since the last.
+func (a *auditLog) configure(p *Proxies) {
+	who := p.Source
+
+	if who == "" {
+		who = "config"
+	}
+
+	a.apply(who, func(map[string]map[string]string) map[string]map[string]string {
+		return snapshot(p)
+	})
+}
+
+// reconfigure records the settings of the proxy on port replaced by r.
+func (a *auditLog) reconfigure(who, port string, r ReverseProxy) {
+	a.apply(who, func(last map[string]map[string]string) map[string]map[string]string {
+		next := make(map[string]map[string]string, len(last)+1)
+
+		for k, v := range last {
+			next[k] = v
+		}
+
+		delete(next, port)
+		next[r.Port] = snapshotProxy(r)
+		return next
+	})
+}
+
+// apply records the configuration returned by update, given the last, with
+// the changes between them.
+func (a *auditLog) apply(who string, update func(last map[string]map[string]string) map[string]map[string]string) {
+	a.mu.Lock()
+	last := a.last
+	next := update(last)
+	a.last = next
+	a.mu.Unlock()
+
+	var added, removed, changed []auditChange
+
+	// Proxies are named by port, and routes by port and From.
+	diff := func(port string, old, new map[string]string) {
+		name := func(k string) string {
+			if k == "" {
+				return port
+			}
+			return port + " " + k
+		}
+
+		for k, v := range new {
+			o, ok := old[k]
+
+			switch {
+			case !ok:
+				_, after := diffSettings("", v)
+				added = append(added, auditChange{Name: name(k), After: after})
+			case o != v:
+				before, after := diffSettings(o, v)
+				changed = append(changed, auditChange{name(k), before, after})
+			}
+		}
+
+		for k, o := range old {
+			if _, ok := new[k]; !ok {
+				before, _ := diffSettings(o, "")
+				removed = append(removed, auditChange{Name: name(k), Before: before})
+			}
+		}
+	}
+
+	for port, routes := range next {
+		diff(port, last[port], routes)
+	}
+
+	for port, routes := range last {
+		if _, ok := next[port]; !ok {
+			diff(port, routes, nil)
+		}
+	}
+
+	for _, c := range [][]auditChange{added, removed, changed} {
+		sort.Slice(c, func(i, j int) bool { return c[i].Name < c[j].Name })
+	}
+
+	a.record(who, "configure", map[string]interface{}{
+		"added":   added,
+		"removed": removed,
+		"changed": changed,
+	})
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAuditConfigure(t *testing.T) {
+	a := &auditLog{}
+	name := filepath.Join(t.TempDir(), "audit.log")
+
+	if err := a.open(name); err != nil {
+		t.Fatal(err)
+	}
+
+	a.configure(&Proxies{Source: "a.json", Proxies: []ReverseProxy{{
+		Port: ":8080",
+		Routes: []Route{
+			{From: "/", To: "http://a"},
+			{From: "/old", To: "http://old", HMAC: &HMAC{Secret: "s1"}},
+		},
+	}}})
+
+	a.configure(&Proxies{Source: "b.json", Proxies: []ReverseProxy{{
+		Port: ":8080",
+		Routes: []Route{
+			{From: "/", To: "http://b"},
+			{From: "/new", To: "http://new"},
+		},
+	}}})
+
+	a.reconfigure("handle", ":8080", ReverseProxy{Port: ":9090"})
+	a.close()
+
+	f, err := os.Open(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	type change struct {
+		Name   string
+		Before map[string]interface{}
+		After  map[string]interface{}
+	}
+
+	type entry struct {
+		Who, Event              string
+		Added, Removed, Changed []change
+	}
+
+	var entries []entry
+
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e entry
+
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("%d entries, want 3", len(entries))
+	}
+
+	first := entries[0]
+
+	if first.Who != "a.json" || len(first.Added) != 3 {
+		t.Errorf("first entry %+v", first)
+	} else if hmac := first.Added[2].After["hmac"].(map[string]interface{}); hmac["secret"] != redacted {
+		t.Errorf("logged secret %v", hmac["secret"])
+	}
+
+	second := entries[1]
+	want := []change{{Name: ":8080 /", Before: map[string]interface{}{"to": "http://a"},
+		After: map[string]interface{}{"to": "http://b"}}}
+
+	if second.Who != "b.json" || len(second.Added) != 1 ||
+		second.Added[0].Name != ":8080 /new" || len(second.Removed) != 1 ||
+		second.Removed[0].Name != ":8080 /old" ||
+		!reflect.DeepEqual(second.Changed, want) {
+		t.Errorf("second entry %+v", second)
+	}
+
+	third := entries[2]
+
+	if third.Who != "handle" || len(third.Added) != 1 ||
+		third.Added[0].Name != ":9090" || len(third.Removed) != 3 {
+		t.Errorf("third entry %+v", third)
+	}
+}
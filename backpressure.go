@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// shed responds to a request refused under load with an RFC 7807 problem
+// details body, asking the client to retry after wait, at least a second.
+func shed(w http.ResponseWriter, req *http.Request, status int, wait time.Duration, detail string) {
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	after := retryAfter(wait)
+	seconds, _ := strconv.Atoi(after)
+
+	problem := map[string]interface{}{
+		"type":        "about:blank",
+		"title":       http.StatusText(status),
+		"status":      status,
+		"detail":      detail,
+		"retry_after": seconds,
+	}
+
+	if id := requestID(req); id != "" {
+		problem["request_id"] = id
+	}
+
+	b, _ := json.Marshal(problem)
+
+	w.Header().Set("Retry-After", after)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)+1))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
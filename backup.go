@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultBackupCooldown = 10 * time.Second
+
+// newBackups returns the backup targets of route.
+func newBackups(route Route) ([]target, error) {
+	if route.BackupCooldown < 0 {
+		return nil, errors.New("proxy: negative backup_cooldown")
+	}
+
+	backups := make([]target, len(route.Backups))
+
+	for i, addr := range route.Backups {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, errors.New("proxy: invalid backup " + addr)
+		}
+
+		backups[i] = target{Addr: addr}
+	}
+
+	return backups, nil
+}
+
+// healthTransport marks backends of a pool down when requests to them fail,
+// and up once they succeed.
+type healthTransport struct {
+	next http.RoundTripper
+	pool *pool
+}
+
+func (t healthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+
+	switch {
+	case err == nil:
+		t.pool.markUp(req.URL.Host)
+	case req.Context().Err() == nil:
+		// Requests cancelled by the client say nothing of the backend.
+		t.pool.markDown(req.URL.Host)
+	}
+
+	return resp, err
+}
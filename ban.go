@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban describes when clients are automatically banned from a proxy for
+// repeatedly tripping rate limits or failing authentication.
+type Ban struct {
+	// Strikes is the number of failures within Window which bans a client.
+	Strikes int `json:"strikes"`
+
+	// Window is optional, defaulting to 1m.
+	Window Duration `json:"window"`
+
+	// Duration is optional. It is how long a ban lasts, defaulting to 10m.
+	Duration Duration `json:"duration"`
+}
+
+const (
+	defaultBanWindow   = time.Minute
+	defaultBanDuration = 10 * time.Minute
+)
+
+// BannedClient is an entry in the ban list.
+type BannedClient struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// banList holds the banned clients of all proxies.
+type banList struct {
+	mu      sync.Mutex
+	clients map[string]BannedClient
+}
+
+var bans = &banList{clients: make(map[string]BannedClient)}
+
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.clients[ip]
+
+	if ok && time.Now().After(c.Until) {
+		delete(b.clients, ip)
+		return false
+	}
+
+	return ok
+}
+
+func (b *banList) add(ip string, d time.Duration, reason string) {
+	b.mu.Lock()
+	b.clients[ip] = BannedClient{
+		IP:     ip,
+		Until:  time.Now().Add(d),
+		Reason: reason,
+	}
+	b.mu.Unlock()
+}
+
+func (b *banList) remove(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.clients[ip]
+	delete(b.clients, ip)
+	return ok
+}
+
+func (b *banList) list() []BannedClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	list := make([]BannedClient, 0, len(b.clients))
+
+	for ip, c := range b.clients {
+		if now.After(c.Until) {
+			delete(b.clients, ip)
+			continue
+		}
+		list = append(list, c)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// striker counts failures per client, banning those with too many.
+type striker struct {
+	strikes  int
+	window   time.Duration
+	duration time.Duration
+
+	mu      sync.Mutex
+	clients map[string][]time.Time
+	swept   time.Time
+}
+
+func newStriker(c *Ban) (*striker, error) {
+	if c.Strikes <= 0 {
+		return nil, errors.New("proxy: ban strikes must be positive")
+	}
+
+	if c.Window < 0 || c.Duration < 0 {
+		return nil, errors.New("proxy: negative ban duration")
+	}
+
+	s := &striker{
+		strikes:  c.Strikes,
+		window:   defaultBanWindow,
+		duration: defaultBanDuration,
+		clients:  make(map[string][]time.Time),
+		swept:    time.Now(),
+	}
+
+	if c.Window != 0 {
+		s.window = time.Duration(c.Window)
+	}
+
+	if c.Duration != 0 {
+		s.duration = time.Duration(c.Duration)
+	}
+
+	return s, nil
+}
+
+func (s *striker) strike(ip, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-s.window)
+
+	if now.Sub(s.swept) > s.window {
+		for k, times := range s.clients {
+			if times[len(times)-1].Before(cutoff) {
+				delete(s.clients, k)
+			}
+		}
+		s.swept = now
+	}
+
+	times := s.clients[ip]
+
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+
+	times = append(times, now)
+
+	if len(times) >= s.strikes {
+		bans.add(ip, s.duration, reason)
+		delete(s.clients, ip)
+		return
+	}
+
+	s.clients[ip] = times
+}
+
+type strikerKey struct{}
+
+// strike records a failure by the client of req, such as tripping a rate
+// limit, if the proxy bans clients.
+func strike(req *http.Request, reason string) {
+	if s, ok := req.Context().Value(strikerKey{}).(*striker); ok {
+		s.strike(clientIP(req), reason)
+	}
+}
+
+// withBans rejects banned clients with 403 Forbidden. If s is non-nil,
+// failures are counted towards bans.
+func withBans(s *striker, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if bans.banned(clientIP(req)) {
+			http.Error(w, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+
+		if s != nil {
+			ctx := context.WithValue(req.Context(), strikerKey{}, s)
+			req = req.WithContext(ctx)
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BasicAuth describes HTTP Basic authentication for a route. Credentials
+// are verified against an htpasswd file or an LDAP server.
+type BasicAuth struct {
+	// File is an htpasswd file. Passwords may be hashed with bcrypt
+	// ("htpasswd -B"), Apache MD5 ("$apr1$"), or SHA-1 ("{SHA}").
+	File string `json:"file"`
+
+	// LDAP is optional. If specified, it is used instead of File.
+	LDAP *LDAP `json:"ldap"`
+
+	// Realm is optional, defaulting to "Restricted".
+	Realm string `json:"realm"`
+}
+
+// Verified credentials are cached, which avoids running bcrypt or querying
+// LDAP on every request.
+const (
+	basicAuthCacheSize = 1024
+	basicAuthCacheTTL  = 5 * time.Minute
+)
+
+type basicAuth struct {
+	users map[string]string
+	ldap  *ldapClient
+	realm string
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newBasicAuth(c *BasicAuth) (*basicAuth, error) {
+	a := &basicAuth{
+		realm:    c.Realm,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+
+	var err error
+
+	if c.LDAP != nil {
+		a.ldap, err = newLDAPClient(c.LDAP)
+	} else {
+		a.users, err = readHtpasswd(c.File)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if a.realm == "" {
+		a.realm = "Restricted"
+	}
+
+	return a, nil
+}
+
+func readHtpasswd(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+
+		if i <= 0 {
+			return nil, fmt.Errorf("proxy: %s:%d: malformed line", name, n)
+		}
+
+		users[line[:i]] = line[i+1:]
+	}
+
+	return users, s.Err()
+}
+
+var errUnsupportedHash = errors.New("proxy: unsupported htpasswd hash")
+
+func checkPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcryptCompare(hash, password)
+	case strings.HasPrefix(hash, "$apr1$"):
+		return subtle.ConstantTimeCompare([]byte(apr1(password, hash)),
+			[]byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1,
+			nil
+	}
+	return false, errUnsupportedHash
+}
+
+// apr1 computes the Apache MD5 crypt of password, taking the salt from hash.
+func apr1(password, hash string) string {
+	const magic = "$apr1$"
+
+	salt := strings.TrimPrefix(hash, magic)
+
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	sum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic + salt))
+
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(sum)
+		} else {
+			ctx.Write(sum[:i])
+		}
+	}
+
+	for i := len(pw); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else if len(pw) > 0 {
+			ctx.Write(pw[:1])
+		}
+	}
+
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+
+		final = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14},
+		{3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|
+			uint32(final[g[2]]), 4)
+	}
+
+	to64(uint32(final[11]), 2)
+	return b.String()
+}
+
+// authenticate returns the user if the request carries valid credentials.
+func (a *basicAuth) authenticate(req *http.Request) (string, bool) {
+	user, password, ok := req.BasicAuth()
+
+	if !ok {
+		return "", false
+	}
+
+	key := sha256.Sum256([]byte(strconv.Quote(user) + password))
+	now := time.Now()
+
+	a.mu.Lock()
+	expires, ok := a.verified[key]
+	a.mu.Unlock()
+
+	if ok && now.Before(expires) {
+		return user, true
+	}
+
+	if a.ldap != nil {
+		ok = a.ldap.check(user, password) == nil
+	} else if hash, found := a.users[user]; found {
+		ok, _ = checkPassword(hash, password)
+	} else {
+		ok = false
+	}
+
+	if !ok {
+		return "", false
+	}
+
+	a.mu.Lock()
+	if len(a.verified) >= basicAuthCacheSize {
+		a.verified = make(map[[sha256.Size]byte]time.Time)
+	}
+	a.verified[key] = now.Add(basicAuthCacheTTL)
+	a.mu.Unlock()
+
+	return user, true
+}
+
+// withBasicAuth requires valid credentials, forwarding the user to the
+// backend in the X-Forwarded-User header instead of the credentials.
+func withBasicAuth(a *basicAuth, h http.Handler) http.Handler {
+	challenge := "Basic realm=" + strconv.Quote(a.realm) + `, charset="UTF-8"`
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, ok := a.authenticate(req)
+
+		if !ok {
+			if _, _, sent := req.BasicAuth(); sent {
+				strike(req, "basic auth")
+			}
+
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		req.Header.Del("Authorization")
+		req.Header.Set("X-Forwarded-User", user)
+		h.ServeHTTP(w, req)
+	})
+}
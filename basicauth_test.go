@@ -0,0 +1,35 @@
+package proxy
+
+import "testing"
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		hash, password string
+		ok             bool
+	}{
+		{"$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1", "password", true},
+		{"$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1", "Password", false},
+		{"$apr1$8sFt66rZ$ZK/HHVsqm79bDB18vhVxp1", "U*U*", true},
+		{"$apr1$8sFt66rZ$ZK/HHVsqm79bDB18vhVxp1", "U*U", false},
+		{"$apr1$abcdefgh$L.PT565ESX4Tp2bqNs7Ie.", "", true},
+		{"$apr1$abcdefgh$L.PT565ESX4Tp2bqNs7Ie.", "password", false},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "passwd", false},
+		{"$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U", true},
+	}
+
+	for _, tt := range tests {
+		ok, err := checkPassword(tt.hash, tt.password)
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.hash, err)
+		} else if ok != tt.ok {
+			t.Errorf("%s, %q: matched %t, want %t", tt.hash, tt.password, ok,
+				tt.ok)
+		}
+	}
+
+	if _, err := checkPassword("password", "password"); err != errUnsupportedHash {
+		t.Errorf("plain text: error %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+)
+
+// A bcrypt verifier, so that htpasswd files created with "htpasswd -B" can
+// be used without depending on golang.org/x/crypto.
+
+// blowfish is the Blowfish cipher state.
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+var (
+	piOnce  sync.Once
+	piState blowfish
+)
+
+// initPi computes the initial Blowfish state, which is the fractional part
+// of pi, rather than embedding 4 KiB of constants. It takes a few
+// milliseconds and is run once.
+func initPi() {
+	const words = 18 + 4*256
+	bits := uint(words*32 + 64)
+	one := new(big.Int).Lsh(big.NewInt(1), bits)
+
+	// Machin's formula: pi = 16 atan(1/5) - 4 atan(1/239).
+	pi := new(big.Int).Mul(atanInv(5, one), big.NewInt(16))
+	pi.Sub(pi, new(big.Int).Mul(atanInv(239, one), big.NewInt(4)))
+	pi.Sub(pi, new(big.Int).Lsh(big.NewInt(3), bits))
+	pi.Rsh(pi, 64)
+
+	b := pi.FillBytes(make([]byte, words*4))
+	word := func(i int) uint32 {
+		return uint32(b[4*i])<<24 | uint32(b[4*i+1])<<16 |
+			uint32(b[4*i+2])<<8 | uint32(b[4*i+3])
+	}
+
+	for i := range piState.p {
+		piState.p[i] = word(i)
+	}
+
+	for i := range piState.s {
+		for j := range piState.s[i] {
+			piState.s[i][j] = word(18 + 256*i + j)
+		}
+	}
+}
+
+// atanInv returns atan(1/x) scaled by one.
+func atanInv(x int64, one *big.Int) *big.Int {
+	sum := new(big.Int)
+	xx := big.NewInt(x * x)
+	term := new(big.Int).Div(one, big.NewInt(x))
+	t := new(big.Int)
+
+	for k := int64(0); term.Sign() != 0; k++ {
+		t.Div(term, big.NewInt(2*k+1))
+
+		if k%2 == 0 {
+			sum.Add(sum, t)
+		} else {
+			sum.Sub(sum, t)
+		}
+
+		term.Div(term, xx)
+	}
+
+	return sum
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) +
+		c.s[3][x&0xff]
+}
+
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	for i := 0; i < 16; i += 2 {
+		l ^= c.p[i]
+		r ^= c.f(l)
+		r ^= c.p[i+1]
+		l ^= c.f(r)
+	}
+
+	l ^= c.p[16]
+	r ^= c.p[17]
+	return r, l
+}
+
+// streamWord reads the next cyclic big-endian word of b.
+func streamWord(b []byte, pos *int) uint32 {
+	var w uint32
+
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(b[*pos])
+		*pos = (*pos + 1) % len(b)
+	}
+
+	return w
+}
+
+// expandKey is the Blowfish key schedule, mixing in salt when non-nil.
+func (c *blowfish) expandKey(key, salt []byte) {
+	pos := 0
+
+	for i := range c.p {
+		c.p[i] ^= streamWord(key, &pos)
+	}
+
+	var l, r uint32
+	spos := 0
+
+	next := func() {
+		if salt != nil {
+			l ^= streamWord(salt, &spos)
+			r ^= streamWord(salt, &spos)
+		}
+		l, r = c.encrypt(l, r)
+	}
+
+	for i := 0; i < len(c.p); i += 2 {
+		next()
+		c.p[i], c.p[i+1] = l, r
+	}
+
+	for i := range c.s {
+		for j := 0; j < 256; j += 2 {
+			next()
+			c.s[i][j], c.s[i][j+1] = l, r
+		}
+	}
+}
+
+var bcryptEncoding = base64.NewEncoding(
+	"./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").
+	WithPadding(base64.NoPadding)
+
+var errBcryptHash = errors.New("proxy: malformed bcrypt hash")
+
+// bcryptCompare reports whether password matches the bcrypt hash, such as
+// "$2y$10$...".
+func bcryptCompare(hash, password string) (bool, error) {
+	if len(hash) != 60 || hash[0] != '$' || hash[1] != '2' ||
+		hash[3] != '$' || hash[6] != '$' {
+		return false, errBcryptHash
+	}
+
+	switch hash[2] {
+	case 'a', 'b', 'y':
+	default:
+		return false, errBcryptHash
+	}
+
+	cost, err := strconv.Atoi(hash[4:6])
+
+	if err != nil || cost < 4 || cost > 31 {
+		return false, errBcryptHash
+	}
+
+	salt, err := bcryptEncoding.DecodeString(hash[7:29])
+
+	if err != nil || len(salt) != 16 {
+		return false, errBcryptHash
+	}
+
+	key := append([]byte(password), 0)
+
+	if len(key) > 72 {
+		key = key[:72]
+	}
+
+	piOnce.Do(initPi)
+	c := piState
+	c.expandKey(key, salt)
+
+	for i := 0; i < 1<<uint(cost); i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	text := []byte("OrpheanBeholderScryDoubt")
+	var words [6]uint32
+	pos := 0
+
+	for i := range words {
+		words[i] = streamWord(text, &pos)
+	}
+
+	for i := 0; i < 64; i++ {
+		for j := 0; j < len(words); j += 2 {
+			words[j], words[j+1] = c.encrypt(words[j], words[j+1])
+		}
+	}
+
+	out := make([]byte, 24)
+
+	for i, w := range words {
+		out[4*i] = byte(w >> 24)
+		out[4*i+1] = byte(w >> 16)
+		out[4*i+2] = byte(w >> 8)
+		out[4*i+3] = byte(w)
+	}
+
+	got := hash[:29] + bcryptEncoding.EncodeToString(out[:23])
+	return subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1, nil
+}
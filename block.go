@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// BlockRule describes requests to reject, such as those of known scanners.
+type BlockRule struct {
+	// Header is optional. It is the request header to match, by default
+	// "User-Agent".
+	Header string `json:"header"`
+
+	// Match is a regular expression matched against each value of the
+	// header.
+	Match string `json:"match"`
+}
+
+type blockRule struct {
+	header string
+	re     *regexp.Regexp
+}
+
+func newBlockRules(c []BlockRule) ([]blockRule, error) {
+	rules := make([]blockRule, len(c))
+
+	for i, r := range c {
+		re, err := regexp.Compile(r.Match)
+
+		if err != nil {
+			return nil, err
+		}
+
+		header := r.Header
+
+		if header == "" {
+			header = "User-Agent"
+		}
+
+		rules[i] = blockRule{header: http.CanonicalHeaderKey(header), re: re}
+	}
+
+	return rules, nil
+}
+
+func blocked(rules []blockRule, req *http.Request) bool {
+	for _, r := range rules {
+		for _, v := range req.Header[r.header] {
+			if r.re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withBlockRules rejects requests matching any of rules with 403 Forbidden.
+func withBlockRules(rules []blockRule, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if blocked(rules, req) {
+			strike(req, "blocked")
+			http.Error(w, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
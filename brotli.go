@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+// brotliWriter compresses to the brotli format (RFC 7932). Each block is a
+// meta-block with one prefix code per alphabet and no context modeling.
+type brotliWriter struct {
+	w       io.Writer
+	m       *matcher
+	buf     []byte
+	b       bitWriter
+	started bool
+	err     error
+
+	seqs []lzSeq
+}
+
+const (
+	brotliInsertCopyAlphabet = 704
+	brotliDistanceAlphabet   = 64
+)
+
+// Base values and extra bits of insert and copy length codes.
+var (
+	brotliInsertBase = []uint32{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34,
+		50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	brotliInsertBits = []uint8{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5,
+		5, 6, 7, 8, 9, 10, 12, 14, 24}
+	brotliCopyBase = []uint32{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22,
+		30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	brotliCopyBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4,
+		5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// brotliCodeLengthOrder is the order in which code length code lengths are
+// stored.
+var brotliCodeLengthOrder = []int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10,
+	11, 12, 13, 14, 15}
+
+// brotliCodeLengthCodes are the fixed codes of code length code lengths 0
+// to 5, with their lengths.
+var brotliCodeLengthCodes = [6][2]uint8{
+	{0, 2}, {7, 4}, {3, 3}, {2, 2}, {1, 2}, {15, 4},
+}
+
+func brotliLengthCode(v uint32, base []uint32, bits []uint8) (int, uint32, uint8) {
+	i := len(base) - 1
+
+	for base[i] > v {
+		i--
+	}
+
+	return i, v - base[i], bits[i]
+}
+
+// brotliCommandCode returns the insert-and-copy symbol of the length codes,
+// always from the cells with an explicit distance.
+func brotliCommandCode(ins, cp int) int {
+	var cell int
+
+	switch {
+	case ins < 8 && cp < 8:
+		cell = 128
+	case ins < 8 && cp < 16:
+		cell = 192
+	case ins < 8:
+		cell = 384
+	case ins < 16 && cp < 8:
+		cell = 256
+	case ins < 16 && cp < 16:
+		cell = 320
+	case ins < 16:
+		cell = 512
+	case cp < 8:
+		cell = 448
+	case cp < 16:
+		cell = 576
+	default:
+		cell = 640
+	}
+
+	return cell | (ins&7)<<3 | cp&7
+}
+
+// brotliDistanceCode returns the distance code and extra bits of a distance,
+// without postfix bits or direct codes.
+func brotliDistanceCode(d int) (int, uint32, uint) {
+	v := uint32(d + 3)
+	nbits := highBit(v) - 1
+	h := (v >> nbits) & 1
+	return 16 + 2*int(nbits-1) + int(h), v - (2+h)<<nbits, nbits
+}
+
+// newBrotliWriter returns a writer compressing at level, from 1 to 11.
+func newBrotliWriter(w io.Writer, level int) *brotliWriter {
+	depth := 1 << uint(level/2+1)
+	return &brotliWriter{w: w, m: newMatcher(depth, level >= 5)}
+}
+
+func (z *brotliWriter) Reset(w io.Writer) {
+	z.w = w
+	z.m.reset()
+	z.buf = z.buf[:0]
+	z.b = bitWriter{out: z.b.out[:0]}
+	z.started = false
+	z.err = nil
+}
+
+func (z *brotliWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		k := lzBlockSize - len(z.buf)
+
+		if k > len(p) {
+			k = len(p)
+		}
+
+		z.buf = append(z.buf, p[:k]...)
+		p = p[k:]
+
+		if len(z.buf) == lzBlockSize {
+			z.metaBlock()
+
+			if err := z.emit(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Flush writes the buffered input as a meta-block, then an empty metadata
+// meta-block to reach a byte boundary.
+func (z *brotliWriter) Flush() error {
+	if z.err != nil {
+		return z.err
+	}
+
+	z.header()
+	z.metaBlock()
+
+	// ISLAST = 0, MNIBBLES = 0 (metadata), reserved, MSKIPBYTES = 0.
+	z.b.write(0, 1)
+	z.b.write(3, 2)
+	z.b.write(0, 1)
+	z.b.write(0, 2)
+	z.b.align()
+
+	return z.emit()
+}
+
+// Close writes the buffered input and the last, empty meta-block.
+func (z *brotliWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+
+	z.header()
+	z.metaBlock()
+
+	// ISLAST = 1, ISLASTEMPTY = 1.
+	z.b.write(3, 2)
+	z.b.align()
+
+	err := z.emit()
+
+	if err == nil {
+		z.err = errors.New("proxy: brotli writer closed")
+	}
+
+	return err
+}
+
+// header writes the stream header, a window of 256 KiB less 16 bytes.
+func (z *brotliWriter) header() {
+	if !z.started {
+		z.b.write(1, 1)
+		z.b.write(18-17, 3)
+		z.started = true
+	}
+}
+
+// emit writes the whole bytes of output.
+func (z *brotliWriter) emit() error {
+	if len(z.b.out) == 0 {
+		return nil
+	}
+
+	_, err := z.w.Write(z.b.out)
+	z.b.out = z.b.out[:0]
+
+	if err != nil {
+		z.err = err
+	}
+
+	return err
+}
+
+// metaBlock writes the buffered input as a compressed meta-block.
+func (z *brotliWriter) metaBlock() {
+	z.header()
+
+	data := z.buf
+	z.buf = z.buf[:0]
+
+	if len(data) == 0 {
+		return
+	}
+
+	seqs, trailing := z.m.parse(data, z.seqs[:0])
+	z.seqs = seqs
+
+	if trailing > 0 {
+		// The copy of the last command is ignored.
+		seqs = append(seqs, lzSeq{lit: trailing, length: 2})
+	}
+
+	var litCounts [256]uint32
+	var cmdCounts [brotliInsertCopyAlphabet]uint32
+	var distCounts [brotliDistanceAlphabet]uint32
+
+	type command struct {
+		sym          int
+		insX, cpX    uint32
+		insB, cpB    uint8
+		dist         int
+		distX        uint32
+		distB        uint
+		lit0, litEnd int
+		last         bool
+	}
+
+	cmds := make([]command, len(seqs))
+	p := 0
+
+	for i, s := range seqs {
+		c := &cmds[i]
+		ins, insX, insB := brotliLengthCode(uint32(s.lit),
+			brotliInsertBase, brotliInsertBits)
+		cp, cpX, cpB := brotliLengthCode(uint32(s.length),
+			brotliCopyBase, brotliCopyBits)
+		c.sym = brotliCommandCode(ins, cp)
+		c.insX, c.insB, c.cpX, c.cpB = insX, insB, cpX, cpB
+		c.lit0, c.litEnd = p, p+s.lit
+		c.last = i == len(seqs)-1 && trailing > 0
+
+		cmdCounts[c.sym]++
+
+		for _, b := range data[p : p+s.lit] {
+			litCounts[b]++
+		}
+
+		if !c.last {
+			c.dist, c.distX, c.distB = brotliDistanceCode(s.offset)
+			distCounts[c.dist]++
+		}
+
+		p += s.lit + s.length
+	}
+
+	b := &z.b
+	mark, acc, nbits := len(b.out), b.acc, b.nbits
+	brotliMLEN(b, len(data))
+
+	// ISUNCOMPRESSED = 0; one block type each of literals, commands and
+	// distances; NPOSTFIX = 0, NDIRECT = 0; one context mode; one
+	// literal and one distance prefix code.
+	b.write(0, 1)
+	b.write(0, 3)
+	b.write(0, 6)
+	b.write(0, 2)
+	b.write(0, 2)
+
+	litLengths, litCodes := brotliPrefixCode(b, litCounts[:], 8)
+	cmdLengths, cmdCodes := brotliPrefixCode(b, cmdCounts[:], 10)
+	distLengths, distCodes := brotliPrefixCode(b, distCounts[:], 6)
+
+	for _, c := range cmds {
+		b.write(uint64(cmdCodes[c.sym]), uint(cmdLengths[c.sym]))
+		b.write(uint64(c.insX), uint(c.insB))
+		b.write(uint64(c.cpX), uint(c.cpB))
+
+		for _, l := range data[c.lit0:c.litEnd] {
+			b.write(uint64(litCodes[l]), uint(litLengths[l]))
+		}
+
+		if !c.last {
+			b.write(uint64(distCodes[c.dist]), uint(distLengths[c.dist]))
+			b.write(uint64(c.distX), c.distB)
+		}
+	}
+
+	// Store incompressible data instead.
+	if len(b.out)-mark > len(data)+8 {
+		b.out, b.acc, b.nbits = b.out[:mark], acc, nbits
+		brotliMLEN(b, len(data))
+		b.write(1, 1)
+		b.align()
+		b.out = append(b.out, data...)
+	}
+}
+
+// brotliMLEN writes ISLAST = 0, then MLEN - 1 in as few nibbles as possible.
+func brotliMLEN(b *bitWriter, n int) {
+	b.write(0, 1)
+	mlen := uint64(n - 1)
+	nibbles := uint(4)
+
+	for nibbles < 6 && mlen >= 1<<(4*nibbles) {
+		nibbles++
+	}
+
+	b.write(uint64(nibbles-4), 2)
+	b.write(mlen, 4*nibbles)
+}
+
+// brotliPrefixCode writes a prefix code for the symbol counts, returning its
+// code lengths and codes. Symbols take bits bits in simple prefix codes.
+func brotliPrefixCode(b *bitWriter, counts []uint32, bits uint) ([]uint8, []uint16) {
+	lengths := huffmanLengths(counts, 15, nil)
+
+	var used []int
+
+	for s, l := range lengths {
+		if l != 0 {
+			used = append(used, s)
+		}
+	}
+
+	if len(used) <= 1 {
+		// A simple prefix code of one symbol, which takes no bits.
+		sym := 0
+
+		if len(used) == 1 {
+			sym = used[0]
+			lengths[sym] = 0
+		}
+
+		b.write(1, 2)
+		b.write(0, 2)
+		b.write(uint64(sym), bits)
+		return lengths, make([]uint16, len(counts))
+	}
+
+	// Code lengths are coded with zero runs as symbol 17, never twice in a
+	// row so that repeat counts are not combined.
+	type clSym struct {
+		sym   int
+		extra uint32
+	}
+
+	var syms []clSym
+	var clCounts [18]uint32
+	last := used[len(used)-1]
+
+	for i := 0; i <= last; {
+		if lengths[i] != 0 {
+			syms = append(syms, clSym{sym: int(lengths[i])})
+			clCounts[lengths[i]]++
+			i++
+			continue
+		}
+
+		run := 0
+
+		for i+run <= last && lengths[i+run] == 0 {
+			run++
+		}
+
+		i += run
+
+		for run > 0 {
+			if run < 3 || len(syms) != 0 && syms[len(syms)-1].sym == 17 {
+				syms = append(syms, clSym{sym: 0})
+				clCounts[0]++
+				run--
+				continue
+			}
+
+			n := run
+
+			if n > 10 {
+				n = 10
+			}
+
+			syms = append(syms, clSym{sym: 17, extra: uint32(n - 3)})
+			clCounts[17]++
+			run -= n
+		}
+	}
+
+	clLengths := huffmanLengths(clCounts[:], 5, nil)
+	clCodes := huffmanCodes(clLengths, nil)
+
+	nonzero := 0
+
+	for _, l := range clLengths {
+		if l != 0 {
+			nonzero++
+		}
+	}
+
+	// A lone code length symbol takes no bits.
+	if nonzero == 1 {
+		clCodes = make([]uint16, len(clCodes))
+	}
+
+	// HSKIP = 0, then code length code lengths until the code is
+	// complete.
+	b.write(0, 2)
+	space := 32
+
+	for _, s := range brotliCodeLengthOrder {
+		l := clLengths[s]
+		b.write(uint64(brotliCodeLengthCodes[l][0]),
+			uint(brotliCodeLengthCodes[l][1]))
+
+		if l != 0 {
+			space -= 32 >> l
+
+			if space <= 0 {
+				break
+			}
+		}
+	}
+
+	for _, s := range syms {
+		if nonzero != 1 {
+			b.write(uint64(clCodes[s.sym]), uint(clLengths[s.sym]))
+		}
+
+		if s.sym == 17 {
+			b.write(uint64(s.extra), 3)
+		}
+	}
+
+	return lengths, huffmanCodes(lengths, nil)
+}
@@ -0,0 +1,561 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// brotliReader decodes the subset of the brotli format (RFC 7932) which
+// brotliWriter uses: one block type per category, no context modeling,
+// NPOSTFIX and NDIRECT zero, simple prefix codes of one symbol, and explicit
+// distances only.
+type brotliReader struct {
+	in    []byte
+	pos   int
+	acc   uint64
+	nbits uint
+}
+
+var errBrotliUnsupported = errors.New("unsupported by the test decoder")
+
+func (r *brotliReader) bits(n uint) (uint32, error) {
+	for r.nbits < n {
+		if r.pos == len(r.in) {
+			return 0, errors.New("unexpected end of stream")
+		}
+
+		r.acc |= uint64(r.in[r.pos]) << r.nbits
+		r.pos++
+		r.nbits += 8
+	}
+
+	v := uint32(r.acc & (1<<n - 1))
+	r.acc >>= n
+	r.nbits -= n
+	return v, nil
+}
+
+// align discards bits to a byte boundary, which must be zero.
+func (r *brotliReader) align() error {
+	v, err := r.bits(r.nbits % 8)
+
+	if err == nil && v != 0 {
+		err = errors.New("nonzero padding")
+	}
+
+	return err
+}
+
+// brotliCode is a canonical prefix code.
+type brotliCode struct {
+	// count holds the number of codes of each length, and syms the
+	// symbols by code.
+	count [16]int
+	syms  []int
+
+	// single is the symbol of codes with one symbol, taking no bits.
+	single int
+}
+
+func newBrotliCode(lengths []uint8) (*brotliCode, error) {
+	c := &brotliCode{single: -1}
+
+	for l := uint8(1); l < 16; l++ {
+		for s, sl := range lengths {
+			if sl == l {
+				c.count[l]++
+				c.syms = append(c.syms, s)
+			}
+		}
+	}
+
+	switch len(c.syms) {
+	case 0:
+		return nil, errors.New("empty prefix code")
+	case 1:
+		c.single = c.syms[0]
+	}
+
+	return c, nil
+}
+
+// decode reads a symbol, whose code is read most significant bit first.
+func (c *brotliCode) decode(r *brotliReader) (int, error) {
+	if c.single >= 0 {
+		return c.single, nil
+	}
+
+	code, first, index := 0, 0, 0
+
+	for l := 1; l < 16; l++ {
+		b, err := r.bits(1)
+
+		if err != nil {
+			return 0, err
+		}
+
+		code |= int(b)
+
+		if code-first < c.count[l] {
+			return c.syms[index+code-first], nil
+		}
+
+		index += c.count[l]
+		first = (first + c.count[l]) << 1
+		code <<= 1
+	}
+
+	return 0, errors.New("invalid prefix code")
+}
+
+// Code lengths of code length symbols are read with a fixed code, indexed by
+// the next four bits.
+var (
+	brotliCLPrefixLength = [16]uint{2, 2, 2, 3, 2, 2, 2, 4, 2, 2, 2, 3, 2, 2, 2, 4}
+	brotliCLPrefixValue  = [16]uint8{0, 4, 3, 2, 0, 4, 3, 1, 0, 4, 3, 2, 0, 4, 3, 5}
+)
+
+func (r *brotliReader) prefixCode(alphabet int, bits uint) (*brotliCode, error) {
+	hskip, err := r.bits(2)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lengths := make([]uint8, alphabet)
+
+	if hskip == 1 {
+		nsym, err := r.bits(2)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if nsym != 0 {
+			return nil, errBrotliUnsupported
+		}
+
+		sym, err := r.bits(bits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if int(sym) >= alphabet {
+			return nil, errors.New("simple prefix code symbol out of range")
+		}
+
+		return &brotliCode{single: int(sym)}, nil
+	}
+
+	clLengths := make([]uint8, 18)
+	space := 32
+
+	for _, s := range brotliCodeLengthOrder[hskip:] {
+		// Peek four bits, then consume the length of the code.
+		for r.nbits < 4 && r.pos < len(r.in) {
+			r.acc |= uint64(r.in[r.pos]) << r.nbits
+			r.pos++
+			r.nbits += 8
+		}
+
+		p := r.acc & 15
+
+		if _, err := r.bits(brotliCLPrefixLength[p]); err != nil {
+			return nil, err
+		}
+
+		l := brotliCLPrefixValue[p]
+		clLengths[s] = l
+
+		if l != 0 {
+			if space -= 32 >> l; space <= 0 {
+				break
+			}
+		}
+	}
+
+	if space < 0 {
+		return nil, errors.New("oversubscribed code length code")
+	}
+
+	cl, err := newBrotliCode(clLengths)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prev, repeatLen := uint8(8), uint8(0)
+	repeat := 0
+	space = 1 << 15
+
+	for i := 0; i < alphabet && space > 0; {
+		sym, err := cl.decode(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if sym < 16 {
+			repeat = 0
+			lengths[i] = uint8(sym)
+			i++
+
+			if sym != 0 {
+				prev = uint8(sym)
+				space -= 1 << 15 >> sym
+			}
+
+			continue
+		}
+
+		extraBits, l := uint(2), prev
+
+		if sym == 17 {
+			extraBits, l = 3, 0
+		}
+
+		if repeatLen != l {
+			repeat, repeatLen = 0, l
+		}
+
+		extra, err := r.bits(extraBits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		old := repeat
+
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+
+		repeat += int(extra) + 3
+
+		for k := old; k < repeat; k++ {
+			if i == alphabet {
+				return nil, errors.New("code length repeat out of range")
+			}
+
+			lengths[i] = l
+			i++
+
+			if l != 0 {
+				space -= 1 << 15 >> l
+			}
+		}
+	}
+
+	if space != 0 {
+		return nil, errors.New("incomplete prefix code")
+	}
+
+	return newBrotliCode(lengths)
+}
+
+// brotliCommandCells are the insert and copy length codes at which each cell
+// of 64 insert-and-copy symbols starts.
+var brotliCommandCells = [11][2]int{
+	{0, 0}, {0, 8}, {0, 0}, {0, 8}, {8, 0}, {8, 8}, {0, 16}, {16, 0},
+	{8, 16}, {16, 8}, {16, 16},
+}
+
+func brotliDecode(in []byte) ([]byte, error) {
+	r := &brotliReader{in: in}
+	var out []byte
+
+	// WBITS takes one, four or seven bits.
+	wbits, err := r.bits(1)
+
+	if err == nil && wbits == 1 {
+		if wbits, err = r.bits(3); err == nil && wbits == 0 {
+			_, err = r.bits(3)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		last, err := r.bits(1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if last == 1 {
+			empty, err := r.bits(1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if empty == 1 {
+				if err := r.align(); err != nil {
+					return nil, err
+				}
+
+				if r.pos != len(r.in) {
+					return nil, errors.New("data after last meta-block")
+				}
+
+				return out, nil
+			}
+		}
+
+		mnibbles, err := r.bits(2)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if mnibbles == 3 {
+			if last == 1 {
+				return nil, errors.New("last metadata meta-block")
+			}
+
+			// Reserved bit, then MSKIPBYTES.
+			v, err := r.bits(3)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if v != 0 {
+				return nil, errBrotliUnsupported
+			}
+
+			if err := r.align(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		m, err := r.bits(4 * uint(mnibbles+4))
+
+		if err != nil {
+			return nil, err
+		}
+
+		mlen := int(m) + 1
+		uncompressed := uint32(0)
+
+		if last == 0 {
+			if uncompressed, err = r.bits(1); err != nil {
+				return nil, err
+			}
+		}
+
+		if uncompressed == 1 {
+			if err := r.align(); err != nil {
+				return nil, err
+			}
+
+			if r.pos+mlen > len(r.in) {
+				return nil, errors.New("short uncompressed meta-block")
+			}
+
+			out = append(out, r.in[r.pos:r.pos+mlen]...)
+			r.pos += mlen
+			continue
+		}
+
+		if out, err = r.metaBlock(out, mlen); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *brotliReader) metaBlock(out []byte, mlen int) ([]byte, error) {
+	// NBLTYPESL, NBLTYPESI and NBLTYPESD of one, NPOSTFIX and NDIRECT,
+	// the literal context mode, then NTREESL and NTREESD of one.
+	header := []uint{1, 1, 1, 6, 2, 1, 1}
+
+	for i, n := range header {
+		v, err := r.bits(n)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if v != 0 && i != 4 {
+			return nil, errBrotliUnsupported
+		}
+	}
+
+	lit, err := r.prefixCode(256, 8)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := r.prefixCode(brotliInsertCopyAlphabet, 10)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dist, err := r.prefixCode(brotliDistanceAlphabet, 6)
+
+	if err != nil {
+		return nil, err
+	}
+
+	end := len(out) + mlen
+
+	for len(out) < end {
+		sym, err := cmd.decode(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cell := brotliCommandCells[sym>>6]
+		ins := cell[0] + sym>>3&7
+		cp := cell[1] + sym&7
+
+		insX, err := r.bits(uint(brotliInsertBits[ins]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		cpX, err := r.bits(uint(brotliCopyBits[cp]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		insLen := int(brotliInsertBase[ins] + insX)
+		cpLen := int(brotliCopyBase[cp] + cpX)
+
+		for i := 0; i < insLen; i++ {
+			b, err := lit.decode(r)
+
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, byte(b))
+		}
+
+		if len(out) > end {
+			return nil, errors.New("literals exceed meta-block")
+		}
+
+		if len(out) == end {
+			break
+		}
+
+		if sym < 128 {
+			return nil, errBrotliUnsupported
+		}
+
+		code, err := dist.decode(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if code < 16 {
+			return nil, errBrotliUnsupported
+		}
+
+		nbits := 1 + uint(code-16)>>1
+		offset := (2+(code-16)&1)<<nbits - 4
+		x, err := r.bits(nbits)
+
+		if err != nil {
+			return nil, err
+		}
+
+		d := offset + int(x) + 1
+
+		if d > len(out) || d > lzWindow {
+			return nil, errors.New("distance beyond the window")
+		}
+
+		for i := 0; i < cpLen; i++ {
+			out = append(out, out[len(out)-d])
+		}
+
+		if len(out) > end {
+			return nil, errors.New("copy exceeds meta-block")
+		}
+	}
+
+	return out, nil
+}
+
+func TestBrotliWriter(t *testing.T) {
+	for name, in := range compressInputs() {
+		for _, level := range []int{1, 5, 11} {
+			var buf bytes.Buffer
+			z := newBrotliWriter(&buf, level)
+
+			// Flush midway, as for streamed responses.
+			half := len(in) / 2
+
+			if _, err := z.Write(in[:half]); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := z.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := z.Write(in[half:]); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := z.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := brotliDecode(buf.Bytes())
+
+			if err != nil {
+				t.Errorf("%s, level %d: %v", name, level, err)
+				continue
+			}
+
+			if !bytes.Equal(out, in) {
+				t.Errorf("%s, level %d: round trip differs", name, level)
+			}
+
+			if name == "text" && buf.Len() > len(in)/20 {
+				t.Errorf("%s, level %d: compressed to %d of %d bytes",
+					name, level, buf.Len(), len(in))
+			}
+		}
+	}
+}
+
+func TestBrotliWriterReset(t *testing.T) {
+	var a, b bytes.Buffer
+	z := newBrotliWriter(&a, 5)
+	z.Write([]byte("first response"))
+	z.Close()
+
+	if _, err := z.Write([]byte("x")); err == nil {
+		t.Error("write after close succeeded")
+	}
+
+	z.Reset(&b)
+	z.Write([]byte("second response"))
+	z.Close()
+
+	out, err := brotliDecode(b.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != "second response" {
+		t.Errorf("after reset, got %q", out)
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import "sync"
+
+var (
+	bufferAllocations = newCounterVec("http_proxy_buffer_allocations_total",
+		"Copy buffers allocated by the buffer pool.")
+	buffersInUse = newGaugeVec("http_proxy_buffers_in_use",
+		"Copy buffers taken from the buffer pool and not yet returned.")
+)
+
+// bufferSize matches the copy buffers of httputil.ReverseProxy.
+const bufferSize = 32 << 10
+
+// bufferPool is an httputil.BufferPool shared by the reverse proxies of all
+// routes. Arrays are pooled rather than slices so that Put does not
+// allocate.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+var buffers = &bufferPool{pool: sync.Pool{New: func() interface{} {
+	bufferAllocations.inc()
+	return new([bufferSize]byte)
+}}}
+
+func (p *bufferPool) Get() []byte {
+	buffersInUse.add(1)
+	return p.pool.Get().(*[bufferSize]byte)[:]
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) < bufferSize {
+		return
+	}
+
+	buffersInUse.add(-1)
+	p.pool.Put((*[bufferSize]byte)(b[:bufferSize]))
+}
@@ -0,0 +1,1039 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cacheRequests = newCounterVec("http_proxy_cache_requests_total",
+	"Cacheable requests by cache result.", "route", "result")
+
+// caches holds the response caches of all running proxies, for purging.
+var caches = &cacheSet{m: make(map[*responseCache]bool)}
+
+type cacheSet struct {
+	mu sync.Mutex
+	m  map[*responseCache]bool
+}
+
+func (cs *cacheSet) add(s *scope, rc *responseCache) {
+	cs.mu.Lock()
+	cs.m[rc] = true
+	cs.mu.Unlock()
+
+	s.run(func() {
+		<-s.ctx.Done()
+		cs.mu.Lock()
+		delete(cs.m, rc)
+		cs.mu.Unlock()
+	})
+}
+
+// purge removes the cached responses matching match from all caches,
+// returning how many were removed.
+func (cs *cacheSet) purge(match func(*cachedResponse) bool) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	n := 0
+
+	for rc := range cs.m {
+		n += rc.purge(match)
+	}
+
+	return n
+}
+
+// Cache describes a cache of backend responses. GET responses are stored as
+// allowed by their Cache-Control, Expires and Vary headers, and served to
+// later GET and HEAD requests without contacting the backend. Requests
+// carrying cookies or credentials of the route's auth stages, and those sent
+// to the route's canary, bypass the cache.
+type Cache struct {
+	// MaxSize is optional. It bounds the bytes of cached responses,
+	// defaulting to 64 MiB. The least recently used are evicted first.
+	MaxSize int64 `json:"max_size"`
+
+	// MaxEntrySize is optional. Responses with larger bodies are not
+	// cached. It defaults to 1 MiB.
+	MaxEntrySize int64 `json:"max_entry_size"`
+
+	// DefaultTTL is optional. It is how long responses without explicit
+	// freshness are cached. By default they are not cached.
+	DefaultTTL Duration `json:"default_ttl"`
+
+	// StaleWhileRevalidate is optional. It is how long after expiring a
+	// response is served while being refreshed in the background, for
+	// responses without the stale-while-revalidate directive.
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+
+	// StaleIfError is optional. It is how long after expiring a response
+	// is served in place of backend errors, for responses without the
+	// stale-if-error directive.
+	StaleIfError Duration `json:"stale_if_error"`
+
+	// Dir is optional. If specified, responses are also stored in this
+	// directory, so that they survive restarts, and responses too large
+	// for memory are stored only there.
+	Dir string `json:"dir"`
+
+	// MaxDiskSize is optional. It bounds the bytes of responses stored in
+	// Dir, defaulting to 1 GiB.
+	MaxDiskSize int64 `json:"max_disk_size"`
+
+	// MaxDiskEntrySize is optional. Responses with larger bodies are not
+	// stored in Dir. It defaults to 256 MiB.
+	MaxDiskEntrySize int64 `json:"max_disk_entry_size"`
+}
+
+const (
+	defaultCacheSize          = 64 << 20
+	defaultCacheEntrySize     = 1 << 20
+	defaultCacheDiskSize      = 1 << 30
+	defaultCacheDiskEntrySize = 256 << 20
+)
+
+// cachedResponse is a stored response. Bodies stored only on disk are read
+// from file.
+type cachedResponse struct {
+	Key     string
+	Primary string
+	Vary    []string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Stored  time.Time
+	Expires time.Time
+
+	// Stale responses may be served until these times, as in RFC 5861.
+	StaleRevalidate time.Time
+	StaleError      time.Time
+
+	file string
+}
+
+func (r *cachedResponse) size() int64 {
+	n := int64(len(r.Body))
+
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+
+	return n
+}
+
+// memoryCache is an LRU store of responses bounded by size.
+type memoryCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key string
+	r   *cachedResponse
+}
+
+func newMemoryCache(max int64) *memoryCache {
+	return &memoryCache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCache) get(key string) (*cachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.items[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	m.ll.MoveToFront(e)
+	return e.Value.(*memoryEntry).r, true
+}
+
+func (m *memoryCache) set(key string, r *cachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.items[key]; ok {
+		m.removeElement(e)
+	}
+
+	m.items[key] = m.ll.PushFront(&memoryEntry{key: key, r: r})
+	m.size += r.size()
+
+	for m.size > m.max && m.ll.Len() > 1 {
+		m.removeElement(m.ll.Back())
+	}
+}
+
+func (m *memoryCache) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.items[key]; ok {
+		m.removeElement(e)
+	}
+}
+
+func (m *memoryCache) purge(match func(*cachedResponse) bool) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+
+	for e := m.ll.Front(); e != nil; {
+		next := e.Next()
+
+		if r := e.Value.(*memoryEntry).r; match(r) {
+			keys = append(keys, r.Key)
+			m.removeElement(e)
+		}
+
+		e = next
+	}
+
+	return keys
+}
+
+func (m *memoryCache) removeElement(e *list.Element) {
+	entry := m.ll.Remove(e).(*memoryEntry)
+	delete(m.items, entry.key)
+	m.size -= entry.r.size()
+}
+
+type responseCache struct {
+	s            *scope
+	route        string
+	mem          *memoryCache
+	maxEntry     int64
+	disk         *diskCache
+	maxDiskEntry int64
+	ttl          time.Duration
+	swr, sie     time.Duration
+
+	// vary holds the request headers each cached URL varies on, and
+	// refreshing the keys being revalidated in the background.
+	mu         sync.Mutex
+	vary       map[string][]string
+	refreshing map[string]bool
+}
+
+func newResponseCache(s *scope, c *Cache, route string) (*responseCache, error) {
+	if c.MaxSize < 0 || c.MaxEntrySize < 0 || c.DefaultTTL < 0 ||
+		c.MaxDiskSize < 0 || c.MaxDiskEntrySize < 0 ||
+		c.StaleWhileRevalidate < 0 || c.StaleIfError < 0 {
+		return nil, errors.New("proxy: negative cache option")
+	}
+
+	rc := &responseCache{
+		s:          s,
+		route:      route,
+		maxEntry:   c.MaxEntrySize,
+		ttl:        time.Duration(c.DefaultTTL),
+		swr:        time.Duration(c.StaleWhileRevalidate),
+		sie:        time.Duration(c.StaleIfError),
+		vary:       make(map[string][]string),
+		refreshing: make(map[string]bool),
+	}
+
+	max := c.MaxSize
+
+	if max == 0 {
+		max = defaultCacheSize
+	}
+
+	if rc.maxEntry == 0 {
+		rc.maxEntry = defaultCacheEntrySize
+	}
+
+	rc.mem = newMemoryCache(max)
+
+	if c.Dir == "" {
+		return rc, nil
+	}
+
+	max = c.MaxDiskSize
+
+	if max == 0 {
+		max = defaultCacheDiskSize
+	}
+
+	rc.maxDiskEntry = c.MaxDiskEntrySize
+
+	if rc.maxDiskEntry == 0 {
+		rc.maxDiskEntry = defaultCacheDiskEntrySize
+	}
+
+	var err error
+
+	if rc.disk, err = newDiskCache(c.Dir, max); err != nil {
+		return nil, err
+	}
+
+	for _, e := range rc.disk.items {
+		r := e.Value.(*diskEntry).r
+		rc.vary[r.Primary] = r.Vary
+	}
+
+	return rc, nil
+}
+
+// get returns the cached response for key from memory, or else from disk.
+func (rc *responseCache) get(key string) (*cachedResponse, bool) {
+	if r, ok := rc.mem.get(key); ok {
+		return r, true
+	}
+
+	if rc.disk == nil {
+		return nil, false
+	}
+
+	r, ok := rc.disk.get(key)
+
+	if !ok {
+		return nil, false
+	}
+
+	// Promote responses small enough for memory.
+	if r.size() <= rc.maxEntry {
+		if head, err := os.Stat(r.file); err == nil &&
+			head.Size() <= rc.maxEntry {
+			if body, err := readBody(r); err == nil {
+				promoted := *r
+				promoted.Body = body
+				promoted.file = ""
+				rc.mem.set(key, &promoted)
+				return &promoted, true
+			}
+		}
+	}
+
+	return r, true
+}
+
+// purge removes the cached responses matching match, returning how many
+// were removed.
+func (rc *responseCache) purge(match func(*cachedResponse) bool) int {
+	purged := make(map[string]bool)
+
+	for _, key := range rc.mem.purge(match) {
+		purged[key] = true
+	}
+
+	if rc.disk != nil {
+		for _, key := range rc.disk.purge(match) {
+			purged[key] = true
+		}
+	}
+
+	return len(purged)
+}
+
+// tags returns the surrogate keys of r, given by the backend in the
+// Surrogate-Key header.
+func (r *cachedResponse) tags() []string {
+	return strings.Fields(strings.Join(r.Header.Values("Surrogate-Key"), " "))
+}
+
+func (rc *responseCache) remove(key string) {
+	rc.mem.remove(key)
+
+	if rc.disk != nil {
+		rc.disk.remove(key)
+	}
+}
+
+// parseCacheControl parses the directives of Cache-Control headers.
+func parseCacheControl(h http.Header) map[string]string {
+	d := make(map[string]string)
+
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+
+			if part == "" {
+				continue
+			}
+
+			k, val := part, ""
+
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				k, val = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+
+			d[strings.ToLower(k)] = val
+		}
+	}
+
+	return d
+}
+
+// primaryKey identifies the resource of req regardless of Vary.
+func primaryKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// varyKey identifies the variant of req, given the headers varied on.
+func varyKey(primary string, names []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(primary)
+
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+
+	return b.String()
+}
+
+func (rc *responseCache) varyOf(primary string) []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.vary[primary]
+}
+
+// freshness returns how long a response with header h is fresh for, and
+// whether it may be cached at all.
+func (rc *responseCache) freshness(status int, h http.Header, now time.Time) (time.Duration, bool) {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0, false
+	}
+
+	if h.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+
+	for _, v := range h.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return 0, false
+		}
+	}
+
+	cc := parseCacheControl(h)
+
+	for _, k := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[k]; ok {
+			return 0, false
+		}
+	}
+
+	var ttl time.Duration
+
+	if v, ok := cc["s-maxage"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			return 0, false
+		}
+
+		ttl = time.Duration(n) * time.Second
+	} else if v, ok := cc["max-age"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			return 0, false
+		}
+
+		ttl = time.Duration(n) * time.Second
+	} else if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+
+		if err != nil {
+			return 0, false
+		}
+
+		date := now
+
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+
+		ttl = exp.Sub(date)
+	} else {
+		ttl = rc.ttl
+	}
+
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+
+	return ttl, true
+}
+
+// staleness returns how long after expiring a response with header h may be
+// served while revalidating, and in place of errors.
+func (rc *responseCache) staleness(h http.Header) (swr, sie time.Duration) {
+	cc := parseCacheControl(h)
+
+	if _, ok := cc["must-revalidate"]; ok {
+		return 0, 0
+	}
+
+	swr, sie = rc.swr, rc.sie
+
+	if n, err := strconv.ParseInt(cc["stale-while-revalidate"], 10, 64); err == nil {
+		swr = time.Duration(n) * time.Second
+	}
+
+	if n, err := strconv.ParseInt(cc["stale-if-error"], 10, 64); err == nil {
+		sie = time.Duration(n) * time.Second
+	}
+
+	return swr, sie
+}
+
+// cacheRecorder passes a response through to the client while buffering it
+// for the cache, up to max bytes.
+type cacheRecorder struct {
+	http.ResponseWriter
+	max      int64
+	status   int
+	header   http.Header
+	body     []byte
+	overflow bool
+
+	// Bodies beyond max spill into file, up to diskMax bytes.
+	disk    *diskCache
+	diskMax int64
+	file    *os.File
+	written int64
+	sum     hash.Hash
+
+	// If stale is true, server errors are withheld from the client, and
+	// failed is set, so that a stale response is served instead.
+	stale  bool
+	failed bool
+}
+
+func (r *cacheRecorder) WriteHeader(status int) {
+	if r.status != 0 {
+		return
+	}
+
+	r.status = status
+	r.header = r.ResponseWriter.Header().Clone()
+
+	if r.stale && status >= http.StatusInternalServerError {
+		r.failed = true
+		r.discard()
+		return
+	}
+
+	// Surrogate keys are for the cache, not the client.
+	r.ResponseWriter.Header().Del("Surrogate-Key")
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if r.failed {
+		return len(b), nil
+	}
+
+	if !r.overflow {
+		r.buffer(b)
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *cacheRecorder) buffer(b []byte) {
+	if r.sum == nil {
+		r.sum = sha256.New()
+	}
+
+	r.sum.Write(b)
+	r.written += int64(len(b))
+
+	if r.file == nil && r.written <= r.max {
+		r.body = append(r.body, b...)
+		return
+	}
+
+	if r.disk == nil || r.written > r.diskMax {
+		r.discard()
+		return
+	}
+
+	if r.file == nil {
+		f, err := r.disk.tempFile()
+
+		if err != nil {
+			r.discard()
+			return
+		}
+
+		r.file = f
+		b = append(r.body, b...)
+		r.body = nil
+	}
+
+	if _, err := r.file.Write(b); err != nil {
+		r.discard()
+	}
+}
+
+// discard gives up on caching the response.
+func (r *cacheRecorder) discard() {
+	r.overflow = true
+	r.body = nil
+
+	if r.file != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+		r.file = nil
+	}
+}
+
+func (r *cacheRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok && !r.failed {
+		if r.status == 0 {
+			r.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// serve writes the cached response r, recording the result of the cache
+// lookup, such as "hit". It returns false, having written nothing, if the
+// stored body is gone.
+func (rc *responseCache) serve(w http.ResponseWriter, req *http.Request, r *cachedResponse, result string, now time.Time) bool {
+	body, err := r.open()
+
+	if err != nil {
+		rc.remove(r.Key)
+		return false
+	}
+
+	defer body.Close()
+
+	cacheRequests.inc(rc.route, result)
+	setLogField(req, "cache", result)
+
+	h := w.Header()
+
+	for k := range h {
+		delete(h, k)
+	}
+
+	status := r.Status
+
+	if status == http.StatusOK && notModified(req, r.Header) {
+		status = http.StatusNotModified
+
+		for _, k := range notModifiedHeaders {
+			if vs := r.Header.Values(k); len(vs) != 0 {
+				h[k] = append([]string(nil), vs...)
+			}
+		}
+	} else {
+		for k, vs := range r.Header {
+			h[k] = append([]string(nil), vs...)
+		}
+	}
+
+	h.Del("Surrogate-Key")
+	h.Set("Age", strconv.FormatInt(int64(now.Sub(r.Stored)/time.Second), 10))
+	h.Set("X-Cache", strings.ToUpper(result))
+	w.WriteHeader(status)
+
+	if req.Method != http.MethodHead && status != http.StatusNotModified {
+		io.Copy(w, body)
+	}
+
+	return true
+}
+
+// refresh revalidates the cached response r to req in the background, unless
+// it is already being revalidated. The request is made conditional on the
+// validators of r, whose freshness is extended if it is not modified.
+func (rc *responseCache) refresh(h http.Handler, req *http.Request, r *cachedResponse) {
+	rc.mu.Lock()
+
+	if rc.refreshing[r.Key] {
+		rc.mu.Unlock()
+		return
+	}
+
+	rc.refreshing[r.Key] = true
+	rc.mu.Unlock()
+
+	cr := req.Clone(rc.s.ctx)
+	cr.Method = http.MethodGet
+	cr.Header.Del("If-None-Match")
+	cr.Header.Del("If-Modified-Since")
+
+	if v := r.Header.Get("ETag"); v != "" {
+		cr.Header.Set("If-None-Match", v)
+	}
+
+	if v := r.Header.Get("Last-Modified"); v != "" {
+		cr.Header.Set("If-Modified-Since", v)
+	}
+
+	rc.s.run(func() {
+		defer func() {
+			rc.mu.Lock()
+			delete(rc.refreshing, r.Key)
+			rc.mu.Unlock()
+		}()
+
+		rec := &cacheRecorder{
+			ResponseWriter: discardWriter{make(http.Header)},
+			max:            rc.maxEntry,
+			disk:           rc.disk,
+			diskMax:        rc.maxDiskEntry,
+		}
+
+		h.ServeHTTP(rec, cr)
+
+		switch {
+		case rec.status == http.StatusNotModified:
+			rec.discard()
+			rc.revalidated(r, rec.header, time.Now())
+		case rec.status < http.StatusInternalServerError:
+			rc.store(cr, rec, time.Now())
+		default:
+			// Keep the stale response on errors, as for
+			// stale-if-error.
+			rec.discard()
+		}
+	})
+}
+
+// revalidated extends the freshness of the cached response r, which the
+// backend reported not modified with the headers h.
+func (rc *responseCache) revalidated(r *cachedResponse, h http.Header, now time.Time) {
+	u := *r
+	u.Header = r.Header.Clone()
+
+	for _, k := range notModifiedHeaders {
+		if vs := h.Values(k); len(vs) != 0 {
+			u.Header[k] = append([]string(nil), vs...)
+		}
+	}
+
+	ttl, ok := rc.freshness(u.Status, u.Header, now)
+	swr, sie := rc.staleness(u.Header)
+
+	if !ok {
+		return
+	}
+
+	u.Stored = now
+	u.Expires = now.Add(ttl)
+	u.StaleRevalidate = now.Add(ttl + swr)
+	u.StaleError = now.Add(ttl + sie)
+
+	if u.file == "" {
+		rc.mem.set(u.Key, &u)
+	}
+
+	if rc.disk != nil {
+		rc.disk.update(&u)
+	}
+}
+
+// discardWriter is a response writer discarding responses.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+// open returns the body of r.
+func (r *cachedResponse) open() (io.ReadCloser, error) {
+	if r.file == "" {
+		return io.NopCloser(bytes.NewReader(r.Body)), nil
+	}
+	return os.Open(r.file)
+}
+
+// store caches the recorded response to req, if allowed.
+func (rc *responseCache) store(req *http.Request, rec *cacheRecorder, now time.Time) bool {
+	if req.Method != http.MethodGet || rec.overflow || rec.status == 0 {
+		rec.discard()
+		return false
+	}
+
+	ttl, ok := rc.freshness(rec.status, rec.header, now)
+	swr, sie := rc.staleness(rec.header)
+
+	if !ok || ttl <= 0 && swr <= 0 && sie <= 0 {
+		rec.discard()
+		return false
+	}
+
+	var names []string
+
+	for _, v := range rec.header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	primary := primaryKey(req)
+
+	rc.mu.Lock()
+	rc.vary[primary] = names
+	rc.mu.Unlock()
+
+	rec.header.Del("X-Cache")
+
+	// Validators let conditional requests be answered from the cache.
+	if rec.status == http.StatusOK {
+		if rec.header.Get("ETag") == "" {
+			if rec.sum == nil {
+				rec.sum = sha256.New()
+			}
+
+			rec.header.Set("ETag",
+				`"`+hex.EncodeToString(rec.sum.Sum(nil)[:16])+`"`)
+		}
+
+		if rec.header.Get("Last-Modified") == "" {
+			rec.header.Set("Last-Modified",
+				now.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	r := &cachedResponse{
+		Key:     varyKey(primary, names, req),
+		Primary: primary,
+		Vary:    names,
+		Status:  rec.status,
+		Header:  rec.header,
+		Body:    rec.body,
+		Stored:  now,
+		Expires: now.Add(ttl),
+
+		StaleRevalidate: now.Add(ttl + swr),
+		StaleError:      now.Add(ttl + sie),
+	}
+
+	if rec.file != nil {
+		// Too large for memory, so only stored on disk.
+		rc.mem.remove(r.Key)
+		r.Body = nil
+		err := rec.file.Close()
+
+		if err == nil {
+			err = rc.disk.set(r, rec.file.Name())
+		} else {
+			os.Remove(rec.file.Name())
+		}
+
+		return err == nil
+	}
+
+	rc.mem.set(r.Key, r)
+
+	if rc.disk != nil {
+		rc.disk.write(r)
+	}
+
+	return true
+}
+
+// cacheBypassKey marks requests which carried credentials, possibly since
+// removed by auth stages, so their responses are neither cached nor served
+// from the cache.
+type cacheBypassKey struct{}
+
+// credentials are the request headers and query parameters read by the
+// auth stages of a route, and whether client certificates are.
+type credentials struct {
+	headers []string
+	query   []string
+	certs   bool
+}
+
+func newCredentials(route Route) *credentials {
+	c := &credentials{headers: []string{"Authorization", "Cookie"}}
+
+	if route.APIKey != nil {
+		header := route.APIKey.Header
+
+		if header == "" {
+			header = "X-API-Key"
+		}
+
+		c.headers = append(c.headers, header)
+
+		if route.APIKey.Query != "" {
+			c.query = append(c.query, route.APIKey.Query)
+		}
+	}
+
+	if route.HMAC != nil {
+		header := route.HMAC.Header
+
+		if header == "" {
+			header = "X-Signature"
+		}
+
+		c.headers = append(c.headers, header)
+	}
+
+	c.certs = route.ClientCert != nil
+	return c
+}
+
+// present reports whether req carries any of the credentials.
+func (c *credentials) present(req *http.Request) bool {
+	for _, k := range c.headers {
+		if req.Header.Get(k) != "" {
+			return true
+		}
+	}
+
+	if len(c.query) != 0 {
+		q := req.URL.Query()
+
+		for _, k := range c.query {
+			if _, ok := q[k]; ok {
+				return true
+			}
+		}
+	}
+
+	return c.certs && req.TLS != nil && len(req.TLS.PeerCertificates) != 0
+}
+
+// withCacheBypass marks requests carrying credentials before they reach the
+// auth stages, and those chosen for the canary, if not nil, so that responses
+// of one version are not served to clients of the other.
+func withCacheBypass(c *credentials, canary *Canary, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c.present(req) || canary != nil && canary.chosen(req) {
+			ctx := context.WithValue(req.Context(), cacheBypassKey{}, true)
+			req = req.WithContext(ctx)
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// withCache serves cacheable requests from c, caching backend responses.
+// Requests with credentials or Cache-Control: private bypass the cache.
+func withCache(c *responseCache, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead ||
+			req.Header.Get("Authorization") != "" ||
+			req.Header.Get("Cookie") != "" ||
+			req.Context().Value(cacheBypassKey{}) != nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		cc := parseCacheControl(req.Header)
+
+		_, noStore := cc["no-store"]
+		_, private := cc["private"]
+
+		if noStore || private {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		now := time.Now()
+		primary := primaryKey(req)
+		key := varyKey(primary, c.varyOf(primary), req)
+
+		_, noCache := cc["no-cache"]
+
+		if cc["max-age"] == "0" {
+			noCache = true
+		}
+
+		var stale *cachedResponse
+
+		if !noCache {
+			r, ok := c.get(key)
+
+			switch {
+			case !ok:
+			case now.Before(r.Expires):
+				if c.serve(w, req, r, "hit", now) {
+					return
+				}
+			case now.Before(r.StaleRevalidate):
+				if c.serve(w, req, r, "stale", now) {
+					c.refresh(h, req, r)
+					return
+				}
+			case now.Before(r.StaleError):
+				stale = r
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+
+		rec := &cacheRecorder{
+			ResponseWriter: w,
+			max:            c.maxEntry,
+			disk:           c.disk,
+			diskMax:        c.maxDiskEntry,
+			stale:          stale != nil,
+		}
+
+		h.ServeHTTP(rec, req)
+
+		if rec.failed {
+			if c.serve(w, req, stale, "stale", now) {
+				return
+			}
+
+			w.Header().Del("X-Cache")
+			http.Error(w, http.StatusText(rec.status), rec.status)
+			return
+		}
+
+		cacheRequests.inc(c.route, "miss")
+		setLogField(req, "cache", "miss")
+
+		if !c.store(req, rec, now) && rec.status != http.StatusNotModified {
+			c.remove(key)
+		}
+	})
+}
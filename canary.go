@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+)
+
+// Canary describes sending some requests of a route to a canary backend
+// running a new version.
+type Canary struct {
+	// Upstream is the address of the canary backend, in the form
+	// "host:port".
+	Upstream string `json:"upstream"`
+
+	// Percent is optional. It is the share of clients, from 0 to 100, whose
+	// requests are sent to the canary. Clients are told apart by IP
+	// address, so that each sees one version.
+	Percent float64 `json:"percent"`
+
+	// Header and Cookie are optional. Requests whose header or cookie of
+	// this name is Value are sent to the canary regardless of Percent, and
+	// those with any other value never are, so that developers may opt in
+	// or out.
+	Header string `json:"header"`
+	Cookie string `json:"cookie"`
+
+	// Value is optional, defaulting to "1".
+	Value string `json:"value"`
+}
+
+func checkCanary(c *Canary) error {
+	if _, _, err := net.SplitHostPort(c.Upstream); err != nil {
+		return errors.New("proxy: invalid canary upstream " + c.Upstream)
+	}
+
+	if c.Percent < 0 || c.Percent > 100 {
+		return errors.New("proxy: canary percent out of range")
+	}
+
+	return nil
+}
+
+// optIn reports whether req opts in to or out of the canary, if it does.
+func (c *Canary) optIn(req *http.Request) (in, ok bool) {
+	value := c.Value
+
+	if value == "" {
+		value = "1"
+	}
+
+	if c.Header != "" {
+		if v, found := req.Header[http.CanonicalHeaderKey(c.Header)]; found &&
+			len(v) != 0 {
+			return v[0] == value, true
+		}
+	}
+
+	if c.Cookie != "" {
+		if cookie, err := req.Cookie(c.Cookie); err == nil {
+			return cookie.Value == value, true
+		}
+	}
+
+	return false, false
+}
+
+// sampled reports whether the client of req is within Percent.
+func (c *Canary) sampled(req *http.Request) bool {
+	if c.Percent <= 0 {
+		return false
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(clientIP(req)))
+	return float64(mix64(h.Sum64())>>11)/(1<<53) < c.Percent/100
+}
+
+// chosen reports whether req is sent to the canary, unless a rule chooses its
+// backend.
+func (c *Canary) chosen(req *http.Request) bool {
+	if in, ok := c.optIn(req); ok {
+		return in
+	}
+
+	return c.sampled(req)
+}
+
+// withCanary sends the requests chosen by c to the canary backend. Requests
+// whose backend a rule has chosen are left alone.
+func withCanary(c *Canary, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := req.Context().Value(upstreamKey{}).(string); !ok {
+			if c.chosen(req) {
+				ctx := context.WithValue(req.Context(), upstreamKey{},
+					c.Upstream)
+				req = req.WithContext(ctx)
+			}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
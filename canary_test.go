@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCanaryBypassesCache(t *testing.T) {
+	serve := func(version string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(version))
+		}))
+
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	stable, canary := serve("stable"), serve("canary")
+	srv := serveProxy(t, ReverseProxy{Routes: []Route{{
+		From:  "/",
+		To:    stable.URL,
+		Cache: &Cache{},
+		Canary: &Canary{
+			Upstream: strings.TrimPrefix(canary.URL, "http://"),
+			Header:   "X-Canary",
+		},
+	}}})
+
+	for _, tt := range []struct {
+		canary bool
+		want   string
+	}{
+		{false, "stable"},
+		{true, "canary"},
+		{false, "stable"},
+		{true, "canary"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/page", nil)
+
+		if tt.canary {
+			req.Header.Set("X-Canary", "1")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(b) != tt.want {
+			t.Errorf("canary %v: served %q, want %q", tt.canary, b, tt.want)
+		}
+	}
+}
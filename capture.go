@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Capture describes logging the bodies and headers of a route's requests and
+// their backend responses in the access log, for debugging. Capture may be
+// turned on and off through the admin API.
+type Capture struct {
+	// Enabled is optional. If true, capture starts turned on.
+	Enabled bool `json:"enabled"`
+
+	// MaxBytes is optional. It is the most bytes of each body logged,
+	// defaulting to 4096.
+	MaxBytes int `json:"max_bytes"`
+
+	// RedactHeaders is optional. It lists headers whose values are hidden,
+	// in addition to Authorization, Cookie, Set-Cookie,
+	// Proxy-Authorization, X-API-Key, X-Signature and the headers of the
+	// route's APIKey and HMAC.
+	RedactHeaders []string `json:"redact_headers"`
+
+	// RedactFields is optional. It lists the names of JSON object fields,
+	// at any depth, whose values are hidden. JSON bodies which cannot be
+	// parsed, such as when cut short by MaxBytes, are then not logged.
+	RedactFields []string `json:"redact_fields"`
+}
+
+const (
+	defaultCaptureMaxBytes = 4096
+	redacted               = "[REDACTED]"
+)
+
+var defaultRedactHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"Proxy-Authorization",
+	"X-API-Key",
+	"X-Signature",
+}
+
+// captures holds the body captures of all running proxies, for the admin API.
+var captures = &captureSet{m: make(map[*capture]bool)}
+
+type captureSet struct {
+	mu sync.Mutex
+	m  map[*capture]bool
+}
+
+func (cs *captureSet) add(s *scope, c *capture) {
+	cs.mu.Lock()
+	cs.m[c] = true
+	cs.mu.Unlock()
+
+	s.run(func() {
+		<-s.ctx.Done()
+		cs.mu.Lock()
+		delete(cs.m, c)
+		cs.mu.Unlock()
+	})
+}
+
+// set turns the captures of the route, or of all routes if route is "", on or
+// off, returning how many there were.
+func (cs *captureSet) set(route string, enabled bool) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	n := 0
+
+	for c := range cs.m {
+		if route == "" || c.route == route {
+			c.enabled.Store(enabled)
+			n++
+		}
+	}
+
+	return n
+}
+
+// list returns whether the capture of each route is turned on.
+func (cs *captureSet) list() map[string]bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	m := make(map[string]bool)
+
+	for c := range cs.m {
+		m[c.route] = m[c.route] || c.enabled.Load()
+	}
+
+	return m
+}
+
+type capture struct {
+	route    string
+	enabled  atomic.Bool
+	maxBytes int
+	headers  map[string]bool
+	fields   map[string]bool
+}
+
+// newCapture returns the capture of c, also redacting the auth headers of the
+// route.
+func newCapture(c *Capture, route string, auth []string) (*capture, error) {
+	if c.MaxBytes < 0 {
+		return nil, errors.New("proxy: negative capture max_bytes")
+	}
+
+	cp := &capture{
+		route:    route,
+		maxBytes: c.MaxBytes,
+		headers:  make(map[string]bool),
+		fields:   make(map[string]bool),
+	}
+
+	cp.enabled.Store(c.Enabled)
+
+	if cp.maxBytes == 0 {
+		cp.maxBytes = defaultCaptureMaxBytes
+	}
+
+	for _, hs := range [][]string{defaultRedactHeaders, auth, c.RedactHeaders} {
+		for _, h := range hs {
+			cp.headers[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	for _, f := range c.RedactFields {
+		cp.fields[strings.ToLower(f)] = true
+	}
+
+	return cp, nil
+}
+
+// header returns h with redacted values hidden.
+func (cp *capture) header(h http.Header) map[string][]string {
+	m := make(map[string][]string, len(h))
+
+	for k, v := range h {
+		if cp.headers[http.CanonicalHeaderKey(k)] {
+			v = []string{redacted}
+		}
+		m[k] = v
+	}
+
+	return m
+}
+
+// redact hides the values of redacted fields within v, a decoded JSON value.
+func (cp *capture) redact(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			if cp.fields[strings.ToLower(k)] {
+				v[k] = redacted
+			} else {
+				cp.redact(x)
+			}
+		}
+	case []interface{}:
+		for _, x := range v {
+			cp.redact(x)
+		}
+	}
+}
+
+// body returns the loggable form of the start of a body, and whether to log
+// it.
+func (cp *capture) body(b []byte, contentType string) (interface{}, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+
+	mt, _, _ := mime.ParseMediaType(contentType)
+
+	if len(cp.fields) == 0 || mt != "application/json" &&
+		!strings.HasSuffix(mt, "+json") {
+		return string(b), true
+	}
+
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false
+	}
+
+	cp.redact(v)
+	return v, true
+}
+
+// captureBuffer keeps the first max bytes written to it.
+type captureBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	max int
+}
+
+func (b *captureBuffer) keep(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n := b.max - b.buf.Len(); n > 0 {
+		if len(p) > n {
+			p = p[:n]
+		}
+		b.buf.Write(p)
+	}
+}
+
+func (b *captureBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+type captureBody struct {
+	io.ReadCloser
+	buf *captureBuffer
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.keep(p[:n])
+	return n, err
+}
+
+// captureWriter keeps the start of a response body.
+type captureWriter struct {
+	http.ResponseWriter
+	buf *captureBuffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.buf.keep(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withCapture logs the headers and bodies of requests and responses while the
+// capture is turned on.
+func withCapture(cp *capture, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !cp.enabled.Load() {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		reqBuf := &captureBuffer{max: cp.maxBytes}
+		respBuf := &captureBuffer{max: cp.maxBytes}
+		setLogField(req, "request_headers", cp.header(req.Header))
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &captureBody{ReadCloser: req.Body, buf: reqBuf}
+		}
+
+		cw := &captureWriter{ResponseWriter: w, buf: respBuf}
+		h.ServeHTTP(cw, req)
+
+		setLogField(req, "response_headers", cp.header(w.Header()))
+
+		if v, ok := cp.body(reqBuf.bytes(), req.Header.Get("Content-Type")); ok {
+			setLogField(req, "request_body", v)
+		}
+
+		if v, ok := cp.body(respBuf.bytes(), w.Header().Get("Content-Type")); ok {
+			setLogField(req, "response_body", v)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCaptureRedactsCredentials(t *testing.T) {
+	route := Route{
+		APIKey: &APIKey{Header: "X-Key"},
+		HMAC:   &HMAC{Secret: "s", Header: "X-Hub-Signature"},
+	}
+
+	cp, err := newCapture(&Capture{RedactHeaders: []string{"x-token"}}, "/",
+		newCredentials(route).headers)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := cp.header(http.Header{
+		"Authorization":   {"Bearer t"},
+		"X-Api-Key":       {"k"},
+		"X-Key":           {"k"},
+		"X-Signature":     {"sig"},
+		"X-Hub-Signature": {"sig"},
+		"X-Token":         {"t"},
+		"Accept":          {"*/*"},
+	})
+
+	for k, v := range got {
+		if want := k != "Accept"; want != (v[0] == redacted) {
+			t.Errorf("%s: %q", k, v[0])
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CaseInsensitive describes matching requests to the routes of a proxy
+// regardless of the case of their hostnames. Requests are proxied with their
+// case unchanged.
+type CaseInsensitive struct {
+	// Paths is optional. If true, paths are also matched regardless of
+	// case.
+	Paths bool `json:"paths"`
+}
+
+// router matches requests to handlers, like http.ServeMux.
+type router interface {
+	http.Handler
+	Handler(req *http.Request) (http.Handler, string)
+}
+
+// foldingMux matches requests to the patterns of mux, which are registered
+// folded, by their folded hosts and paths.
+type foldingMux struct {
+	mux   *http.ServeMux
+	paths bool
+}
+
+// fold returns the pattern of the route as registered.
+func (m *foldingMux) fold(pattern string) string {
+	i := strings.Index(pattern, "/")
+
+	if i < 0 || m.paths {
+		return strings.ToLower(pattern)
+	}
+
+	return strings.ToLower(pattern[:i]) + pattern[i:]
+}
+
+func (m *foldingMux) Handler(req *http.Request) (http.Handler, string) {
+	r := *req
+	u := *req.URL
+	r.URL = &u
+	r.Host = strings.ToLower(req.Host)
+
+	if m.paths {
+		u.Path = strings.ToLower(u.Path)
+		u.RawPath = ""
+	}
+
+	return m.mux.Handler(&r)
+}
+
+func (m *foldingMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, _ := m.Handler(req)
+	h.ServeHTTP(w, req)
+}
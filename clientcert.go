@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ClientCert names the headers in which details of the verified client
+// certificate are forwarded to the backend. Headers left empty are not
+// forwarded. Incoming values of these headers are always removed, so they
+// cannot be spoofed.
+type ClientCert struct {
+	// Subject is the certificate subject distinguished name.
+	Subject string `json:"subject"`
+
+	// SANs is a comma-separated list of the DNS, email, IP, and URI
+	// subject alternative names.
+	SANs string `json:"sans"`
+
+	// Fingerprint is the hex SHA-256 fingerprint of the certificate.
+	Fingerprint string `json:"fingerprint"`
+
+	// PEM is the URL-escaped PEM encoding of the certificate.
+	PEM string `json:"pem"`
+}
+
+// clientCAConfig returns a TLS configuration requiring client certificates
+// signed by a CA in the file, based on base if non-nil.
+func clientCAConfig(base *tls.Config, file string) (*tls.Config, error) {
+	b, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("proxy: no certificates in " + file)
+	}
+
+	var c *tls.Config
+
+	if base != nil {
+		c = base.Clone()
+	} else {
+		c = &tls.Config{}
+	}
+
+	c.ClientCAs = pool
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	return c, nil
+}
+
+func sans(cert *x509.Certificate) string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+
+	return strings.Join(names, ",")
+}
+
+// withClientCert forwards details of the verified client certificate.
+func withClientCert(c *ClientCert, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range []string{c.Subject, c.SANs, c.Fingerprint, c.PEM} {
+			if name != "" {
+				req.Header.Del(name)
+			}
+		}
+
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		cert := req.TLS.VerifiedChains[0][0]
+
+		if c.Subject != "" {
+			req.Header.Set(c.Subject, cert.Subject.String())
+		}
+
+		if c.SANs != "" {
+			req.Header.Set(c.SANs, sans(cert))
+		}
+
+		if c.Fingerprint != "" {
+			sum := sha256.Sum256(cert.Raw)
+			req.Header.Set(c.Fingerprint, hex.EncodeToString(sum[:]))
+		}
+
+		if c.PEM != "" {
+			p := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: cert.Raw,
+			})
+			req.Header.Set(c.PEM, url.QueryEscape(string(p)))
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// clientIP returns the IP address of the client, as resolved from trusted
+// proxies, or otherwise of the client connection.
+func clientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// parseCIDRs parses CIDR ranges, accepting single IP addresses as well.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip,
+				Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withTrustedProxies resolves the client IP from X-Forwarded-For when the
+// connection comes from a trusted proxy: the right-most address not itself
+// trusted is the client.
+func withTrustedProxies(trusted []*net.IPNet, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := net.ParseIP(clientIP(req))
+
+		if ip == nil || !containsIP(trusted, ip) {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		var hops []string
+
+		for _, v := range req.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+
+		client := ip.String()
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+
+			if hop == nil {
+				break
+			}
+
+			client = hop.String()
+
+			if !containsIP(trusted, hop) {
+				break
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), clientIPKey{}, client)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	proxy "github.com/esote/http-proxy"
+)
+
+const echoUsage = "usage: http-proxy echo [-addr addr]"
+
+// echo serves proxy.EchoHandler, to be proxied to while testing routes.
+func echo(args []string) {
+	fs := flag.NewFlagSet("echo", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8081", "address to listen on")
+
+	fs.Usage = func() {
+		log.Println(echoUsage)
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		log.Fatal(echoUsage)
+	}
+
+	log.Println("echoing requests on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, proxy.EchoHandler()))
+}
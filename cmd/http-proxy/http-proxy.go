@@ -1,22 +1,123 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	proxy "github.com/esote/http-proxy"
 )
 
+const usage = "usage: http-proxy config\n" +
+	"       http-proxy -etcd endpoint -etcd-key key\n" +
+	"       http-proxy replay [-timeout d] target file ...\n" +
+	"       http-proxy echo [-addr addr]"
+
+// reloadTimeout bounds graceful shutdown when replacing a configuration.
+const reloadTimeout = 10 * time.Second
+
+// running is a started configuration which can be stopped.
+type running struct {
+	stops []chan bool
+	errs  <-chan error
+}
+
+func start(proxies *proxy.Proxies) *running {
+	r := &running{}
+
+	for i := range proxies.Proxies {
+		stop := make(chan bool, 1)
+		r.stops = append(r.stops, stop)
+		proxies.Proxies[i].Stop = stop
+		proxies.Proxies[i].StopTimeout = reloadTimeout
+	}
+
+	r.errs = proxy.Proxy(proxies)
+	return r
+}
+
+// stop gracefully shuts down all proxies, logging errors until all die.
+func (r *running) stop() {
+	for _, stop := range r.stops {
+		stop <- true
+	}
+
+	for err := range r.errs {
+		log.Println(err)
+	}
+}
+
+func watchEtcd(endpoint, key string) {
+	e := &proxy.Etcd{Endpoint: endpoint, Key: key}
+	updates, errs := e.Watch(context.Background())
+
+	var r *running
+	var died <-chan error
+
+	for {
+		select {
+		case proxies := <-updates:
+			if r != nil {
+				r.stop()
+			}
+
+			log.Println("applying configuration from etcd")
+			proxies.Source = "etcd " + endpoint + " " + key
+			r = start(proxies)
+			died = r.errs
+		case err := <-errs:
+			log.Println(err)
+		case err, ok := <-died:
+			if !ok {
+				log.Fatal("all servers died")
+			}
+
+			log.Println(err)
+		}
+	}
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("usage: http-proxy config")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "echo":
+			echo(os.Args[2:])
+			return
+		}
+	}
+
+	etcd := flag.String("etcd", "", "etcd endpoint to load configuration from")
+	key := flag.String("etcd-key", "", "etcd key holding the configuration")
+
+	flag.Usage = func() {
+		log.Println(usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *etcd != "" {
+		if *key == "" {
+			log.Fatal(usage)
+		}
+
+		watchEtcd(*etcd, *key)
+	}
+
+	if flag.NArg() < 1 {
+		log.Fatal(usage)
 	}
 
 	var proxies proxy.Proxies
 
-	data, err := ioutil.ReadFile(os.Args[1])
+	data, err := ioutil.ReadFile(flag.Arg(0))
 
 	if err != nil {
 		log.Fatal(err)
@@ -26,6 +127,7 @@ func main() {
 		log.Fatal(err)
 	}
 
+	proxies.Source = flag.Arg(0)
 	errs := proxy.Proxy(&proxies)
 
 	for {
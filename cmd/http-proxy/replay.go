@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	proxy "github.com/esote/http-proxy"
+)
+
+const replayUsage = "usage: http-proxy replay [-timeout d] target file ..."
+
+// replay resends the requests saved by Record in the files to target, such as
+// "http://localhost:8080", printing the status of each.
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of each request")
+
+	fs.Usage = func() {
+		log.Println(replayUsage)
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		log.Fatal(replayUsage)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	target, failed := fs.Arg(0), false
+
+	for _, name := range fs.Args()[1:] {
+		rr, err := proxy.ReadRecordedRequest(name)
+
+		if err != nil {
+			log.Println(err)
+			failed = true
+			continue
+		}
+
+		req, err := rr.Request(target)
+
+		if err != nil {
+			log.Println(name, err)
+			failed = true
+			continue
+		}
+
+		note := ""
+
+		if rr.BodyOmitted {
+			note = " (body omitted)"
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+
+		if err != nil {
+			log.Println(name, err)
+			failed = true
+			continue
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		fmt.Printf("%s\t%d\t%s %s%s\t%v\n", name, resp.StatusCode, rr.Method,
+			rr.URI, note, time.Since(start).Round(time.Millisecond))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compress describes compression of responses for clients which accept it,
+// when the backend has not compressed them already. The brotli and zstd
+// encoders favor speed and a small footprint over the best ratios.
+type Compress struct {
+	// Types is optional. It lists the compressible content types, where
+	// "text/*" matches all text types. It defaults to common text, JSON,
+	// JavaScript, XML and SVG types.
+	Types []string `json:"types"`
+
+	// MinSize is optional. Smaller responses are not compressed. It
+	// defaults to 1024 bytes.
+	MinSize int `json:"min_size"`
+
+	// Level is optional. It is the gzip compression level, from 1 (best
+	// speed) to 9 (best compression), defaulting to 6.
+	Level int `json:"level"`
+
+	// Encodings is optional. It lists the encodings offered, from "br",
+	// "zstd" and "gzip", in order of preference when clients accept
+	// several equally. It defaults to all of them, in that order.
+	Encodings []string `json:"encodings"`
+
+	// BrotliLevel is optional. It is the brotli compression level, from 1
+	// to 11, defaulting to 4.
+	BrotliLevel int `json:"brotli_level"`
+
+	// ZstdLevel is optional. It is the zstd compression level, from 1 to
+	// 19, defaulting to 3.
+	ZstdLevel int `json:"zstd_level"`
+}
+
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/problem+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+const (
+	defaultCompressMinSize = 1024
+	defaultBrotliLevel     = 4
+	defaultZstdLevel       = 3
+)
+
+// encoder is a compressing writer, such as *gzip.Writer.
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+type compressor struct {
+	types     []string
+	minSize   int
+	encodings []string
+	pools     map[string]*sync.Pool
+}
+
+// compressLevel returns level, or def if zero, checking it is within
+// [min, max].
+func compressLevel(encoding string, level, def, min, max int) (int, error) {
+	if level == 0 {
+		return def, nil
+	}
+
+	if level < min || level > max {
+		return 0, errors.New("proxy: " + encoding + " level out of range")
+	}
+
+	return level, nil
+}
+
+func newCompressor(c *Compress) (*compressor, error) {
+	if c.MinSize < 0 {
+		return nil, errors.New("proxy: negative compression min_size")
+	}
+
+	gzipLevel, err := compressLevel("gzip", c.Level,
+		gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	brotliLevel, err := compressLevel("brotli", c.BrotliLevel,
+		defaultBrotliLevel, 1, 11)
+
+	if err != nil {
+		return nil, err
+	}
+
+	zstdLevel, err := compressLevel("zstd", c.ZstdLevel,
+		defaultZstdLevel, 1, 19)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &compressor{
+		types:     c.Types,
+		minSize:   c.MinSize,
+		encodings: c.Encodings,
+		pools:     make(map[string]*sync.Pool),
+	}
+
+	if len(cp.encodings) == 0 {
+		cp.encodings = []string{"br", "zstd", "gzip"}
+	}
+
+	for _, e := range cp.encodings {
+		switch e {
+		case "gzip":
+			cp.pools[e] = &sync.Pool{New: func() interface{} {
+				zw, _ := gzip.NewWriterLevel(nil, gzipLevel)
+				return zw
+			}}
+		case "br":
+			cp.pools[e] = &sync.Pool{New: func() interface{} {
+				return newBrotliWriter(nil, brotliLevel)
+			}}
+		case "zstd":
+			cp.pools[e] = &sync.Pool{New: func() interface{} {
+				return newZstdWriter(nil, zstdLevel)
+			}}
+		default:
+			return nil, errors.New("proxy: unknown encoding " + e)
+		}
+	}
+
+	if len(cp.types) == 0 {
+		cp.types = defaultCompressTypes
+	}
+
+	if cp.minSize == 0 {
+		cp.minSize = defaultCompressMinSize
+	}
+
+	return cp, nil
+}
+
+// compressible reports whether responses of the content type may be
+// compressed.
+func (cp *compressor) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	for _, t := range cp.types {
+		if t == mt || strings.HasSuffix(t, "/*") &&
+			strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiate returns the offered encoding the Accept-Encoding header of req
+// weighs highest, or "" if it accepts none.
+func (cp *compressor) negotiate(req *http.Request) string {
+	weights := make(map[string]float64)
+
+	for _, v := range req.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			q := 1.0
+
+			if p := strings.TrimSpace(params); strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+
+			weights[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, e := range cp.encodings {
+		q, ok := weights[e]
+
+		if !ok {
+			q = weights["*"]
+		}
+
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter compresses a response once it is known to be compressible
+// and at least the minimum size.
+type compressWriter struct {
+	http.ResponseWriter
+	cp       *compressor
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	enc      encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.status = status
+	h := w.Header()
+
+	if status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" ||
+		!w.cp.compressible(h.Get("Content-Type")) {
+		w.pass()
+		return
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		if n < w.cp.minSize {
+			w.pass()
+		} else {
+			w.start()
+		}
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+
+	if len(w.buf) >= w.cp.minSize {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// pass sends the response uncompressed.
+func (w *compressWriter) pass() error {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// start sends the response compressed.
+func (w *compressWriter) start() error {
+	w.decided = true
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+
+	// The compressed representation differs from the backend's.
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.enc = w.cp.pools[w.encoding].Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	_, err := w.enc.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.decided {
+		w.start()
+	}
+
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finishes the response.
+func (w *compressWriter) close() {
+	if w.status == 0 {
+		return
+	}
+
+	if !w.decided {
+		w.pass()
+	}
+
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(io.Discard)
+		w.cp.pools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// withCompress compresses responses to clients accepting an encoding of cp.
+func withCompress(cp *compressor, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := cp.negotiate(req)
+
+		if req.Method == http.MethodHead || encoding == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, cp: cp, encoding: encoding}
+		defer cw.close()
+		h.ServeHTTP(cw, req)
+	})
+}
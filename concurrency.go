@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency describes a limit on in-flight requests.
+type Concurrency struct {
+	// Max number of requests served at once.
+	Max int `json:"max"`
+
+	// QueueTimeout is optional. It is how long a request beyond Max waits
+	// for a slot before being shed with 503 Service Unavailable. By
+	// default such requests are shed immediately.
+	QueueTimeout Duration `json:"queue_timeout"`
+
+	// QueueDepth is optional. If positive, it bounds how many requests wait
+	// for a slot, shedding any beyond it immediately. Requires
+	// QueueTimeout.
+	QueueDepth int `json:"queue_depth"`
+}
+
+// semaphore bounds concurrent requests.
+type semaphore struct {
+	slots   chan struct{}
+	timeout time.Duration
+	depth   int64
+	waiting int64
+
+	// held is the moving average of how long slots are held, in
+	// nanoseconds.
+	held int64
+}
+
+func newSemaphore(c *Concurrency) (*semaphore, error) {
+	if c.Max <= 0 {
+		return nil, errors.New("proxy: concurrency max must be positive")
+	}
+
+	if c.QueueTimeout < 0 || c.QueueDepth < 0 {
+		return nil, errors.New("proxy: negative concurrency queue option")
+	}
+
+	if c.QueueDepth > 0 && c.QueueTimeout == 0 {
+		return nil, errors.New("proxy: concurrency queue_depth requires " +
+			"queue_timeout")
+	}
+
+	return &semaphore{
+		slots:   make(chan struct{}, c.Max),
+		timeout: time.Duration(c.QueueTimeout),
+		depth:   int64(c.QueueDepth),
+	}, nil
+}
+
+// acquire takes a slot, waiting in the queue up to the queue timeout or until
+// the request is canceled.
+func (s *semaphore) acquire(req *http.Request) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if s.timeout == 0 {
+		return false
+	}
+
+	n := atomic.AddInt64(&s.waiting, 1)
+	defer atomic.AddInt64(&s.waiting, -1)
+
+	if s.depth > 0 && n > s.depth {
+		return false
+	}
+
+	t := time.NewTimer(s.timeout)
+	defer t.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-req.Context().Done():
+	}
+
+	return false
+}
+
+func (s *semaphore) release(start time.Time) {
+	<-s.slots
+
+	// The average weighs the latest request by 1/8.
+	d := int64(time.Since(start))
+
+	for {
+		old := atomic.LoadInt64(&s.held)
+		avg := old + (d-old)/8
+
+		if old == 0 {
+			avg = d
+		}
+
+		if atomic.CompareAndSwapInt64(&s.held, old, avg) {
+			return
+		}
+	}
+}
+
+// wait estimates how long until the queue ahead of a new request is served.
+func (s *semaphore) wait() time.Duration {
+	n := atomic.LoadInt64(&s.waiting) + 1
+	return time.Duration(atomic.LoadInt64(&s.held) * n / int64(cap(s.slots)))
+}
+
+// withConcurrency sheds requests beyond the limit of s with 503 Service
+// Unavailable, with the estimated wait for a slot.
+func withConcurrency(s *semaphore, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !s.acquire(req) {
+			shed(w, req, http.StatusServiceUnavailable, s.wait(),
+				"concurrency limit reached")
+			return
+		}
+
+		defer s.release(time.Now())
+		h.ServeHTTP(w, req)
+	})
+}
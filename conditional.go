@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModifiedHeaders are the headers of a response kept in a 304 Not
+// Modified response to it.
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// etagMatch reports whether the If-None-Match list matches etag, using weak
+// comparison.
+func etagMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified reports whether the conditional request req is satisfied by a
+// response with header h, so that 304 Not Modified may be sent instead.
+func notModified(req *http.Request, h http.Header) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := req.Header.Values("If-None-Match"); len(inm) != 0 {
+		return etagMatch(strings.Join(inm, ","), h.Get("ETag"))
+	}
+
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+
+	if err != nil {
+		return false
+	}
+
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+
+	return err == nil && !lm.Truncate(time.Second).After(ims)
+}
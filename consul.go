@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Consul describes a Consul service whose healthy instances form the
+// upstream pool of a route.
+type Consul struct {
+	// Addr is optional. It is the URL of the Consul agent, defaulting to
+	// "http://127.0.0.1:8500".
+	Addr string `json:"addr"`
+
+	// Service name to discover.
+	Service string `json:"service"`
+
+	// Tag, Datacenter, and Token are optional. Tag filters instances,
+	// Datacenter selects a datacenter other than the agent's, and Token is
+	// the ACL token sent with each query.
+	Tag        string `json:"tag"`
+	Datacenter string `json:"datacenter"`
+	Token      string `json:"token"`
+}
+
+const (
+	defaultConsulAddr = "http://127.0.0.1:8500"
+	consulWait        = 5 * time.Minute
+	discoveryBackoff  = 5 * time.Second
+)
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+type consulWatch struct {
+	c      *Consul
+	client *http.Client
+	base   *url.URL
+}
+
+func (w *consulWatch) fetch(s *scope, index uint64) ([]target, uint64, error) {
+	u := *w.base
+	u.Path = "/v1/health/service/" + url.PathEscape(w.c.Service)
+
+	q := url.Values{"passing": {"true"}}
+
+	if w.c.Tag != "" {
+		q.Set("tag", w.c.Tag)
+	}
+
+	if w.c.Datacenter != "" {
+		q.Set("dc", w.c.Datacenter)
+	}
+
+	if index != 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait.String())
+	}
+
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if w.c.Token != "" {
+		req.Header.Set("X-Consul-Token", w.c.Token)
+	}
+
+	resp, err := w.client.Do(req)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("proxy: consul %s: %s", w.c.Service,
+			resp.Status)
+	}
+
+	var entries []consulEntry
+
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	// Treat a missing or zero index as 1, as Consul advises, so the next
+	// query still blocks.
+	if next < 1 {
+		next = 1
+	}
+
+	targets := make([]target, 0, len(entries))
+
+	for _, e := range entries {
+		addr := e.Service.Address
+
+		if addr == "" {
+			addr = e.Node.Address
+		}
+
+		weight := e.Service.Weights.Passing
+
+		if weight == 0 {
+			weight = 1
+		}
+
+		targets = append(targets, target{
+			Addr:   net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)),
+			Weight: weight,
+		})
+	}
+
+	return targets, next, nil
+}
+
+// watchConsul populates a pool from the Consul service, using blocking
+// queries to pick up changes until the proxy stops.
+func watchConsul(s *scope, c *Consul) (*pool, error) {
+	if c.Service == "" {
+		return nil, errors.New("proxy: consul service is empty")
+	}
+
+	addr := c.Addr
+
+	if addr == "" {
+		addr = defaultConsulAddr
+	}
+
+	base, err := url.Parse(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	w := &consulWatch{
+		c:      c,
+		client: &http.Client{Timeout: consulWait + time.Minute},
+		base:   base,
+	}
+
+	targets, index, err := w.fetch(s, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{targets: targets}
+
+	s.run(func() {
+		for s.ctx.Err() == nil {
+			targets, next, err := w.fetch(s, index)
+
+			if err != nil {
+				if s.ctx.Err() == nil {
+					s.report(err)
+				}
+
+				select {
+				case <-time.After(discoveryBackoff):
+				case <-s.ctx.Done():
+				}
+				continue
+			}
+
+			p.set(targets)
+
+			// Reset the index if it goes backwards, as Consul advises. When
+			// it did not advance, wait so that a server answering without
+			// blocking is not polled in a tight loop.
+			if next <= index {
+				if next < index {
+					next = 0
+				}
+
+				select {
+				case <-time.After(discoveryBackoff):
+				case <-s.ctx.Done():
+				}
+			}
+
+			index = next
+		}
+	})
+
+	return p, nil
+}
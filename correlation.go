@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Correlation describes a response header echoing an ID of each request, for
+// clients to quote when reporting problems and to find the request's log
+// entry.
+type Correlation struct {
+	// Header is optional, defaulting to "X-Request-Id".
+	Header string `json:"header"`
+
+	// ID is optional. It is "request_id", the default, or "trace_id" for
+	// the W3C trace ID.
+	ID string `json:"id"`
+}
+
+func checkCorrelation(c *Correlation) error {
+	switch c.ID {
+	case "", "request_id", "trace_id":
+		return nil
+	default:
+		return errors.New("proxy: unknown correlation id " + c.ID)
+	}
+}
+
+// correlationWriter sets the header as the response is written, replacing any
+// value from the backend.
+type correlationWriter struct {
+	http.ResponseWriter
+	header, id string
+	wrote      bool
+}
+
+func (w *correlationWriter) WriteHeader(status int) {
+	if !w.wrote && status >= http.StatusOK {
+		w.wrote = true
+		w.Header().Set(w.header, w.id)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *correlationWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *correlationWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *correlationWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withCorrelation echoes the request or trace ID in a response header.
+func withCorrelation(c *Correlation, h http.Handler) http.Handler {
+	header := c.Header
+
+	if header == "" {
+		header = "X-Request-Id"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := requestID(req)
+
+		if c.ID == "trace_id" {
+			tc, _ := traceOf(req)
+			id = tc.traceID
+		}
+
+		if id == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		cw := &correlationWriter{ResponseWriter: w, header: header, id: id}
+		h.ServeHTTP(cw, req)
+	})
+}
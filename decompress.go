@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gzipBody is a decompressed response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// defaultMaxDecompressed limits decompressed bodies of routes without
+// MaxResponseBytes.
+const defaultMaxDecompressed = 64 << 20
+
+// decompress returns a modifier replacing a gzip-encoded response body with
+// its decompressed contents, so that caching and compression see the original
+// representation. Decompressed bodies are limited to max bytes, like those
+// of MaxResponseBytes, or to defaultMaxDecompressed if max is zero.
+func decompress(max int64) func(*http.Response) error {
+	if max == 0 {
+		max = defaultMaxDecompressed
+	}
+
+	return func(resp *http.Response) error {
+		return decompressResponse(resp, max)
+	}
+}
+
+func decompressResponse(resp *http.Response, max int64) error {
+	h := resp.Header
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+	default:
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusPartialContent ||
+		resp.Body == http.NoBody {
+		return nil
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+
+	if err == io.EOF {
+		// An empty body.
+		zr = nil
+	} else if err != nil {
+		return err
+	}
+
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	resp.ContentLength = -1
+
+	// The decompressed representation differs from the backend's.
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	if zr == nil {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	} else {
+		resp.Body = &limitedBody{
+			ReadCloser: &gzipBody{Reader: zr, body: resp.Body},
+			req:        resp.Request,
+			left:       max,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipResponse(t *testing.T, body string) *http.Response {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(body))
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Encoding": {"gzip"},
+			"Etag":             {`"v1"`},
+		},
+		Body:    io.NopCloser(&buf),
+		Request: httptest.NewRequest(http.MethodGet, "/", nil),
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	body := strings.Repeat("a", 1000)
+
+	resp := gzipResponse(t, body)
+
+	if err := decompress(0)(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(resp.Body)
+
+	if err != nil || string(got) != body {
+		t.Errorf("read %d bytes, error %v", len(got), err)
+	}
+
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("ETag") != `W/"v1"` {
+		t.Errorf("header %v", resp.Header)
+	}
+
+	// Bodies which decompress larger than the limit are cut off.
+	resp = gzipResponse(t, body)
+
+	if err := decompress(100)(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = io.ReadAll(resp.Body); err != errResponseTooLarge {
+		t.Errorf("read beyond the limit: error %v", err)
+	}
+}
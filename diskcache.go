@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// diskCache is an LRU store of responses on disk bounded by size. Each
+// response is kept as a metadata file and a body file, named by the hash of
+// its key, so that the cache survives restarts.
+type diskCache struct {
+	dir string
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type diskEntry struct {
+	r    *cachedResponse
+	size int64
+}
+
+func newDiskCache(dir string, max int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	d := &diskCache{
+		dir:   dir,
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type loaded struct {
+		r    *cachedResponse
+		size int64
+	}
+
+	var found []loaded
+
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(name)
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".meta") {
+			continue
+		}
+
+		r, size, err := d.load(name)
+
+		if err != nil {
+			os.Remove(name)
+			os.Remove(strings.TrimSuffix(name, ".meta") + ".body")
+			continue
+		}
+
+		found = append(found, loaded{r, size})
+	}
+
+	// Treat the most recently stored as the most recently used.
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].r.Stored.Before(found[j].r.Stored)
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, l := range found {
+		d.insert(l.r, l.size)
+	}
+
+	return d, nil
+}
+
+func (d *diskCache) load(meta string) (*cachedResponse, int64, error) {
+	f, err := os.Open(meta)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer f.Close()
+
+	var r cachedResponse
+
+	if err = gob.NewDecoder(f).Decode(&r); err != nil {
+		return nil, 0, err
+	}
+
+	r.file = strings.TrimSuffix(meta, ".meta") + ".body"
+	fi, err := os.Stat(r.file)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &r, fi.Size() + r.size(), nil
+}
+
+// path returns the path, without extension, of the files of key.
+func (d *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+// tempFile creates a temporary file in the cache directory, from which
+// bodies are renamed into place.
+func (d *diskCache) tempFile() (*os.File, error) {
+	return os.CreateTemp(d.dir, "*.tmp")
+}
+
+func (d *diskCache) get(key string) (*cachedResponse, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.items[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	d.ll.MoveToFront(e)
+	return e.Value.(*diskEntry).r, true
+}
+
+// set stores r, whose body has been written to the temporary file body.
+func (d *diskCache) set(r *cachedResponse, body string) error {
+	base := d.path(r.Key)
+
+	fi, err := os.Stat(body)
+
+	if err != nil {
+		os.Remove(body)
+		return err
+	}
+
+	meta, err := d.tempFile()
+
+	if err != nil {
+		os.Remove(body)
+		return err
+	}
+
+	stored := *r
+	stored.Body = nil
+	err = gob.NewEncoder(meta).Encode(&stored)
+
+	if cerr := meta.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(body, base+".body")
+	}
+
+	if err == nil {
+		err = os.Rename(meta.Name(), base+".meta")
+	}
+
+	if err != nil {
+		os.Remove(body)
+		os.Remove(meta.Name())
+		return err
+	}
+
+	stored.file = base + ".body"
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.items[r.Key]; ok {
+		d.unlink(e, false)
+	}
+
+	d.insert(&stored, fi.Size()+stored.size())
+	return nil
+}
+
+// write stores r along with its in-memory body.
+func (d *diskCache) write(r *cachedResponse) error {
+	f, err := d.tempFile()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(r.Body)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return d.set(r, f.Name())
+}
+
+// update replaces the metadata of the stored response r, keeping its body.
+// It does nothing if r is no longer stored.
+func (d *diskCache) update(r *cachedResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.items[r.Key]
+
+	if !ok {
+		return nil
+	}
+
+	entry := e.Value.(*diskEntry)
+
+	meta, err := d.tempFile()
+
+	if err != nil {
+		return err
+	}
+
+	stored := *r
+	stored.Body = nil
+	err = gob.NewEncoder(meta).Encode(&stored)
+
+	if cerr := meta.Close(); err == nil {
+		err = cerr
+	}
+
+	base := strings.TrimSuffix(entry.r.file, ".body")
+
+	if err == nil {
+		err = os.Rename(meta.Name(), base+".meta")
+	}
+
+	if err != nil {
+		os.Remove(meta.Name())
+		return err
+	}
+
+	stored.file = entry.r.file
+	d.size += stored.size() - entry.r.size()
+	entry.size += stored.size() - entry.r.size()
+	entry.r = &stored
+	d.ll.MoveToFront(e)
+	return nil
+}
+
+func (d *diskCache) remove(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.items[key]; ok {
+		d.unlink(e, true)
+	}
+}
+
+func (d *diskCache) purge(match func(*cachedResponse) bool) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var keys []string
+
+	for e := d.ll.Front(); e != nil; {
+		next := e.Next()
+
+		if r := e.Value.(*diskEntry).r; match(r) {
+			keys = append(keys, r.Key)
+			d.unlink(e, true)
+		}
+
+		e = next
+	}
+
+	return keys
+}
+
+func (d *diskCache) insert(r *cachedResponse, size int64) {
+	d.items[r.Key] = d.ll.PushFront(&diskEntry{r: r, size: size})
+	d.size += size
+
+	for d.size > d.max && d.ll.Len() > 1 {
+		d.unlink(d.ll.Back(), true)
+	}
+}
+
+// unlink removes e from the index, and its files if files is true.
+func (d *diskCache) unlink(e *list.Element, files bool) {
+	entry := d.ll.Remove(e).(*diskEntry)
+	delete(d.items, entry.r.Key)
+	d.size -= entry.size
+
+	if files {
+		base := strings.TrimSuffix(entry.r.file, ".body")
+		os.Remove(base + ".meta")
+		os.Remove(base + ".body")
+	}
+}
+
+// readBody reads the body of r, when stored on disk.
+func readBody(r *cachedResponse) ([]byte, error) {
+	f, err := os.Open(r.file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// A minimal DNS client used to learn record TTLs, which the net package does
+// not expose.
+
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsClassINET = 1
+)
+
+var errDNSFormat = errors.New("proxy: malformed dns message")
+
+// dnsRecord is a resource record from an answer section.
+type dnsRecord struct {
+	typ  uint16
+	ttl  uint32
+	data []byte
+}
+
+func dnsQuery(ctx context.Context, server, name string, qtype uint16) ([]dnsRecord, error) {
+	var id [2]byte
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+
+	q, err := dnsBuildQuery(binary.BigEndian.Uint16(id[:]), name, qtype)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsExchange(ctx, "udp", server, q)
+
+	if err == nil && resp[2]&0x02 != 0 {
+		// Truncated, retry over TCP.
+		resp, err = dnsExchange(ctx, "tcp", server, q)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dnsParse(resp, q[:2], qtype)
+}
+
+func dnsBuildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	b[2] = 0x01                          // recursion desired
+	binary.BigEndian.PutUint16(b[4:], 1) // one question
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errors.New("proxy: invalid dns name " + name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, dnsClassINET)
+	return b, nil
+}
+
+func dnsExchange(ctx context.Context, network, server string, q []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err = conn.Write(q); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 4096)
+
+		for {
+			n, err := conn.Read(buf)
+
+			if err != nil {
+				return nil, err
+			}
+
+			// Ignore stray responses with a different ID.
+			if n >= 12 && buf[0] == q[0] && buf[1] == q[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+
+	if _, err = io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 12 {
+		return nil, errDNSFormat
+	}
+
+	return resp, nil
+}
+
+func dnsParse(msg, id []byte, qtype uint16) ([]dnsRecord, error) {
+	if len(msg) < 12 || msg[0] != id[0] || msg[1] != id[1] {
+		return nil, errDNSFormat
+	}
+
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: "server failure",
+			IsTemporary: rcode == 2}
+	}
+
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+
+	for i := 0; i < qd; i++ {
+		var err error
+
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return nil, err
+		}
+
+		off += 4
+	}
+
+	var records []dnsRecord
+
+	for i := 0; i < an; i++ {
+		var err error
+
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return nil, err
+		}
+
+		if off+10 > len(msg) {
+			return nil, errDNSFormat
+		}
+
+		typ := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		n := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+
+		if off+n > len(msg) {
+			return nil, errDNSFormat
+		}
+
+		// CNAME records are followed by the records of the target.
+		if typ == qtype {
+			records = append(records, dnsRecord{
+				typ:  typ,
+				ttl:  ttl,
+				data: msg[off : off+n],
+			})
+		}
+
+		off += n
+	}
+
+	return records, nil
+}
+
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSFormat
+		}
+
+		l := int(msg[off])
+
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		}
+
+		off += 1 + l
+	}
+}
+
+// systemNameservers returns the nameservers listed in /etc/resolv.conf.
+func systemNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	var servers []string
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		if net.ParseIP(fields[1]) != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+
+	return servers
+}
+
+// hostsIPs returns the addresses of host in the hosts file name, such as
+// "/etc/hosts".
+func hostsIPs(name, host string) []net.IP {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	host = strings.TrimSuffix(host, ".")
+
+	var ips []net.IP
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+
+		if ip == nil {
+			continue
+		}
+
+		for _, h := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(h, "."), host) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+
+	return ips
+}
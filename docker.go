@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Docker describes a Docker daemon whose running containers are proxied
+// according to their labels. With the default prefix, a container labeled
+// "http-proxy.host=app.localhost" is routed from "app.localhost/" to its
+// address. The optional "http-proxy.path" label replaces "/", and
+// "http-proxy.port" selects the container port, defaulting to 80.
+type Docker struct {
+	// Host is optional. It is the daemon address, such as
+	// "tcp://127.0.0.1:2375", defaulting to
+	// "unix:///var/run/docker.sock".
+	Host string `json:"host"`
+
+	// Network is optional. It selects which container network address is
+	// used, defaulting to the first one.
+	Network string `json:"network"`
+
+	// LabelPrefix is optional, defaulting to "http-proxy".
+	LabelPrefix string `json:"label_prefix"`
+}
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerWatch struct {
+	d      *Docker
+	s      *scope
+	client *http.Client
+	base   string
+	prefix string
+
+	// backend sends the requests of all discovered routes, so that
+	// refreshes do not each create transports and connection pools.
+	backend http.RoundTripper
+
+	// mux is the current *http.ServeMux of discovered routes.
+	mux atomic.Value
+}
+
+// watchDocker returns a handler which serves requests not matched by static
+// with the routes discovered from container labels, refreshed as containers
+// start and stop.
+func watchDocker(s *scope, d *Docker, static router) (http.Handler, error) {
+	host := d.Host
+
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	u, err := url.Parse(host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dockerWatch{
+		d:      d,
+		s:      s,
+		prefix: d.LabelPrefix,
+	}
+
+	if w.prefix == "" {
+		w.prefix = "http-proxy"
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		w.base = "http://docker"
+	case "tcp", "http":
+		w.base = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("proxy: unsupported docker host %q", host)
+	}
+
+	w.client = &http.Client{Transport: t}
+	w.backend = s.roundTripper
+
+	if w.backend == nil {
+		res, err := newResolver(nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if w.backend, err = newTransport(Route{Transport: s.transport}, res); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = w.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.run(w.watch)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, pattern := static.Handler(req); pattern != "" {
+			static.ServeHTTP(rw, req)
+			return
+		}
+
+		w.mux.Load().(*http.ServeMux).ServeHTTP(rw, req)
+	}), nil
+}
+
+func (w *dockerWatch) get(path string, query url.Values) (*http.Response, error) {
+	u := w.base + path + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(w.s.ctx, http.MethodGet, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxy: docker %s: %s", path, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// refresh lists the labeled containers and replaces the discovered routes.
+func (w *dockerWatch) refresh() error {
+	filters, _ := json.Marshal(map[string][]string{
+		"label": {w.prefix + ".host"},
+	})
+
+	resp, err := w.get("/containers/json", url.Values{
+		"filters": {string(filters)},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+
+	if err = json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	seen := make(map[string]bool)
+
+	for _, c := range containers {
+		route, ok := w.route(c)
+
+		if !ok || seen[route.From] {
+			continue
+		}
+
+		handler, err := routeHandler(w.s, route)
+
+		if err == nil {
+			err = handle(mux, route.From, handler)
+		}
+
+		if err != nil {
+			w.s.report(fmt.Errorf("proxy: docker container %.12s: %w",
+				c.ID, err))
+			continue
+		}
+
+		seen[route.From] = true
+	}
+
+	w.mux.Store(mux)
+	return nil
+}
+
+// handle registers the handler like mux.Handle, but returns an error rather
+// than panicking on invalid patterns taken from labels.
+func handle(mux *http.ServeMux, pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("proxy: invalid route %q: %v", pattern, r)
+		}
+	}()
+
+	mux.Handle(pattern, handler)
+	return nil
+}
+
+func (w *dockerWatch) route(c dockerContainer) (Route, bool) {
+	var ip string
+
+	if w.d.Network != "" {
+		ip = c.NetworkSettings.Networks[w.d.Network].IPAddress
+	} else {
+		// Sort for a stable choice between networks.
+		names := make([]string, 0, len(c.NetworkSettings.Networks))
+
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ip = c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+				break
+			}
+		}
+	}
+
+	if ip == "" {
+		return Route{}, false
+	}
+
+	path := c.Labels[w.prefix+".path"]
+
+	if path == "" {
+		path = "/"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	port := c.Labels[w.prefix+".port"]
+
+	if port == "" {
+		port = "80"
+	}
+
+	return Route{
+		From:         c.Labels[w.prefix+".host"] + path,
+		To:           "http://" + net.JoinHostPort(ip, port),
+		RoundTripper: w.backend,
+	}, true
+}
+
+// watch refreshes the routes on container lifecycle events until the proxy
+// stops.
+func (w *dockerWatch) watch() {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "stop", "pause", "unpause"},
+	})
+
+	for w.s.ctx.Err() == nil {
+		err := w.events(string(filters))
+
+		if w.s.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			w.s.report(err)
+		}
+
+		select {
+		case <-time.After(discoveryBackoff):
+		case <-w.s.ctx.Done():
+			return
+		}
+
+		// Events may have been missed while disconnected.
+		if err := w.refresh(); err != nil {
+			w.s.report(err)
+		}
+	}
+}
+
+func (w *dockerWatch) events(filters string) error {
+	resp, err := w.get("/events", url.Values{"filters": {filters}})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var ev json.RawMessage
+
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+
+		if err := w.refresh(); err != nil {
+			return err
+		}
+	}
+}
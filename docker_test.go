@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingTransport counts the requests it sends.
+type countingTransport struct {
+	n int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.n, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDocker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("container " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	events := make(chan struct{})
+	refreshed := make(chan struct{}, 2)
+
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/containers/json":
+			c := dockerContainer{ID: "abc", Labels: map[string]string{
+				"http-proxy.host": "app.localhost",
+				"http-proxy.port": port,
+			}}
+			c.NetworkSettings.Networks = map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			}{"bridge": {host}}
+			json.NewEncoder(w).Encode([]dockerContainer{c})
+			refreshed <- struct{}{}
+		case "/events":
+			w.(http.Flusher).Flush()
+
+			for {
+				select {
+				case <-events:
+					w.Write([]byte(`{"status":"start"}`))
+					w.(http.Flusher).Flush()
+				case <-req.Context().Done():
+					return
+				}
+			}
+		}
+	}))
+	defer daemon.Close()
+
+	for _, rt := range []*countingTransport{nil, {}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &scope{ctx: ctx}
+
+		if rt != nil {
+			s.roundTripper = rt
+		}
+
+		h, err := watchDocker(s, &Docker{Host: daemon.URL}, http.NewServeMux())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		<-refreshed
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+				"http://app.localhost/x", nil))
+
+			if got := w.Body.String(); got != "container /x" {
+				t.Errorf("discovered route responded %q", got)
+			}
+
+			// Routes refreshed on events are rebuilt.
+			events <- struct{}{}
+			<-refreshed
+		}
+
+		if rt != nil {
+			if n := atomic.LoadInt32(&rt.n); n != 2 {
+				t.Errorf("sent %d requests through the proxy's round tripper, want 2", n)
+			}
+		}
+
+		cancel()
+		s.wg.Wait()
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"unicode/utf8"
+)
+
+// maxEchoBody bounds the request body echoed.
+const maxEchoBody = 1 << 20
+
+// EchoHandler returns a handler which answers each request with a JSON
+// description of it, as received: its method, URI, host, headers, body and
+// trailer. Run as a backend, it shows what the proxy forwards.
+func EchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := io.ReadAll(io.LimitReader(req.Body, maxEchoBody+1))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		echo := map[string]interface{}{
+			"method":      req.Method,
+			"uri":         req.RequestURI,
+			"host":        req.Host,
+			"proto":       req.Proto,
+			"remote_addr": req.RemoteAddr,
+			"headers":     req.Header,
+		}
+
+		if len(b) > maxEchoBody {
+			b = b[:maxEchoBody]
+			echo["body_truncated"] = true
+		}
+
+		if len(b) != 0 {
+			if utf8.Valid(b) {
+				echo["body"] = string(b)
+			} else {
+				echo["body_base64"] = base64.StdEncoding.EncodeToString(b)
+			}
+		}
+
+		if len(req.Trailer) != 0 {
+			echo["trailers"] = req.Trailer
+		}
+
+		if len(req.TransferEncoding) != 0 {
+			echo["transfer_encoding"] = req.TransferEncoding
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		_ = enc.Encode(echo)
+	})
+}
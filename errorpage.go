@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ErrorPage describes the response sent when the backend of a route cannot
+// be reached, instead of a bare 502 Bad Gateway.
+type ErrorPage struct {
+	// Status is optional. It defaults to 502, 503 if the backend was
+	// overloaded, or 504 if it timed out.
+	Status int `json:"status"`
+
+	// Template is optional. It is a Go template file for the response
+	// body, executed with .Status, .StatusText, .RequestID and .Time. It
+	// is parsed as an HTML template if ContentType is HTML. It defaults
+	// to the status text.
+	Template string `json:"template"`
+
+	// ContentType is optional. It is the content type of Template, such as
+	// "application/json", defaulting to "text/html; charset=utf-8".
+	ContentType string `json:"content_type"`
+
+	// JSONTemplate is optional. It is a Go text template file, executed
+	// like Template, for the body sent as application/json to clients
+	// whose Accept header prefers JSON. Its json function encodes a
+	// value as JSON. It defaults to an object with the status, error,
+	// request_id and time.
+	JSONTemplate string `json:"json_template"`
+
+	// Fallback is optional. It is a URL, such as "http://localhost:8081",
+	// whose scheme and host replace those of the backend when resending
+	// requests without a body. The error page is sent if it fails too.
+	Fallback string `json:"fallback"`
+
+	// Redirect is optional. If true, clients are redirected to Fallback
+	// with 307 Temporary Redirect instead, including those of requests
+	// with a body.
+	Redirect bool `json:"redirect"`
+
+	// Replace5xx is optional. If true, 5xx responses from the backend are
+	// replaced like failures to reach it, by the fallback or the error
+	// page, which then defaults to the backend's status.
+	Replace5xx bool `json:"replace_5xx"`
+}
+
+// upstreamStatusError is returned for backend responses replaced by the
+// error page.
+type upstreamStatusError struct {
+	status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "proxy: backend responded " + strconv.Itoa(e.status)
+}
+
+// errorPageData is the data of error page templates.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	Time       time.Time
+}
+
+// executor is a parsed text or HTML template.
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type errorPage struct {
+	status      int
+	tmpl        executor
+	jsonTmpl    executor
+	contentType string
+	fallback    *httputil.ReverseProxy
+	redirect    *url.URL
+}
+
+// acceptWeight returns the weight the Accept header of req gives the media
+// type, or -1 if it has none.
+func acceptWeight(req *http.Request, mediaType string) float64 {
+	accept := req.Header.Values("Accept")
+
+	if len(accept) == 0 {
+		return -1
+	}
+
+	typ, _, _ := strings.Cut(mediaType, "/")
+	best, specificity := 0.0, -1
+
+	for _, v := range accept {
+		for _, part := range strings.Split(v, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+			if err != nil {
+				continue
+			}
+
+			n := -1
+
+			switch mt {
+			case mediaType:
+				n = 2
+			case typ + "/*":
+				n = 1
+			case "*/*":
+				n = 0
+			}
+
+			if n <= specificity {
+				continue
+			}
+
+			q := 1.0
+
+			if f, err := strconv.ParseFloat(params["q"], 64); err == nil {
+				q = f
+			}
+
+			best, specificity = q, n
+		}
+	}
+
+	return best
+}
+
+// prefersJSON reports whether req accepts JSON over HTML.
+func prefersJSON(req *http.Request) bool {
+	return acceptWeight(req, "application/json") > acceptWeight(req, "text/html")
+}
+
+// newErrorHandler returns the ErrorHandler of rp for the error page. The
+// fallback is proxied like rp. With Replace5xx, rp.ModifyResponse is wrapped
+// to pass 5xx responses to the handler.
+func newErrorHandler(c *ErrorPage, rp *httputil.ReverseProxy) (func(http.ResponseWriter, *http.Request, error), error) {
+	if c.Status != 0 && (c.Status < 100 || c.Status > 999) {
+		return nil, errors.New("proxy: invalid error page status " +
+			strconv.Itoa(c.Status))
+	}
+
+	p := &errorPage{
+		status:      c.Status,
+		contentType: c.ContentType,
+	}
+
+	if p.contentType == "" {
+		p.contentType = "text/html; charset=utf-8"
+	}
+
+	if c.Template != "" {
+		b, err := os.ReadFile(c.Template)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.Contains(p.contentType, "html") {
+			p.tmpl, err = htmltemplate.New(c.Template).Parse(string(b))
+		} else {
+			p.tmpl, err = template.New(c.Template).Parse(string(b))
+		}
+
+		if err != nil {
+			return nil, errors.New("proxy: " + err.Error())
+		}
+	}
+
+	if c.JSONTemplate != "" {
+		b, err := os.ReadFile(c.JSONTemplate)
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.jsonTmpl, err = template.New(c.JSONTemplate).Funcs(jsonFuncs).Parse(string(b))
+
+		if err != nil {
+			return nil, errors.New("proxy: " + err.Error())
+		}
+	}
+
+	if c.Fallback != "" {
+		u, err := url.Parse(c.Fallback)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("proxy: invalid fallback " + c.Fallback)
+		}
+
+		if c.Redirect {
+			p.redirect = u
+		} else {
+			p.fallback = &httputil.ReverseProxy{
+				Director: func(req *http.Request) {
+					req.URL.Scheme = u.Scheme
+					req.URL.Host = u.Host
+					req.Host = u.Host
+					req.Header.Set("Host", u.Host)
+				},
+				Transport:      rp.Transport,
+				BufferPool:     rp.BufferPool,
+				ModifyResponse: rp.ModifyResponse,
+				ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+					setLogField(req, "fallback_error", err.Error())
+					p.serve(w, req, err)
+				},
+			}
+		}
+	} else if c.Redirect {
+		return nil, errors.New("proxy: error page redirect without fallback")
+	}
+
+	if c.Replace5xx {
+		modify := rp.ModifyResponse
+
+		rp.ModifyResponse = func(resp *http.Response) error {
+			if resp.StatusCode >= 500 && resp.StatusCode <= 599 {
+				return &upstreamStatusError{status: resp.StatusCode}
+			}
+
+			if modify != nil {
+				return modify(resp)
+			}
+
+			return nil
+		}
+	}
+
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		setLogField(req, "proxy_error", err.Error())
+
+		if p.redirect != nil && req.Context().Err() == nil {
+			u := *p.redirect
+			u.Path, u.RawPath = req.URL.Path, req.URL.RawPath
+			u.RawQuery = req.URL.RawQuery
+			http.Redirect(w, req, u.String(), http.StatusTemporaryRedirect)
+			return
+		}
+
+		if p.fallback != nil && req.Context().Err() == nil &&
+			(req.Body == nil || req.Body == http.NoBody) {
+			// The request was already forwarded, so clearing the remote
+			// address keeps its X-Forwarded-For from being appended again.
+			r := req.Clone(req.Context())
+			r.RemoteAddr = ""
+			p.fallback.ServeHTTP(w, r)
+			return
+		}
+
+		p.serve(w, req, err)
+	}, nil
+}
+
+func (p *errorPage) serve(w http.ResponseWriter, req *http.Request, err error) {
+	status := p.status
+
+	if status == 0 {
+		status = http.StatusBadGateway
+
+		var ne net.Error
+		var se *upstreamStatusError
+
+		switch {
+		case errors.As(err, &se):
+			status = se.status
+		case errors.Is(err, errOverloaded):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, context.DeadlineExceeded),
+			errors.As(err, &ne) && ne.Timeout():
+			status = http.StatusGatewayTimeout
+		}
+	}
+
+	data := &errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  requestID(req),
+		Time:       time.Now(),
+	}
+
+	tmpl, contentType := p.tmpl, p.contentType
+
+	if prefersJSON(req) {
+		tmpl, contentType = p.jsonTmpl, "application/json"
+
+		if tmpl == nil {
+			tmpl = defaultJSONErrorPage
+		}
+	}
+
+	overloaded := errors.Is(err, errOverloaded)
+
+	if tmpl == nil && overloaded {
+		shed(w, req, status, 0, "backend concurrency limit reached")
+		return
+	}
+
+	if tmpl == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if overloaded {
+		w.Header().Set("Retry-After", retryAfter(time.Second))
+	}
+
+	var b strings.Builder
+
+	if err := tmpl.Execute(&b, data); err != nil {
+		setLogField(req, "error_page", err.Error())
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(status)
+	io.WriteString(w, b.String())
+}
+
+// jsonFuncs are the functions of JSON error page templates: json encodes its
+// argument.
+var jsonFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// defaultJSONErrorPage is sent to clients preferring JSON without a
+// JSONTemplate.
+var defaultJSONErrorPage = template.Must(template.New("error").Funcs(jsonFuncs).Parse(`{"status":{{.Status}},"error":{{json .StatusText}},` +
+	`"request_id":{{json .RequestID}},"time":{{json .Time}}}` + "\n"))
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Etcd describes an etcd key holding a JSON Proxies configuration. The etcd
+// v3 JSON gateway is used, so no client library is required.
+type Etcd struct {
+	// Endpoint is the URL of an etcd member, such as
+	// "http://127.0.0.1:2379".
+	Endpoint string
+
+	// Key holding the configuration.
+	Key string
+
+	// Username and Password are optional, used when etcd authentication
+	// is enabled.
+	Username string
+	Password string
+
+	// Client is optional, defaulting to http.DefaultClient.
+	Client *http.Client
+}
+
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	KVs []etcdKV `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Canceled     bool   `json:"canceled"`
+		CancelReason string `json:"cancel_reason"`
+		Events       []struct {
+			Type string `json:"type"`
+			KV   etcdKV `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Watch sends the configuration stored at the key along the returned
+// channel, followed by every later revision, until ctx is canceled. Errors,
+// such as connection failures or invalid JSON, are passed along the error
+// channel and watching resumes after a short delay. Both channels are closed
+// once ctx is canceled.
+func (e *Etcd) Watch(ctx context.Context) (<-chan *Proxies, <-chan error) {
+	updates := make(chan *Proxies)
+	errs := make(chan error)
+
+	go func() {
+		defer close(updates)
+		defer close(errs)
+
+		var rev int64
+
+		for ctx.Err() == nil {
+			var err error
+
+			if rev == 0 {
+				rev, err = e.load(ctx, updates)
+			} else {
+				rev, err = e.watch(ctx, rev, updates, errs)
+			}
+
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+			}
+
+			select {
+			case <-time.After(discoveryBackoff):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return updates, errs
+}
+
+func (e *Etcd) post(ctx context.Context, path string, body interface{}, token string) (*http.Response, error) {
+	b, err := json.Marshal(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimSuffix(e.Endpoint, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u,
+		bytes.NewReader(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	client := e.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxy: etcd %s: %s", path, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (e *Etcd) token(ctx context.Context) (string, error) {
+	if e.Username == "" {
+		return "", nil
+	}
+
+	resp, err := e.post(ctx, "/v3/auth/authenticate", map[string]string{
+		"name":     e.Username,
+		"password": e.Password,
+	}, "")
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", err
+	}
+
+	return auth.Token, nil
+}
+
+func (e *Etcd) send(ctx context.Context, kv etcdKV, updates chan<- *Proxies) error {
+	var p Proxies
+
+	if err := json.Unmarshal(kv.Value, &p); err != nil {
+		return fmt.Errorf("proxy: etcd %s: %w", e.Key, err)
+	}
+
+	select {
+	case updates <- &p:
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+// load fetches the current configuration, returning the revision to watch
+// from.
+func (e *Etcd) load(ctx context.Context, updates chan<- *Proxies) (int64, error) {
+	token, err := e.token(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := e.post(ctx, "/v3/kv/range", map[string][]byte{
+		"key": []byte(e.Key),
+	}, token)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	var r etcdRangeResponse
+
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, err
+	}
+
+	if len(r.KVs) == 0 {
+		return 0, fmt.Errorf("proxy: etcd key %q not found", e.Key)
+	}
+
+	rev, err := strconv.ParseInt(r.Header.Revision, 10, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return rev, e.send(ctx, r.KVs[0], updates)
+}
+
+// watch streams changes after rev, returning the last revision seen.
+// Invalid configurations are reported without ending the watch.
+func (e *Etcd) watch(ctx context.Context, rev int64, updates chan<- *Proxies, errs chan<- error) (int64, error) {
+	token, err := e.token(ctx)
+
+	if err != nil {
+		return rev, err
+	}
+
+	resp, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(e.Key),
+			"start_revision": strconv.FormatInt(rev+1, 10),
+		},
+	}, token)
+
+	if err != nil {
+		return rev, err
+	}
+
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var w etcdWatchResponse
+
+		if err := dec.Decode(&w); err != nil {
+			return rev, err
+		}
+
+		if w.Error != nil {
+			return rev, errors.New("proxy: etcd watch: " + w.Error.Message)
+		}
+
+		if w.Result.Canceled {
+			// Most likely compacted: reload the current value.
+			return 0, errors.New("proxy: etcd watch canceled: " +
+				w.Result.CancelReason)
+		}
+
+		for _, ev := range w.Result.Events {
+			if n, err := strconv.ParseInt(ev.KV.ModRevision, 10, 64); err == nil {
+				rev = n
+			}
+
+			if ev.Type == "DELETE" {
+				continue
+			}
+
+			if err := e.send(ctx, ev.KV, updates); err != nil {
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+					return rev, nil
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ExecHook describes an external program run before each request is proxied,
+// such as an existing authorization script.
+//
+// The program reads a JSON object from standard input, with the request
+// "method", "uri", "host", "proto", "client_ip", and "headers" as a map of
+// names to lists of values. It answers on standard output in the style of
+// CGI: header lines, a blank line, then a body. If it exits with status 0 the
+// request is allowed and the headers are set on the proxied request.
+// Otherwise the request is denied: the headers and body are the response,
+// whose status is given by a "Status" header between 200 and 599,
+// defaulting to 403 Forbidden.
+type ExecHook struct {
+	// Command is the program and its arguments.
+	Command []string `json:"command"`
+
+	// Timeout is optional, defaulting to 5s.
+	Timeout Duration `json:"timeout"`
+}
+
+const (
+	defaultExecHookTimeout = 5 * time.Second
+	execHookMaxOutput      = 64 << 10
+)
+
+type execHook struct {
+	command []string
+	timeout time.Duration
+}
+
+func newExecHook(c *ExecHook) (*execHook, error) {
+	if len(c.Command) == 0 {
+		return nil, errors.New("proxy: exec_hook command is empty")
+	}
+
+	if _, err := exec.LookPath(c.Command[0]); err != nil {
+		return nil, err
+	}
+
+	e := &execHook{command: c.Command, timeout: defaultExecHookTimeout}
+
+	if c.Timeout > 0 {
+		e.timeout = time.Duration(c.Timeout)
+	}
+
+	return e, nil
+}
+
+// limitedBuffer keeps at most max bytes written to it, discarding the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n < len(p) {
+		b.Buffer.Write(p[:n])
+	} else {
+		b.Buffer.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// run runs the program for req, returning whether it allowed the request and
+// its output.
+func (e *execHook) run(req *http.Request) (bool, []byte, error) {
+	header := req.Header.Clone()
+
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+
+	proto := "http"
+
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	input, err := json.Marshal(struct {
+		Method   string      `json:"method"`
+		URI      string      `json:"uri"`
+		Host     string      `json:"host"`
+		Proto    string      `json:"proto"`
+		ClientIP string      `json:"client_ip"`
+		Headers  http.Header `json:"headers"`
+	}{req.Method, req.URL.RequestURI(), req.Host, proto, clientIP(req), header})
+
+	if err != nil {
+		return false, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), e.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	out := &limitedBuffer{max: execHookMaxOutput}
+	cmd.Stdout = out
+
+	// Children of the program may hold its output open after it is
+	// killed.
+	cmd.WaitDelay = 100 * time.Millisecond
+	err = cmd.Run()
+
+	var exit *exec.ExitError
+
+	if errors.As(err, &exit) && ctx.Err() == nil {
+		return false, out.Bytes(), nil
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	return true, out.Bytes(), nil
+}
+
+// execHookStatus returns the code of a CGI status line, such as
+// "401 Unauthorized", or 0 if there is none.
+func execHookStatus(s string) int {
+	if len(s) > 3 && s[3] != ' ' {
+		return 0
+	}
+
+	if len(s) > 3 {
+		s = s[:3]
+	}
+
+	status, _ := strconv.Atoi(s)
+	return status
+}
+
+func withExecHook(e *execHook, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		allowed, out, err := e.run(req)
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadGateway),
+				http.StatusBadGateway)
+			return
+		}
+
+		r := bufio.NewReader(bytes.NewReader(out))
+		header, err := textproto.NewReader(r).ReadMIMEHeader()
+
+		// Output may end without the blank line.
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			http.Error(w, http.StatusText(http.StatusBadGateway),
+				http.StatusBadGateway)
+			return
+		}
+
+		status := execHookStatus(header.Get("Status"))
+		delete(header, "Status")
+
+		if allowed {
+			for k, v := range header {
+				req.Header[k] = v
+			}
+
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		if status < 200 || status > 599 {
+			status = http.StatusForbidden
+		}
+
+		if status == http.StatusUnauthorized ||
+			status == http.StatusForbidden {
+			strike(req, "exec hook")
+		}
+
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+
+		for _, k := range hopHeaders {
+			w.Header().Del(k)
+		}
+
+		w.Header().Del("Content-Length")
+		w.WriteHeader(status)
+		_, _ = r.WriteTo(w)
+	})
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+)
+
+func TestExecHook(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	tests := []struct {
+		script string
+		want   int
+		body   string
+	}{
+		{`printf 'X-User: alice\n\n'`, http.StatusOK, ""},
+		{`printf 'Status: 401 Unauthorized\n\ndenied'; exit 1`,
+			http.StatusUnauthorized, "denied"},
+		{`printf 'Status: 429\n\n'; exit 1`, http.StatusTooManyRequests, ""},
+		{`printf 'Status: 4012\n\n'; exit 1`, http.StatusForbidden, ""},
+		{`printf 'Status: 101\n\n'; exit 1`, http.StatusForbidden, ""},
+		{`printf 'Status: 600\n\n'; exit 1`, http.StatusForbidden, ""},
+		{`exit 1`, http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		e, err := newExecHook(&ExecHook{Command: []string{"sh", "-c", tt.script}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var user string
+		h := withExecHook(e, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			user = req.Header.Get("X-User")
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != tt.want || w.Body.String() != tt.body {
+			t.Errorf("%s: responded %d %q, want %d %q", tt.script, w.Code,
+				w.Body, tt.want, tt.body)
+		}
+
+		if tt.want == http.StatusOK && user != "alice" {
+			t.Errorf("%s: X-User %q", tt.script, user)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package proxy
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expressions are a subset of Go expression syntax evaluated against a
+// request. They are type checked when compiled.
+
+type exprKind int
+
+const (
+	exprString exprKind = iota
+	exprInt
+	exprBool
+)
+
+func (k exprKind) String() string {
+	switch k {
+	case exprString:
+		return "string"
+	case exprInt:
+		return "int"
+	}
+	return "bool"
+}
+
+// expr is a compiled expression. Only the function of its kind is set.
+type expr struct {
+	kind exprKind
+	str  func(req *http.Request) string
+	num  func(req *http.Request) int64
+	cond func(req *http.Request) bool
+}
+
+// exprIdents are the request attributes available as identifiers.
+var exprIdents = map[string]func(req *http.Request) string{
+	"method": func(req *http.Request) string { return req.Method },
+	"path":   func(req *http.Request) string { return req.URL.Path },
+	"query":  func(req *http.Request) string { return req.URL.RawQuery },
+	"host":   func(req *http.Request) string { return req.Host },
+	"ip":     clientIP,
+	"scheme": func(req *http.Request) string {
+		if req.TLS != nil {
+			return "https"
+		}
+		return "http"
+	},
+}
+
+func exprError(e ast.Expr, msg string) error {
+	return errors.New("proxy: expression: " + msg + " at offset " +
+		strconv.Itoa(int(e.Pos())-1))
+}
+
+// compileCondition compiles a boolean expression.
+func compileCondition(src string) (func(req *http.Request) bool, error) {
+	e, err := parser.ParseExpr(src)
+
+	if err != nil {
+		return nil, errors.New("proxy: expression: " + err.Error())
+	}
+
+	x, err := compileExpr(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if x.kind != exprBool {
+		return nil, exprError(e, "expected bool, found "+x.kind.String())
+	}
+
+	return x.cond, nil
+}
+
+func compileExpr(e ast.Expr) (*expr, error) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return compileExpr(e.X)
+	case *ast.BasicLit:
+		return compileLiteral(e)
+	case *ast.Ident:
+		switch e.Name {
+		case "true", "false":
+			v := e.Name == "true"
+			return &expr{kind: exprBool,
+				cond: func(*http.Request) bool { return v }}, nil
+		}
+
+		if f, ok := exprIdents[e.Name]; ok {
+			return &expr{kind: exprString, str: f}, nil
+		}
+
+		return nil, exprError(e, "unknown identifier "+e.Name)
+	case *ast.UnaryExpr:
+		return compileUnary(e)
+	case *ast.BinaryExpr:
+		return compileBinary(e)
+	case *ast.CallExpr:
+		return compileCall(e)
+	}
+
+	return nil, exprError(e, "unsupported expression")
+}
+
+func compileLiteral(e *ast.BasicLit) (*expr, error) {
+	switch e.Kind {
+	case token.STRING:
+		v, err := strconv.Unquote(e.Value)
+
+		if err != nil {
+			return nil, exprError(e, "invalid string")
+		}
+
+		return &expr{kind: exprString,
+			str: func(*http.Request) string { return v }}, nil
+	case token.INT:
+		v, err := strconv.ParseInt(e.Value, 0, 64)
+
+		if err != nil {
+			return nil, exprError(e, "invalid integer")
+		}
+
+		return &expr{kind: exprInt,
+			num: func(*http.Request) int64 { return v }}, nil
+	}
+
+	return nil, exprError(e, "unsupported literal")
+}
+
+func compileUnary(e *ast.UnaryExpr) (*expr, error) {
+	x, err := compileExpr(e.X)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case e.Op == token.NOT && x.kind == exprBool:
+		f := x.cond
+		return &expr{kind: exprBool,
+			cond: func(req *http.Request) bool { return !f(req) }}, nil
+	case e.Op == token.SUB && x.kind == exprInt:
+		f := x.num
+		return &expr{kind: exprInt,
+			num: func(req *http.Request) int64 { return -f(req) }}, nil
+	}
+
+	return nil, exprError(e, "invalid operation "+e.Op.String()+
+		" on "+x.kind.String())
+}
+
+func compileBinary(e *ast.BinaryExpr) (*expr, error) {
+	x, err := compileExpr(e.X)
+
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := compileExpr(e.Y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if x.kind != y.kind {
+		return nil, exprError(e, "mismatched types "+x.kind.String()+
+			" and "+y.kind.String())
+	}
+
+	bad := exprError(e, "invalid operation "+e.Op.String()+" on "+
+		x.kind.String())
+
+	cond := func(f func(req *http.Request) bool) (*expr, error) {
+		return &expr{kind: exprBool, cond: f}, nil
+	}
+
+	switch x.kind {
+	case exprBool:
+		a, b := x.cond, y.cond
+
+		switch e.Op {
+		case token.LAND:
+			return cond(func(req *http.Request) bool { return a(req) && b(req) })
+		case token.LOR:
+			return cond(func(req *http.Request) bool { return a(req) || b(req) })
+		case token.EQL:
+			return cond(func(req *http.Request) bool { return a(req) == b(req) })
+		case token.NEQ:
+			return cond(func(req *http.Request) bool { return a(req) != b(req) })
+		}
+	case exprString:
+		a, b := x.str, y.str
+
+		switch e.Op {
+		case token.ADD:
+			return &expr{kind: exprString, str: func(req *http.Request) string {
+				return a(req) + b(req)
+			}}, nil
+		case token.EQL:
+			return cond(func(req *http.Request) bool { return a(req) == b(req) })
+		case token.NEQ:
+			return cond(func(req *http.Request) bool { return a(req) != b(req) })
+		case token.LSS:
+			return cond(func(req *http.Request) bool { return a(req) < b(req) })
+		case token.LEQ:
+			return cond(func(req *http.Request) bool { return a(req) <= b(req) })
+		case token.GTR:
+			return cond(func(req *http.Request) bool { return a(req) > b(req) })
+		case token.GEQ:
+			return cond(func(req *http.Request) bool { return a(req) >= b(req) })
+		}
+	case exprInt:
+		a, b := x.num, y.num
+
+		switch e.Op {
+		case token.ADD:
+			return &expr{kind: exprInt, num: func(req *http.Request) int64 {
+				return a(req) + b(req)
+			}}, nil
+		case token.SUB:
+			return &expr{kind: exprInt, num: func(req *http.Request) int64 {
+				return a(req) - b(req)
+			}}, nil
+		case token.EQL:
+			return cond(func(req *http.Request) bool { return a(req) == b(req) })
+		case token.NEQ:
+			return cond(func(req *http.Request) bool { return a(req) != b(req) })
+		case token.LSS:
+			return cond(func(req *http.Request) bool { return a(req) < b(req) })
+		case token.LEQ:
+			return cond(func(req *http.Request) bool { return a(req) <= b(req) })
+		case token.GTR:
+			return cond(func(req *http.Request) bool { return a(req) > b(req) })
+		case token.GEQ:
+			return cond(func(req *http.Request) bool { return a(req) >= b(req) })
+		}
+	}
+
+	return nil, bad
+}
+
+// exprFuncs are the functions available to expressions, by name. Each takes
+// its arguments compiled and returns the call.
+var exprFuncs = map[string]func(call *ast.CallExpr, args []*expr) (*expr, error){
+	"header": strFunc(func(req *http.Request, name string) string {
+		return req.Header.Get(name)
+	}),
+	"param": strFunc(func(req *http.Request, name string) string {
+		return req.URL.Query().Get(name)
+	}),
+	"cookie": strFunc(func(req *http.Request, name string) string {
+		c, err := req.Cookie(name)
+
+		if err != nil {
+			return ""
+		}
+
+		return c.Value
+	}),
+	"lower": strFunc(func(_ *http.Request, s string) string {
+		return strings.ToLower(s)
+	}),
+	"len":        exprLen,
+	"has_prefix": strCond(strings.HasPrefix),
+	"has_suffix": strCond(strings.HasSuffix),
+	"contains":   strCond(strings.Contains),
+	"matches":    exprMatches,
+	"in_cidr":    exprInCIDR,
+}
+
+func checkArgs(call *ast.CallExpr, args []*expr, kinds ...exprKind) error {
+	name := call.Fun.(*ast.Ident).Name
+
+	if len(args) != len(kinds) {
+		return exprError(call, name+" takes "+strconv.Itoa(len(kinds))+
+			" arguments")
+	}
+
+	for i, a := range args {
+		if a.kind != kinds[i] {
+			return exprError(call.Args[i], name+" expects "+
+				kinds[i].String()+", found "+a.kind.String())
+		}
+	}
+
+	return nil
+}
+
+// literalArg returns the string literal argument i of call, which the
+// function compiles ahead of time.
+func literalArg(call *ast.CallExpr, i int) (string, error) {
+	lit, ok := call.Args[i].(*ast.BasicLit)
+
+	if !ok || lit.Kind != token.STRING {
+		return "", exprError(call.Args[i], "expected a string literal")
+	}
+
+	return strconv.Unquote(lit.Value)
+}
+
+func strFunc(f func(req *http.Request, s string) string) func(*ast.CallExpr, []*expr) (*expr, error) {
+	return func(call *ast.CallExpr, args []*expr) (*expr, error) {
+		if err := checkArgs(call, args, exprString); err != nil {
+			return nil, err
+		}
+
+		a := args[0].str
+		return &expr{kind: exprString, str: func(req *http.Request) string {
+			return f(req, a(req))
+		}}, nil
+	}
+}
+
+func strCond(f func(s, t string) bool) func(*ast.CallExpr, []*expr) (*expr, error) {
+	return func(call *ast.CallExpr, args []*expr) (*expr, error) {
+		if err := checkArgs(call, args, exprString, exprString); err != nil {
+			return nil, err
+		}
+
+		a, b := args[0].str, args[1].str
+		return &expr{kind: exprBool, cond: func(req *http.Request) bool {
+			return f(a(req), b(req))
+		}}, nil
+	}
+}
+
+func exprLen(call *ast.CallExpr, args []*expr) (*expr, error) {
+	if err := checkArgs(call, args, exprString); err != nil {
+		return nil, err
+	}
+
+	a := args[0].str
+	return &expr{kind: exprInt, num: func(req *http.Request) int64 {
+		return int64(len(a(req)))
+	}}, nil
+}
+
+func exprMatches(call *ast.CallExpr, args []*expr) (*expr, error) {
+	if err := checkArgs(call, args, exprString, exprString); err != nil {
+		return nil, err
+	}
+
+	pattern, err := literalArg(call, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return nil, exprError(call.Args[1], err.Error())
+	}
+
+	a := args[0].str
+	return &expr{kind: exprBool, cond: func(req *http.Request) bool {
+		return re.MatchString(a(req))
+	}}, nil
+}
+
+func exprInCIDR(call *ast.CallExpr, args []*expr) (*expr, error) {
+	if err := checkArgs(call, args, exprString, exprString); err != nil {
+		return nil, err
+	}
+
+	cidr, err := literalArg(call, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nets, err := parseCIDRs(strings.Split(cidr, ","))
+
+	if err != nil {
+		return nil, exprError(call.Args[1], err.Error())
+	}
+
+	a := args[0].str
+	return &expr{kind: exprBool, cond: func(req *http.Request) bool {
+		ip := net.ParseIP(a(req))
+		return ip != nil && containsIP(nets, ip)
+	}}, nil
+}
+
+func compileCall(call *ast.CallExpr) (*expr, error) {
+	ident, ok := call.Fun.(*ast.Ident)
+
+	if !ok {
+		return nil, exprError(call, "unsupported call")
+	}
+
+	f, ok := exprFuncs[ident.Name]
+
+	if !ok {
+		return nil, exprError(call, "unknown function "+ident.Name)
+	}
+
+	args := make([]*expr, len(call.Args))
+
+	for i, a := range call.Args {
+		x, err := compileExpr(a)
+
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = x
+	}
+
+	return f(call, args)
+}
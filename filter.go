@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// ResponseFilter transforms the body of a backend response. It may change
+// the headers of resp, and returns the body sent in place of resp.Body, which
+// it should read from as the new body is read so that responses stream. The
+// returned body is closed once sent, and must close resp.Body.
+//
+// Filters see decompressed bodies when the route decompresses responses.
+type ResponseFilter func(resp *http.Response) (io.ReadCloser, error)
+
+// filterResponse returns a ModifyResponse function applying the filters in
+// order.
+func filterResponse(filters []ResponseFilter) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, f := range filters {
+			body, err := f(resp)
+
+			if err != nil {
+				return err
+			}
+
+			if body != resp.Body {
+				// The length of the new body is unknown.
+				resp.Header.Del("Content-Length")
+				resp.ContentLength = -1
+				resp.Body = body
+			}
+		}
+
+		return nil
+	}
+}
+
+// chainModify returns a ModifyResponse function calling each function in
+// order, until one fails.
+func chainModify(chain []func(*http.Response) error) func(*http.Response) error {
+	if len(chain) == 0 {
+		return nil
+	}
+
+	return func(resp *http.Response) error {
+		for _, f := range chain {
+			if err := f(resp); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ForwardAuth describes an external authorization service consulted before
+// each request is proxied. The service receives a GET request with the
+// original headers plus X-Forwarded-Method, X-Forwarded-Proto,
+// X-Forwarded-Host, X-Forwarded-Uri, and X-Forwarded-For. A 2xx response
+// allows the request; any other response is returned to the client.
+type ForwardAuth struct {
+	// URL of the authorization endpoint.
+	URL string `json:"url"`
+
+	// ResponseHeaders is optional. It lists headers copied from a 2xx
+	// authorization response onto the proxied request, such as
+	// "X-Auth-User".
+	ResponseHeaders []string `json:"response_headers"`
+
+	// Timeout is optional, defaulting to 10s.
+	Timeout Duration `json:"timeout"`
+}
+
+const (
+	defaultForwardAuthTimeout = 10 * time.Second
+	forwardAuthMaxBody        = 64 << 10
+)
+
+// hopHeaders are hop-by-hop headers, which are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type forwardAuth struct {
+	c      *ForwardAuth
+	client *http.Client
+}
+
+func newForwardAuth(c *ForwardAuth) (*forwardAuth, error) {
+	if c.URL == "" {
+		return nil, errors.New("proxy: forward_auth url is empty")
+	}
+
+	timeout := defaultForwardAuthTimeout
+
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout)
+	}
+
+	return &forwardAuth{
+		c: c,
+		client: &http.Client{
+			Timeout: timeout,
+			// Redirects are for the client to follow, such as to a
+			// login page.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+func withForwardAuth(a *forwardAuth, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ar, err := http.NewRequestWithContext(req.Context(), http.MethodGet,
+			a.c.URL, nil)
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+
+		ar.Header = req.Header.Clone()
+
+		for _, k := range hopHeaders {
+			ar.Header.Del(k)
+		}
+
+		proto := "http"
+
+		if req.TLS != nil {
+			proto = "https"
+		}
+
+		ar.Header.Set("X-Forwarded-Method", req.Method)
+		ar.Header.Set("X-Forwarded-Proto", proto)
+		ar.Header.Set("X-Forwarded-Host", req.Host)
+		ar.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+		ar.Header.Set("X-Forwarded-For", clientIP(req))
+
+		resp, err := a.client.Do(ar)
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadGateway),
+				http.StatusBadGateway)
+			return
+		}
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			defer resp.Body.Close()
+
+			if resp.StatusCode == http.StatusUnauthorized ||
+				resp.StatusCode == http.StatusForbidden {
+				strike(req, "forward auth")
+			}
+
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+
+			for _, k := range hopHeaders {
+				w.Header().Del(k)
+			}
+
+			w.Header().Del("Content-Length")
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, io.LimitReader(resp.Body, forwardAuthMaxBody))
+			return
+		}
+
+		// Free the connection to the auth service before proxying, which
+		// may take long.
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, forwardAuthMaxBody))
+		resp.Body.Close()
+
+		for _, k := range a.c.ResponseHeaders {
+			if v := resp.Header.Values(k); len(v) != 0 {
+				req.Header[http.CanonicalHeaderKey(k)] = v
+			} else {
+				req.Header.Del(k)
+			}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForwardAuth(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "denied by auth", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("X-Auth-User", "alice")
+		w.Write([]byte("ok"))
+	}))
+	defer auth.Close()
+
+	a, err := newForwardAuth(&ForwardAuth{URL: auth.URL,
+		ResponseHeaders: []string{"X-Auth-User"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With a single connection to the auth service, a second check made
+	// while proxying must not wait for the first.
+	a.client.Transport = &http.Transport{MaxConnsPerHost: 1}
+
+	var user string
+	var reused error
+
+	h := withForwardAuth(a, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user = req.Header.Get("X-Auth-User")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, auth.URL, nil)
+		resp, err := a.client.Do(r)
+
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		reused = err
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer good")
+	req.Header.Set("X-Auth-User", "spoofed")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || user != "alice" {
+		t.Errorf("allowed: status %d, user %q", w.Code, user)
+	}
+
+	if reused != nil {
+		t.Errorf("auth connection still busy while proxying: %v", reused)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "denied by auth\n" ||
+		w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("denied: status %d, body %q, header %v", w.Code, w.Body,
+			w.Header())
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// UnmarshalJSON decodes a route, whose "from" may be a list of patterns: the
+// first is From, and the rest are Aliases.
+func (r *Route) UnmarshalJSON(b []byte) error {
+	type route Route
+
+	aux := struct {
+		*route
+		From json.RawMessage `json:"from"`
+	}{route: (*route)(r)}
+
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	if len(aux.From) == 0 || string(aux.From) == "null" {
+		return nil
+	}
+
+	if aux.From[0] != '[' {
+		return json.Unmarshal(aux.From, &r.From)
+	}
+
+	var from []string
+
+	if err := json.Unmarshal(aux.From, &from); err != nil {
+		return err
+	}
+
+	if len(from) == 0 {
+		return errors.New("proxy: empty route from list")
+	}
+
+	r.From = from[0]
+	r.Aliases = append(from[1:len(from):len(from)], r.Aliases...)
+	return nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GeoIP describes country-based access control, using a MaxMind DB format
+// database such as GeoLite2-Country.
+type GeoIP struct {
+	// Database is the path of the MaxMind DB file.
+	Database string `json:"database"`
+
+	// Allow is optional. If specified, only clients from these ISO 3166
+	// country codes are allowed.
+	Allow []string `json:"allow"`
+
+	// Deny is optional. Clients from these ISO 3166 country codes are
+	// denied.
+	Deny []string `json:"deny"`
+
+	// Header is optional. If specified, the country code of the client is
+	// forwarded to the backend in this header.
+	Header string `json:"header"`
+}
+
+type geoIP struct {
+	db          *mmdb
+	allow, deny map[string]bool
+	header      string
+}
+
+func newGeoIP(c *GeoIP) (*geoIP, error) {
+	if c.Database == "" {
+		return nil, errors.New("proxy: geoip database missing")
+	}
+
+	db, err := openMMDB(c.Database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	g := &geoIP{
+		db:     db,
+		allow:  make(map[string]bool, len(c.Allow)),
+		deny:   make(map[string]bool, len(c.Deny)),
+		header: c.Header,
+	}
+
+	for _, cc := range c.Allow {
+		g.allow[strings.ToUpper(cc)] = true
+	}
+
+	for _, cc := range c.Deny {
+		g.deny[strings.ToUpper(cc)] = true
+	}
+
+	return g, nil
+}
+
+// country returns the ISO 3166 country code of ip, or "" if unknown.
+func (g *geoIP) country(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	v, err := g.db.lookup(ip)
+
+	if err != nil {
+		return ""
+	}
+
+	m, _ := v.(map[string]interface{})
+
+	for _, k := range []string{"country", "registered_country"} {
+		c, _ := m[k].(map[string]interface{})
+
+		if cc, ok := c["iso_code"].(string); ok {
+			return cc
+		}
+	}
+
+	return ""
+}
+
+// withGeoIP rejects clients from countries not allowed by g with 403
+// Forbidden, and records the country of allowed clients.
+func withGeoIP(g *geoIP, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cc := g.country(net.ParseIP(clientIP(req)))
+
+		if g.deny[cc] || (len(g.allow) != 0 && !g.allow[cc]) {
+			http.Error(w, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+
+		if cc != "" {
+			setLogField(req, "country", cc)
+		}
+
+		if g.header != "" {
+			req.Header.Del(g.header)
+
+			if cc != "" {
+				req.Header.Set(g.header, cc)
+			}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// proxySet counts the running proxies started by one call of Start. Once none
+// are running, idle is closed.
+type proxySet struct {
+	errs chan error
+
+	mu      sync.Mutex
+	running int
+	closed  bool
+	idle    chan struct{}
+}
+
+// add counts another running proxy, unless the set is already idle.
+func (ps *proxySet) add() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.closed {
+		return false
+	}
+
+	ps.running++
+	return true
+}
+
+func (ps *proxySet) done() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.running--; ps.running == 0 {
+		ps.closed = true
+		close(ps.idle)
+	}
+}
+
+// Handle controls one running reverse proxy.
+type Handle struct {
+	r   ReverseProxy
+	set *proxySet
+
+	mu   sync.Mutex
+	quit chan time.Duration
+	done chan struct{}
+}
+
+func newHandle(r ReverseProxy, set *proxySet) *Handle {
+	return &Handle{
+		r:    r,
+		set:  set,
+		quit: make(chan time.Duration, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// Port returns the port the proxy listens on.
+func (h *Handle) Port() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.r.Port
+}
+
+// Done returns a channel closed once the proxy dies.
+func (h *Handle) Done() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.done
+}
+
+// Stop gracefully shuts down the proxy, waiting up to timeout for requests in
+// flight, or forever if timeout is -1, and returns once the proxy has died.
+// Other proxies keep serving.
+func (h *Handle) Stop(timeout time.Duration) {
+	audit.record("handle", "stop", map[string]interface{}{
+		"port":    h.Port(),
+		"timeout": Duration(timeout),
+	})
+	h.stop(timeout)
+}
+
+func (h *Handle) stop(timeout time.Duration) {
+	h.mu.Lock()
+	quit, done := h.quit, h.done
+	h.mu.Unlock()
+
+	select {
+	case quit <- timeout:
+	default:
+	}
+
+	<-done
+}
+
+// Start starts the proxy again once it has died, rebinding its port and
+// reloading its certificate. If r is not nil, it replaces the configuration
+// of the proxy. Errors starting are returned, and later errors are passed
+// along the error channel of the proxies. The proxy cannot be started once
+// all proxies started with it have died.
+func (h *Handle) Start(r *ReverseProxy) error {
+	err := h.start(r)
+	details := map[string]interface{}{"port": h.Port()}
+
+	if err != nil {
+		details["error"] = err.Error()
+	}
+
+	audit.record("handle", "start", details)
+	return err
+}
+
+func (h *Handle) start(r *ReverseProxy) error {
+	h.mu.Lock()
+
+	select {
+	case <-h.done:
+	default:
+		h.mu.Unlock()
+		return errors.New("proxy: proxy is running")
+	}
+
+	if !h.set.add() {
+		h.mu.Unlock()
+		return errors.New("proxy: all proxies have died")
+	}
+
+	if r != nil {
+		audit.reconfigure("handle", h.r.Port, *r)
+		h.r = *r
+	}
+
+	h.quit = make(chan time.Duration, 1)
+	h.done = make(chan struct{})
+	h.mu.Unlock()
+
+	started := make(chan error, 1)
+	go listenAndServe(h, started)
+	return <-started
+}
+
+// Restart stops the proxy like Stop, if it is running, then starts it like
+// Start. The error channel stays open in between, even if the proxy is the
+// only one running.
+func (h *Handle) Restart(r *ReverseProxy, timeout time.Duration) error {
+	if !h.set.add() {
+		return errors.New("proxy: all proxies have died")
+	}
+
+	defer h.set.done()
+
+	audit.record("handle", "restart", map[string]interface{}{
+		"port":    h.Port(),
+		"timeout": Duration(timeout),
+	})
+	h.stop(timeout)
+	return h.start(r)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+func checkHealthPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return errors.New("proxy: health path must start with /")
+	}
+	return nil
+}
+
+// withHealth answers requests for path with 200 OK, before any other handling,
+// so that health checks depend on neither backends nor client limits. They
+// are not logged.
+func withHealth(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if req.Method != http.MethodHead {
+			_, _ = w.Write([]byte("ok\n"))
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HMAC describes request signature verification for a route, such as for
+// webhook receivers. The signature is computed over the configured
+// components joined by newlines.
+type HMAC struct {
+	// Secret key.
+	Secret string `json:"secret"`
+
+	// Header is optional. It carries the signature, defaulting to
+	// "X-Signature".
+	Header string `json:"header"`
+
+	// Prefix is optional. It is stripped from the header value, such as
+	// "sha256=".
+	Prefix string `json:"prefix"`
+
+	// Algorithm is optional: "sha1", "sha256", or "sha512", defaulting to
+	// "sha256".
+	Algorithm string `json:"algorithm"`
+
+	// Encoding is optional: "hex" or "base64", defaulting to "hex".
+	Encoding string `json:"encoding"`
+
+	// Components is optional. It lists what is signed, in order, from
+	// "method", "host", "uri", "body", "timestamp", and "header:<name>",
+	// defaulting to just "body".
+	Components []string `json:"components"`
+
+	// TimestampHeader is optional. If specified, it must carry a Unix
+	// timestamp within MaxSkew of the proxy's clock.
+	TimestampHeader string `json:"timestamp_header"`
+
+	// MaxSkew is optional, defaulting to 5m.
+	MaxSkew Duration `json:"max_skew"`
+
+	// MaxBody is optional. It bounds the body buffered for verification,
+	// defaulting to 10 MiB.
+	MaxBody int64 `json:"max_body"`
+}
+
+const (
+	defaultHMACSkew    = 5 * time.Minute
+	defaultHMACMaxBody = 10 << 20
+)
+
+type hmacVerifier struct {
+	c       *HMAC
+	hash    func() hash.Hash
+	header  string
+	comps   []string
+	skew    time.Duration
+	maxBody int64
+	body    bool
+}
+
+func newHMACVerifier(c *HMAC) (*hmacVerifier, error) {
+	if c.Secret == "" {
+		return nil, errors.New("proxy: hmac secret is empty")
+	}
+
+	v := &hmacVerifier{
+		c:       c,
+		header:  c.Header,
+		comps:   c.Components,
+		skew:    defaultHMACSkew,
+		maxBody: defaultHMACMaxBody,
+	}
+
+	switch c.Algorithm {
+	case "sha1":
+		v.hash = sha1.New
+	case "", "sha256":
+		v.hash = sha256.New
+	case "sha512":
+		v.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("proxy: unsupported hmac algorithm %q",
+			c.Algorithm)
+	}
+
+	switch c.Encoding {
+	case "", "hex", "base64":
+	default:
+		return nil, fmt.Errorf("proxy: unsupported hmac encoding %q",
+			c.Encoding)
+	}
+
+	if v.header == "" {
+		v.header = "X-Signature"
+	}
+
+	if len(v.comps) == 0 {
+		v.comps = []string{"body"}
+	}
+
+	for _, comp := range v.comps {
+		switch {
+		case comp == "body":
+			v.body = true
+		case comp == "timestamp" && c.TimestampHeader == "":
+			return nil, errors.New("proxy: hmac timestamp component " +
+				"requires timestamp_header")
+		case comp == "method", comp == "host", comp == "uri",
+			comp == "timestamp", strings.HasPrefix(comp, "header:"):
+		default:
+			return nil, fmt.Errorf("proxy: unknown hmac component %q", comp)
+		}
+	}
+
+	if c.MaxSkew > 0 {
+		v.skew = time.Duration(c.MaxSkew)
+	}
+
+	if c.MaxBody > 0 {
+		v.maxBody = c.MaxBody
+	}
+
+	return v, nil
+}
+
+func (v *hmacVerifier) verify(req *http.Request) error {
+	sig := strings.TrimPrefix(req.Header.Get(v.header), v.c.Prefix)
+
+	var want []byte
+	var err error
+
+	if v.c.Encoding == "base64" {
+		want, err = base64.StdEncoding.DecodeString(sig)
+	} else {
+		want, err = hex.DecodeString(sig)
+	}
+
+	if err != nil || len(want) == 0 {
+		return errors.New("proxy: missing or malformed signature")
+	}
+
+	if v.c.TimestampHeader != "" {
+		ts, err := strconv.ParseInt(req.Header.Get(v.c.TimestampHeader), 10, 64)
+
+		if err != nil {
+			return errors.New("proxy: malformed signature timestamp")
+		}
+
+		if d := time.Since(time.Unix(ts, 0)); d > v.skew || d < -v.skew {
+			return errors.New("proxy: signature timestamp out of range")
+		}
+	}
+
+	var body []byte
+
+	if v.body && req.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(req.Body, v.maxBody+1))
+		req.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if int64(len(body)) > v.maxBody {
+			return errors.New("proxy: body too large to verify")
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	mac := hmac.New(v.hash, []byte(v.c.Secret))
+
+	for i, comp := range v.comps {
+		if i > 0 {
+			mac.Write([]byte{'\n'})
+		}
+
+		switch comp {
+		case "method":
+			mac.Write([]byte(req.Method))
+		case "host":
+			mac.Write([]byte(req.Host))
+		case "uri":
+			mac.Write([]byte(req.URL.RequestURI()))
+		case "body":
+			mac.Write(body)
+		case "timestamp":
+			mac.Write([]byte(req.Header.Get(v.c.TimestampHeader)))
+		default:
+			name := strings.TrimPrefix(comp, "header:")
+			mac.Write([]byte(req.Header.Get(name)))
+		}
+	}
+
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return errors.New("proxy: signature mismatch")
+	}
+
+	return nil
+}
+
+// withHMAC rejects requests without a valid signature with 401
+// Unauthorized.
+func withHMAC(v *hmacVerifier, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := v.verify(req); err != nil {
+			strike(req, "hmac")
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMAC(t *testing.T) {
+	sign := func(secret string, parts ...string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(strings.Join(parts, "\n")))
+		return mac.Sum(nil)
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name   string
+		c      HMAC
+		header http.Header
+		want   int
+	}{
+		{"body", HMAC{Secret: "s"}, http.Header{
+			"X-Signature": {hex.EncodeToString(sign("s", "payload"))},
+		}, http.StatusOK},
+		{"wrong secret", HMAC{Secret: "s"}, http.Header{
+			"X-Signature": {hex.EncodeToString(sign("t", "payload"))},
+		}, http.StatusUnauthorized},
+		{"missing", HMAC{Secret: "s"}, nil, http.StatusUnauthorized},
+		{"prefix and base64", HMAC{Secret: "s", Header: "X-Hub-Signature",
+			Prefix: "sha256=", Encoding: "base64"}, http.Header{
+			"X-Hub-Signature": {"sha256=" +
+				base64.StdEncoding.EncodeToString(sign("s", "payload"))},
+		}, http.StatusOK},
+		{"components", HMAC{Secret: "s", TimestampHeader: "X-Timestamp",
+			Components: []string{"method", "uri", "timestamp",
+				"header:X-Id", "body"}}, http.Header{
+			"X-Timestamp": {now},
+			"X-Id":        {"7"},
+			"X-Signature": {hex.EncodeToString(sign("s", "POST",
+				"/hook?a=1", now, "7", "payload"))},
+		}, http.StatusOK},
+		{"stale timestamp", HMAC{Secret: "s", TimestampHeader: "X-Timestamp",
+			Components: []string{"timestamp", "body"}}, http.Header{
+			"X-Timestamp": {old},
+			"X-Signature": {hex.EncodeToString(sign("s", old, "payload"))},
+		}, http.StatusUnauthorized},
+		{"body too large", HMAC{Secret: "s", MaxBody: 4}, http.Header{
+			"X-Signature": {hex.EncodeToString(sign("s", "payload"))},
+		}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		v, err := newHMACVerifier(&tt.c)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body string
+		h := withHMAC(v, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			b, _ := io.ReadAll(req.Body)
+			body = string(b)
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/hook?a=1",
+			strings.NewReader("payload"))
+
+		for k, vs := range tt.header {
+			req.Header[k] = vs
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+
+		// The verified body is still passed on.
+		if tt.want == http.StatusOK && body != "payload" {
+			t.Errorf("%s: backend read body %q", tt.name, body)
+		}
+	}
+}
+
+func TestHMACAlgorithm(t *testing.T) {
+	v, err := newHMACVerifier(&HMAC{Secret: "s", Algorithm: "sha512"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha512.New, []byte("s"))
+	mac.Write([]byte("payload"))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("payload"))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	if err := v.verify(req); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []HMAC{
+		{},
+		{Secret: "s", Algorithm: "md5"},
+		{Secret: "s", Encoding: "base32"},
+		{Secret: "s", Components: []string{"timestamp"}},
+		{Secret: "s", Components: []string{"cookie"}},
+	} {
+		if _, err := newHMACVerifier(&c); err == nil {
+			t.Errorf("%+v: accepted", c)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var honeypotHits = newCounterVec("http_proxy_honeypot_hits_total",
+	"Requests to honeypot paths.", "listener", "path")
+
+// Honeypot describes trap paths, such as "/wp-login.php", which no
+// legitimate client requests. They are never proxied.
+type Honeypot struct {
+	// Paths are the trap paths, as patterns of http.ServeMux.
+	Paths []string `json:"paths"`
+
+	// Ban is optional. If positive, clients hitting a trap are banned for
+	// this long. Otherwise hits count as strikes towards a ban.
+	Ban Duration `json:"ban"`
+
+	// Tarpit is optional. If specified, hits are answered very slowly as
+	// in Tarpit. Rate and Burst are ignored.
+	Tarpit *Tarpit `json:"tarpit"`
+
+	// Status is optional. It is the status of responses to hits,
+	// defaulting to 404 Not Found.
+	Status int `json:"status"`
+}
+
+type honeypot struct {
+	listener string
+	ban      time.Duration
+	tarpit   *tarpit
+	status   int
+}
+
+func newHoneypot(c *Honeypot, listener string) (*honeypot, error) {
+	if c.Ban < 0 {
+		return nil, errors.New("proxy: negative honeypot ban")
+	}
+
+	if c.Status != 0 && (c.Status < 100 || c.Status > 999) {
+		return nil, errors.New("proxy: invalid honeypot status " +
+			strconv.Itoa(c.Status))
+	}
+
+	hp := &honeypot{
+		listener: listener,
+		ban:      time.Duration(c.Ban),
+		status:   c.Status,
+	}
+
+	if hp.status == 0 {
+		hp.status = http.StatusNotFound
+	}
+
+	if c.Tarpit != nil {
+		tc := *c.Tarpit
+		tc.Rate, tc.Burst = 1, 1
+
+		var err error
+
+		if hp.tarpit, err = newTarpit(&tc); err != nil {
+			return nil, err
+		}
+	}
+
+	return hp, nil
+}
+
+// handler returns the handler of a trap path.
+func (hp *honeypot) handler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		honeypotHits.inc(hp.listener, path)
+		setLogField(req, "honeypot", path)
+
+		if hp.ban > 0 {
+			bans.add(clientIP(req), hp.ban, "honeypot")
+		} else {
+			strike(req, "honeypot")
+		}
+
+		if hp.tarpit != nil {
+			hp.tarpit.serve(w, req)
+			return
+		}
+
+		http.Error(w, http.StatusText(hp.status), hp.status)
+	})
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHoneypotStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status, want int
+	}{
+		{0, http.StatusNotFound},
+		{http.StatusGone, http.StatusGone},
+	} {
+		hp, err := newHoneypot(&Honeypot{Status: tt.status}, "test")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		hp.handler("/wp-login.php").ServeHTTP(w,
+			httptest.NewRequest(http.MethodGet, "/wp-login.php", nil))
+
+		if w.Code != tt.want {
+			t.Errorf("status %d: responded %d, want %d", tt.status, w.Code,
+				tt.want)
+		}
+	}
+
+	for _, status := range []int{-1, 42, 1000} {
+		if _, err := newHoneypot(&Honeypot{Status: status}, "test"); err == nil {
+			t.Errorf("status %d: accepted", status)
+		}
+	}
+}
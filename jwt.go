@@ -0,0 +1,482 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // for crypto.SHA256
+	_ "crypto/sha512" // for crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWT describes bearer token validation for a route. Tokens must be signed
+// by a key from the JWKS with RS256, RS384, RS512, PS256, PS384, PS512,
+// ES256, ES384, or ES512.
+type JWT struct {
+	// JWKS is the URL of the JSON Web Key Set.
+	JWKS string `json:"jwks"`
+
+	// Issuer and Audience are optional. If specified, the "iss" claim
+	// must equal Issuer and the "aud" claim must contain Audience.
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+
+	// Claims is optional. It maps claim names to request headers in which
+	// the claim values are forwarded, such as {"sub": "X-User"}.
+	Claims map[string]string `json:"claims"`
+
+	// Leeway is optional. It is the allowed clock skew when checking
+	// "exp" and "nbf".
+	Leeway Duration `json:"leeway"`
+
+	// OptionalExp is optional. If true, tokens without an "exp" claim are
+	// accepted, which otherwise never expire and so are rejected.
+	OptionalExp bool `json:"optional_exp"`
+
+	// CacheTTL is optional. It is how long the JWKS is cached, defaulting
+	// to 1h. Unknown key IDs trigger an early refresh.
+	CacheTTL Duration `json:"cache_ttl"`
+}
+
+const (
+	defaultJWKSTTL   = time.Hour
+	jwksMinRefresh   = time.Minute
+	jwksFetchTimeout = 10 * time.Second
+)
+
+var errInvalidToken = errors.New("proxy: invalid token")
+
+// jwks is a cached JSON Web Key Set.
+type jwks struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	// fetching is closed once the fetch in progress, if any, is done. err
+	// is the error of the last fetch.
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching chan struct{}
+	err      error
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWKS(url string, ttl time.Duration) *jwks {
+	if ttl <= 0 {
+		ttl = defaultJWKSTTL
+	}
+
+	return &jwks{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+func b64int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64int(k.N)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := b64int(k.E)
+
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("proxy: invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("proxy: unsupported curve %q", k.Crv)
+		}
+
+		x, err := b64int(k.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := b64int(k.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("proxy: unsupported key type %q", k.Kty)
+}
+
+func (j *jwks) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := j.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy: jwks %s: %s", j.url, resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		// Skip keys of unsupported types rather than failing the set.
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+
+	return keys, nil
+}
+
+// key returns the key with the ID, refreshing the set when it is stale or
+// the ID is unknown. Concurrent refreshes share one fetch, made without the
+// lock held.
+func (j *jwks) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+
+	age := time.Since(j.fetched)
+	key, ok := j.keys[kid]
+
+	if j.keys != nil && age <= j.ttl && (ok || age <= jwksMinRefresh) {
+		j.mu.Unlock()
+
+		if !ok {
+			return nil, errInvalidToken
+		}
+
+		return key, nil
+	}
+
+	done := j.fetching
+
+	if done == nil {
+		done = make(chan struct{})
+		j.fetching = done
+		j.mu.Unlock()
+
+		// The fetch is shared, so it outlives the request starting it.
+		keys, err := j.fetch(context.WithoutCancel(ctx))
+
+		j.mu.Lock()
+
+		if err == nil {
+			j.keys = keys
+		}
+
+		// On failure keep the stale set, retrying after jwksMinRefresh.
+		j.fetched = time.Now()
+		j.err = err
+		j.fetching = nil
+		close(done)
+	} else {
+		j.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		j.mu.Lock()
+	}
+
+	defer j.mu.Unlock()
+
+	if j.keys == nil {
+		return nil, j.err
+	}
+
+	if key, ok = j.keys[kid]; !ok {
+		return nil, errInvalidToken
+	}
+
+	return key, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyJWT checks the signature of token, returning its claims. Time and
+// audience checks are left to the caller.
+func verifyJWT(ctx context.Context, keys *jwks, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var h jwtHeader
+
+	if err = json.Unmarshal(hb, &h); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if len(h.Alg) != 5 {
+		return nil, errInvalidToken
+	}
+
+	var hash crypto.Hash
+
+	switch h.Alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return nil, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	key, err := keys.key(ctx, h.Kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hh := hash.New()
+	hh.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hh.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch h.Alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		default:
+			err = errInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+
+		if h.Alg[:2] != "ES" || len(sig) != 2*size {
+			return nil, errInvalidToken
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+
+		if !ecdsa.Verify(pub, digest, r, s) {
+			err = errInvalidToken
+		}
+	default:
+		err = errInvalidToken
+	}
+
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var claims map[string]interface{}
+
+	if err = json.Unmarshal(cb, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	return claims, nil
+}
+
+// checkClaims validates the registered time, issuer, and audience claims.
+// The "exp" claim is required unless optionalExp is true.
+func checkClaims(claims map[string]interface{}, issuer, audience string, leeway time.Duration, optionalExp bool) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+			return errors.New("proxy: token expired")
+		}
+	} else if _, ok := claims["exp"]; ok || !optionalExp {
+		return errors.New("proxy: token expiry missing or invalid")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("proxy: token not yet valid")
+		}
+	}
+
+	if issuer != "" && claims["iss"] != issuer {
+		return errors.New("proxy: token issuer mismatch")
+	}
+
+	if audience == "" {
+		return nil
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("proxy: token audience mismatch")
+}
+
+// claimString formats a claim value for a header.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+type jwtAuth struct {
+	c      *JWT
+	keys   *jwks
+	leeway time.Duration
+}
+
+func newJWTAuth(c *JWT) (*jwtAuth, error) {
+	if c.JWKS == "" {
+		return nil, errors.New("proxy: jwt jwks is empty")
+	}
+
+	return &jwtAuth{
+		c:      c,
+		keys:   newJWKS(c.JWKS, time.Duration(c.CacheTTL)),
+		leeway: time.Duration(c.Leeway),
+	}, nil
+}
+
+// withJWT rejects requests without a valid bearer token with 401
+// Unauthorized, forwarding the configured claims as headers.
+func withJWT(a *jwtAuth, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+
+		var claims map[string]interface{}
+		err := errInvalidToken
+
+		if token != auth {
+			claims, err = verifyJWT(req.Context(), a.keys, token)
+		}
+
+		if err == nil {
+			err = checkClaims(claims, a.c.Issuer, a.c.Audience, a.leeway,
+				a.c.OptionalExp)
+		}
+
+		if err != nil {
+			if auth != "" {
+				strike(req, "jwt")
+			}
+
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		for claim, header := range a.c.Claims {
+			req.Header.Del(header)
+
+			if v, ok := claims[claim]; ok {
+				req.Header.Set(header, claimString(v))
+			}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jwtTestKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtTestKeys{rsa: rk, ec: ek}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwks returns the JSON Web Key Set of the public keys, with IDs "rsa" and
+// "ec", and the RSA key again as "enc", for encryption only.
+func (k *jwtTestKeys) jwks() []byte {
+	size := (k.ec.Curve.Params().BitSize + 7) / 8
+	set := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "rsa",
+		"n":   b64(k.rsa.N.Bytes()),
+		"e":   b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+	}, {
+		"kty": "EC",
+		"kid": "ec",
+		"crv": "P-256",
+		"x":   b64(k.ec.X.FillBytes(make([]byte, size))),
+		"y":   b64(k.ec.Y.FillBytes(make([]byte, size))),
+	}, {
+		"kty": "RSA",
+		"kid": "enc",
+		"use": "enc",
+		"n":   b64(k.rsa.N.Bytes()),
+		"e":   b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+	}}}
+
+	b, _ := json.Marshal(set)
+	return b
+}
+
+// sign returns a token of the claims signed with alg, using the RSA key for
+// RS and PS algorithms and otherwise the EC key.
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	hb, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	cb, _ := json.Marshal(claims)
+	input := b64(hb) + "." + b64(cb)
+
+	h := crypto.SHA256.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+
+	switch alg[:2] {
+	case "RS":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest)
+	case "PS":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest, nil)
+	default:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest)
+
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + b64(sig)
+}
+
+// serveJWKS serves the key set, counting fetches.
+func serveJWKS(t *testing.T, k *jwtTestKeys, fetches *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(k.jwks())
+	}))
+
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestVerifyJWT(t *testing.T) {
+	k := newJWTTestKeys(t)
+	var fetches int32
+	keys := newJWKS(serveJWKS(t, k, &fetches).URL, 0)
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", k.sign(t, "RS256", "rsa", claims), true},
+		{"PS256", k.sign(t, "PS256", "rsa", claims), true},
+		{"ES256", k.sign(t, "ES256", "ec", claims), true},
+		{"wrong key type", k.sign(t, "ES256", "rsa", claims), false},
+		{"unknown kid", k.sign(t, "RS256", "other", claims), false},
+		{"encryption key", k.sign(t, "RS256", "enc", claims), false},
+		{"none", b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." +
+			b64([]byte(`{"sub":"alice"}`)) + ".", false},
+		{"malformed", "abc", false},
+	}
+
+	for _, tt := range tests {
+		got, err := verifyJWT(context.Background(), keys, tt.token)
+
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+
+		if tt.ok && got["sub"] != "alice" {
+			t.Errorf("%s: claims %v", tt.name, got)
+		}
+	}
+
+	// A tampered payload fails verification.
+	token := k.sign(t, "RS256", "rsa", claims)
+	parts := strings.Split(token, ".")
+	parts[1] = b64([]byte(`{"sub":"mallory"}`))
+
+	if _, err := verifyJWT(context.Background(), keys,
+		parts[0]+"."+parts[1]+"."+parts[2]); err == nil {
+		t.Error("tampered token verified")
+	}
+
+	// Unknown key IDs refresh the set at most every jwksMinRefresh.
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetched the key set %d times, want 1", n)
+	}
+}
+
+func TestJWKSSingleFetch(t *testing.T) {
+	k := newJWTTestKeys(t)
+	var fetches int32
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.Write(k.jwks())
+	}))
+	defer srv.Close()
+
+	keys := newJWKS(srv.URL, 0)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			_, err := keys.key(context.Background(), "rsa")
+			errs <- err
+		}()
+	}
+
+	// A lookup canceled during the fetch returns without waiting for it.
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := keys.key(ctx, "rsa"); err != context.Canceled {
+		t.Errorf("canceled lookup during fetch: error %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetched the key set %d times, want 1", n)
+	}
+}
+
+func TestCheckClaims(t *testing.T) {
+	now := float64(time.Now().Unix())
+
+	tests := []struct {
+		name        string
+		claims      map[string]interface{}
+		optionalExp bool
+		ok          bool
+	}{
+		{"valid", map[string]interface{}{"exp": now + 60, "iss": "me",
+			"aud": "api"}, false, true},
+		{"expired", map[string]interface{}{"exp": now - 60, "iss": "me",
+			"aud": "api"}, false, false},
+		{"expired within leeway", map[string]interface{}{"exp": now - 5,
+			"iss": "me", "aud": "api"}, false, true},
+		{"no exp", map[string]interface{}{"iss": "me", "aud": "api"},
+			false, false},
+		{"no exp, optional", map[string]interface{}{"iss": "me",
+			"aud": "api"}, true, true},
+		{"invalid exp, optional", map[string]interface{}{"exp": "soon",
+			"iss": "me", "aud": "api"}, true, false},
+		{"not yet valid", map[string]interface{}{"exp": now + 60,
+			"nbf": now + 60, "iss": "me", "aud": "api"}, false, false},
+		{"wrong issuer", map[string]interface{}{"exp": now + 60,
+			"iss": "you", "aud": "api"}, false, false},
+		{"audience list", map[string]interface{}{"exp": now + 60,
+			"iss": "me", "aud": []interface{}{"web", "api"}}, false, true},
+		{"wrong audience", map[string]interface{}{"exp": now + 60,
+			"iss": "me", "aud": []interface{}{"web"}}, false, false},
+	}
+
+	for _, tt := range tests {
+		err := checkClaims(tt.claims, "me", "api", 10*time.Second,
+			tt.optionalExp)
+
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+}
+
+func TestWithJWT(t *testing.T) {
+	k := newJWTTestKeys(t)
+	var fetches int32
+	a, err := newJWTAuth(&JWT{
+		JWKS:   serveJWKS(t, k, &fetches).URL,
+		Claims: map[string]string{"sub": "X-User"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var user string
+	h := withJWT(a, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user = req.Header.Get("X-User")
+	}))
+
+	exp := float64(time.Now().Add(time.Minute).Unix())
+	valid := k.sign(t, "ES256", "ec", map[string]interface{}{"sub": "alice",
+		"exp": exp})
+
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"Bearer " + valid, http.StatusOK},
+		{valid, http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+		{"Bearer " + k.sign(t, "ES256", "ec",
+			map[string]interface{}{"sub": "alice"}), http.StatusUnauthorized},
+	}
+
+	for i, tt := range tests {
+		user = ""
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", "spoofed")
+
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%d: status %d, want %d", i, w.Code, tt.want)
+		}
+
+		if tt.want == http.StatusOK && user != "alice" {
+			t.Errorf("%d: X-User %q, want %q", i, user, "alice")
+		}
+	}
+}
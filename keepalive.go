@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// KeepAlive describes the TCP keep-alive probes of connections, which keep
+// idle connections open across NATs and firewalls, and detect dead peers.
+type KeepAlive struct {
+	// Disable is optional. If true, no probes are sent.
+	Disable bool `json:"disable"`
+
+	// Idle is optional. It is how long a connection is idle before probes
+	// are sent, defaulting to 30s for backend connections and 15s for
+	// client connections.
+	Idle Duration `json:"idle"`
+
+	// Interval is optional. It is the time between probes, defaulting to
+	// Idle.
+	Interval Duration `json:"interval"`
+
+	// Count is optional. It is how many unanswered probes close the
+	// connection, defaulting to 9.
+	Count int `json:"count"`
+}
+
+func checkKeepAlive(k *KeepAlive) error {
+	if k.Idle < 0 || k.Interval < 0 || k.Count < 0 {
+		return errors.New("proxy: negative keep_alive setting")
+	}
+	return nil
+}
+
+// keepAliveConfig returns the configuration of k, whose idle time defaults to
+// idle, and the KeepAlive field of a net.Dialer or net.ListenConfig, which is
+// negative to disable probes.
+func keepAliveConfig(k *KeepAlive, idle time.Duration) (net.KeepAliveConfig, time.Duration) {
+	if k == nil {
+		return net.KeepAliveConfig{}, idle
+	}
+
+	if k.Disable {
+		return net.KeepAliveConfig{}, -1
+	}
+
+	c := net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     idle,
+		Interval: time.Duration(k.Interval),
+		Count:    k.Count,
+	}
+
+	if k.Idle != 0 {
+		c.Idle = time.Duration(k.Idle)
+	}
+
+	if c.Interval == 0 {
+		c.Interval = c.Idle
+	}
+
+	return c, idle
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kubernetes describes a Kubernetes service whose ready endpoints form the
+// upstream pool of a route. By default the in-cluster service account is
+// used to watch EndpointSlices.
+type Kubernetes struct {
+	// Service name to discover.
+	Service string `json:"service"`
+
+	// Namespace is optional, defaulting to the namespace of the service
+	// account.
+	Namespace string `json:"namespace"`
+
+	// Port is optional. It is the name of the endpoint port to use,
+	// defaulting to the first port.
+	Port string `json:"port"`
+
+	// APIServer, TokenFile, and CAFile are optional. They override the
+	// in-cluster API server URL and service account credentials.
+	APIServer string `json:"api_server"`
+	TokenFile string `json:"token_file"`
+	CAFile    string `json:"ca_file"`
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubeWatch struct {
+	k         *Kubernetes
+	client    *http.Client
+	base      string
+	namespace string
+	tokenFile string
+	slices    map[string]endpointSlice
+}
+
+func watchKubernetes(s *scope, k *Kubernetes) (*pool, error) {
+	if k.Service == "" {
+		return nil, errors.New("proxy: kubernetes service is empty")
+	}
+
+	w := &kubeWatch{
+		k:         k,
+		base:      k.APIServer,
+		namespace: k.Namespace,
+		tokenFile: k.TokenFile,
+		slices:    make(map[string]endpointSlice),
+	}
+
+	if w.base == "" {
+		host := os.Getenv("KUBERNETES_SERVICE_HOST")
+		port := os.Getenv("KUBERNETES_SERVICE_PORT")
+
+		if host == "" || port == "" {
+			return nil, errors.New("proxy: not running in kubernetes " +
+				"and no api_server specified")
+		}
+
+		w.base = "https://" + net.JoinHostPort(host, port)
+	}
+
+	if w.tokenFile == "" {
+		w.tokenFile = serviceAccountDir + "token"
+	}
+
+	caFile := k.CAFile
+
+	if caFile == "" && k.APIServer == "" {
+		caFile = serviceAccountDir + "ca.crt"
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("proxy: no certificates in " + caFile)
+		}
+
+		t.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	w.client = &http.Client{Transport: t}
+
+	if w.namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "namespace")
+
+		if err != nil {
+			return nil, err
+		}
+
+		w.namespace = strings.TrimSpace(string(ns))
+	}
+
+	version, err := w.list(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{targets: w.targets()}
+
+	s.run(func() {
+		for s.ctx.Err() == nil {
+			if version == "" {
+				if version, err = w.list(s); err == nil {
+					p.set(w.targets())
+				}
+			} else {
+				version, err = w.watch(s, version, p)
+			}
+
+			if err != nil && s.ctx.Err() == nil {
+				s.report(err)
+
+				select {
+				case <-time.After(discoveryBackoff):
+				case <-s.ctx.Done():
+				}
+			}
+		}
+	})
+
+	return p, nil
+}
+
+func (w *kubeWatch) get(s *scope, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", "kubernetes.io/service-name="+w.k.Service)
+
+	u := w.base + "/apis/discovery.k8s.io/v1/namespaces/" +
+		url.PathEscape(w.namespace) + "/endpointslices?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Service account tokens are rotated, so read it for every request.
+	if token, err := os.ReadFile(w.tokenFile); err == nil {
+		req.Header.Set("Authorization",
+			"Bearer "+strings.TrimSpace(string(token)))
+	} else if w.k.TokenFile != "" {
+		return nil, err
+	}
+
+	resp, err := w.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxy: kubernetes %s/%s: %s",
+			w.namespace, w.k.Service, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// list fetches all slices of the service, returning the resource version to
+// watch from.
+func (w *kubeWatch) list(s *scope) (string, error) {
+	resp, err := w.get(s, url.Values{})
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	w.slices = make(map[string]endpointSlice, len(list.Items))
+
+	for _, slice := range list.Items {
+		w.slices[slice.Metadata.Name] = slice
+	}
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies slice events to the pool until the watch ends, returning the
+// resource version to resume from, or "" if a full list is required.
+func (w *kubeWatch) watch(s *scope, version string, p *pool) (string, error) {
+	resp, err := w.get(s, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var ev kubeEvent
+
+		if err := dec.Decode(&ev); err != nil {
+			// The server closes watches periodically; resume.
+			return version, nil
+		}
+
+		if ev.Type == "ERROR" {
+			// Usually 410 Gone for an expired resource version.
+			return "", nil
+		}
+
+		var slice endpointSlice
+
+		if err := json.Unmarshal(ev.Object, &slice); err != nil {
+			return "", err
+		}
+
+		version = slice.Metadata.ResourceVersion
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			w.slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(w.slices, slice.Metadata.Name)
+		default:
+			continue
+		}
+
+		p.set(w.targets())
+	}
+}
+
+func (w *kubeWatch) targets() []target {
+	var targets []target
+
+	for _, slice := range w.slices {
+		port := -1
+
+		for _, sp := range slice.Ports {
+			name := ""
+
+			if sp.Name != nil {
+				name = *sp.Name
+			}
+
+			if sp.Port != nil && (w.k.Port == "" || w.k.Port == name) {
+				port = *sp.Port
+				break
+			}
+		}
+
+		if port < 0 {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+
+			for _, addr := range ep.Addresses {
+				targets = append(targets, target{
+					Addr:   net.JoinHostPort(addr, strconv.Itoa(port)),
+					Weight: 1,
+				})
+			}
+		}
+	}
+
+	return targets
+}
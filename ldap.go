@@ -0,0 +1,663 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LDAP describes an LDAP or Active Directory server against which Basic
+// auth credentials are verified. The user is found by searching with the
+// service account, then authenticated by binding as the user.
+type LDAP struct {
+	// URL of the server, such as "ldaps://ldap.example.com" or
+	// "ldap://ldap.example.com:389".
+	URL string `json:"url"`
+
+	// StartTLS is optional. If true, "ldap://" connections are upgraded
+	// to TLS before binding.
+	StartTLS bool `json:"start_tls"`
+
+	// BindDN and BindPassword are optional. They are the service account
+	// used to search for users, defaulting to an anonymous bind.
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+
+	// BaseDN is where users are searched for.
+	BaseDN string `json:"base_dn"`
+
+	// Filter is optional. It finds the user, with %s replaced by the
+	// escaped username, defaulting to "(uid=%s)". Active Directory
+	// typically uses "(sAMAccountName=%s)".
+	Filter string `json:"filter"`
+
+	// Group is optional. If specified, the user's memberOf attribute must
+	// contain this group DN.
+	Group string `json:"group"`
+
+	// Timeout is optional. It bounds each verification, defaulting to 10s.
+	Timeout Duration `json:"timeout"`
+}
+
+const defaultLDAPTimeout = 10 * time.Second
+
+// BER tags used by the LDAP messages below.
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+)
+
+var errLDAPInvalid = errors.New("proxy: invalid credentials")
+
+type ldapClient struct {
+	c       *LDAP
+	u       *url.URL
+	timeout time.Duration
+}
+
+func newLDAPClient(c *LDAP) (*ldapClient, error) {
+	u, err := url.Parse(c.URL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("proxy: unsupported ldap url %q", c.URL)
+	}
+
+	if c.BaseDN == "" {
+		return nil, errors.New("proxy: ldap base_dn is empty")
+	}
+
+	filter := c.Filter
+
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+
+	if _, err = parseLDAPFilter(fmt.Sprintf(filter, "x")); err != nil {
+		return nil, err
+	}
+
+	timeout := defaultLDAPTimeout
+
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout)
+	}
+
+	cc := *c
+	cc.Filter = filter
+	return &ldapClient{c: &cc, u: u, timeout: timeout}, nil
+}
+
+// ber encodes a TLV.
+func ber(tag byte, content ...[]byte) []byte {
+	n := 0
+
+	for _, c := range content {
+		n += len(c)
+	}
+
+	b := []byte{tag}
+
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	case n < 0x10000:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	for _, c := range content {
+		b = append(b, c...)
+	}
+
+	return b
+}
+
+func berInt(tag byte, v int) []byte {
+	var b []byte
+
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+
+		if v == 0 && b[0] < 0x80 {
+			break
+		}
+	}
+
+	return ber(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return ber(tag, []byte(s))
+}
+
+// berValue is a decoded TLV.
+type berValue struct {
+	tag     byte
+	content []byte
+}
+
+func readBER(r io.Reader) (berValue, error) {
+	var hdr [2]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return berValue{}, err
+	}
+
+	n := int(hdr[1])
+
+	if n&0x80 != 0 {
+		l := n & 0x7f
+
+		if l == 0 || l > 4 {
+			return berValue{}, errors.New("proxy: ldap: bad length")
+		}
+
+		b := make([]byte, l)
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return berValue{}, err
+		}
+
+		n = 0
+
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+	}
+
+	if n > 1<<20 {
+		return berValue{}, errors.New("proxy: ldap: message too large")
+	}
+
+	content := make([]byte, n)
+
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berValue{}, err
+	}
+
+	return berValue{tag: hdr[0], content: content}, nil
+}
+
+// children decodes the TLVs within a constructed value.
+func (v berValue) children() ([]berValue, error) {
+	var out []berValue
+	r := strings.NewReader(string(v.content))
+
+	for r.Len() > 0 {
+		c, err := readBER(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, c)
+	}
+
+	return out, nil
+}
+
+func (v berValue) int() int {
+	n := 0
+
+	for i, c := range v.content {
+		if i == 0 && c&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(c)
+	}
+
+	return n
+}
+
+// parseLDAPFilter encodes an RFC 4515 filter string.
+func parseLDAPFilter(s string) ([]byte, error) {
+	b, rest, err := parseFilterItem(s)
+
+	if err == nil && rest != "" {
+		err = errors.New("trailing characters")
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("proxy: ldap filter %q: %w", s, err)
+	}
+
+	return b, nil
+}
+
+func parseFilterItem(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("expected (")
+	}
+
+	s = s[1:]
+
+	if s == "" {
+		return nil, "", errors.New("unexpected end")
+	}
+
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+
+		s = s[1:]
+		var items [][]byte
+
+		for strings.HasPrefix(s, "(") {
+			item, rest, err := parseFilterItem(s)
+
+			if err != nil {
+				return nil, "", err
+			}
+
+			items = append(items, item)
+			s = rest
+		}
+
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("expected )")
+		}
+
+		return ber(tag, items...), s[1:], nil
+	case '!':
+		item, rest, err := parseFilterItem(s[1:])
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("expected )")
+		}
+
+		return ber(0xa2, item), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+
+	if end < 0 {
+		return nil, "", errors.New("expected )")
+	}
+
+	item, rest := s[:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+
+	if eq <= 0 {
+		return nil, "", errors.New("expected attribute=value")
+	}
+
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(0xa3)
+
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	}
+
+	if tag == 0xa3 && value == "*" {
+		return berString(0x87, attr), rest, nil
+	}
+
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs [][]byte
+
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+
+			v, err := unescapeFilterValue(p)
+
+			if err != nil {
+				return nil, "", err
+			}
+
+			switch i {
+			case 0:
+				subs = append(subs, berString(0x80, v))
+			case len(parts) - 1:
+				subs = append(subs, berString(0x82, v))
+			default:
+				subs = append(subs, berString(0x81, v))
+			}
+		}
+
+		return ber(0xa4, berString(berOctetString, attr),
+			ber(berSequence, subs...)), rest, nil
+	}
+
+	v, err := unescapeFilterValue(value)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ber(tag, berString(berOctetString, attr),
+		berString(berOctetString, v)), rest, nil
+}
+
+func unescapeFilterValue(s string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", errors.New("bad escape")
+		}
+
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+
+		if err != nil {
+			return "", errors.New("bad escape")
+		}
+
+		b.WriteByte(byte(n))
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// escapeFilterValue escapes a value for inclusion in a filter.
+func escapeFilterValue(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+type ldapConn struct {
+	conn net.Conn
+	id   int
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.id++
+	_, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.id), op))
+	return err
+}
+
+// recv reads the protocol op of the next message.
+func (c *ldapConn) recv() (berValue, error) {
+	msg, err := readBER(c.conn)
+
+	if err != nil {
+		return berValue{}, err
+	}
+
+	parts, err := msg.children()
+
+	if err != nil || len(parts) < 2 {
+		return berValue{}, errors.New("proxy: ldap: malformed message")
+	}
+
+	return parts[1], nil
+}
+
+// result checks an LDAPResult, returning its code.
+func ldapResult(op berValue) (int, error) {
+	parts, err := op.children()
+
+	if err != nil || len(parts) < 3 {
+		return 0, errors.New("proxy: ldap: malformed result")
+	}
+
+	return parts[0].int(), nil
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	err := c.send(ber(ldapBindRequest, berInt(berInteger, 3),
+		berString(berOctetString, dn), berString(0x80, password)))
+
+	if err != nil {
+		return err
+	}
+
+	op, err := c.recv()
+
+	if err != nil {
+		return err
+	}
+
+	if op.tag != ldapBindResponse {
+		return errors.New("proxy: ldap: unexpected bind response")
+	}
+
+	code, err := ldapResult(op)
+
+	switch {
+	case err != nil:
+		return err
+	case code == 49: // invalidCredentials
+		return errLDAPInvalid
+	case code != 0:
+		return fmt.Errorf("proxy: ldap: bind failed with code %d", code)
+	}
+
+	return nil
+}
+
+func (c *ldapConn) startTLS(host string) error {
+	err := c.send(ber(ldapExtendedRequest,
+		berString(0x80, "1.3.6.1.4.1.1466.20037")))
+
+	if err != nil {
+		return err
+	}
+
+	op, err := c.recv()
+
+	if err != nil {
+		return err
+	}
+
+	if code, err := ldapResult(op); err != nil || op.tag != ldapExtendedResponse || code != 0 {
+		return errors.New("proxy: ldap: StartTLS refused")
+	}
+
+	tc := tls.Client(c.conn, &tls.Config{ServerName: host})
+
+	if err = tc.Handshake(); err != nil {
+		return err
+	}
+
+	c.conn = tc
+	return nil
+}
+
+// search returns the DN and memberOf values of the single matching entry.
+func (c *ldapConn) search(base string, filter []byte) (string, []string, error) {
+	err := c.send(ber(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 2),    // sizeLimit, to detect ambiguity
+		berInt(berInteger, 0),
+		ber(berBoolean, []byte{0}),
+		filter,
+		ber(berSequence, berString(berOctetString, "memberOf"))))
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	var dn string
+	var groups []string
+	entries := 0
+
+	for {
+		op, err := c.recv()
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch op.tag {
+		case ldapSearchEntry:
+			entries++
+			parts, err := op.children()
+
+			if err != nil || len(parts) < 2 {
+				return "", nil, errors.New("proxy: ldap: malformed entry")
+			}
+
+			dn = string(parts[0].content)
+			attrs, _ := parts[1].children()
+
+			for _, attr := range attrs {
+				kv, _ := attr.children()
+
+				if len(kv) < 2 || !strings.EqualFold(string(kv[0].content), "memberOf") {
+					continue
+				}
+
+				vals, _ := kv[1].children()
+
+				for _, v := range vals {
+					groups = append(groups, string(v.content))
+				}
+			}
+		case ldapSearchDone:
+			code, err := ldapResult(op)
+
+			if err != nil {
+				return "", nil, err
+			}
+
+			// sizeLimitExceeded also implies more than one entry.
+			if entries != 1 || (code != 0 && code != 4) {
+				return "", nil, errLDAPInvalid
+			}
+
+			return dn, groups, nil
+		}
+		// Ignore search result references.
+	}
+}
+
+// check verifies the user's credentials and group membership.
+func (l *ldapClient) check(user, password string) error {
+	// An empty password would be an unauthenticated bind, which succeeds.
+	if user == "" || password == "" {
+		return errLDAPInvalid
+	}
+
+	host := l.u.Hostname()
+	port := l.u.Port()
+
+	if port == "" {
+		port = "389"
+
+		if l.u.Scheme == "ldaps" {
+			port = "636"
+		}
+	}
+
+	d := net.Dialer{Timeout: l.timeout}
+	addr := net.JoinHostPort(host, port)
+
+	var conn net.Conn
+	var err error
+
+	if l.u.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(&d, "tcp", addr,
+			&tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(l.timeout))
+
+	c := &ldapConn{conn: conn}
+
+	if l.c.StartTLS && l.u.Scheme == "ldap" {
+		if err = c.startTLS(host); err != nil {
+			return err
+		}
+	}
+
+	if err = c.bind(l.c.BindDN, l.c.BindPassword); err != nil {
+		return err
+	}
+
+	filter, err := parseLDAPFilter(fmt.Sprintf(l.c.Filter,
+		escapeFilterValue(user)))
+
+	if err != nil {
+		return err
+	}
+
+	dn, groups, err := c.search(l.c.BaseDN, filter)
+
+	if err != nil {
+		return err
+	}
+
+	if l.c.Group != "" {
+		member := false
+
+		for _, g := range groups {
+			if strings.EqualFold(g, l.c.Group) {
+				member = true
+				break
+			}
+		}
+
+		if !member {
+			return errLDAPInvalid
+		}
+	}
+
+	return c.bind(dn, password)
+}
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBER(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0x10000} {
+		content := bytes.Repeat([]byte{'x'}, n)
+		v, err := readBER(bytes.NewReader(ber(berOctetString, content)))
+
+		if err != nil {
+			t.Errorf("length %d: %v", n, err)
+		} else if v.tag != berOctetString || !bytes.Equal(v.content, content) {
+			t.Errorf("length %d: decoded tag %#x, length %d", n, v.tag,
+				len(v.content))
+		}
+	}
+
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 1 << 20} {
+		v, err := readBER(bytes.NewReader(berInt(berInteger, n)))
+
+		if err != nil {
+			t.Errorf("%d: %v", n, err)
+		} else if v.int() != n {
+			t.Errorf("%d: decoded %d", n, v.int())
+		}
+	}
+
+	// The bind request of the message is decoded back into its parts.
+	msg := ber(berSequence, berInt(berInteger, 7),
+		ber(ldapBindRequest, berInt(berInteger, 3),
+			berString(berOctetString, "cn=svc"), berString(0x80, "pw")))
+	v, err := readBER(bytes.NewReader(msg))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts, err := v.children()
+
+	if err != nil || len(parts) != 2 || parts[0].int() != 7 ||
+		parts[1].tag != ldapBindRequest {
+		t.Fatalf("message %v, %v", parts, err)
+	}
+
+	bind, err := parts[1].children()
+
+	if err != nil || len(bind) != 3 || bind[0].int() != 3 ||
+		string(bind[1].content) != "cn=svc" || bind[2].tag != 0x80 ||
+		string(bind[2].content) != "pw" {
+		t.Errorf("bind request %v, %v", bind, err)
+	}
+
+	if _, err := readBER(bytes.NewReader([]byte{berSequence, 0x85, 0, 0, 0, 0, 1})); err == nil {
+		t.Error("5-byte length accepted")
+	}
+}
+
+func TestLDAPFilter(t *testing.T) {
+	eq := func(attr, value string) []byte {
+		return ber(0xa3, berString(berOctetString, attr),
+			berString(berOctetString, value))
+	}
+
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(uid=alice)", eq("uid", "alice")},
+		{`(uid=a\2ab\28c\29\5c\00)`, eq("uid", "a*b(c)\\\x00")},
+		{"(uid=*)", berString(0x87, "uid")},
+		{"(&(uid=alice)(!(ou=x)))", ber(0xa0, eq("uid", "alice"),
+			ber(0xa2, eq("ou", "x")))},
+		{"(cn=a*b)", ber(0xa4, berString(berOctetString, "cn"),
+			ber(berSequence, berString(0x80, "a"), berString(0x82, "b")))},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLDAPFilter(tt.filter)
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: encoded %x, want %x", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, filter := range []string{"uid=alice", "(uid=alice", "(uid)",
+		"(uid=alice))", `(uid=\2)`} {
+		if _, err := parseLDAPFilter(filter); err == nil {
+			t.Errorf("%s: accepted", filter)
+		}
+	}
+
+	// Escaped usernames are always matched literally.
+	user := "*)(uid=*"
+
+	if got := escapeFilterValue(user); got != `\2a\29\28uid=\2a` {
+		t.Errorf("escaped %q to %q", user, got)
+	}
+
+	got, err := parseLDAPFilter("(uid=" + escapeFilterValue(user) + ")")
+
+	if err != nil || !bytes.Equal(got, eq("uid", user)) {
+		t.Errorf("filter for %q: %x, %v", user, got, err)
+	}
+}
+
+// ldapTestServer answers binds for the service account and users, and
+// searches by uid. Both entries for "bob" have the password, so only the
+// ambiguity check refuses them.
+type ldapTestServer struct {
+	ln    net.Listener
+	conns int32
+
+	mu          sync.Mutex
+	uids        []string
+	sizeLimits  []int
+	passwords   map[string]string
+	memberships map[string]string
+}
+
+func newLDAPTestServer(t *testing.T) *ldapTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ldapTestServer{
+		ln: ln,
+		passwords: map[string]string{
+			"cn=svc":                  "svcpw",
+			"uid=alice,dc=example":    "pw",
+			"uid=bob,ou=a,dc=example": "pw",
+			"uid=bob,ou=b,dc=example": "pw",
+		},
+		memberships: map[string]string{
+			"uid=alice,dc=example": "cn=staff,dc=example",
+		},
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *ldapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reply := func(id int, op []byte) {
+		conn.Write(ber(berSequence, berInt(berInteger, id), op))
+	}
+
+	result := func(tag byte, code int) []byte {
+		return ber(tag, berInt(berEnumerated, code),
+			berString(berOctetString, ""), berString(berOctetString, ""))
+	}
+
+	for {
+		msg, err := readBER(conn)
+
+		if err != nil {
+			return
+		}
+
+		parts, err := msg.children()
+
+		if err != nil || len(parts) < 2 {
+			return
+		}
+
+		id := parts[0].int()
+		req, err := parts[1].children()
+
+		if err != nil {
+			return
+		}
+
+		switch parts[1].tag {
+		case ldapBindRequest:
+			dn, password := string(req[1].content), string(req[2].content)
+			code := 49
+
+			if want, ok := s.passwords[dn]; ok && want == password {
+				code = 0
+			}
+
+			reply(id, result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			filter, _ := req[6].children()
+			uid := string(filter[1].content)
+
+			s.mu.Lock()
+			s.uids = append(s.uids, uid)
+			s.sizeLimits = append(s.sizeLimits, req[3].int())
+			s.mu.Unlock()
+
+			var dns []string
+
+			for dn := range s.passwords {
+				if strings.HasPrefix(dn, "uid="+uid+",") {
+					dns = append(dns, dn)
+				}
+			}
+
+			for _, dn := range dns {
+				var attrs [][]byte
+
+				if g, ok := s.memberships[dn]; ok {
+					attrs = append(attrs, ber(berSequence,
+						berString(berOctetString, "memberOf"),
+						ber(berSet, berString(berOctetString, g))))
+				}
+
+				reply(id, ber(ldapSearchEntry, berString(berOctetString, dn),
+					ber(berSequence, attrs...)))
+			}
+
+			code := 0
+
+			if len(dns) > 1 {
+				code = 4 // sizeLimitExceeded
+			}
+
+			reply(id, result(ldapSearchDone, code))
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPCheck(t *testing.T) {
+	s := newLDAPTestServer(t)
+	l, err := newLDAPClient(&LDAP{
+		URL:          "ldap://" + s.ln.Addr().String(),
+		BindDN:       "cn=svc",
+		BindPassword: "svcpw",
+		BaseDN:       "dc=example",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		err            error
+	}{
+		{"alice", "pw", nil},
+		{"alice", "wrong", errLDAPInvalid},
+		{"carol", "pw", errLDAPInvalid},
+		{"bob", "pw", errLDAPInvalid},
+		{"*", "pw", errLDAPInvalid},
+	}
+
+	for _, tt := range tests {
+		if err := l.check(tt.user, tt.password); err != tt.err {
+			t.Errorf("%s, %s: error %v, want %v", tt.user, tt.password, err,
+				tt.err)
+		}
+	}
+
+	s.mu.Lock()
+
+	// "*" is searched for as a literal value, not a presence filter.
+	want := []string{"alice", "alice", "carol", "bob", "*"}
+
+	if strings.Join(s.uids, " ") != strings.Join(want, " ") {
+		t.Errorf("searched for %q, want %q", s.uids, want)
+	}
+
+	for _, n := range s.sizeLimits {
+		if n != 2 {
+			t.Errorf("size limit %d, want 2", n)
+		}
+	}
+
+	s.mu.Unlock()
+
+	// An empty password is refused before connecting, since it would be an
+	// unauthenticated bind.
+	conns := atomic.LoadInt32(&s.conns)
+
+	if err := l.check("alice", ""); err != errLDAPInvalid {
+		t.Errorf("empty password: error %v", err)
+	}
+
+	if n := atomic.LoadInt32(&s.conns); n != conns {
+		t.Errorf("empty password: %d connections made", n-conns)
+	}
+
+	l.c.Group = "cn=admins,dc=example"
+
+	if err := l.check("alice", "pw"); err != errLDAPInvalid {
+		t.Errorf("not in group: error %v", err)
+	}
+
+	l.c.Group = "CN=staff,dc=example"
+
+	if err := l.check("alice", "pw"); err != nil {
+		t.Errorf("in group: error %v", err)
+	}
+}
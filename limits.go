@@ -0,0 +1,58 @@
+package proxy
+
+import "net/http"
+
+// Limits describes limits on the size of requests.
+type Limits struct {
+	// MaxHeaderBytes is optional. If positive, it limits the size of the
+	// request line and headers. Larger requests are rejected by the server
+	// with 431 Request Header Fields Too Large.
+	MaxHeaderBytes int `json:"max_header_bytes"`
+
+	// MaxURLLength is optional. If positive, requests with a longer
+	// request URI are rejected with 414 URI Too Long.
+	MaxURLLength int `json:"max_url_length"`
+
+	// MaxHeaders is optional. If positive, requests with more header
+	// fields are rejected with 431 Request Header Fields Too Large.
+	MaxHeaders int `json:"max_headers"`
+
+	// Body is optional. It replaces the default body of responses to
+	// requests over MaxURLLength or MaxHeaders.
+	Body string `json:"body"`
+}
+
+// withLimits rejects requests over the limits of l.
+func withLimits(l *Limits, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := 0
+
+		if l.MaxURLLength > 0 && len(req.RequestURI) > l.MaxURLLength {
+			status = http.StatusRequestURITooLong
+		} else if l.MaxHeaders > 0 {
+			n := 0
+
+			for _, v := range req.Header {
+				n += len(v)
+			}
+
+			if n > l.MaxHeaders {
+				status = http.StatusRequestHeaderFieldsTooLarge
+			}
+		}
+
+		if status == 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		body := l.Body
+
+		if body == "" {
+			body = http.StatusText(status)
+		}
+
+		w.Header().Set("Connection", "close")
+		http.Error(w, body, status)
+	})
+}
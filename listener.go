@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	connectionsOpen = newGaugeVec("http_proxy_connections",
+		"Open client connections.", "listener")
+	connectionsRejected = newCounterVec("http_proxy_rejected_connections_total",
+		"Client connections closed for exceeding max_connections.",
+		"listener")
+)
+
+// limitListener closes accepted connections beyond max instead of serving
+// them.
+type limitListener struct {
+	net.Listener
+	name string
+	max  int64
+	open int64
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if atomic.AddInt64(&l.open, 1) > l.max {
+			atomic.AddInt64(&l.open, -1)
+			connectionsRejected.inc(l.name)
+			conn.Close()
+			continue
+		}
+
+		connectionsOpen.add(1, l.name)
+		return &limitConn{Conn: conn, l: l}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	l    *limitListener
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+
+	c.once.Do(func() {
+		atomic.AddInt64(&c.l.open, -1)
+		connectionsOpen.add(-1, c.l.name)
+	})
+
+	return err
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+)
+
+// LogSampling describes logging a fraction of the requests of a route. Slow
+// requests are always logged.
+type LogSampling struct {
+	// Rate is the fraction of responses with statuses below 400 which are
+	// logged, such as 0.01.
+	Rate float64 `json:"rate"`
+
+	// ErrorRate is optional. It is the fraction of other responses which
+	// are logged, defaulting to 1.
+	ErrorRate float64 `json:"error_rate"`
+}
+
+func checkLogSampling(c *LogSampling) error {
+	if c.Rate < 0 || c.Rate > 1 || c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return errors.New("proxy: log sampling rate out of range")
+	}
+	return nil
+}
+
+// withLogSampling samples the access log entries of requests.
+func withLogSampling(c *LogSampling, h http.Handler) http.Handler {
+	errorRate := c.ErrorRate
+
+	if errorRate == 0 {
+		errorRate = 1
+	}
+
+	sample := func(status int) bool {
+		if status < 400 {
+			return rand.Float64() < c.Rate
+		}
+		return rand.Float64() < errorRate
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		setLogSampling(req, sample)
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import "sort"
+
+// The brotli and zstd encoders share LZ77 parsing, prefix codes and an
+// LSB-first bit writer.
+
+const (
+	lzMinMatch = 4
+	lzMaxMatch = 1<<16 - 1
+	lzHashBits = 15
+
+	// lzWindow is the farthest back matches reach. It fits the smallest
+	// window either format describes with one header field.
+	lzWindow = 1<<18 - 16
+
+	// lzBlockSize is the most input compressed at once.
+	lzBlockSize = 1 << 17
+)
+
+// lzSeq is a run of literals followed by a match.
+type lzSeq struct {
+	lit    int
+	length int
+	offset int
+}
+
+// matcher finds matches within a sliding window using hash chains.
+type matcher struct {
+	depth int
+	lazy  bool
+
+	buf   []byte
+	head  []int32
+	chain []int32
+}
+
+// newMatcher returns a matcher following depth candidates per position, and
+// deferring matches for longer ones at the next position if lazy is true.
+func newMatcher(depth int, lazy bool) *matcher {
+	return &matcher{
+		depth: depth,
+		lazy:  lazy,
+		head:  make([]int32, 1<<lzHashBits),
+	}
+}
+
+func (m *matcher) reset() {
+	m.buf = m.buf[:0]
+	m.chain = m.chain[:0]
+
+	for i := range m.head {
+		m.head[i] = 0
+	}
+}
+
+func lzHash(b []byte) uint32 {
+	v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	return (v * 2654435761) >> (32 - lzHashBits)
+}
+
+// slide drops history beyond the window, keeping positions in the chains
+// relative to buf.
+func (m *matcher) slide() {
+	if len(m.buf) <= lzWindow+lzBlockSize {
+		return
+	}
+
+	drop := int32(len(m.buf) - lzWindow)
+	m.buf = m.buf[:copy(m.buf, m.buf[drop:])]
+	m.chain = m.chain[:copy(m.chain, m.chain[drop:])]
+
+	rebase := func(v []int32) {
+		for i, p := range v {
+			if p > drop {
+				v[i] = p - drop
+			} else {
+				v[i] = 0
+			}
+		}
+	}
+
+	rebase(m.head)
+	rebase(m.chain)
+}
+
+// insert adds position p, which must have lzMinMatch bytes following it, to
+// the hash chains.
+func (m *matcher) insert(p int) {
+	h := lzHash(m.buf[p:])
+	m.chain[p] = m.head[h]
+	m.head[h] = int32(p + 1)
+}
+
+// find returns the longest match for position p, before end, and its offset.
+func (m *matcher) find(p, end int) (int, int) {
+	max := end - p
+
+	if max > lzMaxMatch {
+		max = lzMaxMatch
+	}
+
+	best, offset := 0, 0
+	cur := m.buf[p : p+max]
+
+	for c, n := m.head[lzHash(cur)], m.depth; c > 0 && n > 0; c, n = m.chain[c-1], n-1 {
+		cand := int(c - 1)
+
+		if p-cand > lzWindow {
+			break
+		}
+
+		prev := m.buf[cand:]
+
+		if prev[best] != cur[best] {
+			continue
+		}
+
+		l := 0
+
+		for l < max && prev[l] == cur[l] {
+			l++
+		}
+
+		if l > best {
+			best, offset = l, p-cand
+
+			if l == max {
+				break
+			}
+		}
+	}
+
+	return best, offset
+}
+
+// parse appends block to the history and appends its sequences to seqs. It
+// also returns the number of literals following the last sequence.
+func (m *matcher) parse(block []byte, seqs []lzSeq) ([]lzSeq, int) {
+	m.slide()
+
+	start := len(m.buf)
+	m.buf = append(m.buf, block...)
+	end := len(m.buf)
+
+	for len(m.chain) < end {
+		m.chain = append(m.chain, 0)
+	}
+
+	pos, lit := start, start
+
+	for pos+lzMinMatch <= end {
+		l, off := m.find(pos, end)
+		m.insert(pos)
+
+		if l < lzMinMatch {
+			pos++
+			continue
+		}
+
+		for m.lazy && pos+1+lzMinMatch <= end {
+			l2, off2 := m.find(pos+1, end)
+
+			if l2 <= l {
+				break
+			}
+
+			pos++
+			m.insert(pos)
+			l, off = l2, off2
+		}
+
+		seqs = append(seqs, lzSeq{lit: pos - lit, length: l, offset: off})
+
+		for i := pos + 1; i < pos+l && i+lzMinMatch <= end; i++ {
+			m.insert(i)
+		}
+
+		pos += l
+		lit = pos
+	}
+
+	return seqs, end - lit
+}
+
+// bitWriter writes bits least significant first.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write writes the low n bits of v, for n at most 32.
+func (b *bitWriter) write(v uint64, n uint) {
+	b.acc |= (v & (1<<n - 1)) << b.nbits
+	b.nbits += n
+
+	for b.nbits >= 8 {
+		b.out = append(b.out, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+// align pads with zero bits to a byte boundary.
+func (b *bitWriter) align() {
+	if b.nbits > 0 {
+		b.write(0, 8-b.nbits)
+	}
+}
+
+// huffmanLengths returns prefix code lengths for the symbol counts, at most
+// max bits. Unused symbols get length zero. A lone used symbol gets length
+// one.
+func huffmanLengths(counts []uint32, max uint8, lengths []uint8) []uint8 {
+	lengths = append(lengths[:0], make([]uint8, len(counts))...)
+
+	var used []int
+
+	for s, c := range counts {
+		if c != 0 {
+			used = append(used, s)
+		}
+	}
+
+	if len(used) == 1 {
+		lengths[used[0]] = 1
+	}
+
+	if len(used) < 2 {
+		return lengths
+	}
+
+	// Flattening the counts shortens the longest codes; double the floor
+	// until they fit.
+	for floor := uint32(1); ; floor *= 2 {
+		type node struct {
+			count  uint32
+			parent int
+		}
+
+		leaves := make([]int, len(used))
+		copy(leaves, used)
+
+		weight := func(s int) uint32 {
+			if counts[s] < floor {
+				return floor
+			}
+			return counts[s]
+		}
+
+		sort.SliceStable(leaves, func(i, j int) bool {
+			return weight(leaves[i]) < weight(leaves[j])
+		})
+
+		nodes := make([]node, 0, 2*len(leaves)-1)
+
+		for _, s := range leaves {
+			nodes = append(nodes, node{count: weight(s), parent: -1})
+		}
+
+		// Two queues: leaves in order, then internal nodes as made.
+		i, j := 0, len(leaves)
+		pop := func() int {
+			if i < len(leaves) && (j >= len(nodes) ||
+				nodes[i].count <= nodes[j].count) {
+				i++
+				return i - 1
+			}
+			j++
+			return j - 1
+		}
+
+		for k := 0; k < len(leaves)-1; k++ {
+			a, b := pop(), pop()
+			nodes = append(nodes, node{
+				count:  nodes[a].count + nodes[b].count,
+				parent: -1,
+			})
+			nodes[a].parent = len(nodes) - 1
+			nodes[b].parent = len(nodes) - 1
+		}
+
+		depth := make([]uint8, len(nodes))
+		deepest := uint8(0)
+
+		for n := len(nodes) - 2; n >= 0; n-- {
+			depth[n] = depth[nodes[n].parent] + 1
+
+			if n < len(leaves) && depth[n] > deepest {
+				deepest = depth[n]
+			}
+		}
+
+		if deepest > max {
+			continue
+		}
+
+		for n, s := range leaves {
+			lengths[s] = depth[n]
+		}
+
+		return lengths
+	}
+}
+
+// huffmanCodes returns the canonical codes for the lengths, bit-reversed
+// so that they are written most significant bit first by bitWriter.
+func huffmanCodes(lengths []uint8, codes []uint16) []uint16 {
+	codes = append(codes[:0], make([]uint16, len(lengths))...)
+
+	var count [16]uint16
+
+	for _, l := range lengths {
+		count[l]++
+	}
+
+	count[0] = 0
+
+	var next [16]uint16
+	code := uint16(0)
+
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+
+		c := next[l]
+		next[l]++
+
+		r := uint16(0)
+
+		for k := uint8(0); k < l; k++ {
+			r = r<<1 | c&1
+			c >>= 1
+		}
+
+		codes[s] = r
+	}
+
+	return codes
+}
+
+// highBit returns the index of the most significant set bit of v > 0.
+func highBit(v uint32) uint {
+	n := uint(0)
+
+	for v > 1 {
+		v >>= 1
+		n++
+	}
+
+	return n
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// compressInputs are inputs for round trips through the encoders: empty,
+// short, repetitive, incompressible, and spanning blocks and the window.
+func compressInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+
+	random := make([]byte, 3*lzBlockSize/2)
+	rng.Read(random)
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 20000)
+
+	// Words drawn at random repeat at varied distances.
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon ",
+		"zeta ", "eta ", "theta "}
+	var mixed bytes.Buffer
+
+	for mixed.Len() < 2*lzWindow {
+		if rng.Intn(8) == 0 {
+			mixed.WriteByte(byte(rng.Intn(256)))
+			continue
+		}
+
+		mixed.WriteString(words[rng.Intn(len(words))])
+	}
+
+	return map[string][]byte{
+		"empty":  nil,
+		"byte":   []byte("x"),
+		"short":  []byte("hello, hello, hello world"),
+		"run":    bytes.Repeat([]byte{'a'}, lzMaxMatch+100),
+		"random": random,
+		"text":   text,
+		"mixed":  mixed.Bytes(),
+	}
+}
+
+func TestMatcherParse(t *testing.T) {
+	for name, in := range compressInputs() {
+		for _, lazy := range []bool{false, true} {
+			m := newMatcher(16, lazy)
+			var out []byte
+
+			for p := in; len(p) > 0; {
+				block := p
+
+				if len(block) > lzBlockSize {
+					block = block[:lzBlockSize]
+				}
+
+				p = p[len(block):]
+				seqs, trailing := m.parse(block, nil)
+				q := 0
+
+				for _, s := range seqs {
+					if s.length < lzMinMatch || s.length > lzMaxMatch ||
+						s.offset < 1 || s.offset > lzWindow ||
+						s.offset > len(out)+s.lit {
+						t.Fatalf("%s: invalid sequence %+v", name, s)
+					}
+
+					out = append(out, block[q:q+s.lit]...)
+					q += s.lit
+
+					for i := 0; i < s.length; i++ {
+						out = append(out, out[len(out)-s.offset])
+					}
+
+					q += s.length
+				}
+
+				if q+trailing != len(block) {
+					t.Fatalf("%s: sequences cover %d of %d bytes", name,
+						q+trailing, len(block))
+				}
+
+				out = append(out, block[q:]...)
+			}
+
+			if !bytes.Equal(out, in) {
+				t.Errorf("%s (lazy %v): sequences do not reproduce the input",
+					name, lazy)
+			}
+		}
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// Fibonacci counts give the deepest trees.
+	counts := make([]uint32, 30)
+	a, b := uint32(1), uint32(1)
+
+	for i := range counts {
+		counts[i] = a
+		a, b = b, a+b
+	}
+
+	for _, max := range []uint8{5, 7, 15} {
+		lengths := huffmanLengths(counts, max, nil)
+		kraft := 0
+
+		for _, l := range lengths {
+			if l == 0 || l > max {
+				t.Fatalf("max %d: length %d", max, l)
+			}
+
+			kraft += 1 << (max - l)
+		}
+
+		if kraft != 1<<max {
+			t.Errorf("max %d: lengths %v are not a complete code", max,
+				lengths)
+		}
+	}
+}
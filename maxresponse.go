@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+var errResponseTooLarge = errors.New("proxy: response exceeds max_response_bytes")
+
+// limitResponse returns a ModifyResponse func failing responses announced
+// larger than max, and aborting those which grow larger once max bytes have
+// been proxied. Both are logged at the warn level.
+func limitResponse(max int64) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.ContentLength > max {
+			logTooLarge(resp.Request)
+			return errResponseTooLarge
+		}
+
+		resp.Body = &limitedBody{
+			ReadCloser: resp.Body,
+			req:        resp.Request,
+			left:       max,
+		}
+		return nil
+	}
+}
+
+func logTooLarge(req *http.Request) {
+	setLogField(req, "level", "warn")
+	setLogField(req, "response_too_large", true)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	req  *http.Request
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		// Check for more before failing, so that bodies of exactly the
+		// limit are proxied.
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+
+		if n == 0 {
+			return 0, err
+		}
+
+		logTooLarge(b.req)
+		return 0, errResponseTooLarge
+	}
+
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
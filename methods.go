@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withMethods rejects requests whose method is not in methods with 405
+// Method Not Allowed.
+func withMethods(methods []string, h http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(methods))
+	upper := make([]string, len(methods))
+
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+		allowed[upper[i]] = true
+	}
+
+	allow := strings.Join(upper, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !allowed[req.Method] {
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// MetricLabels describes the labels of the proxy metrics, to control their
+// cardinality.
+type MetricLabels struct {
+	// Static is optional. These labels, such as env or region, are added
+	// to every metric.
+	Static map[string]string `json:"static"`
+
+	// Dynamic is optional. It lists which of the labels "route", "host",
+	// "method", "status" and "upstream" are kept, defaulting to "route",
+	// "status" and "upstream". The status is in the code and class
+	// labels. Other labels are always kept.
+	Dynamic []string `json:"dynamic"`
+}
+
+// dynamicLabels are the label names controlled by MetricLabels.Dynamic.
+var dynamicLabels = map[string][]string{
+	"route":    {"route"},
+	"host":     {"host"},
+	"method":   {"method"},
+	"status":   {"code", "class"},
+	"upstream": {"upstream"},
+}
+
+var defaultDynamicLabels = []string{"route", "status", "upstream"}
+
+// metricLabels is the label configuration of all metrics.
+var metricLabels = newLabelConfig()
+
+type labelConfig struct {
+	mu     sync.RWMutex
+	static []string // name, value pairs, sorted by name
+	drop   map[string]bool
+}
+
+func newLabelConfig() *labelConfig {
+	lc := &labelConfig{}
+	_ = lc.set(nil) // The defaults are valid.
+	return lc
+}
+
+// validLabelName reports whether name is a Prometheus label name not
+// reserved for internal use.
+func validLabelName(name string) bool {
+	if name == "" || len(name) >= 2 && name[:2] == "__" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func dynamicLabelName(name string) bool {
+	for _, names := range dynamicLabels {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// set applies c, or the defaults if c is nil.
+func (lc *labelConfig) set(c *MetricLabels) error {
+	if c == nil {
+		c = &MetricLabels{}
+	}
+
+	dynamic := c.Dynamic
+
+	if dynamic == nil {
+		dynamic = defaultDynamicLabels
+	}
+
+	drop := make(map[string]bool)
+
+	for _, names := range dynamicLabels {
+		for _, name := range names {
+			drop[name] = true
+		}
+	}
+
+	for _, d := range dynamic {
+		names, ok := dynamicLabels[d]
+
+		if !ok {
+			return errors.New("proxy: unknown dynamic metric label " + d)
+		}
+
+		for _, name := range names {
+			delete(drop, name)
+		}
+	}
+
+	static := make([]string, 0, 2*len(c.Static))
+	names := make([]string, 0, len(c.Static))
+
+	for name := range c.Static {
+		if !validLabelName(name) || name == "le" || dynamicLabelName(name) {
+			return errors.New("proxy: invalid static metric label " + name)
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		static = append(static, name, c.Static[name])
+	}
+
+	lc.mu.Lock()
+	lc.static, lc.drop = static, drop
+	lc.mu.Unlock()
+	return nil
+}
+
+// filter returns values with those of dropped labels blanked, so that they
+// share series.
+func (lc *labelConfig) filter(names, values []string) []string {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	var out []string
+
+	for i, name := range names {
+		if lc.drop[name] && values[i] != "" {
+			if out == nil {
+				out = append([]string(nil), values...)
+			}
+			out[i] = ""
+		}
+	}
+
+	if out == nil {
+		return values
+	}
+
+	return out
+}
+
+// labels returns the names and values of the labels written out: those not
+// dropped, then the static labels.
+func (lc *labelConfig) labels(names, values []string) ([]string, []string) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	var n, v []string
+
+	for i, name := range names {
+		if !lc.drop[name] {
+			n = append(n, name)
+			v = append(v, values[i])
+		}
+	}
+
+	for i := 0; i < len(lc.static); i += 2 {
+		n = append(n, lc.static[i])
+		v = append(v, lc.static[i+1])
+	}
+
+	return n, v
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics are kept in a package-level registry and exposed in the Prometheus
+// text format by MetricsHandler.
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+	sort.Slice(registry.metrics, func(i, j int) bool {
+		return registry.metrics[i].name() < registry.metrics[j].name()
+	})
+}
+
+// MetricsHandler serves the proxy metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		registry.mu.Lock()
+		metrics := append([]metric(nil), registry.metrics...)
+		registry.mu.Unlock()
+
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+// labelSet formats label names and values as {a="x",b="y"}.
+func labelSet(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(values[i]))
+	}
+
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// counterVec is a set of counters partitioned by label values.
+type counterVec struct {
+	n, help string
+	labels  []string
+
+	mu     sync.Mutex
+	values map[string]*uint64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		n:      name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*uint64),
+		keys:   make(map[string][]string),
+	}
+	register(c)
+	return c
+}
+
+func (c *counterVec) name() string { return c.n }
+
+// with returns the counter for the label values, which must match the label
+// names in number.
+func (c *counterVec) with(values ...string) *uint64 {
+	values = metricLabels.filter(c.labels, values)
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+
+	if !ok {
+		v = new(uint64)
+		c.values[key] = v
+		c.keys[key] = append([]string(nil), values...)
+	}
+
+	return v
+}
+
+func (c *counterVec) add(n uint64, values ...string) {
+	atomic.AddUint64(c.with(values...), n)
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+// sums returns the value of each series by its label set, adding together
+// series whose labels are no longer told apart.
+func (c *counterVec) sums() (map[string]uint64, []string) {
+	sums := make(map[string]uint64, len(c.values))
+
+	for key, v := range c.values {
+		names, values := metricLabels.labels(c.labels, c.keys[key])
+		sums[labelSet(names, values)] += atomic.LoadUint64(v)
+	}
+
+	sets := make([]string, 0, len(sums))
+
+	for set := range sums {
+		sets = append(sets, set)
+	}
+
+	sort.Strings(sets)
+	return sums, sets
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.n, c.help, c.n)
+
+	sums, sets := c.sums()
+
+	for _, set := range sets {
+		fmt.Fprintf(w, "%s%s %d\n", c.n, set, sums[set])
+	}
+}
+
+// gaugeVec is a set of gauges partitioned by label values.
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{counterVec{
+		n:      name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*uint64),
+		keys:   make(map[string][]string),
+	}}
+	register(g)
+	return g
+}
+
+// add adjusts the gauge by delta, which may be negative.
+func (g *gaugeVec) add(delta int64, values ...string) {
+	atomic.AddUint64(g.with(values...), uint64(delta))
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.n, g.help, g.n)
+
+	sums, sets := g.sums()
+
+	for _, set := range sets {
+		fmt.Fprintf(w, "%s%s %d\n", g.n, set, int64(sums[set]))
+	}
+}
+
+// histogramVec is a set of histograms partitioned by label values.
+type histogramVec struct {
+	n, help string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+	keys   map[string][]string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newHistogramVec registers a histogram with the upper bounds of buckets, in
+// increasing order.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		n:       name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+		keys:    make(map[string][]string),
+	}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) name() string { return h.n }
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	values = metricLabels.filter(h.labels, values)
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	o, ok := h.values[key]
+
+	if !ok {
+		o = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = o
+		h.keys[key] = append([]string(nil), values...)
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			o.counts[i]++
+			break
+		}
+	}
+
+	o.sum += v
+	o.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.n, h.help, h.n)
+
+	// Series whose labels are no longer told apart are merged.
+	type series struct {
+		names, values []string
+		histogram
+	}
+
+	merged := make(map[string]*series, len(h.values))
+	var sets []string
+
+	for key, o := range h.values {
+		names, values := metricLabels.labels(h.labels, h.keys[key])
+		set := labelSet(names, values)
+		m, ok := merged[set]
+
+		if !ok {
+			m = &series{names: names, values: values}
+			m.counts = make([]uint64, len(h.buckets))
+			merged[set] = m
+			sets = append(sets, set)
+		}
+
+		for i, n := range o.counts {
+			m.counts[i] += n
+		}
+
+		m.sum += o.sum
+		m.count += o.count
+	}
+
+	sort.Strings(sets)
+
+	for _, set := range sets {
+		m := merged[set]
+		names := append(append([]string(nil), m.names...), "le")
+		values := append(append([]string(nil), m.values...), "")
+		var n uint64
+
+		for i, b := range h.buckets {
+			n += m.counts[i]
+			values[len(values)-1] = formatFloat(b)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, labelSet(names, values), n)
+		}
+
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, labelSet(names, values), m.count)
+
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.n, set, formatFloat(m.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.n, set, m.count)
+	}
+}
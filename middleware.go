@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Middleware wraps the handling of requests.
+type Middleware interface {
+	Wrap(h http.Handler) http.Handler
+}
+
+// MiddlewareFunc is a function used as Middleware.
+type MiddlewareFunc func(h http.Handler) http.Handler
+
+// Wrap returns f(h).
+func (f MiddlewareFunc) Wrap(h http.Handler) http.Handler {
+	return f(h)
+}
+
+// stage is a configured middleware in a chain.
+type stage func(h http.Handler) (http.Handler, error)
+
+// defaultRouteMiddleware is the order of the built-in middleware of routes,
+// from the first to see requests to the last.
+var defaultRouteMiddleware = []string{
+	"methods",
+	"waf",
+	"geoip",
+	"acl",
+	"tarpit",
+	"rate_limit",
+	"concurrency",
+	"hmac",
+	"api_key",
+	"exec_hook",
+	"forward_auth",
+	"oidc",
+	"jwt",
+	"basic_auth",
+	"client_cert",
+	"plugins",
+	"wasm",
+	"rules",
+	"compress",
+	"cache",
+}
+
+var middlewares = struct {
+	mu sync.RWMutex
+	m  map[string]Middleware
+}{m: make(map[string]Middleware)}
+
+// RegisterMiddleware makes middleware available by name to the Middleware
+// lists of routes and proxies. It panics if the name is empty, a built-in, or
+// already registered.
+func RegisterMiddleware(name string, m Middleware) {
+	middlewares.mu.Lock()
+	defer middlewares.mu.Unlock()
+
+	if name == "" || m == nil {
+		panic("proxy: RegisterMiddleware with empty name or nil middleware")
+	}
+
+	for _, b := range defaultRouteMiddleware {
+		if name == b {
+			panic("proxy: RegisterMiddleware of built-in " + name)
+		}
+	}
+
+	if _, ok := middlewares.m[name]; ok {
+		panic("proxy: RegisterMiddleware called twice for " + name)
+	}
+
+	middlewares.m[name] = m
+}
+
+func registered(name string) (Middleware, bool) {
+	middlewares.mu.RLock()
+	defer middlewares.mu.RUnlock()
+
+	m, ok := middlewares.m[name]
+	return m, ok
+}
+
+// chain wraps h by the named middleware, the first seeing requests first.
+// Names are of built-in stages, which are skipped unless configured, or of
+// registered middleware. If names is empty, defaults is used. Configured
+// stages must all be named.
+func chain(h http.Handler, names, defaults []string, stages map[string]stage) (http.Handler, error) {
+	if len(names) == 0 {
+		names = defaults
+	}
+
+	used := make(map[string]bool)
+
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+
+		if used[name] {
+			return nil, errors.New("proxy: middleware " + name +
+				" listed twice")
+		}
+
+		used[name] = true
+
+		if st, ok := stages[name]; ok {
+			var err error
+
+			if h, err = st(h); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if m, ok := registered(name); ok {
+			h = m.Wrap(h)
+			continue
+		}
+
+		builtin := false
+
+		for _, b := range defaults {
+			builtin = builtin || b == name
+		}
+
+		if !builtin {
+			return nil, errors.New("proxy: unknown middleware " + name)
+		}
+	}
+
+	for name := range stages {
+		if !used[name] {
+			return nil, errors.New("proxy: middleware omits configured " +
+				name)
+		}
+	}
+
+	return h, nil
+}
+
+// wrapStage returns a stage wrapping handlers by with.
+func wrapStage(with func(h http.Handler) http.Handler) stage {
+	return func(h http.Handler) (http.Handler, error) {
+		return with(h), nil
+	}
+}
+
+// routeStages returns the configured built-in middleware of route.
+func routeStages(s *scope, route Route) (map[string]stage, error) {
+	stages := make(map[string]stage)
+
+	if route.Cache != nil {
+		c, err := newResponseCache(s, route.Cache, route.From)
+
+		if err != nil {
+			return nil, err
+		}
+
+		caches.add(s, c)
+		stages["cache"] = wrapStage(func(h http.Handler) http.Handler {
+			return withCache(c, h)
+		})
+	}
+
+	if route.Compress != nil {
+		cp, err := newCompressor(route.Compress)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["compress"] = wrapStage(func(h http.Handler) http.Handler {
+			return withCompress(cp, h)
+		})
+	}
+
+	if len(route.Rules) != 0 {
+		rules, err := newRules(route.Rules)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["rules"] = wrapStage(func(h http.Handler) http.Handler {
+			return withRules(rules, h)
+		})
+	}
+
+	if len(route.WASM) != 0 {
+		filters := make([]*wasmFilter, len(route.WASM))
+
+		for i := range route.WASM {
+			f, err := newWASMFilter(&route.WASM[i])
+
+			if err != nil {
+				return nil, err
+			}
+
+			filters[i] = f
+		}
+
+		stages["wasm"] = wrapStage(func(h http.Handler) http.Handler {
+			for i := len(filters) - 1; i >= 0; i-- {
+				h = withWASM(filters[i], h)
+			}
+
+			return h
+		})
+	}
+
+	if len(route.Plugins) != 0 {
+		stages["plugins"] = func(h http.Handler) (http.Handler, error) {
+			return withPlugins(route.Plugins, h)
+		}
+	}
+
+	if route.ClientCert != nil {
+		stages["client_cert"] = wrapStage(func(h http.Handler) http.Handler {
+			return withClientCert(route.ClientCert, h)
+		})
+	}
+
+	if route.BasicAuth != nil {
+		a, err := newBasicAuth(route.BasicAuth)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["basic_auth"] = wrapStage(func(h http.Handler) http.Handler {
+			return withBasicAuth(a, h)
+		})
+	}
+
+	if route.JWT != nil {
+		a, err := newJWTAuth(route.JWT)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["jwt"] = wrapStage(func(h http.Handler) http.Handler {
+			return withJWT(a, h)
+		})
+	}
+
+	if route.OIDC != nil {
+		a, err := newOIDCAuth(route.OIDC)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["oidc"] = wrapStage(func(h http.Handler) http.Handler {
+			return withOIDC(a, h)
+		})
+	}
+
+	if route.ForwardAuth != nil {
+		a, err := newForwardAuth(route.ForwardAuth)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["forward_auth"] = wrapStage(func(h http.Handler) http.Handler {
+			return withForwardAuth(a, h)
+		})
+	}
+
+	if route.ExecHook != nil {
+		e, err := newExecHook(route.ExecHook)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["exec_hook"] = wrapStage(func(h http.Handler) http.Handler {
+			return withExecHook(e, h)
+		})
+	}
+
+	if route.APIKey != nil {
+		a, err := newAPIKeyAuth(s, route.APIKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["api_key"] = wrapStage(func(h http.Handler) http.Handler {
+			return withAPIKey(a, h)
+		})
+	}
+
+	if route.HMAC != nil {
+		v, err := newHMACVerifier(route.HMAC)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["hmac"] = wrapStage(func(h http.Handler) http.Handler {
+			return withHMAC(v, h)
+		})
+	}
+
+	if route.Concurrency != nil {
+		sem, err := newSemaphore(route.Concurrency)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["concurrency"] = wrapStage(func(h http.Handler) http.Handler {
+			return withConcurrency(sem, h)
+		})
+	}
+
+	if route.RateLimit != nil {
+		l, err := newLimiter(s, route.RateLimit, route.From)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["rate_limit"] = wrapStage(func(h http.Handler) http.Handler {
+			return withRateLimit(l, h)
+		})
+	}
+
+	if route.Tarpit != nil {
+		t, err := newTarpit(route.Tarpit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["tarpit"] = wrapStage(func(h http.Handler) http.Handler {
+			return withTarpit(t, h)
+		})
+	}
+
+	if route.ACL != nil {
+		a, err := newACL(route.ACL)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["acl"] = wrapStage(func(h http.Handler) http.Handler {
+			return withACL(a, h)
+		})
+	}
+
+	if route.GeoIP != nil {
+		g, err := newGeoIP(route.GeoIP)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["geoip"] = wrapStage(func(h http.Handler) http.Handler {
+			return withGeoIP(g, h)
+		})
+	}
+
+	if route.WAF != nil {
+		w, err := newWAF(route.WAF, route.From)
+
+		if err != nil {
+			return nil, err
+		}
+
+		stages["waf"] = wrapStage(func(h http.Handler) http.Handler {
+			return withWAF(w, h)
+		})
+	}
+
+	if len(route.Methods) != 0 {
+		stages["methods"] = wrapStage(func(h http.Handler) http.Handler {
+			return withMethods(route.Methods, h)
+		})
+	}
+
+	return stages, nil
+}
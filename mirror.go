@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var mirrored = newCounterVec("http_proxy_mirror_requests_total",
+	"Requests considered for mirroring, by result.", "route", "result")
+
+// Mirror describes copying requests to a second backend, such as to test a new
+// version with real traffic. Its responses are discarded.
+type Mirror struct {
+	// To is the HTTP URL of the mirror backend, joined to request paths
+	// like the To of routes.
+	To string `json:"to"`
+
+	// Percent is optional. It is the share of requests, from 0 to 100,
+	// which are copied, defaulting to 100.
+	Percent float64 `json:"percent"`
+
+	// MaxBodyBytes is optional. Requests with larger bodies are not
+	// copied, defaulting to 64 KiB. Bodies are buffered to be copied.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+
+	// Timeout is optional. It limits each copied request, defaulting to
+	// 10s.
+	Timeout Duration `json:"timeout"`
+}
+
+const (
+	defaultMirrorMaxBody = 64 << 10
+	defaultMirrorTimeout = 10 * time.Second
+
+	// maxMirrorInFlight bounds the copies in flight for each route, beyond
+	// which requests are not copied.
+	maxMirrorInFlight = 64
+)
+
+type mirror struct {
+	s       *scope
+	to      *url.URL
+	route   string
+	percent float64
+	maxBody int64
+	timeout time.Duration
+	client  *http.Client
+	slots   chan struct{}
+}
+
+func newMirror(s *scope, c *Mirror, route string, transport http.RoundTripper) (*mirror, error) {
+	to, err := url.Parse(c.To)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if to.Scheme != "http" && to.Scheme != "https" || to.Host == "" {
+		return nil, errors.New("proxy: invalid mirror to " + c.To)
+	}
+
+	if c.Percent < 0 || c.Percent > 100 {
+		return nil, errors.New("proxy: mirror percent out of range")
+	}
+
+	if c.MaxBodyBytes < 0 || c.Timeout < 0 {
+		return nil, errors.New("proxy: negative mirror setting")
+	}
+
+	m := &mirror{
+		s:       s,
+		to:      to,
+		route:   route,
+		percent: c.Percent,
+		maxBody: c.MaxBodyBytes,
+		timeout: time.Duration(c.Timeout),
+		client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		slots: make(chan struct{}, maxMirrorInFlight),
+	}
+
+	if m.percent == 0 {
+		m.percent = 100
+	}
+
+	if m.maxBody == 0 {
+		m.maxBody = defaultMirrorMaxBody
+	}
+
+	if m.timeout == 0 {
+		m.timeout = defaultMirrorTimeout
+	}
+
+	return m, nil
+}
+
+// body buffers the body of req to be copied, leaving req readable as before,
+// and reports false if it is too large.
+func (m *mirror) body(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	if req.ContentLength > m.maxBody {
+		return nil, false, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(req.Body, m.maxBody+1))
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	rest := req.Body
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), rest), rest}
+
+	return b, int64(len(b)) <= m.maxBody, nil
+}
+
+// send copies req with body to the mirror backend, in the background.
+func (m *mirror) send(req *http.Request, body []byte) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrored.inc(m.route, "dropped")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(m.s.ctx, m.timeout)
+	out := req.Clone(ctx)
+	out.RequestURI = ""
+	out.URL.Scheme = m.to.Scheme
+	out.URL.Host = m.to.Host
+	out.URL.Path, out.URL.RawPath = joinURLPath(m.to, req.URL)
+	out.Host = m.to.Host
+	out.Trailer = nil
+
+	for _, k := range hopHeaders {
+		out.Header.Del(k)
+	}
+
+	out.Body, out.ContentLength = http.NoBody, 0
+
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+
+	m.s.run(func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+
+		resp, err := m.client.Do(out)
+
+		if err != nil {
+			mirrored.inc(m.route, "error")
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		mirrored.inc(m.route, "sent")
+	})
+}
+
+// withMirror copies a share of requests to the mirror backend.
+func withMirror(m *mirror, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if m.percent < 100 && rand.Float64()*100 >= m.percent {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		body, ok, err := m.body(req)
+
+		switch {
+		case err != nil:
+			mirrored.inc(m.route, "error")
+		case !ok:
+			mirrored.inc(m.route, "too_large")
+		default:
+			m.send(req, body)
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
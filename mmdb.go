@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+)
+
+var (
+	errMMDBInvalid = errors.New("proxy: invalid MaxMind database")
+	mmdbMarker     = []byte("\xab\xcd\xefMaxMind.com")
+)
+
+// mmdb is a reader of MaxMind DB files.
+type mmdb struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func openMMDB(name string) (*mmdb, error) {
+	buf, err := os.ReadFile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMarker)
+
+	if i < 0 {
+		return nil, errMMDBInvalid
+	}
+
+	meta := buf[i+len(mmdbMarker):]
+	v, _, err := mmdbDecode(meta, 0, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := v.(map[string]interface{})
+
+	if !ok {
+		return nil, errMMDBInvalid
+	}
+
+	db := &mmdb{buf: buf}
+	db.nodeCount, _ = mmdbUint(m["node_count"])
+	db.recordSize, _ = mmdbUint(m["record_size"])
+	db.ipVersion, _ = mmdbUint(m["ip_version"])
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, errMMDBInvalid
+	}
+
+	treeSize := db.recordSize / 4 * db.nodeCount
+
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBInvalid
+	}
+
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+
+		for j := 0; j < 96 && node < db.nodeCount; j++ {
+			node = db.record(node, 0)
+		}
+
+		db.ipv4Start = node
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	size := db.recordSize / 4
+	b := db.buf[node*size : (node+1)*size]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 |
+				uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 |
+			uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil if there is none.
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < 8*len(ip) && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	v, _, err := mmdbDecode(db.data, node-db.nodeCount-16, 0)
+	return v, err
+}
+
+// mmdbDecode decodes the field of buf at off, returning the offset after it.
+func mmdbDecode(buf []byte, off uint, depth int) (interface{}, uint, error) {
+	if depth > 32 || off >= uint(len(buf)) {
+		return nil, 0, errMMDBInvalid
+	}
+
+	ctrl := buf[off]
+	off++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 {
+		n := uint(ctrl>>3) & 3
+
+		if off+n+1 > uint(len(buf)) {
+			return nil, 0, errMMDBInvalid
+		}
+
+		var p uint
+
+		if n != 3 {
+			p = uint(ctrl & 7)
+		}
+
+		for _, c := range buf[off : off+n+1] {
+			p = p<<8 | uint(c)
+		}
+
+		p += [...]uint{0, 2048, 526336, 0}[n]
+		v, _, err := mmdbDecode(buf, p, depth+1)
+		return v, off + n + 1, err
+	}
+
+	if typ == 0 {
+		if off >= uint(len(buf)) {
+			return nil, 0, errMMDBInvalid
+		}
+
+		typ = 7 + uint(buf[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+
+	if size >= 29 {
+		n := size - 28
+
+		if off+n > uint(len(buf)) {
+			return nil, 0, errMMDBInvalid
+		}
+
+		var ext uint
+
+		for _, c := range buf[off : off+n] {
+			ext = ext<<8 | uint(c)
+		}
+
+		size = [...]uint{29, 285, 65821}[n-1] + ext
+		off += n
+	}
+
+	switch typ {
+	case 7:
+		m := make(map[string]interface{}, size)
+
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecode(buf, off, depth+1)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+
+			if !ok {
+				return nil, 0, errMMDBInvalid
+			}
+
+			v, next, err := mmdbDecode(buf, next, depth+1)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			m[key] = v
+			off = next
+		}
+
+		return m, off, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+
+		for i := uint(0); i < size; i++ {
+			v, next, err := mmdbDecode(buf, off, depth+1)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+			off = next
+		}
+
+		return a, off, nil
+	case 14:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(buf)) {
+		return nil, 0, errMMDBInvalid
+	}
+
+	b := buf[off : off+size]
+	off += size
+
+	switch typ {
+	case 2:
+		return string(b), off, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4, 10:
+		return b, off, nil
+	case 5, 6, 9:
+		var u uint64
+
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+
+		return u, off, nil
+	case 8:
+		var u uint32
+
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+
+		return int32(u), off, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errMMDBInvalid
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	default:
+		return nil, 0, errMMDBInvalid
+	}
+}
+
+func mmdbUint(v interface{}) (uint, bool) {
+	u, ok := v.(uint64)
+	return uint(u), ok
+}
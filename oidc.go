@@ -0,0 +1,483 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC describes an OpenID Connect login flow performed by the proxy.
+// Unauthenticated browser requests are redirected to the provider, and once
+// logged in a signed session cookie is set and identity claims are forwarded
+// to the backend as headers.
+type OIDC struct {
+	// Issuer URL, used for discovery through
+	// "/.well-known/openid-configuration".
+	Issuer string `json:"issuer"`
+
+	// ClientID and ClientSecret registered with the provider.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+
+	// RedirectURL is the registered callback URL, which must be routed to
+	// this route, such as "https://app.example.com/oauth2/callback".
+	RedirectURL string `json:"redirect_url"`
+
+	// Scopes is optional, defaulting to "openid", "email", and "profile".
+	Scopes []string `json:"scopes"`
+
+	// CookieSecret signs session cookies. It must be at least 32 bytes.
+	CookieSecret string `json:"cookie_secret"`
+
+	// CookieName is optional, defaulting to "_http_proxy_oidc".
+	CookieName string `json:"cookie_name"`
+
+	// SessionTTL is optional. It is how long a session lasts, defaulting
+	// to 8h.
+	SessionTTL Duration `json:"session_ttl"`
+
+	// Claims is optional. It maps ID token claims to forwarded headers,
+	// defaulting to {"sub": "X-Forwarded-User", "email":
+	// "X-Forwarded-Email"}.
+	Claims map[string]string `json:"claims"`
+}
+
+const (
+	defaultOIDCCookie = "_http_proxy_oidc"
+	defaultSessionTTL = 8 * time.Hour
+	oidcLoginTTL      = 10 * time.Minute
+)
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcAuth struct {
+	c        *OIDC
+	secret   []byte
+	cookie   string
+	scopes   string
+	ttl      time.Duration
+	claims   map[string]string
+	callback string
+	client   *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     *jwks
+	fetching chan struct{}
+	err      error
+}
+
+// oidcLogin is kept in a cookie while the user logs in.
+type oidcLogin struct {
+	State  string `json:"state"`
+	Nonce  string `json:"nonce"`
+	Return string `json:"return"`
+	Exp    int64  `json:"exp"`
+}
+
+// oidcSession is the signed session cookie value.
+type oidcSession struct {
+	Claims map[string]string `json:"claims"`
+	Exp    int64             `json:"exp"`
+}
+
+func newOIDCAuth(c *OIDC) (*oidcAuth, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, errors.New("proxy: oidc requires issuer, client_id, " +
+			"and redirect_url")
+	}
+
+	if len(c.CookieSecret) < 32 {
+		return nil, errors.New("proxy: oidc cookie_secret must be at " +
+			"least 32 bytes")
+	}
+
+	redirect, err := url.Parse(c.RedirectURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a := &oidcAuth{
+		c:        c,
+		secret:   []byte(c.CookieSecret),
+		cookie:   c.CookieName,
+		scopes:   "openid email profile",
+		ttl:      defaultSessionTTL,
+		claims:   c.Claims,
+		callback: redirect.Path,
+		client:   &http.Client{Timeout: jwksFetchTimeout},
+	}
+
+	if a.cookie == "" {
+		a.cookie = defaultOIDCCookie
+	}
+
+	if len(c.Scopes) != 0 {
+		a.scopes = strings.Join(c.Scopes, " ")
+	}
+
+	if c.SessionTTL > 0 {
+		a.ttl = time.Duration(c.SessionTTL)
+	}
+
+	if a.claims == nil {
+		a.claims = map[string]string{
+			"sub":   "X-Forwarded-User",
+			"email": "X-Forwarded-Email",
+		}
+	}
+
+	return a, nil
+}
+
+// discover fetches the provider configuration, retrying on later calls if
+// it fails. Concurrent calls share one fetch, made without the lock held.
+func (a *oidcAuth) discover(req *http.Request) (*oidcProvider, *jwks, error) {
+	a.mu.Lock()
+
+	if a.provider != nil {
+		defer a.mu.Unlock()
+		return a.provider, a.keys, nil
+	}
+
+	done := a.fetching
+
+	if done == nil {
+		done = make(chan struct{})
+		a.fetching = done
+		a.mu.Unlock()
+
+		// The fetch is shared, so it outlives the request starting it.
+		p, err := a.fetch(context.WithoutCancel(req.Context()))
+
+		a.mu.Lock()
+
+		if err == nil {
+			a.provider = p
+			a.keys = newJWKS(p.JWKSURI, 0)
+		}
+
+		a.err = err
+		a.fetching = nil
+		close(done)
+	} else {
+		a.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-req.Context().Done():
+			return nil, nil, req.Context().Err()
+		}
+
+		a.mu.Lock()
+	}
+
+	defer a.mu.Unlock()
+
+	if a.provider == nil {
+		return nil, nil, a.err
+	}
+
+	return a.provider, a.keys, nil
+}
+
+func (a *oidcAuth) fetch(ctx context.Context) (*oidcProvider, error) {
+	u := strings.TrimSuffix(a.c.Issuer, "/") +
+		"/.well-known/openid-configuration"
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Do(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy: oidc discovery: %s", resp.Status)
+	}
+
+	var p oidcProvider
+
+	if err = json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *oidcAuth) sign(v interface{}) string {
+	b, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+
+	return payload + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *oidcAuth) verify(value string, v interface{}) bool {
+	i := strings.LastIndexByte(value, '.')
+
+	if i < 0 {
+		return false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(value[:i]))
+
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(value[:i])
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+func (a *oidcAuth) setCookie(w http.ResponseWriter, req *http.Request, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *oidcAuth) session(req *http.Request) (*oidcSession, bool) {
+	c, err := req.Cookie(a.cookie)
+
+	if err != nil {
+		return nil, false
+	}
+
+	var s oidcSession
+
+	if !a.verify(c.Value, &s) || time.Now().Unix() > s.Exp {
+		return nil, false
+	}
+
+	return &s, true
+}
+
+// login redirects the browser to the provider.
+func (a *oidcAuth) login(w http.ResponseWriter, req *http.Request) {
+	p, _, err := a.discover(req)
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway),
+			http.StatusBadGateway)
+		return
+	}
+
+	l := oidcLogin{
+		State:  randomString(),
+		Nonce:  randomString(),
+		Return: req.URL.RequestURI(),
+		Exp:    time.Now().Add(oidcLoginTTL).Unix(),
+	}
+
+	a.setCookie(w, req, a.cookie+"_login", a.sign(l), oidcLoginTTL)
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.c.ClientID},
+		"redirect_uri":  {a.c.RedirectURL},
+		"scope":         {a.scopes},
+		"state":         {l.State},
+		"nonce":         {l.Nonce},
+	}
+
+	sep := "?"
+
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	http.Redirect(w, req, p.AuthorizationEndpoint+sep+q.Encode(),
+		http.StatusFound)
+}
+
+// finish handles the provider's redirect back to the callback.
+func (a *oidcAuth) finish(w http.ResponseWriter, req *http.Request) {
+	var l oidcLogin
+
+	c, err := req.Cookie(a.cookie + "_login")
+
+	if err != nil || !a.verify(c.Value, &l) || time.Now().Unix() > l.Exp ||
+		req.URL.Query().Get("state") != l.State {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	code := req.URL.Query().Get("code")
+
+	if code == "" {
+		http.Error(w, "login failed: "+req.URL.Query().Get("error"),
+			http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := a.exchange(req, code, l.Nonce)
+
+	if err != nil {
+		strike(req, "oidc")
+		http.Error(w, http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	}
+
+	s := oidcSession{
+		Claims: make(map[string]string),
+		Exp:    time.Now().Add(a.ttl).Unix(),
+	}
+
+	for claim := range a.claims {
+		if v, ok := claims[claim]; ok {
+			s.Claims[claim] = claimString(v)
+		}
+	}
+
+	a.setCookie(w, req, a.cookie+"_login", "", -1)
+	a.setCookie(w, req, a.cookie, a.sign(s), a.ttl)
+
+	ret := l.Return
+
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") {
+		ret = "/"
+	}
+
+	http.Redirect(w, req, ret, http.StatusFound)
+}
+
+// exchange redeems the authorization code and validates the ID token.
+func (a *oidcAuth) exchange(req *http.Request, code, nonce string) (map[string]interface{}, error) {
+	p, keys, err := a.discover(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {a.c.RedirectURL},
+	}
+
+	r, err := http.NewRequestWithContext(req.Context(), http.MethodPost,
+		p.TokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(url.QueryEscape(a.c.ClientID),
+		url.QueryEscape(a.c.ClientSecret))
+
+	resp, err := a.client.Do(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy: oidc token: %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	claims, err := verifyJWT(req.Context(), keys, tokens.IDToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkClaims(claims, a.c.Issuer, a.c.ClientID, 0, false); err != nil {
+		return nil, err
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, errInvalidToken
+	}
+
+	return claims, nil
+}
+
+// withOIDC requires a session, redirecting browsers to log in and rejecting
+// other requests with 401 Unauthorized.
+func withOIDC(a *oidcAuth, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == a.callback {
+			a.finish(w, req)
+			return
+		}
+
+		s, ok := a.session(req)
+
+		if !ok {
+			if req.Method == http.MethodGet &&
+				strings.Contains(req.Header.Get("Accept"), "text/html") {
+				a.login(w, req)
+				return
+			}
+
+			http.Error(w, http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		}
+
+		for claim, header := range a.claims {
+			req.Header.Del(header)
+
+			if v, ok := s.Claims[claim]; ok {
+				req.Header.Set(header, v)
+			}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// oidcTestProvider is a fake provider issuing ID tokens with nonce for the
+// code "good".
+type oidcTestProvider struct {
+	srv   *httptest.Server
+	keys  *jwtTestKeys
+	nonce string
+}
+
+func newOIDCTestProvider(t *testing.T) *oidcTestProvider {
+	p := &oidcTestProvider{keys: newJWTTestKeys(t)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": p.srv.URL + "/authorize",
+			"token_endpoint":         p.srv.URL + "/token",
+			"jwks_uri":               p.srv.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		w.Write(p.keys.jwks())
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+
+		if id != "client" || secret != "secret" ||
+			req.PostFormValue("code") != "good" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+
+		token := p.keys.sign(t, "RS256", "rsa", map[string]interface{}{
+			"iss":   p.srv.URL,
+			"aud":   "client",
+			"exp":   float64(time.Now().Add(time.Minute).Unix()),
+			"nonce": p.nonce,
+			"sub":   "alice",
+			"email": "alice@example.com",
+		})
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": token})
+	})
+
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func TestOIDC(t *testing.T) {
+	p := newOIDCTestProvider(t)
+	a, err := newOIDCAuth(&OIDC{
+		Issuer:       p.srv.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/oauth2/callback",
+		CookieSecret: strings.Repeat("k", 32),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var user string
+	h := withOIDC(a, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user = req.Header.Get("X-Forwarded-User")
+	}))
+
+	do := func(target string, cookies []*http.Cookie, html bool) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Forwarded-User", "spoofed")
+
+		if html {
+			req.Header.Set("Accept", "text/html")
+		}
+
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// Other than browsers are refused.
+	if resp := do("/app", nil, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without a session: status %d", resp.StatusCode)
+	}
+
+	resp := do("/app?x=1", nil, true)
+	loc, err := url.Parse(resp.Header.Get("Location"))
+
+	if err != nil || resp.StatusCode != http.StatusFound ||
+		loc.Path != "/authorize" {
+		t.Fatalf("login: status %d, location %v", resp.StatusCode, loc)
+	}
+
+	q := loc.Query()
+	login := resp.Cookies()
+
+	if q.Get("client_id") != "client" || q.Get("state") == "" ||
+		q.Get("redirect_uri") != "https://app.example.com/oauth2/callback" {
+		t.Fatalf("authorization request %v", q)
+	}
+
+	callback := "/oauth2/callback?code=good&state=" + url.QueryEscape(q.Get("state"))
+
+	// The state and nonce must match those of the login.
+	if resp := do("/oauth2/callback?code=good&state=other", login, true); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong state: status %d", resp.StatusCode)
+	}
+
+	p.nonce = "other"
+
+	if resp := do(callback, login, true); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong nonce: status %d", resp.StatusCode)
+	}
+
+	p.nonce = q.Get("nonce")
+
+	if resp := do(strings.Replace(callback, "good", "bad", 1), login, true); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad code: status %d", resp.StatusCode)
+	}
+
+	resp = do(callback, login, true)
+
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/app?x=1" {
+		t.Fatalf("callback: status %d, location %q", resp.StatusCode,
+			resp.Header.Get("Location"))
+	}
+
+	var session []*http.Cookie
+
+	for _, c := range resp.Cookies() {
+		if c.Name == defaultOIDCCookie && c.Value != "" {
+			session = append(session, c)
+		}
+	}
+
+	if len(session) != 1 {
+		t.Fatalf("callback set cookies %v", resp.Cookies())
+	}
+
+	if resp := do("/app", session, false); resp.StatusCode != http.StatusOK || user != "alice" {
+		t.Errorf("with a session: status %d, user %q", resp.StatusCode, user)
+	}
+
+	// Tampered sessions are refused.
+	forged := *session[0]
+	payload := a.sign(oidcSession{Claims: map[string]string{"sub": "mallory"},
+		Exp: time.Now().Add(time.Hour).Unix()})
+	forged.Value = payload[:strings.IndexByte(payload, '.')] +
+		forged.Value[strings.LastIndexByte(forged.Value, '.'):]
+
+	if resp := do("/app", []*http.Cookie{&forged}, false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged session: status %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCDiscover(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": "http://jwks"})
+	}))
+	defer srv.Close()
+
+	a, err := newOIDCAuth(&OIDC{
+		Issuer:       srv.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/oauth2/callback",
+		CookieSecret: strings.Repeat("k", 32),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first caller gives up, but the fetch it started goes on.
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	errs := make(chan error, 4)
+
+	go func() {
+		_, _, err := a.discover(req)
+		errs <- err
+	}()
+
+	for atomic.LoadInt32(&fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := a.discover(httptest.NewRequest(http.MethodGet, "/", nil))
+			errs <- err
+		}()
+	}
+
+	// A waiter whose request is canceled returns without the fetch.
+	waiter, stop := context.WithCancel(context.Background())
+	stop()
+
+	if _, _, err := a.discover(req.WithContext(waiter)); err != context.Canceled {
+		t.Errorf("canceled waiter: %v", err)
+	}
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("discover: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%d discovery fetches, want 1", n)
+	}
+
+	if a.provider == nil || a.provider.JWKSURI != "http://jwks" {
+		t.Errorf("provider %+v", a.provider)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"plugin"
+	"sort"
+)
+
+// Plugin is middleware loaded from a Go plugin, built with "go build
+// -buildmode=plugin". The plugin exports it as the symbol Middleware, either
+// a value implementing Plugin or a variable of type Plugin.
+type Plugin interface {
+	// Name identifies the middleware in errors.
+	Name() string
+
+	// Order positions the middleware among the plugins of a route: lower
+	// orders see requests first.
+	Order() int
+
+	// Wrap returns h wrapped by the middleware, configured by the raw JSON
+	// config of the route.
+	Wrap(config json.RawMessage, h http.Handler) (http.Handler, error)
+}
+
+// PluginConfig describes Go plugin middleware used by a route.
+type PluginConfig struct {
+	// Path is the plugin .so file.
+	Path string `json:"path"`
+
+	// Config is optional. It is passed to the middleware unparsed.
+	Config json.RawMessage `json:"config"`
+}
+
+func loadPlugin(path string) (Plugin, error) {
+	p, err := plugin.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sym, err := p.Lookup("Middleware")
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch m := sym.(type) {
+	case Plugin:
+		return m, nil
+	case *Plugin:
+		if *m != nil {
+			return *m, nil
+		}
+	}
+
+	return nil, errors.New("proxy: plugin " + path +
+		" Middleware does not implement Plugin")
+}
+
+// withPlugins wraps h by the plugin middleware, by order.
+func withPlugins(c []PluginConfig, h http.Handler) (http.Handler, error) {
+	type loaded struct {
+		p      Plugin
+		config json.RawMessage
+	}
+
+	plugins := make([]loaded, len(c))
+
+	for i, pc := range c {
+		p, err := loadPlugin(pc.Path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		plugins[i] = loaded{p, pc.Config}
+	}
+
+	sort.SliceStable(plugins, func(i, j int) bool {
+		return plugins[i].p.Order() < plugins[j].p.Order()
+	})
+
+	for i := len(plugins) - 1; i >= 0; i-- {
+		l := plugins[i]
+		wrapped, err := l.p.Wrap(l.config, h)
+
+		if err != nil {
+			return nil, errors.New("proxy: plugin " + l.p.Name() + ": " +
+				err.Error())
+		}
+
+		h = wrapped
+	}
+
+	return h, nil
+}
@@ -4,6 +4,8 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -15,11 +17,289 @@ import (
 // Route describes the reverse proxy route: redirecting from From to To.
 type Route struct {
 	// From must be a path or hostname+path, such as "/index", or
-	// "abc.example.com/", or "abc.example.com/xyz/".
+	// "abc.example.com/", or "abc.example.com/xyz/". In JSON, it may be a
+	// list of patterns, of which the rest are Aliases.
 	From string `json:"from"`
 
-	// To is an HTTP URL including the protocol scheme.
+	// Aliases is optional. They are further patterns served by the route,
+	// sharing its backends, state and metrics, which are labeled by From.
+	Aliases []string `json:"aliases"`
+
+	// RawURI is optional. If true, the path of requests is sent to
+	// backends exactly as the client sent it, joined to the path of To,
+	// rather than normalized. Changes to the path by middleware are then
+	// ignored.
+	RawURI bool `json:"raw_uri"`
+
+	// ExpectContinue is optional. It is how "Expect: 100-continue" is
+	// handled: "pass", the default, sends it on, waiting up to
+	// Transport.ExpectContinueTimeout for the backend to answer, or
+	// "local" answers the client itself and sends the body at once, for
+	// backends which hang on it.
+	ExpectContinue string `json:"expect_continue"`
+
+	// Host is optional. If specified, it is the Host header sent to
+	// backends, such as a name they serve as a virtual host, rather than
+	// the host of the backend. It does not change the TLS server name.
+	Host string `json:"host"`
+
+	// Query is optional. It describes changes to the query of requests.
+	Query *QueryRewrite `json:"query"`
+
+	// TrailingSlash is optional. It is how requests for patterns ending in
+	// a slash, such as "/api/", are handled without the slash: "redirect",
+	// the default, to the pattern, "rewrite" to add the slash before
+	// proxying, or "same" to proxy them unchanged.
+	TrailingSlash string `json:"trailing_slash"`
+
+	// To is an HTTP URL including the protocol scheme. If the scheme is
+	// "http+srv" or "https+srv", the host is a DNS SRV name, such as
+	// "http+srv://_api._tcp.example.com", and requests are balanced across
+	// its targets.
 	To string `json:"to"`
+
+	// SRVInterval is optional. It is how often SRV names in To are
+	// re-resolved, defaulting to 30s.
+	SRVInterval Duration `json:"srv_interval"`
+
+	// ProxyProtocol is optional. If 1 or 2, a PROXY protocol header of
+	// that version is sent on each upstream connection, carrying the
+	// original client address. Upstream keep-alives are disabled since
+	// each connection belongs to a single client.
+	ProxyProtocol int `json:"proxy_protocol"`
+
+	// UpstreamProxy is optional. It is the URL of an HTTP proxy through
+	// which backend connections are made, such as
+	// "http://proxy.example.com:3128". If empty, the HTTP_PROXY,
+	// HTTPS_PROXY, and NO_PROXY environment variables are used. "direct"
+	// disables proxying for the route.
+	UpstreamProxy string `json:"upstream_proxy"`
+
+	// SOCKS5 is optional. If specified, backends are dialed through the
+	// SOCKS5 proxy and UpstreamProxy is ignored.
+	SOCKS5 *SOCKS5 `json:"socks5"`
+
+	// DNS is optional. It configures how backend hostnames are resolved.
+	DNS *DNS `json:"dns"`
+
+	// Transport is optional. It tunes the connections made to backends,
+	// defaulting to that of the proxy.
+	Transport *Transport `json:"transport"`
+
+	// RoundTripper is ignored when parsing JSON. If specified, it sends
+	// requests to backends, instead of a transport built from DNS, SOCKS5,
+	// UpstreamProxy, ProxyProtocol and Transport. It defaults to that of
+	// the proxy.
+	RoundTripper http.RoundTripper `json:"-"`
+
+	// Consul is optional. If specified, requests are balanced across the
+	// healthy instances of the Consul service, replacing the host of To.
+	Consul *Consul `json:"consul"`
+
+	// Kubernetes is optional. If specified, requests are balanced across
+	// the ready endpoints of the Kubernetes service, replacing the host of
+	// To.
+	Kubernetes *Kubernetes `json:"kubernetes"`
+
+	// RateLimit is optional. If specified, requests beyond the limit are
+	// rejected with 429 Too Many Requests.
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	// Concurrency is optional. It limits the requests in flight to the
+	// route.
+	Concurrency *Concurrency `json:"concurrency"`
+
+	// Tarpit is optional. If specified, clients exceeding its per-client
+	// rate are answered very slowly.
+	Tarpit *Tarpit `json:"tarpit"`
+
+	// BasicAuth is optional. If specified, requests must carry valid
+	// credentials from its htpasswd file.
+	BasicAuth *BasicAuth `json:"basic_auth"`
+
+	// JWT is optional. If specified, requests must carry a valid bearer
+	// token.
+	JWT *JWT `json:"jwt"`
+
+	// OIDC is optional. If specified, users must log in with the OpenID
+	// Connect provider.
+	OIDC *OIDC `json:"oidc"`
+
+	// ForwardAuth is optional. If specified, an external service
+	// authorizes each request.
+	ForwardAuth *ForwardAuth `json:"forward_auth"`
+
+	// ExecHook is optional. If specified, an external program allows or
+	// denies each request.
+	ExecHook *ExecHook `json:"exec_hook"`
+
+	// APIKey is optional. If specified, requests must carry a valid API
+	// key.
+	APIKey *APIKey `json:"api_key"`
+
+	// HMAC is optional. If specified, requests must carry a valid HMAC
+	// signature.
+	HMAC *HMAC `json:"hmac"`
+
+	// ClientCert is optional. If specified, details of the verified client
+	// certificate are forwarded to the backend.
+	ClientCert *ClientCert `json:"client_cert"`
+
+	// ACL is optional. It restricts which client IP addresses may use the
+	// route.
+	ACL *ACL `json:"acl"`
+
+	// GeoIP is optional. It restricts which countries clients may use the
+	// route from.
+	GeoIP *GeoIP `json:"geoip"`
+
+	// Methods is optional. If specified, requests with other methods are
+	// rejected with 405 Method Not Allowed.
+	Methods []string `json:"methods"`
+
+	// WAF is optional. If specified, requests are inspected by a web
+	// application firewall.
+	WAF *WAF `json:"waf"`
+
+	// Cache is optional. If specified, cacheable responses are cached.
+	Cache *Cache `json:"cache"`
+
+	// Compress is optional. If specified, responses are compressed for
+	// clients which accept it.
+	Compress *Compress `json:"compress"`
+
+	// Decompress is optional. If true, gzip-encoded backend responses are
+	// decompressed before caching and compression, and backends are asked
+	// for gzip regardless of what the client accepts. MaxResponseBytes
+	// then limits bodies both before and after decompression, defaulting
+	// to 64 MiB after.
+	Decompress bool `json:"decompress"`
+
+	// Rules is optional. They conditionally change, deny or redirect
+	// requests.
+	Rules []Rule `json:"rules"`
+
+	// WASM is optional. It lists WebAssembly filters for the route, which
+	// see requests after authentication, in order.
+	WASM []WASM `json:"wasm"`
+
+	// Plugins is optional. It lists Go plugin middleware for the route,
+	// which sees requests after authentication.
+	Plugins []PluginConfig `json:"plugins"`
+
+	// Middleware is optional. It orders the middleware of the route, from
+	// the first to see requests to the last, by the names of built-ins
+	// and of middleware passed to RegisterMiddleware. Built-ins are named
+	// by their fields such as "basic_auth", and all those configured must
+	// be listed. It defaults to the built-ins in the order "methods",
+	// "waf", "geoip", "acl", "tarpit", "rate_limit", "concurrency",
+	// "hmac", "api_key", "exec_hook", "forward_auth", "oidc", "jwt",
+	// "basic_auth", "client_cert", "plugins", "wasm", "rules", "compress",
+	// "cache".
+	Middleware []string `json:"middleware"`
+
+	// Use is ignored when parsing JSON. It is middleware which sees
+	// requests before all other middleware of the route, in order.
+	Use []Middleware `json:"-"`
+
+	// Director is ignored when parsing JSON. If specified, it is called
+	// with each outgoing request once it is addressed to the backend, and
+	// may change it further.
+	Director func(req *http.Request) `json:"-"`
+
+	// Response is optional. It rewrites the status and headers of backend
+	// responses.
+	Response *ResponseRewrite `json:"response"`
+
+	// ModifyResponse is ignored when parsing JSON. If specified, it is
+	// called with each backend response, after Response is applied and
+	// before Filters. An error fails the request with 502 Bad Gateway.
+	ModifyResponse func(resp *http.Response) error `json:"-"`
+
+	// Filters is ignored when parsing JSON. They transform backend
+	// response bodies, in order.
+	Filters []ResponseFilter `json:"-"`
+
+	// Balance is optional. It is how requests are spread across the
+	// backends of SRV names, Consul or Kubernetes: "random", the default,
+	// by weight, or "ip_hash" to send each client IP address to the same
+	// backend while it remains, without cookies. Both favor weightier
+	// backends.
+	Balance string `json:"balance"`
+
+	// Mirror is optional. If specified, requests are also copied to a
+	// mirror backend, whose responses are discarded.
+	Mirror *Mirror `json:"mirror"`
+
+	// Canary is optional. If specified, some requests are sent to a canary
+	// backend instead.
+	Canary *Canary `json:"canary"`
+
+	// Backups is optional. They are backend addresses, such as
+	// "10.0.0.2:8080", which receive requests only while every other
+	// backend, of To or those discovered, is down. Backends are down for
+	// BackupCooldown after requests to them fail.
+	Backups []string `json:"backups"`
+
+	// BackupCooldown is optional, defaulting to 10s.
+	BackupCooldown Duration `json:"backup_cooldown"`
+
+	// SlowStart is optional. If positive, backends which join the route's
+	// pool, such as when they recover, receive a growing share of requests
+	// over this long rather than their full share at once.
+	SlowStart Duration `json:"slow_start"`
+
+	// AdaptiveConcurrency is optional. If specified, the requests in
+	// flight to each backend are limited, adapting to its latency.
+	AdaptiveConcurrency *AdaptiveConcurrency `json:"adaptive_concurrency"`
+
+	// SlowRequest is optional. If positive, requests taking at least this
+	// long are logged at the warn level, with the timing of the backend
+	// request.
+	SlowRequest Duration `json:"slow_request"`
+
+	// UpstreamTiming is optional. If true, the DNS, connect, TLS and first
+	// byte times of backend requests, and whether their connections were
+	// reused, are exported as metrics and added to the access log of each
+	// request.
+	UpstreamTiming bool `json:"upstream_timing"`
+
+	// LogSampling is optional. If specified, only a fraction of the
+	// requests of the route are written to the access log.
+	LogSampling *LogSampling `json:"log_sampling"`
+
+	// MaxResponseBytes is optional. If positive, it limits the size of
+	// backend response bodies. Responses announced larger fail with 502
+	// Bad Gateway, and those growing larger are cut off, aborting the
+	// connection to the client. Both are logged at the warn level.
+	MaxResponseBytes int64 `json:"max_response_bytes"`
+
+	// SlowClient is optional. If specified, clients reading responses too
+	// slowly are cut off.
+	SlowClient *SlowClient `json:"slow_client"`
+
+	// Capture is optional. If specified, request and backend response
+	// bodies may be logged for debugging.
+	Capture *Capture `json:"capture"`
+
+	// Record is optional. If specified, requests are saved to files to be
+	// replayed.
+	Record *Record `json:"record"`
+
+	// Retry is optional. If specified, requests which fail are resent.
+	Retry *Retry `json:"retry"`
+
+	// Timeout is optional. It limits the time spent proxying each request.
+	Timeout *Timeout `json:"timeout"`
+
+	// Error is optional. It describes the response sent when the backend
+	// cannot be reached, defaulting to that of the proxy.
+	Error *ErrorPage `json:"error"`
+
+	// ErrorHandler is ignored when parsing JSON. If specified, it is
+	// called instead of sending Error when the backend cannot be reached
+	// or ModifyResponse fails.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, err error) `json:"-"`
 }
 
 // ReverseProxy describes a reverse proxy server.
@@ -34,9 +314,114 @@ type ReverseProxy struct {
 
 	Routes []Route `json:"routes"`
 
+	// Docker is optional. If specified, routes are also discovered from
+	// the labels of running containers. Static routes take precedence.
+	Docker *Docker `json:"docker"`
+
+	// Concurrency is optional. It limits the requests in flight across all
+	// routes of the proxy.
+	Concurrency *Concurrency `json:"concurrency"`
+
+	// KeepAlive is optional. It describes the TCP keep-alive probes of
+	// client connections.
+	KeepAlive *KeepAlive `json:"keep_alive"`
+
+	// MaxConnections is optional. If positive, client connections beyond
+	// it are closed as soon as they are accepted.
+	MaxConnections int `json:"max_connections"`
+
+	// ReadTimeout is optional. It limits reading each request, including
+	// its body, defaulting to no limit.
+	ReadTimeout Duration `json:"read_timeout"`
+
+	// ReadHeaderTimeout is optional. It limits reading the headers of each
+	// request, defaulting to 10s. A negative value means no limit.
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+
+	// WriteTimeout is optional. It limits the time from reading the
+	// headers of each request to writing its response, defaulting to no
+	// limit, which suits streaming routes.
+	WriteTimeout Duration `json:"write_timeout"`
+
+	// IdleTimeout is optional. Client connections waiting for another
+	// request are closed after it, defaulting to 2m. A negative value
+	// means no limit.
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	// Metrics is optional. If specified, it is the path, such as
+	// "/metrics", on which MetricsHandler is served.
+	Metrics string `json:"metrics"`
+
+	// CaseInsensitive is optional. If specified, requests are matched to
+	// routes regardless of the case of their hostnames, and optionally
+	// paths.
+	CaseInsensitive *CaseInsensitive `json:"case_insensitive"`
+
+	// Health is optional. If specified, it is the path, such as "/healthz",
+	// which the proxy itself answers with 200 OK, taking precedence over
+	// routes.
+	Health string `json:"health"`
+
+	// Honeypot is optional. It describes trap paths whose clients are
+	// logged, counted and may be banned.
+	Honeypot *Honeypot `json:"honeypot"`
+
+	// Limits is optional. It limits the size of requests.
+	Limits *Limits `json:"limits"`
+
+	// Block is optional. Requests matching any of its rules are rejected
+	// before routing.
+	Block []BlockRule `json:"block"`
+
+	// TrustedProxies is optional. It lists CIDR ranges of proxies in front
+	// of this one, whose X-Forwarded-For headers are trusted to give the
+	// client IP address.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Middleware is optional. It lists middleware passed to
+	// RegisterMiddleware which sees the requests of all routes, in order.
+	Middleware []string `json:"middleware"`
+
+	// Use is ignored when parsing JSON. It is middleware which sees the
+	// requests of all routes, in order, after those of Middleware.
+	Use []Middleware `json:"-"`
+
+	// Transport is optional. It tunes the connections made to backends by
+	// routes without their own.
+	Transport *Transport `json:"transport"`
+
+	// RoundTripper is ignored when parsing JSON. If specified, it sends
+	// the requests of routes without their own to backends.
+	RoundTripper http.RoundTripper `json:"-"`
+
+	// Error is optional. It describes the response sent when the backend
+	// of a route without its own cannot be reached.
+	Error *ErrorPage `json:"error"`
+
+	// AccessLog is optional. If specified, each request is logged as a
+	// JSON object to this file, or to standard output if "-".
+	AccessLog string `json:"access_log"`
+
+	// Correlation is optional. If specified, responses carry the ID of
+	// their request in a header.
+	Correlation *Correlation `json:"correlation"`
+
+	// Tracing is optional. If specified, requests are exported as spans.
+	// Otherwise, W3C trace context is only passed on to backends.
+	Tracing *Tracing `json:"tracing"`
+
+	// Ban is optional. If specified, clients which repeatedly trip rate
+	// limits or fail authentication are banned. Banned clients, including
+	// those banned through the admin API, are rejected with 403 Forbidden.
+	Ban *Ban `json:"ban"`
+
 	// TLSConfig is ignored when parsing JSON. Used when Key != "".
 	TLSConfig *tls.Config `json:"-"`
 
+	// ClientCA is optional. If specified with Key, clients must present a
+	// certificate signed by a CA in this PEM file.
+	ClientCA string `json:"client_ca"`
+
 	// Stop is ignored with parsing JSON. Sending "true" along the channel
 	// will gracefully shutdown the proxy server.
 	//
@@ -53,6 +438,25 @@ type ReverseProxy struct {
 // Proxies describes a list of reverse proxies.
 type Proxies struct {
 	Proxies []ReverseProxy `json:"proxies"`
+
+	// Admin is optional. If specified, the admin API is served while the
+	// proxies run.
+	Admin *Admin `json:"admin"`
+
+	// AuditLog is optional. If specified, each configuration applied, with
+	// the proxies and routes it changes and their settings before and
+	// after, each change made through the admin API, and each proxy
+	// stopped, started or restarted through its Handle is appended to this
+	// file as a JSON object. Secrets are hidden.
+	AuditLog string `json:"audit_log"`
+
+	// MetricLabels is optional. It describes the labels of the metrics of
+	// the proxies.
+	MetricLabels *MetricLabels `json:"metric_labels"`
+
+	// Source is ignored when parsing JSON. It names where the
+	// configuration came from, such as its file, in the audit log.
+	Source string `json:"-"`
 }
 
 var active sync.WaitGroup
@@ -61,22 +465,75 @@ var active sync.WaitGroup
 // channel. When all proxies die the error channel is closed. This should only
 // be called once or until all previous proxies die.
 func Proxy(p *Proxies) <-chan error {
+	_, errs := Start(p)
+	return errs
+}
+
+// Start starts a list of reverse proxies like Proxy, also returning a handle
+// to each, in order, through which it may be stopped alone.
+func Start(p *Proxies) ([]*Handle, <-chan error) {
 	errs := make(chan error)
 
 	// If Proxy has been called before, wait for existing proxies to die.
 	active.Wait()
-	active.Add(len(p.Proxies))
+	active.Add(1)
+
+	// The set counts Start itself until the proxies are started, so that
+	// it is not idle before then.
+	set := &proxySet{errs: errs, running: 1, idle: make(chan struct{})}
+
+	var pending sync.WaitGroup
+
+	if err := metricLabels.set(p.MetricLabels); err != nil {
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			errs <- err
+		}()
+	}
+
+	if p.AuditLog != "" {
+		if err := audit.open(p.AuditLog); err != nil {
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				errs <- err
+			}()
+		} else {
+			audit.configure(p)
+		}
+	}
+
+	handles := make([]*Handle, len(p.Proxies))
+
+	for i, proxy := range p.Proxies {
+		handles[i] = newHandle(proxy, set)
+		set.add()
+		go listenAndServe(handles[i], nil)
+	}
+
+	set.done()
+
+	var admin *adminServer
 
-	for _, proxy := range p.Proxies {
-		go listenAndServe(proxy, errs)
+	if p.Admin != nil {
+		admin = startAdmin(p.Admin, errs)
 	}
 
 	go func() {
-		active.Wait()
+		<-set.idle
+
+		if admin != nil {
+			admin.close()
+		}
+
+		pending.Wait()
+		audit.close()
 		close(errs)
+		active.Done()
 	}()
 
-	return errs
+	return handles, errs
 }
 
 // From golang src/net/http/httputil/reverseproxy.go:singleJoiningSlash()
@@ -94,86 +551,798 @@ func join(a, b string) string {
 	return a + b
 }
 
-func listenAndServe(r ReverseProxy, errs chan error) {
+// From golang src/net/http/httputil/reverseproxy.go:joinURLPath()
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return join(a.Path, b.Path), ""
+	}
+
+	// Same as join, but with an escaped path to go with the unescaped.
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+
+	return a.Path + b.Path, apath + bpath
+}
+
+// rawRequestPath returns the path of the request target as the client sent
+// it.
+func rawRequestPath(req *http.Request) (string, bool) {
+	uri := req.RequestURI
+
+	if uri == "" || uri == "*" {
+		return "", false
+	}
+
+	// Absolute-form targets are reduced to the path.
+	if i := strings.Index(uri, "://"); i >= 0 {
+		rest := uri[i+3:]
+		j := strings.IndexAny(rest, "/?")
+
+		if j < 0 || rest[j] == '?' {
+			return "/", true
+		}
+
+		uri = rest[j:]
+	}
+
+	path, _, _ := strings.Cut(uri, "?")
+	return path, strings.HasPrefix(path, "/")
+}
+
+// scope holds state shared by the routes of a running reverse proxy. Its
+// context is canceled once the server stops, and background goroutines
+// started with run are waited on before the proxy is reported as dead.
+type scope struct {
+	ctx  context.Context
+	errs chan<- error
+	wg   sync.WaitGroup
+
+	// transport, roundTripper and errorPage are the defaults of routes.
+	transport    *Transport
+	roundTripper http.RoundTripper
+	errorPage    *ErrorPage
+}
+
+// report passes err along the error channel, unless the proxy has stopped.
+// Errors are dropped if there is no channel.
+func (s *scope) report(err error) {
+	if s.errs == nil {
+		return
+	}
+
+	select {
+	case s.errs <- err:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *scope) run(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+func routeHandler(s *scope, route Route) (http.Handler, error) {
+	to, err := url.Parse(route.To)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch route.Balance {
+	case "", "random", "ip_hash":
+	default:
+		return nil, errors.New("proxy: unknown balance " + route.Balance)
+	}
+
+	switch route.ExpectContinue {
+	case "", "pass", "local":
+	default:
+		return nil, errors.New("proxy: unknown expect_continue " +
+			route.ExpectContinue)
+	}
+
+	res, err := newResolver(route.DNS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if route.Transport == nil {
+		route.Transport = s.transport
+	}
+
+	transport := route.RoundTripper
+
+	if transport == nil {
+		transport = s.roundTripper
+	}
+
+	if transport == nil {
+		t, err := newTransport(route, res)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport = t
+	}
+
+	// Mirrored requests skip the retries and metrics below.
+	base := transport
+
+	var upstreams *pool
+
+	if scheme, ok := srvScheme(to.Scheme); ok {
+		to.Scheme = scheme
+
+		if upstreams, err = watchSRV(s, res, to.Hostname(), route); err != nil {
+			return nil, err
+		}
+	} else if route.Consul != nil {
+		if upstreams, err = watchConsul(s, route.Consul); err != nil {
+			return nil, err
+		}
+	} else if route.Kubernetes != nil {
+		if upstreams, err = watchKubernetes(s, route.Kubernetes); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(route.Backups) != 0 {
+		backups, err := newBackups(route)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if upstreams == nil {
+			upstreams = &pool{targets: []target{{Addr: to.Host}}}
+		}
+
+		cooldown := time.Duration(route.BackupCooldown)
+
+		if cooldown == 0 {
+			cooldown = defaultBackupCooldown
+		}
+
+		upstreams.setBackups(backups, cooldown)
+	}
+
+	if upstreams != nil && route.SlowStart != 0 {
+		if route.SlowStart < 0 {
+			return nil, errors.New("proxy: negative slow_start")
+		}
+
+		upstreams.setSlowStart(time.Duration(route.SlowStart))
+	}
+
+	if route.SlowRequest < 0 {
+		return nil, errors.New("proxy: negative slow_request")
+	}
+
+	if route.SlowRequest != 0 || route.UpstreamTiming {
+		transport = traceTransport{
+			next:    transport,
+			route:   route.From,
+			metrics: route.UpstreamTiming,
+		}
+	}
+
+	// Note the backend of each attempt for the response metrics.
+	transport = noteTransport{next: transport}
+
+	if len(route.Backups) != 0 {
+		transport = healthTransport{next: transport, pool: upstreams}
+	}
+
+	if route.AdaptiveConcurrency != nil {
+		if transport, err = newAdaptiveTransport(route.AdaptiveConcurrency,
+			route.From, transport); err != nil {
+			return nil, err
+		}
+	}
+
+	if route.Retry != nil {
+		if transport, err = newRetryTransport(route.Retry, route.From,
+			route.Host, transport, upstreams); err != nil {
+			return nil, err
+		}
+	}
+
+	raw := to.RawQuery
+
+	// Custom director to change Host header
+	director := func(req *http.Request) {
+		host := to.Host
+
+		if t, ok := req.Context().Value(upstreamKey{}).(string); ok {
+			host = t
+		}
+
+		if route.Host != "" {
+			req.Host = route.Host
+		} else {
+			req.Host = host
+		}
+
+		req.Header.Set("Host", req.Host)
+
+		// From director func in NewSingleHostReverseProxy
+		req.URL.Scheme = to.Scheme
+		req.URL.Host = host
+		req.URL.Path, req.URL.RawPath = joinURLPath(to, req.URL)
+
+		if p, ok := rawRequestPath(req); route.RawURI && ok {
+			// The path is sent byte for byte as Opaque.
+			req.URL.Opaque = join(to.EscapedPath(), p)
+		}
+
+		if raw == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = raw + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = raw + "&" + req.URL.RawQuery
+		}
+
+		if route.Query != nil {
+			req.URL.RawQuery = route.Query.rewrite(req.URL.RawQuery)
+		}
+
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header.Set("User-Agent", "")
+		}
+
+		if route.Decompress {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		forwardTrailers(req)
+
+		// The client is sent 100 Continue once its body is first read.
+		if route.ExpectContinue == "local" {
+			req.Header.Del("Expect")
+		}
+
+		if route.Director != nil {
+			route.Director(req)
+		}
+	}
+
+	rp := &httputil.ReverseProxy{
+		Director:   director,
+		Transport:  transport,
+		BufferPool: buffers,
+	}
+
+	var modify []func(*http.Response) error
+
+	if route.MaxResponseBytes < 0 {
+		return nil, errors.New("proxy: negative max_response_bytes")
+	}
+
+	if route.MaxResponseBytes != 0 {
+		modify = append(modify, limitResponse(route.MaxResponseBytes))
+	}
+
+	if route.Decompress {
+		modify = append(modify, decompress(route.MaxResponseBytes))
+	}
+
+	if route.Response != nil {
+		rewrite, err := newResponseRewrite(route.Response)
+
+		if err != nil {
+			return nil, err
+		}
+
+		modify = append(modify, rewrite)
+	}
+
+	if route.ModifyResponse != nil {
+		modify = append(modify, route.ModifyResponse)
+	}
+
+	if len(route.Filters) != 0 {
+		modify = append(modify, filterResponse(route.Filters))
+	}
+
+	rp.ModifyResponse = chainModify(modify)
+
+	page := route.Error
+
+	if page == nil {
+		page = s.errorPage
+	}
+
+	if page == nil && (route.Timeout != nil ||
+		route.AdaptiveConcurrency != nil) {
+		// The default error handler answers timeouts and shedding with
+		// 502.
+		page = &ErrorPage{}
+	}
+
+	if route.ErrorHandler != nil {
+		rp.ErrorHandler = route.ErrorHandler
+	} else if page != nil {
+		if rp.ErrorHandler, err = newErrorHandler(page, rp); err != nil {
+			return nil, err
+		}
+	}
+
+	var handler http.Handler = rp
+
+	if route.Mirror != nil {
+		m, err := newMirror(s, route.Mirror, route.From, base)
+
+		if err != nil {
+			return nil, err
+		}
+
+		handler = withMirror(m, handler)
+	}
+
+	if route.Capture != nil {
+		cp, err := newCapture(route.Capture, route.From,
+			newCredentials(route).headers)
+
+		if err != nil {
+			return nil, err
+		}
+
+		captures.add(s, cp)
+		handler = withCapture(cp, handler)
+	}
+
+	if route.Record != nil {
+		rec, err := newRecorder(s, route.Record, route.From,
+			newCredentials(route))
+
+		if err != nil {
+			return nil, err
+		}
+
+		handler = withRecord(rec, handler)
+	}
+
+	if route.Timeout != nil {
+		if err := checkTimeout(route.Timeout); err != nil {
+			return nil, err
+		}
+
+		handler = withTimeout(route.Timeout, handler)
+	}
+
+	if route.ProxyProtocol != 0 {
+		handler = withClientAddr(handler)
+	}
+
+	if upstreams != nil {
+		handler = withUpstream(upstreams, route.Balance == "ip_hash",
+			handler)
+	}
+
+	if route.Canary != nil {
+		if err := checkCanary(route.Canary); err != nil {
+			return nil, err
+		}
+
+		handler = withCanary(route.Canary, handler)
+	}
+
+	stages, err := routeStages(s, route)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if handler, err = chain(handler, route.Middleware,
+		defaultRouteMiddleware, stages); err != nil {
+		return nil, err
+	}
+
+	if route.Cache != nil {
+		// Auth stages remove credentials, so they are looked for first.
+		handler = withCacheBypass(newCredentials(route), route.Canary,
+			handler)
+	}
+
+	for i := len(route.Use) - 1; i >= 0; i-- {
+		handler = route.Use[i].Wrap(handler)
+	}
+
+	if route.SlowRequest != 0 || route.UpstreamTiming {
+		handler = withRequestTiming(time.Duration(route.SlowRequest),
+			route.UpstreamTiming, route.From, handler)
+	}
+
+	if route.SlowClient != nil {
+		if err := checkSlowClient(route.SlowClient); err != nil {
+			return nil, err
+		}
+
+		handler = withSlowClient(route.SlowClient, handler)
+	}
+
+	if route.LogSampling != nil {
+		if err := checkLogSampling(route.LogSampling); err != nil {
+			return nil, err
+		}
+
+		handler = withLogSampling(route.LogSampling, handler)
+	}
+
+	return withRouteMetrics(route.From, handler), nil
+}
+
+// BuildHandler returns the handler of the reverse proxy, without listening, so
+// that it may be served by another server or combined with other handlers.
+// Settings of the listener, such as Port, Cert, MaxConnections and
+// Limits.MaxHeaderBytes, are ignored. Stop is required: background work, such
+// as watching for backends, runs until Stop receives true or is closed, and
+// its errors are dropped.
+func BuildHandler(r ReverseProxy) (http.Handler, error) {
+	if r.Stop == nil {
+		return nil, errors.New("proxy: BuildHandler requires Stop")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scope{ctx: ctx}
+	handler, err := buildHandler(s, r)
+
+	if err != nil {
+		cancel()
+		s.wg.Wait()
+		return nil, err
+	}
+
+	go func() {
+		defer cancel()
+
+		for stop := range r.Stop {
+			if stop {
+				return
+			}
+		}
+	}()
+
+	return handler, nil
+}
+
+// buildHandler builds the handler of the reverse proxy, whose background work
+// runs within s.
+func buildHandler(s *scope, r ReverseProxy) (http.Handler, error) {
+	s.transport = r.Transport
+	s.roundTripper = r.RoundTripper
+	s.errorPage = r.Error
 	mux := http.NewServeMux()
+	var routes router = mux
+	fold := func(pattern string) string { return pattern }
+
+	if r.CaseInsensitive != nil {
+		fm := &foldingMux{mux: mux, paths: r.CaseInsensitive.Paths}
+		routes, fold = fm, fm.fold
+	}
+
+	if r.Metrics != "" {
+		mux.Handle(fold(r.Metrics), MetricsHandler())
+	}
 
 	for _, route := range r.Routes {
-		to, err := url.Parse(route.To)
+		handler, err := routeHandler(s, route)
 
 		if err != nil {
-			errs <- err
-			return
+			return nil, err
 		}
 
-		raw := to.RawQuery
+		if err := checkTrailingSlash(route.TrailingSlash); err != nil {
+			return nil, err
+		}
 
-		// Custom director to change Host header
-		director := func(req *http.Request) {
-			req.Host = to.Host
-			req.Header.Set("Host", to.Host)
+		for _, from := range append([]string{route.From}, route.Aliases...) {
+			if err := handleRoute(mux, fold(from), route.TrailingSlash, handler); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-			// From director func in NewSingleHostReverseProxy
-			req.URL.Scheme = to.Scheme
-			req.URL.Host = to.Host
-			req.URL.Path = join(to.Path, req.URL.Path)
+	if r.Honeypot != nil {
+		hp, err := newHoneypot(r.Honeypot, r.Port)
 
-			if raw == "" || req.URL.RawQuery == "" {
-				req.URL.RawQuery = raw + req.URL.RawQuery
-			} else {
-				req.URL.RawQuery = raw + "&" + req.URL.RawQuery
-			}
+		if err != nil {
+			return nil, err
+		}
 
-			if _, ok := req.Header["User-Agent"]; !ok {
-				req.Header.Set("User-Agent", "")
+		for _, path := range r.Honeypot.Paths {
+			if err := handle(mux, fold(path), hp.handler(path)); err != nil {
+				return nil, err
 			}
 		}
+	}
 
-		proxy := &httputil.ReverseProxy{Director: director}
-		mux.Handle(route.From, proxy)
+	var handler http.Handler = routes
+
+	if r.Docker != nil {
+		var err error
+
+		if handler, err = watchDocker(s, r.Docker, routes); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := len(r.Use) - 1; i >= 0; i-- {
+		handler = r.Use[i].Wrap(handler)
+	}
+
+	if len(r.Middleware) != 0 {
+		var err error
+
+		if handler, err = chain(handler, r.Middleware, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Concurrency != nil {
+		sem, err := newSemaphore(r.Concurrency)
+
+		if err != nil {
+			return nil, err
+		}
+
+		handler = withConcurrency(sem, handler)
+	}
+
+	if len(r.Block) != 0 {
+		rules, err := newBlockRules(r.Block)
+
+		if err != nil {
+			return nil, err
+		}
+
+		handler = withBlockRules(rules, handler)
+	}
+
+	if r.Limits != nil {
+		handler = withLimits(r.Limits, handler)
+	}
+
+	var st *striker
+
+	if r.Ban != nil {
+		var err error
+
+		if st, err = newStriker(r.Ban); err != nil {
+			return nil, err
+		}
+	}
+
+	handler = withBans(st, handler)
+
+	if r.Correlation != nil {
+		if err := checkCorrelation(r.Correlation); err != nil {
+			return nil, err
+		}
+
+		handler = withCorrelation(r.Correlation, handler)
+	}
+
+	var tr *tracer
+
+	if r.Tracing != nil {
+		var err error
+
+		if tr, err = newTracer(s, r.Tracing); err != nil {
+			return nil, err
+		}
+	}
+
+	handler = withTraceContext(tr, handler)
+	handler = withRequestID(handler)
+
+	if r.AccessLog != "" {
+		l, err := openAccessLog(r.AccessLog)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.run(func() {
+			<-s.ctx.Done()
+			l.close()
+		})
+
+		handler = withAccessLog(l, handler)
+	}
+
+	handler = withTrailers(handler)
+
+	// The client IP is resolved before it is traced and logged.
+	if len(r.TrustedProxies) != 0 {
+		trusted, err := parseCIDRs(r.TrustedProxies)
+
+		if err != nil {
+			return nil, err
+		}
+
+		handler = withTrustedProxies(trusted, handler)
+	}
+
+	if r.Health != "" {
+		if err := checkHealthPath(r.Health); err != nil {
+			return nil, err
+		}
+
+		handler = withHealth(r.Health, handler)
+	}
+
+	return handler, nil
+}
+
+const (
+	defaultServerReadHeaderTimeout = 10 * time.Second
+	defaultServerIdleTimeout       = 2 * time.Minute
+	defaultListenKeepAlive         = 15 * time.Second
+)
+
+// listenAndServe runs the proxy of h until it dies. The proxy has been added
+// to h.set. If started is not nil, errors starting the proxy are sent along
+// it, rather than errs, and nil once it is listening.
+func listenAndServe(h *Handle, started chan<- error) {
+	h.mu.Lock()
+	r, quit, done := h.r, h.quit, h.done
+	h.mu.Unlock()
+
+	errs := h.set.errs
+
+	fail := func(err error) {
+		if started != nil {
+			started <- err
+		} else {
+			errs <- err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scope{ctx: ctx, errs: errs}
+
+	defer func() {
+		cancel()
+		s.wg.Wait()
+		close(done)
+		h.set.done()
+	}()
+
+	handler, err := buildHandler(s, r)
+
+	if err != nil {
+		fail(err)
+		return
 	}
 
 	srv := &http.Server{
-		Addr:    r.Port,
-		Handler: mux,
+		Addr:              r.Port,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(r.ReadTimeout),
+		ReadHeaderTimeout: defaultServerReadHeaderTimeout,
+		WriteTimeout:      time.Duration(r.WriteTimeout),
+		IdleTimeout:       defaultServerIdleTimeout,
 	}
 
-	var err error
+	if r.ReadHeaderTimeout != 0 {
+		srv.ReadHeaderTimeout = time.Duration(r.ReadHeaderTimeout)
+	}
+
+	if r.IdleTimeout != 0 {
+		srv.IdleTimeout = time.Duration(r.IdleTimeout)
+	}
+
+	if r.Limits != nil {
+		srv.MaxHeaderBytes = r.Limits.MaxHeaderBytes
+	}
 
 	go func(stop <-chan bool, timeout time.Duration) {
-		if stop == nil {
-			return
-		}
 		for {
 			select {
 			case s, ok := <-stop:
 				if !ok {
-					return
+					// Only the handle may stop the proxy now.
+					stop = nil
+					continue
 				}
 				if !s {
 					continue
 				}
-				ctx := context.Background()
-				if timeout != time.Duration(-1) {
-					var cancel context.CancelFunc
-					ctx, cancel = context.WithTimeout(ctx, timeout)
-					defer cancel()
-				}
-				_ = srv.Shutdown(ctx)
+			case timeout = <-quit:
+			case <-done:
 				return
 			}
+			ctx := context.Background()
+			if timeout != time.Duration(-1) {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			_ = srv.Shutdown(ctx)
+			return
 		}
 	}(r.Stop, r.StopTimeout)
 
+	addr := r.Port
+
+	if addr == "" {
+		if r.Key == "" {
+			addr = ":http"
+		} else {
+			addr = ":https"
+		}
+	}
+
+	if r.Key != "" {
+		srv.TLSConfig = r.TLSConfig
+
+		if r.ClientCA != "" {
+			if srv.TLSConfig, err = clientCAConfig(r.TLSConfig, r.ClientCA); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		// Check the certificate now, rather than once serving.
+		if _, err = tls.LoadX509KeyPair(r.Cert, r.Key); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	lc := net.ListenConfig{}
+
+	if r.KeepAlive != nil {
+		if err = checkKeepAlive(r.KeepAlive); err != nil {
+			fail(err)
+			return
+		}
+
+		lc.KeepAliveConfig, lc.KeepAlive = keepAliveConfig(r.KeepAlive,
+			defaultListenKeepAlive)
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if r.MaxConnections > 0 {
+		ln = &limitListener{
+			Listener: ln,
+			name:     r.Port,
+			max:      int64(r.MaxConnections),
+		}
+	}
+
+	if started != nil {
+		started <- nil
+	}
+
 	if r.Key == "" {
-		err = srv.ListenAndServe()
+		err = srv.Serve(ln)
 	} else {
-		srv.TLSConfig = r.TLSConfig
-		err = srv.ListenAndServeTLS(r.Cert, r.Key)
+		err = srv.ServeTLS(ln, r.Cert, r.Key)
 	}
 
 	if err != nil && err != http.ErrServerClosed {
 		errs <- err
 	}
-
-	active.Done()
 }
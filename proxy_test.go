@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// serveProxy serves the handler of r for the duration of the test.
+func serveProxy(t *testing.T, r ReverseProxy) *httptest.Server {
+	t.Helper()
+
+	stop := make(chan bool)
+	r.Stop = stop
+	h, err := BuildHandler(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+
+	t.Cleanup(func() {
+		srv.Close()
+		close(stop)
+	})
+
+	return srv
+}
+
+func TestBuildHandlerRequiresStop(t *testing.T) {
+	r := ReverseProxy{Routes: []Route{{From: "/", To: "http://127.0.0.1"}}}
+
+	if _, err := BuildHandler(r); err == nil {
+		t.Error("built a handler without Stop")
+	}
+}
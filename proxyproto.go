@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+type clientAddrKey struct{}
+
+// withClientAddr stores the client's remote address in the request context
+// so that upstream dialers can retrieve it.
+func withClientAddr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), clientAddrKey{}, req.RemoteAddr)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func checkProxyProtocol(version int) error {
+	if version != 1 && version != 2 {
+		return fmt.Errorf("proxy: unsupported PROXY protocol version %d",
+			version)
+	}
+	return nil
+}
+
+// proxyProtocolDialer wraps dial so that each new connection begins with a
+// PROXY protocol header describing the original client connection.
+func proxyProtocolDialer(dial dialFunc, version int) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = conn.Write(proxyHeader(ctx, version)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+func proxyHeader(ctx context.Context, version int) []byte {
+	src, _ := ctx.Value(clientAddrKey{}).(string)
+	dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+
+	var srcIP, dstIP net.IP
+	var srcPort, dstPort uint16
+	var err error
+
+	if dst != nil {
+		srcIP, srcPort, err = splitAddr(src)
+	}
+
+	if err == nil && srcIP != nil {
+		dstIP, dstPort, err = splitAddr(dst.String())
+	}
+
+	if err != nil || srcIP == nil ||
+		(srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		// Unknown or mixed origin, as allowed by the specification.
+		if version == 1 {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		return proxyHeaderV2(nil, nil, 0, 0)
+	}
+
+	if srcIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	if version == 1 {
+		family := "TCP4"
+		if len(srcIP) == net.IPv6len {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			srcIP, dstIP, srcPort, dstPort))
+	}
+
+	return proxyHeaderV2(srcIP, dstIP, srcPort, dstPort)
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func proxyHeaderV2(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+
+	switch len(src) {
+	case net.IPv4len:
+		b.Write([]byte{0x21, 0x11}) // PROXY, TCP over IPv4
+		binary.Write(&b, binary.BigEndian, uint16(12))
+	case net.IPv6len:
+		b.Write([]byte{0x21, 0x21}) // PROXY, TCP over IPv6
+		binary.Write(&b, binary.BigEndian, uint16(36))
+	default:
+		b.Write([]byte{0x20, 0x00}) // LOCAL, unspecified
+		binary.Write(&b, binary.BigEndian, uint16(0))
+		return b.Bytes()
+	}
+
+	b.Write(src)
+	b.Write(dst)
+	binary.Write(&b, binary.BigEndian, srcPort)
+	binary.Write(&b, binary.BigEndian, dstPort)
+	return b.Bytes()
+}
+
+func splitAddr(addr string) (net.IP, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return nil, 0, errors.New("proxy: invalid IP " + host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ip, uint16(p), nil
+}
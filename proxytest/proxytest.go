@@ -0,0 +1,177 @@
+// Package proxytest runs reverse proxies on ephemeral ports, with temporary
+// certificates and fake backends, for integration tests of configurations.
+package proxytest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	proxy "github.com/esote/http-proxy"
+)
+
+// Proxy is a reverse proxy running for a test.
+type Proxy struct {
+	// URL is the base URL of the proxy, such as "https://127.0.0.1:41234".
+	URL string
+
+	// Client sends requests to the proxy, trusting its certificate.
+	// Requests for any hostname, as routes may match, are sent to the
+	// proxy.
+	Client *http.Client
+
+	srv  *httptest.Server
+	stop chan bool
+}
+
+// Start starts the handler of r, as built by proxy.BuildHandler, on an
+// ephemeral port of the loopback address. If useTLS is true, it serves HTTPS
+// with a temporary certificate valid for localhost, 127.0.0.1 and ::1, and
+// r.TLSConfig, rather than r.Cert and r.Key. Other settings of the listener
+// are ignored, as by BuildHandler. Many proxies may run at once, unlike with
+// proxy.Start. The proxy must be closed with Close.
+func Start(r proxy.ReverseProxy, useTLS bool) (*Proxy, error) {
+	p := &Proxy{stop: make(chan bool, 1)}
+	r.Stop = p.stop
+
+	h, err := proxy.BuildHandler(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.srv = httptest.NewUnstartedServer(h)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if useTLS {
+		cert, pool, err := newCert()
+
+		if err != nil {
+			p.stop <- true
+			return nil, err
+		}
+
+		config := &tls.Config{}
+
+		if r.TLSConfig != nil {
+			config = r.TLSConfig.Clone()
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+		p.srv.TLS = config
+		p.srv.StartTLS()
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			ServerName: "localhost",
+		}
+	} else {
+		p.srv.Start()
+	}
+
+	// Dial the proxy whichever host is requested.
+	addr := p.srv.Listener.Addr().String()
+	var d net.Dialer
+
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	transport.Proxy = nil
+
+	p.URL = p.srv.URL
+	p.Client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return p, nil
+}
+
+// Close stops the proxy, once requests in flight are served, and its
+// background work.
+func (p *Proxy) Close() {
+	p.Client.CloseIdleConnections()
+	p.srv.Close()
+	p.stop <- true
+}
+
+// newCert returns a self-signed certificate valid for the loopback address
+// and a pool trusting it.
+func newCert() (tls.Certificate, *x509.CertPool, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxytest"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey,
+		priv)
+
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, pool, nil
+}
+
+// NewEcho starts a fake backend answering each request with a JSON
+// description of it, as proxy.EchoHandler does. It must be closed.
+func NewEcho() *httptest.Server {
+	return httptest.NewServer(proxy.EchoHandler())
+}
+
+// NewBackend starts a fake backend answering every request with status and
+// body, as text. It must be closed.
+func NewBackend(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = strings.NewReader(body).WriteTo(w)
+	}))
+}
@@ -0,0 +1,90 @@
+package proxytest_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	proxy "github.com/esote/http-proxy"
+	"github.com/esote/http-proxy/proxytest"
+)
+
+func TestStart(t *testing.T) {
+	echo := proxytest.NewEcho()
+	defer echo.Close()
+
+	backend := proxytest.NewBackend(http.StatusTeapot, "fallback")
+	defer backend.Close()
+
+	r := proxy.ReverseProxy{Routes: []proxy.Route{
+		{From: "app.example.com/", To: echo.URL},
+		{From: "/", To: backend.URL},
+	}}
+
+	// Proxies run side by side, over HTTP and HTTPS.
+	for _, useTLS := range []bool{false, true} {
+		p, err := proxytest.Start(r, useTLS)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer p.Close()
+
+		if strings.HasPrefix(p.URL, "https://") != useTLS {
+			t.Errorf("TLS %v: URL %s", useTLS, p.URL)
+		}
+
+		scheme := "http"
+
+		if useTLS {
+			scheme = "https"
+		}
+
+		resp, err := p.Client.Get(scheme + "://app.example.com/x?y=1")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got struct {
+			URI  string `json:"uri"`
+			Host string `json:"host"`
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.URI != "/x?y=1" {
+			t.Errorf("TLS %v: echoed URI %q", useTLS, got.URI)
+		}
+
+		resp, err = p.Client.Get(p.URL + "/other")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTeapot || string(b) != "fallback" {
+			t.Errorf("TLS %v: fallback route: %d %q", useTLS,
+				resp.StatusCode, b)
+		}
+	}
+}
+
+func TestStartInvalid(t *testing.T) {
+	r := proxy.ReverseProxy{Routes: []proxy.Route{{From: "/", To: "%"}}}
+
+	if _, err := proxytest.Start(r, false); err == nil {
+		t.Error("started a proxy with an invalid route")
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// QueryRewrite describes changes to the query of requests before they are
+// proxied, made in the order of the fields, after the query of To is added.
+type QueryRewrite struct {
+	// Strip is optional. It lists parameters removed, where a trailing "*"
+	// matches any suffix, such as "utm_*".
+	Strip []string `json:"strip"`
+
+	// Rename is optional. It maps parameters to their new names, replacing
+	// any parameters already of those names.
+	Rename map[string]string `json:"rename"`
+
+	// Set is optional. These parameters are set, replacing their values.
+	Set map[string]string `json:"set"`
+}
+
+func (q *QueryRewrite) stripped(name string) bool {
+	for _, s := range q.Strip {
+		if p, ok := strings.CutSuffix(s, "*"); ok && strings.HasPrefix(name, p) ||
+			s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// queryPair is a pair of a raw query.
+type queryPair struct {
+	name string // decoded, or "" if it cannot be
+	raw  string
+}
+
+// value returns the decoded value of the pair.
+func (p queryPair) value() string {
+	_, v, _ := strings.Cut(p.raw, "=")
+	v, _ = url.QueryUnescape(v)
+	return v
+}
+
+// splitQuery returns the pairs of a raw query, as they are encoded.
+func splitQuery(raw string) []queryPair {
+	if raw == "" {
+		return nil
+	}
+
+	var pairs []queryPair
+
+	for _, p := range strings.Split(raw, "&") {
+		key, _, _ := strings.Cut(p, "=")
+		name, err := url.QueryUnescape(key)
+
+		if err != nil {
+			name = ""
+		}
+
+		pairs = append(pairs, queryPair{name, p})
+	}
+
+	return pairs
+}
+
+func joinQuery(pairs []queryPair) string {
+	parts := make([]string, len(pairs))
+
+	for i, p := range pairs {
+		parts[i] = p.raw
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// removeQuery returns raw without the pairs named name, and whether there
+// were any. Other pairs keep their order and encoding.
+func removeQuery(raw, name string) (string, bool) {
+	pairs := splitQuery(raw)
+	kept := pairs[:0]
+
+	for _, p := range pairs {
+		if p.name != name || name == "" {
+			kept = append(kept, p)
+		}
+	}
+
+	if len(kept) == len(pairs) {
+		return raw, false
+	}
+
+	return joinQuery(kept), true
+}
+
+// redactQuery returns raw with the values of the pairs whose names are in
+// names hidden.
+func redactQuery(raw string, names map[string]bool) string {
+	if len(names) == 0 || raw == "" {
+		return raw
+	}
+
+	pairs := splitQuery(raw)
+	changed := false
+
+	for i, p := range pairs {
+		if p.name != "" && names[p.name] {
+			key, _, _ := strings.Cut(p.raw, "=")
+			pairs[i].raw = key + "=" + url.QueryEscape(redacted)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return raw
+	}
+
+	return joinQuery(pairs)
+}
+
+// redactURI returns the request URI uri with the values of the query
+// parameters in names hidden.
+func redactURI(uri string, names map[string]bool) string {
+	path, raw, ok := strings.Cut(uri, "?")
+
+	if !ok {
+		return uri
+	}
+
+	return path + "?" + redactQuery(raw, names)
+}
+
+// rewrite returns the raw query rewritten. Pairs which are not changed keep
+// their order and encoding.
+func (q *QueryRewrite) rewrite(raw string) string {
+	pairs := splitQuery(raw)
+	kept := pairs[:0]
+
+	for _, p := range pairs {
+		if p.name == "" || !q.stripped(p.name) {
+			kept = append(kept, p)
+		}
+	}
+
+	pairs = kept
+
+	// Parameters renamed replace any already of their new names.
+	replaced := make(map[string]bool)
+
+	for _, p := range pairs {
+		if to, ok := q.Rename[p.name]; ok && p.name != "" {
+			replaced[to] = true
+		}
+	}
+
+	kept = pairs[:0]
+
+	for _, p := range pairs {
+		if to, ok := q.Rename[p.name]; ok && p.name != "" {
+			_, value, _ := strings.Cut(p.raw, "=")
+			p.name, p.raw = to, url.QueryEscape(to)+"="+value
+		} else if replaced[p.name] {
+			continue
+		}
+
+		kept = append(kept, p)
+	}
+
+	pairs = kept
+
+	// Parameters set replace the first of their name, or else are added.
+	set := make(map[string]bool)
+	kept = pairs[:0]
+
+	for _, p := range pairs {
+		if v, ok := q.Set[p.name]; ok && p.name != "" {
+			if set[p.name] {
+				continue
+			}
+
+			set[p.name] = true
+			p.raw = url.QueryEscape(p.name) + "=" + url.QueryEscape(v)
+		}
+
+		kept = append(kept, p)
+	}
+
+	pairs = kept
+
+	var add []string
+
+	for name := range q.Set {
+		if !set[name] {
+			add = append(add, name)
+		}
+	}
+
+	sort.Strings(add)
+
+	for _, name := range add {
+		pairs = append(pairs, queryPair{name, url.QueryEscape(name) + "=" +
+			url.QueryEscape(q.Set[name])})
+	}
+
+	return joinQuery(pairs)
+}
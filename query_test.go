@@ -0,0 +1,29 @@
+package proxy
+
+import "testing"
+
+func TestQueryRewrite(t *testing.T) {
+	q := &QueryRewrite{
+		Strip:  []string{"utm_*", "fbclid"},
+		Rename: map[string]string{"q": "search", "p": "page"},
+		Set:    map[string]string{"lang": "en", "v": "2 b"},
+	}
+
+	tests := []struct {
+		raw, want string
+	}{
+		{"", "lang=en&v=2+b"},
+		// Unchanged pairs keep their order and encoding.
+		{"z=%7e&a=1;b&utm_source=x&fbclid=y", "z=%7e&a=1;b&lang=en&v=2+b"},
+		{"q=a%20b&search=old&x=1", "search=a%20b&x=1&lang=en&v=2+b"},
+		{"v=1&lang=fr&v=3&y", "v=2+b&lang=en&y"},
+		{"p=2&page=1&page=3", "page=2&lang=en&v=2+b"},
+		{"bad=%zz&utm_x=1", "bad=%zz&lang=en&v=2+b"},
+	}
+
+	for _, tt := range tests {
+		if got := q.rewrite(tt.raw); got != tt.want {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit describes a token bucket limiting the request rate of a route.
+type RateLimit struct {
+	// Rate of requests per second.
+	Rate float64 `json:"rate"`
+
+	// Burst is optional. It is the number of requests which may exceed
+	// Rate at once, defaulting to Rate rounded up.
+	Burst int `json:"burst"`
+
+	// Redis is optional. If specified, the bucket is stored in Redis so
+	// that the limit is shared by all proxy instances using the same key.
+	// If Redis is unreachable, requests are allowed.
+	Redis *Redis `json:"redis"`
+}
+
+// limiter decides whether a request may proceed, returning how long to wait
+// otherwise.
+type limiter interface {
+	take(ctx context.Context) (bool, time.Duration)
+}
+
+func newLimiter(s *scope, c *RateLimit, name string) (limiter, error) {
+	b, err := newBucket(c)
+
+	if err != nil || c.Redis == nil {
+		return b, err
+	}
+
+	client, err := newRedisClient(c.Redis)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := c.Redis.Key
+
+	if key == "" {
+		key = "http-proxy:ratelimit:" + name
+	}
+
+	return &redisBucket{
+		s:      s,
+		client: client,
+		key:    key,
+		rate:   strconv.FormatFloat(b.rate, 'f', -1, 64),
+		burst:  strconv.FormatFloat(b.burst, 'f', -1, 64),
+	}, nil
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(c *RateLimit) (*bucket, error) {
+	if c.Rate <= 0 || math.IsInf(c.Rate, 0) || math.IsNaN(c.Rate) {
+		return nil, errors.New("proxy: rate limit must be positive")
+	}
+
+	if c.Burst < 0 {
+		return nil, errors.New("proxy: negative rate limit burst")
+	}
+
+	burst := float64(c.Burst)
+
+	if burst == 0 {
+		burst = math.Ceil(c.Rate)
+	}
+
+	return &bucket{
+		rate:   c.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}, nil
+}
+
+// take removes a token if one is available. Otherwise it returns how long
+// until the next token.
+func (b *bucket) take(context.Context) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / b.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// redisBucket is a token bucket kept in a Redis hash, updated atomically by
+// a script using the server's clock.
+type redisBucket struct {
+	s           *scope
+	client      *redisClient
+	key         string
+	rate, burst string
+
+	// reported is when an error was last reported, in Unix nanoseconds.
+	reported int64
+}
+
+// redisReportInterval limits error reports while Redis is unreachable.
+const redisReportInterval = 10 * time.Second
+
+const redisBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local v = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(v[1]) or burst
+local last = tonumber(v[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return tostring(wait)
+`
+
+func (b *redisBucket) take(ctx context.Context) (bool, time.Duration) {
+	v, err := b.client.do(ctx, "EVAL", redisBucketScript, "1", b.key,
+		b.rate, b.burst)
+
+	if err != nil {
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&b.reported)
+
+		if now-last > int64(redisReportInterval) &&
+			atomic.CompareAndSwapInt64(&b.reported, last, now) {
+			go b.s.report(err)
+		}
+
+		return true, 0
+	}
+
+	s, _ := v.(string)
+	wait, err := strconv.ParseFloat(s, 64)
+
+	if err != nil || wait <= 0 {
+		return true, 0
+	}
+
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// clientBuckets holds a token bucket per client key, discarding buckets
+// which have refilled.
+type clientBuckets struct {
+	c *RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+const sweepInterval = time.Minute
+
+func newClientBuckets(c *RateLimit) (*clientBuckets, error) {
+	// Validate the configuration once up front.
+	if _, err := newBucket(c); err != nil {
+		return nil, err
+	}
+
+	return &clientBuckets{
+		c:       c,
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}, nil
+}
+
+func (cb *clientBuckets) take(key string) (bool, time.Duration) {
+	cb.mu.Lock()
+
+	now := time.Now()
+
+	if now.Sub(cb.swept) > sweepInterval {
+		for k, b := range cb.buckets {
+			b.mu.Lock()
+			full := b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+			b.mu.Unlock()
+
+			if full {
+				delete(cb.buckets, k)
+			}
+		}
+
+		cb.swept = now
+	}
+
+	b, ok := cb.buckets[key]
+
+	if !ok {
+		b, _ = newBucket(cb.c)
+		cb.buckets[key] = b
+	}
+
+	cb.mu.Unlock()
+
+	return b.take(context.Background())
+}
+
+// retryAfter formats d as a Retry-After value in whole seconds, rounding up.
+func retryAfter(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// withRateLimit responds with 429 Too Many Requests once l is exhausted,
+// with the wait until it refills.
+func withRateLimit(l limiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, wait := l.take(req.Context()); !ok {
+			strike(req, "rate limit")
+			shed(w, req, http.StatusTooManyRequests, wait,
+				"rate limit exceeded")
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
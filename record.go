@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+var recorded = newCounterVec("http_proxy_recorded_requests_total",
+	"Requests considered for recording, by result.", "route", "result")
+
+// Record describes saving sampled requests of a route to files, one JSON
+// RecordedRequest each, so that they may be resent with "http-proxy replay".
+// Headers and JSON fields are redacted like those of Capture, as are the
+// query parameters of RedactQuery and the route's APIKey.
+type Record struct {
+	// Dir is the directory the files are written to.
+	Dir string `json:"dir"`
+
+	// Percent is optional. It is the share of requests, from 0 to 100,
+	// which are recorded, defaulting to 100.
+	Percent float64 `json:"percent"`
+
+	// MaxBodyBytes is optional. Larger bodies are left out of files,
+	// defaulting to 64 KiB.
+	MaxBodyBytes int `json:"max_body_bytes"`
+
+	// MaxFiles is optional. Recording stops once the proxy has written
+	// this many files, defaulting to 1000.
+	MaxFiles int64 `json:"max_files"`
+
+	// RedactHeaders and RedactFields are optional, as in Capture.
+	RedactHeaders []string `json:"redact_headers"`
+	RedactFields  []string `json:"redact_fields"`
+
+	// RedactQuery is optional. It lists query parameters whose values are
+	// hidden, in addition to the Query of the route's APIKey.
+	RedactQuery []string `json:"redact_query"`
+}
+
+// RecordedRequest is a request saved by Record.
+type RecordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Route  string      `json:"route"`
+	Method string      `json:"method"`
+	URI    string      `json:"uri"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+
+	// Base64 is whether Body is base64, not being UTF-8.
+	Base64 bool `json:"base64,omitempty"`
+
+	// BodyOmitted is whether the request had a body left out, being too
+	// large or not redactable.
+	BodyOmitted bool `json:"body_omitted,omitempty"`
+}
+
+const (
+	defaultRecordMaxBody  = 64 << 10
+	defaultRecordMaxFiles = 1000
+	recordReportInterval  = time.Minute
+)
+
+type recorder struct {
+	s        *scope
+	c        *Record
+	route    string
+	redact   *capture
+	query    map[string]bool
+	maxBody  int
+	maxFiles int64
+	files    int64
+
+	// reported is when a write error was last reported, in Unix
+	// nanoseconds.
+	reported int64
+}
+
+func newRecorder(s *scope, c *Record, route string, auth *credentials) (*recorder, error) {
+	if c.Dir == "" {
+		return nil, errors.New("proxy: record dir is empty")
+	}
+
+	if c.Percent < 0 || c.Percent > 100 {
+		return nil, errors.New("proxy: record percent out of range")
+	}
+
+	if c.MaxBodyBytes < 0 || c.MaxFiles < 0 {
+		return nil, errors.New("proxy: negative record limit")
+	}
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	redact, err := newCapture(&Capture{
+		RedactHeaders: c.RedactHeaders,
+		RedactFields:  c.RedactFields,
+	}, route, auth.headers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recorder{
+		s:        s,
+		c:        c,
+		route:    route,
+		redact:   redact,
+		query:    make(map[string]bool),
+		maxBody:  c.MaxBodyBytes,
+		maxFiles: c.MaxFiles,
+	}
+
+	for _, hs := range [][]string{auth.query, c.RedactQuery} {
+		for _, name := range hs {
+			rec.query[name] = true
+		}
+	}
+
+	if rec.maxBody == 0 {
+		rec.maxBody = defaultRecordMaxBody
+	}
+
+	if rec.maxFiles == 0 {
+		rec.maxFiles = defaultRecordMaxFiles
+	}
+
+	return rec, nil
+}
+
+// body returns b, redacted if JSON and fields are redacted, and whether it
+// can be recorded.
+func (rec *recorder) body(b []byte, contentType string) ([]byte, bool) {
+	if len(b) > rec.maxBody {
+		return nil, false
+	}
+
+	mt, _, _ := mime.ParseMediaType(contentType)
+
+	if len(rec.redact.fields) == 0 || mt != "application/json" &&
+		!strings.HasSuffix(mt, "+json") {
+		return b, true
+	}
+
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false
+	}
+
+	rec.redact.redact(v)
+	b, err := json.Marshal(v)
+	return b, err == nil
+}
+
+// report reports err, at most once a minute.
+func (rec *recorder) report(err error) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&rec.reported)
+
+	if now-last > int64(recordReportInterval) &&
+		atomic.CompareAndSwapInt64(&rec.reported, last, now) {
+		rec.s.report(err)
+	}
+}
+
+func (rec *recorder) write(rr *RecordedRequest) error {
+	b, err := json.MarshalIndent(rr, "", "\t")
+
+	if err != nil {
+		return err
+	}
+
+	name := rr.Time.UTC().Format("20060102T150405.000000000") + "-" +
+		randomHex(4) + ".json"
+	return os.WriteFile(filepath.Join(rec.c.Dir, name), b, 0600)
+}
+
+// withRecord saves a share of requests once they have been served, with the
+// part of their bodies read.
+func withRecord(rec *recorder, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rec.c.Percent != 0 && rand.Float64()*100 >= rec.c.Percent ||
+			atomic.LoadInt64(&rec.files) >= rec.maxFiles {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		rr := &RecordedRequest{
+			Time:   time.Now(),
+			Route:  rec.route,
+			Method: req.Method,
+			URI:    redactURI(req.RequestURI, rec.query),
+			Host:   req.Host,
+			Header: rec.redact.header(req.Header),
+		}
+
+		buf := &captureBuffer{max: rec.maxBody + 1}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &captureBody{ReadCloser: req.Body, buf: buf}
+		}
+
+		h.ServeHTTP(w, req)
+
+		if b := buf.bytes(); len(b) != 0 {
+			body, ok := rec.body(b, req.Header.Get("Content-Type"))
+			rr.setBody(body)
+			rr.BodyOmitted = !ok
+		}
+
+		if atomic.AddInt64(&rec.files, 1) > rec.maxFiles {
+			recorded.inc(rec.route, "limit")
+			return
+		}
+
+		rec.s.run(func() {
+			if err := rec.write(rr); err != nil {
+				recorded.inc(rec.route, "error")
+				rec.report(err)
+				return
+			}
+
+			recorded.inc(rec.route, "written")
+		})
+	})
+}
+
+func (rr *RecordedRequest) setBody(b []byte) {
+	if utf8.Valid(b) {
+		rr.Body = string(b)
+	} else {
+		rr.Body, rr.Base64 = base64.StdEncoding.EncodeToString(b), true
+	}
+}
+
+// ReadRecordedRequest reads a file written by Record.
+func ReadRecordedRequest(name string) (*RecordedRequest, error) {
+	b, err := os.ReadFile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rr RecordedRequest
+
+	if err = json.Unmarshal(b, &rr); err != nil {
+		return nil, errors.New("proxy: " + name + ": " + err.Error())
+	}
+
+	return &rr, nil
+}
+
+// Request returns rr as a request to resend to target, an HTTP URL whose
+// scheme and host replace those of the original request. Redacted headers
+// and query parameters are left out, as are hop-by-hop headers.
+func (rr *RecordedRequest) Request(target string) (*http.Request, error) {
+	base, err := url.Parse(target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.ParseRequestURI(rr.URI)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := splitQuery(u.RawQuery)
+	kept := pairs[:0]
+
+	for _, p := range pairs {
+		if p.value() != redacted {
+			kept = append(kept, p)
+		}
+	}
+
+	u.RawQuery = joinQuery(kept)
+	body := []byte(rr.Body)
+
+	if rr.Base64 {
+		if body, err = base64.StdEncoding.DecodeString(rr.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	u.Scheme, u.Host = base.Scheme, base.Host
+	req, err := http.NewRequest(rr.Method, u.String(), bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range rr.Header {
+		if len(v) == 1 && v[0] == redacted {
+			continue
+		}
+		req.Header[k] = v
+	}
+
+	for _, k := range hopHeaders {
+		req.Header.Del(k)
+	}
+
+	req.Header.Del("Content-Length")
+	req.Host = rr.Host
+	req.ContentLength = int64(len(body))
+	return req, nil
+}
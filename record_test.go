@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordRedactsQuery(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scope{ctx: ctx}
+
+	rec, err := newRecorder(s, &Record{Dir: dir, RedactQuery: []string{"token"}},
+		"/", newCredentials(Route{APIKey: &APIKey{Query: "api_key"}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := withRecord(rec, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet,
+		"/x?a=1&api_key=k3y&token=t0ken&b=%20", nil))
+
+	cancel()
+	s.wg.Wait()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+
+	if len(files) != 1 {
+		t.Fatalf("wrote %d files, want 1", len(files))
+	}
+
+	b, err := os.ReadFile(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "k3y") || strings.Contains(string(b), "t0ken") {
+		t.Errorf("recorded secrets: %s", b)
+	}
+
+	rr, err := ReadRecordedRequest(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replays leave redacted parameters out.
+	req, err := rr.Request("http://backend")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := req.URL.RawQuery; got != "a=1&b=%20" {
+		t.Errorf("replayed query %q", got)
+	}
+}
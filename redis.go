@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Redis describes a Redis server used to share state between proxy
+// instances.
+type Redis struct {
+	// Addr of the server, such as "127.0.0.1:6379".
+	Addr string `json:"addr"`
+
+	// Password and DB are optional.
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+
+	// Key is optional. It is the key, or key prefix, under which state is
+	// stored.
+	Key string `json:"key"`
+}
+
+const (
+	redisTimeout  = time.Second
+	redisMaxIdle  = 8
+	redisRespSize = 64 << 10
+)
+
+// redisClient is a minimal RESP client with a small connection pool.
+type redisClient struct {
+	c    *Redis
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "proxy: redis: " + string(e) }
+
+func newRedisClient(c *Redis) (*redisClient, error) {
+	if c.Addr == "" {
+		return nil, errors.New("proxy: redis addr is empty")
+	}
+
+	return &redisClient{c: c, idle: make(chan *redisConn, redisMaxIdle)}, nil
+}
+
+func (rc *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", rc.c.Addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if rc.c.Password != "" {
+		if _, err = c.do("AUTH", rc.c.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if rc.c.DB != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(rc.c.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// do runs a command on a pooled connection.
+func (rc *redisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	var c *redisConn
+
+	select {
+	case c = <-rc.idle:
+	default:
+		var err error
+
+		if c, err = rc.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+
+	v, err := c.do(args...)
+
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection state is unknown.
+		c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case rc.idle <- c:
+	default:
+		c.conn.Close()
+	}
+
+	return v, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+
+	for _, a := range args {
+		b = append(b, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		b = append(b, a...)
+		b = append(b, "\r\n"...)
+	}
+
+	if _, err := c.conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+// read parses a reply. Errors replies are returned as redisError.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("proxy: redis: malformed reply")
+	}
+
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+
+		if err != nil || n > redisRespSize {
+			return nil, errors.New("proxy: redis: bad bulk length")
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+
+		if err != nil {
+			return nil, errors.New("proxy: redis: bad array length")
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		a := make([]interface{}, n)
+
+		for i := range a {
+			if a[i], err = c.read(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+
+		return a, nil
+	}
+
+	return nil, fmt.Errorf("proxy: redis: unknown reply type %q", kind)
+}
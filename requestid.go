@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// requestID returns the ID of req, or "" if it has none.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether an incoming X-Request-Id may be kept: up to
+// 128 characters, which are letters, digits or "-._:+/=".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == ':', c == '+', c == '/', c == '=':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID gives each request an ID, keeping a valid X-Request-Id from
+// the client. The ID is sent to backends as X-Request-Id and logged.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		req.Header.Set("X-Request-Id", id)
+		setLogField(req, "request_id", id)
+
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
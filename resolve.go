@@ -0,0 +1,542 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNS describes how backend hostnames are resolved.
+type DNS struct {
+	// Servers is optional. If specified, lookups are sent to these servers
+	// in turn instead of the system resolver, such as "1.1.1.1" or
+	// "[2606:4700::1111]:53".
+	Servers []string `json:"servers"`
+
+	// Timeout is optional. It bounds each lookup, defaulting to 5s.
+	Timeout Duration `json:"timeout"`
+
+	// Cache is optional. If true, lookups are cached for the TTL of the
+	// returned records and re-resolved once it expires. New connections
+	// are spread across all cached addresses. Names in /etc/hosts are
+	// resolved from it first.
+	Cache bool `json:"cache"`
+
+	// MinTTL and MaxTTL are optional. They bound the cache TTL, defaulting
+	// to 1s and 1h. MinTTL is also used when the TTL is unknown, such as
+	// for single-label names resolved through search domains.
+	MinTTL Duration `json:"min_ttl"`
+	MaxTTL Duration `json:"max_ttl"`
+
+	// IPFamily is optional. It is "ipv4" or "ipv6" to dial only addresses
+	// of that family, or "prefer_ipv4" or "prefer_ipv6" to dial them
+	// first. By default, the family of the first address resolved is
+	// dialed first.
+	IPFamily string `json:"ip_family"`
+
+	// FallbackDelay is optional. It is how long dialing addresses of the
+	// first family may take before those of the other family are raced
+	// against them, defaulting to 300ms. A negative value dials them in
+	// turn.
+	FallbackDelay Duration `json:"fallback_delay"`
+
+	// Cooldown is optional. Addresses which fail to connect are dialed
+	// after the others for this long, defaulting to 30s. A negative value
+	// dials them in the order resolved.
+	Cooldown Duration `json:"cooldown"`
+}
+
+const (
+	defaultDNSTimeout = 5 * time.Second
+	defaultMinTTL     = time.Second
+	defaultMaxTTL     = time.Hour
+
+	defaultFallbackDelay = 300 * time.Millisecond
+	defaultCooldown      = 30 * time.Second
+)
+
+type resolver struct {
+	r       *net.Resolver
+	timeout time.Duration
+
+	// family and fallback control the dialing of dual-stack hosts.
+	family   string
+	fallback time.Duration
+
+	// failed holds when addresses which failed to connect may be dialed
+	// first again.
+	cooldown time.Duration
+	failedMu sync.Mutex
+	failed   map[string]time.Time
+
+	// Cache options, servers are for TTL-aware queries, made for names
+	// not in the hosts file.
+	cache          bool
+	hosts          string
+	servers        []string
+	minTTL, maxTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+	next    uint32
+
+	// changed, if non-nil, is called when a cached address set changes.
+	changed func()
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newResolver(c *DNS) (*resolver, error) {
+	r := &resolver{
+		r:        net.DefaultResolver,
+		timeout:  defaultDNSTimeout,
+		fallback: defaultFallbackDelay,
+		cooldown: defaultCooldown,
+		failed:   make(map[string]time.Time),
+	}
+
+	if c == nil {
+		return r, nil
+	}
+
+	switch c.IPFamily {
+	case "", "ipv4", "ipv6", "prefer_ipv4", "prefer_ipv6":
+		r.family = c.IPFamily
+	default:
+		return nil, errors.New("proxy: unknown dns ip_family " + c.IPFamily)
+	}
+
+	if c.FallbackDelay != 0 {
+		r.fallback = time.Duration(c.FallbackDelay)
+	}
+
+	if c.Cooldown != 0 {
+		r.cooldown = time.Duration(c.Cooldown)
+	}
+
+	if c.Timeout < 0 || c.MinTTL < 0 || c.MaxTTL < 0 {
+		return nil, errors.New("proxy: negative dns duration")
+	}
+
+	if c.Timeout != 0 {
+		r.timeout = time.Duration(c.Timeout)
+	}
+
+	servers := make([]string, len(c.Servers))
+
+	for i, s := range c.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		servers[i] = s
+	}
+
+	if c.Cache {
+		r.cache = true
+		r.hosts = "/etc/hosts"
+		r.entries = make(map[string]*dnsEntry)
+		r.minTTL, r.maxTTL = defaultMinTTL, defaultMaxTTL
+
+		if c.MinTTL != 0 {
+			r.minTTL = time.Duration(c.MinTTL)
+		}
+
+		if c.MaxTTL != 0 {
+			r.maxTTL = time.Duration(c.MaxTTL)
+		}
+
+		if r.minTTL > r.maxTTL {
+			return nil, errors.New("proxy: dns min_ttl exceeds max_ttl")
+		}
+
+		r.servers = servers
+
+		if len(r.servers) == 0 {
+			r.servers = systemNameservers()
+		}
+	}
+
+	if len(servers) == 0 {
+		return r, nil
+	}
+
+	var next uint32
+	var d net.Dialer
+
+	r.r = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			i := atomic.AddUint32(&next, 1)
+			return d.DialContext(ctx, network,
+				servers[int(i)%len(servers)])
+		},
+	}
+
+	return r, nil
+}
+
+// lookup resolves host to its IP addresses. IP literals are returned as-is.
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if !r.cache {
+		ips, _, err := r.resolve(ctx, host)
+		return ips, err
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	e := r.entries[host]
+	r.mu.Unlock()
+
+	if e == nil || now.After(e.expires) {
+		ips, ttl, err := r.resolve(ctx, host)
+
+		switch {
+		case err == nil:
+			if ttl < r.minTTL {
+				ttl = r.minTTL
+			} else if ttl > r.maxTTL {
+				ttl = r.maxTTL
+			}
+
+			changed := e != nil && !sameIPs(e.ips, ips)
+			e = &dnsEntry{ips: ips, expires: now.Add(ttl)}
+
+			r.mu.Lock()
+			r.entries[host] = e
+			r.mu.Unlock()
+
+			if changed && r.changed != nil {
+				r.changed()
+			}
+		case e != nil:
+			// Keep using the stale addresses until the next attempt.
+			e = &dnsEntry{ips: e.ips, expires: now.Add(r.minTTL)}
+
+			r.mu.Lock()
+			r.entries[host] = e
+			r.mu.Unlock()
+		default:
+			return nil, err
+		}
+	}
+
+	// Rotate the addresses so new connections are spread across them.
+	n := len(e.ips)
+	start := int(atomic.AddUint32(&r.next, 1) % uint32(n))
+	ips := make([]net.IP, 0, n)
+	ips = append(ips, e.ips[start:]...)
+	ips = append(ips, e.ips[:start]...)
+
+	return ips, nil
+}
+
+// resolve looks up host, returning the minimum record TTL when known.
+func (r *resolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if r.cache && len(r.servers) > 0 && strings.Contains(host, ".") {
+		// As with the system resolver, the hosts file comes first. Its
+		// addresses are kept for MinTTL.
+		if ips := hostsIPs(r.hosts, host); len(ips) != 0 {
+			return ips, 0, nil
+		}
+
+		var err error
+
+		for _, s := range r.servers {
+			var ips []net.IP
+			var ttl time.Duration
+
+			if ips, ttl, err = queryIPs(ctx, s, host); err == nil {
+				return ips, ttl, nil
+			}
+		}
+
+		return nil, 0, err
+	}
+
+	addrs, err := r.r.LookupIPAddr(ctx, host)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+
+	return ips, 0, nil
+}
+
+func queryIPs(ctx context.Context, server, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl uint32
+	var err error
+	found := false
+
+	// The addresses of one family are kept if the query for the other
+	// fails.
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		records, qerr := dnsQuery(ctx, server, host, qtype)
+
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+
+		for _, rr := range records {
+			if len(rr.data) != net.IPv4len && len(rr.data) != net.IPv6len {
+				continue
+			}
+
+			ips = append(ips, net.IP(append([]byte(nil), rr.data...)))
+
+			if !found || rr.ttl < ttl {
+				ttl, found = rr.ttl, true
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host,
+			Server: server, IsNotFound: true}
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	set := make(map[string]bool, len(a))
+
+	for _, ip := range a {
+		set[ip.String()] = true
+	}
+
+	for _, ip := range b {
+		if !set[ip.String()] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialer returns a dialFunc which resolves the address host with r and
+// dials the resolved addresses in order until one succeeds, those which failed
+// recently last. With addresses of both families, those of the other family
+// are raced against the first after the fallback delay.
+func (r *resolver) dialer(d *net.Dialer) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := r.lookup(ctx, host)
+
+		if err != nil {
+			return nil, err
+		}
+
+		primary, fallback := r.partition(r.demote(ips))
+
+		if len(primary) == 0 {
+			return nil, &net.DNSError{Err: "no addresses", Name: host}
+		}
+
+		if len(fallback) == 0 || r.fallback < 0 {
+			return r.dialSerial(ctx, d, network, port,
+				append(primary, fallback...))
+		}
+
+		return r.dialParallel(ctx, d, network, port, primary, fallback)
+	}
+}
+
+// partition splits ips by family, as preferred, or otherwise by the family of
+// the first address. Addresses of a forced family are never in fallback.
+func (r *resolver) partition(ips []net.IP) (primary, fallback []net.IP) {
+	var v4, v6 []net.IP
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch r.family {
+	case "ipv4":
+		return v4, nil
+	case "ipv6":
+		return v6, nil
+	case "prefer_ipv4":
+		primary, fallback = v4, v6
+	case "prefer_ipv6":
+		primary, fallback = v6, v4
+	default:
+		if len(ips) != 0 && ips[0].To4() == nil {
+			primary, fallback = v6, v4
+		} else {
+			primary, fallback = v4, v6
+		}
+	}
+
+	if len(primary) == 0 {
+		return fallback, nil
+	}
+
+	return primary, fallback
+}
+
+// demote returns ips with those in their cooldown moved to the end, in order.
+func (r *resolver) demote(ips []net.IP) []net.IP {
+	if r.cooldown < 0 {
+		return ips
+	}
+
+	now := time.Now()
+	ok := make([]net.IP, 0, len(ips))
+	var failed []net.IP
+
+	r.failedMu.Lock()
+
+	for _, ip := range ips {
+		until, found := r.failed[ip.String()]
+
+		switch {
+		case !found:
+			ok = append(ok, ip)
+		case now.After(until):
+			delete(r.failed, ip.String())
+			ok = append(ok, ip)
+		default:
+			failed = append(failed, ip)
+		}
+	}
+
+	r.failedMu.Unlock()
+
+	return append(ok, failed...)
+}
+
+// dialSerial dials ips in order until one succeeds, noting which fail.
+func (r *resolver) dialSerial(ctx context.Context, d *net.Dialer, network, port string, ips []net.IP) (net.Conn, error) {
+	var err error
+
+	for _, ip := range ips {
+		var conn net.Conn
+
+		conn, err = d.DialContext(ctx, network,
+			net.JoinHostPort(ip.String(), port))
+
+		r.failedMu.Lock()
+
+		if err == nil {
+			delete(r.failed, ip.String())
+		} else if ctx.Err() == nil && r.cooldown > 0 {
+			// Dials cancelled by the caller are not failures.
+			r.failed[ip.String()] = time.Now().Add(r.cooldown)
+		}
+
+		r.failedMu.Unlock()
+
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialParallel dials primary, racing fallback against it once the fallback
+// delay passes or primary fails, per Happy Eyeballs (RFC 8305). The error of
+// primary is returned if both fail.
+func (r *resolver) dialParallel(ctx context.Context, d *net.Dialer, network, port string, primary, fallback []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	returned := make(chan struct{})
+	defer close(returned)
+
+	results := make(chan dialResult)
+
+	race := func(ips []net.IP) {
+		conn, err := r.dialSerial(ctx, d, network, port, ips)
+
+		select {
+		case results <- dialResult{conn, err}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(primary)
+
+	timer := time.NewTimer(r.fallback)
+	defer timer.Stop()
+
+	var firstErr error
+	pending, started := 1, false
+
+	for {
+		select {
+		case <-timer.C:
+			if !started {
+				started = true
+				pending++
+				go race(fallback)
+			}
+		case res := <-results:
+			pending--
+
+			if res.err == nil {
+				return res.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = res.err
+			}
+
+			if !started {
+				started = true
+				pending++
+				go race(fallback)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolverHostsFile(t *testing.T) {
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(hosts, []byte("# comment\n"+
+		"192.0.2.1 backend.internal backend # primary\n"+
+		"2001:db8::1 BACKEND.internal.\n"+
+		"192.0.2.9 other.internal\n"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server refuses queries, so names must come from the hosts file.
+	r, err := newResolver(&DNS{Servers: []string{"127.0.0.1:1"}, Cache: true,
+		Timeout: Duration(time.Second)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.hosts = hosts
+	ips, err := r.lookup(context.Background(), "backend.internal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameIPs(ips, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}) {
+		t.Errorf("resolved %v", ips)
+	}
+
+	if ips, err := r.lookup(context.Background(), "missing.internal"); err == nil {
+		t.Errorf("resolved missing name to %v", ips)
+	}
+}
+
+// serveTestDNS answers A queries with 192.0.2.1 and fails AAAA queries.
+func serveTestDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			q := buf[:n]
+			resp := append([]byte(nil), q...)
+			resp[2] |= 0x80 // response
+
+			if binary.BigEndian.Uint16(q[n-4:]) == dnsTypeA {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, dnsClassINET,
+					0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+			} else {
+				resp[3] |= 2 // server failure
+			}
+
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestQueryIPsOneFamilyFails(t *testing.T) {
+	server := serveTestDNS(t)
+	ips, ttl, err := queryIPs(context.Background(), server, "backend.internal")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameIPs(ips, []net.IP{net.ParseIP("192.0.2.1")}) {
+		t.Errorf("resolved %v", ips)
+	}
+
+	if ttl != time.Minute {
+		t.Errorf("ttl %v", ttl)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// ResponseRewrite describes changes made to backend responses.
+type ResponseRewrite struct {
+	// Status is optional. It maps backend statuses to those sent instead,
+	// such as {"404": 410}.
+	Status map[int]int `json:"status"`
+
+	// SetHeaders is optional. It sets response headers, deleting those
+	// set to "".
+	SetHeaders map[string]string `json:"set_headers"`
+
+	// AddHeaders is optional. It adds values to response headers.
+	AddHeaders map[string]string `json:"add_headers"`
+
+	// RemoveHeaders is optional. It lists response headers to delete,
+	// such as "Server".
+	RemoveHeaders []string `json:"remove_headers"`
+}
+
+func newResponseRewrite(c *ResponseRewrite) (func(*http.Response) error, error) {
+	for from, to := range c.Status {
+		if from < 100 || from > 999 || to < 100 || to > 999 {
+			return nil, errors.New("proxy: invalid response status " +
+				strconv.Itoa(from) + " to " + strconv.Itoa(to))
+		}
+	}
+
+	return func(resp *http.Response) error {
+		if to, ok := c.Status[resp.StatusCode]; ok {
+			resp.StatusCode = to
+			resp.Status = strconv.Itoa(to) + " " + http.StatusText(to)
+		}
+
+		for _, k := range c.RemoveHeaders {
+			resp.Header.Del(k)
+		}
+
+		for k, v := range c.SetHeaders {
+			if v == "" {
+				resp.Header.Del(k)
+			} else {
+				resp.Header.Set(k, v)
+			}
+		}
+
+		for k, v := range c.AddHeaders {
+			resp.Header.Add(k, v)
+		}
+
+		return nil
+	}, nil
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	retries = newCounterVec("http_proxy_retries_total",
+		"Requests resent to backends, by reason.", "route", "reason")
+	retriesDenied = newCounterVec("http_proxy_retries_denied_total",
+		"Retries not made because the retry budget was spent.", "route")
+)
+
+// Retry describes resending failed requests to backends. Only requests with
+// idempotent methods, or an Idempotency-Key header, are retried, and only if
+// their bodies are small enough to buffer. Routes with several backends
+// retry on another one when possible.
+type Retry struct {
+	// Attempts is the most times each request is resent.
+	Attempts int `json:"attempts"`
+
+	// Statuses is optional. It lists backend statuses, such as 502 and
+	// 503, which are retried as well as failures to reach the backend.
+	Statuses []int `json:"statuses"`
+
+	// Budget is optional. It limits retries to this fraction of requests
+	// over the last ten seconds, defaulting to 0.2. A few retries are
+	// always allowed.
+	Budget float64 `json:"budget"`
+}
+
+const (
+	defaultRetryBudget = 0.2
+	retryBudgetWindow  = 10 * time.Second
+	retryBudgetMin     = 3
+	maxRetryBody       = 64 << 10
+)
+
+// retryBudget counts requests and retries over the current and previous
+// windows.
+type retryBudget struct {
+	ratio float64
+
+	mu                 sync.Mutex
+	start              time.Time
+	requests, retries  float64
+	prevReq, prevRetry float64
+}
+
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.start) < retryBudgetWindow {
+		return
+	}
+
+	if now.Sub(b.start) < 2*retryBudgetWindow {
+		b.prevReq, b.prevRetry = b.requests, b.retries
+	} else {
+		b.prevReq, b.prevRetry = 0, 0
+	}
+
+	b.start = now
+	b.requests, b.retries = 0, 0
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.roll(time.Now())
+	b.requests++
+	b.mu.Unlock()
+}
+
+// spend reports whether a retry is within budget, counting it if so.
+func (b *retryBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(time.Now())
+	spent := b.retries + b.prevRetry
+
+	if spent >= retryBudgetMin && spent >= b.ratio*(b.requests+b.prevReq) {
+		return false
+	}
+
+	b.retries++
+	return true
+}
+
+// retryTransport resends failed requests.
+type retryTransport struct {
+	next     http.RoundTripper
+	route    string
+	attempts int
+	statuses map[int]bool
+	budget   *retryBudget
+	upstream *pool
+
+	// host is the Host header set by the route, if any.
+	host string
+}
+
+func newRetryTransport(c *Retry, route, host string, next http.RoundTripper, upstream *pool) (*retryTransport, error) {
+	if c.Attempts <= 0 {
+		return nil, errors.New("proxy: retry attempts must be positive")
+	}
+
+	if c.Budget < 0 || c.Budget > 1 {
+		return nil, errors.New("proxy: retry budget out of range")
+	}
+
+	t := &retryTransport{
+		next:     next,
+		route:    route,
+		attempts: c.Attempts,
+		statuses: make(map[int]bool),
+		budget:   &retryBudget{ratio: c.Budget},
+		upstream: upstream,
+		host:     host,
+	}
+
+	if t.budget.ratio == 0 {
+		t.budget.ratio = defaultRetryBudget
+	}
+
+	for _, s := range c.Statuses {
+		t.statuses[s] = true
+	}
+
+	return t, nil
+}
+
+// retryable reports whether req may be sent more than once.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// bufferBody reads small bodies into memory so that the request can be
+// resent, reporting false if the body is too large.
+func bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+
+	if req.ContentLength > maxRetryBody {
+		return false, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(b) > maxRetryBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		return false, nil
+	}
+
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.budget.request()
+
+	if !retryable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	ok, err := bufferBody(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		reason := "error"
+
+		switch {
+		case err == nil && !t.statuses[resp.StatusCode]:
+			return resp, nil
+		case err == nil:
+			reason = "status"
+		}
+
+		if attempt == t.attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if !t.budget.spend() {
+			retriesDenied.inc(t.route)
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryBody))
+			resp.Body.Close()
+		}
+
+		retries.inc(t.route, reason)
+
+		if req, err = t.resend(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resend returns the request to resend. Its backend is picked again from the
+// pool, as for the first attempt, unless a canary or rule chose it.
+func (t *retryTransport) resend(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.Body = body
+	}
+
+	key, picked := req.Context().Value(upstreamPickKey{}).(string)
+
+	if t.upstream != nil && picked {
+		if addr, ok := t.upstream.pick(key); ok {
+			r.URL.Host = addr
+
+			if t.host == "" {
+				r.Host = addr
+				r.Header.Set("Host", addr)
+			}
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// retryTestTransport fails every request with 503, recording where each was
+// sent.
+type retryTestTransport struct {
+	hosts, addrs []string
+}
+
+func (rt *retryTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.hosts = append(rt.hosts, req.Host)
+	rt.addrs = append(rt.addrs, req.URL.Host)
+
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestRetryResend(t *testing.T) {
+	p := &pool{}
+	p.set([]target{{Addr: "a:80", Weight: 1}, {Addr: "b:80", Weight: 1},
+		{Addr: "c:80", Weight: 1}})
+
+	want, _ := p.pick("192.0.2.1")
+
+	tests := []struct {
+		name   string
+		host   string
+		picked bool
+		hosts  string
+		addrs  string
+	}{
+		{"route host", "app.internal", true, "app.internal", want},
+		{"backend host", "", true, want, want},
+		{"chosen by a rule", "", false, "x:80", "x:80"},
+	}
+
+	for _, tt := range tests {
+		rt := &retryTestTransport{}
+		retry, err := newRetryTransport(&Retry{Attempts: 3, Statuses: []int{503}},
+			"/", tt.host, rt, p)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://x:80/", nil)
+		req.Host = "x:80"
+
+		if tt.host != "" {
+			req.Host = tt.host
+		}
+
+		if tt.picked {
+			req.URL.Host = want
+			req = req.WithContext(context.WithValue(req.Context(),
+				upstreamPickKey{}, "192.0.2.1"))
+		}
+
+		resp, err := retry.RoundTrip(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if len(rt.addrs) != 4 {
+			t.Fatalf("%s: sent %d times, want 4", tt.name, len(rt.addrs))
+		}
+
+		// Retries after the first attempt must match it.
+		for i := 1; i < len(rt.addrs); i++ {
+			if rt.addrs[i] != tt.addrs {
+				t.Errorf("%s: attempt %d sent to %s, want %s", tt.name, i,
+					rt.addrs[i], tt.addrs)
+			}
+
+			if rt.hosts[i] != tt.hosts {
+				t.Errorf("%s: attempt %d Host %s, want %s", tt.name, i,
+					rt.hosts[i], tt.hosts)
+			}
+		}
+	}
+}
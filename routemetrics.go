@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var sizeBuckets = []float64{100, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8}
+
+var (
+	requestBytes = newCounterVec("http_proxy_request_bytes_total",
+		"Request body bytes received from clients.", "route")
+	responseBytes = newCounterVec("http_proxy_response_bytes_total",
+		"Response body bytes sent to clients.", "route")
+	requestSizes = newHistogramVec("http_proxy_request_size_bytes",
+		"Request body sizes.", sizeBuckets, "route")
+	responseSizes = newHistogramVec("http_proxy_response_size_bytes",
+		"Response body sizes.", sizeBuckets, "route")
+	responses = newCounterVec("http_proxy_responses_total",
+		"Responses by status, and the backend last tried.", "route",
+		"host", "method", "upstream", "class", "code")
+)
+
+// upstreamNote records the backend a request was last sent to.
+type upstreamNote struct {
+	mu   sync.Mutex
+	addr string
+}
+
+type upstreamNoteKey struct{}
+
+// noteTransport records the backend of each request sent.
+type noteTransport struct {
+	next http.RoundTripper
+}
+
+func (t noteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if n, ok := req.Context().Value(upstreamNoteKey{}).(*upstreamNote); ok {
+		n.mu.Lock()
+		n.addr = req.URL.Host
+		n.mu.Unlock()
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// metricMethod returns the method label of a request, folding nonstandard
+// methods together.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// withRouteMetrics records the body sizes of the requests of a route and of
+// their responses, and counts the responses.
+func withRouteMetrics(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body *countingBody
+
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+
+		note := &upstreamNote{}
+		ctx := context.WithValue(req.Context(), upstreamNoteKey{}, note)
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, req.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		note.mu.Lock()
+		upstream := note.addr
+		note.mu.Unlock()
+
+		responses.inc(route, req.Host, metricMethod(req.Method), upstream,
+			strconv.Itoa(rec.status/100)+"xx", strconv.Itoa(rec.status))
+
+		var in int64
+
+		if body != nil {
+			in = atomic.LoadInt64(&body.n)
+		}
+
+		requestBytes.add(uint64(in), route)
+		responseBytes.add(uint64(rec.bytes), route)
+		requestSizes.observe(float64(in), route)
+		responseSizes.observe(float64(rec.bytes), route)
+	})
+}
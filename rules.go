@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Rule is a conditional action on the requests of a route.
+type Rule struct {
+	// If is an expression which must be true for the rule to apply, such
+	// as `header("X-Env") == "staging" && matches(path, "^/api/")`.
+	//
+	// Expressions use Go syntax with string, int and bool values. The
+	// identifiers method, path, query, host, ip and scheme give the
+	// request. The functions are header, param (of the query), cookie,
+	// lower and len of strings; has_prefix, has_suffix and contains;
+	// matches(s, regexp) and in_cidr(ip, cidrs), whose second arguments
+	// are string literals, with cidrs separated by commas.
+	If string `json:"if"`
+
+	// SetHeaders is optional. It sets request headers sent to the
+	// backend, deleting those set to "".
+	SetHeaders map[string]string `json:"set_headers"`
+
+	// Deny is optional. If nonzero, requests are answered with this
+	// status, which must be between 200 and 599.
+	Deny int `json:"deny"`
+
+	// Upstream is optional. If specified, requests are sent to this
+	// backend address, in the form "host:port", instead.
+	Upstream string `json:"upstream"`
+}
+
+type rule struct {
+	cond       func(req *http.Request) bool
+	setHeaders map[string]string
+	deny       int
+	upstream   string
+}
+
+func newRules(c []Rule) ([]rule, error) {
+	rules := make([]rule, len(c))
+
+	for i, r := range c {
+		cond, err := compileCondition(r.If)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Deny != 0 && (r.Deny < 200 || r.Deny > 599) {
+			return nil, errors.New("proxy: invalid rule deny status " +
+				strconv.Itoa(r.Deny))
+		}
+
+		rules[i] = rule{
+			cond:       cond,
+			setHeaders: r.SetHeaders,
+			deny:       r.Deny,
+			upstream:   r.Upstream,
+		}
+	}
+
+	return rules, nil
+}
+
+// withRules applies the rules matching each request in order. The first
+// matching rule which denies the request or chooses its upstream is the
+// last applied.
+func withRules(rules []rule, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range rules {
+			if !r.cond(req) {
+				continue
+			}
+
+			for k, v := range r.setHeaders {
+				if v == "" {
+					req.Header.Del(k)
+				} else {
+					req.Header.Set(k, v)
+				}
+			}
+
+			if r.deny != 0 {
+				http.Error(w, http.StatusText(r.deny), r.deny)
+				return
+			}
+
+			if r.upstream != "" {
+				ctx := context.WithValue(req.Context(), upstreamKey{},
+					r.upstream)
+				req = req.WithContext(ctx)
+				break
+			}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	rules, err := newRules([]Rule{
+		{If: `header("X-Env") == "staging"`, SetHeaders: map[string]string{
+			"X-Staging": "1", "X-Debug": ""}},
+		{If: `has_prefix(path, "/admin")`, Deny: http.StatusForbidden},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got http.Header
+	h := withRules(rules, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Env", "staging")
+	req.Header.Set("X-Debug", "1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Get("X-Staging") != "1" || got.Get("X-Debug") != "" {
+		t.Errorf("headers %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/x", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("denied request: status %d", w.Code)
+	}
+
+	for _, deny := range []int{-1, 42, 100, 199, 600, 1000} {
+		if _, err := newRules([]Rule{{If: "true", Deny: deny}}); err == nil {
+			t.Errorf("deny %d: accepted", deny)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// SlowClient describes how slowly clients may read responses before they are
+// cut off, freeing the backend connection.
+type SlowClient struct {
+	// Timeout is optional. It limits each write of the response to the
+	// client, defaulting to 10s.
+	Timeout Duration `json:"timeout"`
+
+	// MinRate is optional. If positive, it is the slowest rate, in bytes
+	// per second, at which clients must read, so that each write is
+	// allowed Timeout plus its size at this rate.
+	MinRate int64 `json:"min_rate"`
+}
+
+const defaultSlowClientTimeout = 10 * time.Second
+
+func checkSlowClient(c *SlowClient) error {
+	if c.Timeout < 0 {
+		return errors.New("proxy: negative slow_client timeout")
+	}
+
+	if c.MinRate < 0 {
+		return errors.New("proxy: negative slow_client min_rate")
+	}
+
+	return nil
+}
+
+// slowClientWriter sets the write deadline of the connection before each
+// write.
+type slowClientWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	req     *http.Request
+	timeout time.Duration
+	rate    int64
+}
+
+func (w *slowClientWriter) extend(n int) {
+	d := w.timeout
+
+	if w.rate > 0 {
+		d += time.Duration(n) * time.Second / time.Duration(w.rate)
+	}
+
+	_ = w.rc.SetWriteDeadline(time.Now().Add(d))
+}
+
+func (w *slowClientWriter) check(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		setLogField(w.req, "level", "warn")
+		setLogField(w.req, "slow_client", true)
+	}
+	return err
+}
+
+func (w *slowClientWriter) Write(b []byte) (int, error) {
+	w.extend(len(b))
+	n, err := w.ResponseWriter.Write(b)
+	return n, w.check(err)
+}
+
+func (w *slowClientWriter) FlushError() error {
+	w.extend(0)
+	return w.check(w.rc.Flush())
+}
+
+// Flush lets handlers asserting http.Flusher, such as
+// httputil.ReverseProxy, flush through the writer.
+func (w *slowClientWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *slowClientWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withSlowClient cuts off clients reading responses more slowly than c allows.
+// Writes which time out fail, aborting the request.
+func withSlowClient(c *SlowClient, h http.Handler) http.Handler {
+	timeout := time.Duration(c.Timeout)
+
+	if timeout == 0 {
+		timeout = defaultSlowClientTimeout
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &slowClientWriter{
+			ResponseWriter: w,
+			rc:             http.NewResponseController(w),
+			req:            req,
+			timeout:        timeout,
+			rate:           c.MinRate,
+		}
+
+		h.ServeHTTP(sw, req)
+
+		// Allow the rest of the response to be sent once h returns.
+		sw.extend(0)
+	})
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSlowClientFlush(t *testing.T) {
+	var flusher bool
+	h := withSlowClient(&SlowClient{}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var f http.Flusher
+		f, flusher = w.(http.Flusher)
+
+		if flusher {
+			w.Write([]byte("partial"))
+			f.Flush()
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !flusher {
+		t.Fatal("slow client writer is not an http.Flusher")
+	}
+
+	if !w.Flushed {
+		t.Error("flush did not reach the underlying writer")
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestTiming is the breakdown of the last attempt of a request to a
+// backend.
+type requestTiming struct {
+	mu       sync.Mutex
+	upstream string
+	start    time.Time
+	dns      time.Duration
+	connect  time.Duration
+	tls      time.Duration
+	ttfb     time.Duration
+	got      bool // whether a connection was obtained
+	reused   bool
+}
+
+type requestTimingKey struct{}
+
+// traceTransport records the timing of requests sent to backends, and if
+// metrics is true, the metrics of each attempt.
+type traceTransport struct {
+	next    http.RoundTripper
+	route   string
+	metrics bool
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt, ok := req.Context().Value(requestTimingKey{}).(*requestTiming)
+
+	if !ok && !t.metrics {
+		return t.next.RoundTrip(req)
+	}
+
+	if !ok {
+		rt = &requestTiming{}
+	}
+
+	start := time.Now()
+
+	// Only the last attempt is kept.
+	rt.mu.Lock()
+	rt.upstream, rt.start, rt.got, rt.reused = req.URL.Host, start, false, false
+	rt.dns, rt.connect, rt.tls, rt.ttfb = 0, 0, 0, 0
+	rt.mu.Unlock()
+
+	// Trace hooks may run concurrently, as dials to several addresses
+	// race, so start times are guarded by rt.mu too, and those of dials
+	// kept by address.
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+
+	mark := func(t *time.Time) {
+		rt.mu.Lock()
+		*t = time.Now()
+		rt.mu.Unlock()
+	}
+
+	since := func(t *time.Time, d *time.Duration) {
+		rt.mu.Lock()
+		*d = time.Since(*t)
+		rt.mu.Unlock()
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.mu.Lock()
+			rt.got, rt.reused = true, info.Reused
+			rt.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { since(&dnsStart, &rt.dns) },
+		ConnectStart: func(network, addr string) {
+			rt.mu.Lock()
+			connectStart[network+" "+addr] = time.Now()
+			rt.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			rt.mu.Lock()
+			defer rt.mu.Unlock()
+
+			// Prefer the time of the dial which succeeded.
+			if t, ok := connectStart[network+" "+addr]; ok &&
+				(err == nil || rt.connect == 0) {
+				rt.connect = time.Since(t)
+			}
+		},
+		TLSHandshakeStart: func() { mark(&tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			since(&tlsStart, &rt.tls)
+		},
+		GotFirstResponseByte: func() { since(&start, &rt.ttfb) },
+	}
+
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+
+	if t.metrics {
+		rt.observe(t.route, err == nil)
+	}
+
+	return resp, err
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// withRequestTiming adds the timing of the backend request to the access log,
+// for all requests if all is true, and otherwise for requests taking at least
+// slow, if positive, which are marked at the warn level.
+func withRequestTiming(slow time.Duration, all bool, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rt := &requestTiming{}
+		ctx := context.WithValue(req.Context(), requestTimingKey{}, rt)
+		h.ServeHTTP(w, req.WithContext(ctx))
+
+		elapsed := time.Since(start)
+
+		if slow > 0 && elapsed >= slow {
+			setLogField(req, "level", "warn")
+			setLogField(req, "slow", true)
+			setLogField(req, "route", route)
+		} else if !all {
+			return
+		}
+
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+
+		if rt.start.IsZero() {
+			return
+		}
+
+		setLogField(req, "upstream", rt.upstream)
+		setLogField(req, "upstream_reused", rt.reused)
+		setLogField(req, "before_upstream_ms", milliseconds(rt.start.Sub(start)))
+		setLogField(req, "dns_ms", milliseconds(rt.dns))
+		setLogField(req, "connect_ms", milliseconds(rt.connect))
+		setLogField(req, "tls_ms", milliseconds(rt.tls))
+		setLogField(req, "ttfb_ms", milliseconds(rt.ttfb))
+	})
+}
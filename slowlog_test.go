@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// raceTestTransport calls the trace hooks as racing dials do, then responds.
+type raceTestTransport struct{}
+
+func (raceTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	trace.DNSStart(httptrace.DNSStartInfo{})
+	trace.DNSDone(httptrace.DNSDoneInfo{})
+
+	var wg sync.WaitGroup
+
+	for _, addr := range []string{"[2001:db8::1]:443", "192.0.2.1:443", "192.0.2.2:443"} {
+		wg.Add(1)
+
+		go func(addr string) {
+			defer wg.Done()
+			trace.ConnectStart("tcp", addr)
+
+			var err error
+
+			if addr != "192.0.2.1:443" {
+				err = errors.New("refused")
+			} else {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			trace.ConnectDone("tcp", addr, err)
+			trace.TLSHandshakeStart()
+			trace.TLSHandshakeDone(tls.ConnectionState{}, nil)
+		}(addr)
+	}
+
+	wg.Wait()
+	trace.GotConn(httptrace.GotConnInfo{})
+	trace.GotFirstResponseByte()
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestTraceTransport(t *testing.T) {
+	rt := &requestTiming{}
+	tr := traceTransport{next: raceTestTransport{}, route: "/"}
+
+	req := httptest.NewRequest(http.MethodGet, "http://backend/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), requestTimingKey{}, rt))
+
+	resp, err := tr.RoundTrip(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if !rt.got || rt.upstream != "backend" {
+		t.Errorf("got %v, upstream %q", rt.got, rt.upstream)
+	}
+
+	// The connect time is that of the dial which succeeded.
+	if rt.connect < 10*time.Millisecond {
+		t.Errorf("connect time %v, want that of the successful dial", rt.connect)
+	}
+
+	if rt.ttfb < rt.connect {
+		t.Errorf("time to first byte %v, less than connect time %v", rt.ttfb,
+			rt.connect)
+	}
+}
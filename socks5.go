@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 describes a SOCKS5 proxy used to dial backends.
+type SOCKS5 struct {
+	// Addr of the SOCKS5 server, such as "127.0.0.1:1080".
+	Addr string `json:"addr"`
+
+	// Username and Password are optional. If specified, username/password
+	// authentication (RFC 1929) is offered to the server.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+const socks5Version = 5
+
+// socks5HandshakeTimeout bounds the handshake when the dial has no deadline.
+const socks5HandshakeTimeout = 30 * time.Second
+
+const (
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+)
+
+const (
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var socks5Replies = [...]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (s *SOCKS5) check() error {
+	if s.Addr == "" {
+		return errors.New("proxy: socks5 addr is empty")
+	}
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("proxy: socks5 credentials too long")
+	}
+	return nil
+}
+
+// dialer returns a dialFunc which connects to addr through the SOCKS5 server,
+// using dial to reach the server itself. Hostnames are resolved by the SOCKS5
+// server.
+func (s *SOCKS5) dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, "tcp", s.Addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		deadline, ok := ctx.Deadline()
+
+		if !ok {
+			deadline = time.Now().Add(socks5HandshakeTimeout)
+		}
+
+		conn.SetDeadline(deadline)
+
+		// Canceling ctx interrupts the handshake.
+		stop := context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Unix(1, 0))
+		})
+
+		err = s.connect(conn, addr)
+
+		if !stop() {
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy: socks5 %s: %w", s.Addr, err)
+		}
+
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+func (s *SOCKS5) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{socks5AuthNone}
+	if s.Username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if s.Username == "" {
+			return errors.New("server requires authentication")
+		}
+		if err = s.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAccept:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", resp[1])
+	}
+
+	req = []byte{socks5Version, 0x01, 0x00} // CONNECT
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("hostname too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socks5Replies) {
+			return errors.New(socks5Replies[reply[1]])
+		}
+		return fmt.Errorf("unknown reply %d", reply[1])
+	}
+
+	// Discard the bound address.
+	var n int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err = io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unknown address type %d", reply[3])
+	}
+
+	_, err = io.CopyN(io.Discard, conn, int64(n)+2)
+	return err
+}
+
+func (s *SOCKS5) authenticate(conn net.Conn) error {
+	req := []byte{0x01, byte(len(s.Username))}
+	req = append(req, s.Username...)
+	req = append(req, byte(len(s.Password)))
+	req = append(req, s.Password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+
+	if resp[1] != 0 {
+		return errors.New("authentication failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveSOCKS5 accepts connections, answering the handshake of each if ok is
+// true, and otherwise stalling.
+func serveSOCKS5(t *testing.T, ok bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if !ok {
+					io.Copy(io.Discard, conn)
+					return
+				}
+
+				// Methods, then CONNECT to an IPv4 address.
+				var b [3 + 10]byte
+
+				if _, err := io.ReadFull(conn, b[:3]); err != nil {
+					return
+				}
+
+				conn.Write([]byte{socks5Version, socks5AuthNone})
+
+				if _, err := io.ReadFull(conn, b[3:]); err != nil {
+					return
+				}
+
+				conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4,
+					0, 0, 0, 0, 0, 0})
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestSOCKS5Dial(t *testing.T) {
+	var d net.Dialer
+	s := &SOCKS5{Addr: serveSOCKS5(t, true)}
+	conn, err := s.dialer(d.DialContext)(context.Background(), "tcp", "192.0.2.1:80")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	// A stalled handshake ends once the dial is canceled.
+	s = &SOCKS5{Addr: serveSOCKS5(t, false)}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = s.dialer(d.DialContext)(ctx, "tcp", "192.0.2.1:80")
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled handshake: error %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled handshake took %v", elapsed)
+	}
+}
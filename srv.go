@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSRVInterval = 30 * time.Second
+
+// srvScheme reports whether scheme refers to an SRV name, returning the
+// underlying protocol scheme.
+func srvScheme(scheme string) (string, bool) {
+	switch s := strings.ToLower(scheme); s {
+	case "http+srv", "https+srv":
+		return strings.TrimSuffix(s, "+srv"), true
+	}
+	return scheme, false
+}
+
+func lookupSRV(ctx context.Context, res *resolver, name string) ([]target, error) {
+	ctx, cancel := context.WithTimeout(ctx, res.timeout)
+	defer cancel()
+
+	_, srvs, err := res.r.LookupSRV(ctx, "", "", name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]target, len(srvs))
+
+	for i, srv := range srvs {
+		targets[i] = target{
+			Addr: net.JoinHostPort(strings.TrimSuffix(srv.Target, "."),
+				strconv.Itoa(int(srv.Port))),
+			Priority: int(srv.Priority),
+			Weight:   int(srv.Weight),
+		}
+	}
+
+	return targets, nil
+}
+
+// watchSRV resolves the SRV name into a pool and keeps re-resolving it until
+// the proxy stops. If re-resolution fails, the previous targets are kept.
+func watchSRV(s *scope, res *resolver, name string, route Route) (*pool, error) {
+	interval := defaultSRVInterval
+
+	if route.SRVInterval > 0 {
+		interval = time.Duration(route.SRVInterval)
+	}
+
+	targets, err := lookupSRV(s.ctx, res, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{targets: targets}
+
+	s.run(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				targets, err := lookupSRV(s.ctx, res, name)
+
+				if err != nil {
+					s.report(err)
+					continue
+				}
+
+				p.set(targets)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	})
+
+	return p, nil
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Tarpit describes a per-client rate which, when exceeded, causes the client
+// to be answered very slowly, wasting its resources rather than handing it a
+// fast 429.
+type Tarpit struct {
+	// Rate and Burst give the per-client limit, as in RateLimit.
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	// Duration is optional. It is how long a tarpitted response lasts,
+	// defaulting to 30s.
+	Duration Duration `json:"duration"`
+
+	// Interval is optional. It is the delay between trickled bytes,
+	// defaulting to 1s.
+	Interval Duration `json:"interval"`
+
+	// Max is optional. It bounds the number of clients held in the tarpit
+	// at once, defaulting to 100. Clients beyond it receive a plain 429.
+	Max int `json:"max"`
+}
+
+const (
+	defaultTarpitDuration = 30 * time.Second
+	defaultTarpitInterval = time.Second
+	defaultTarpitMax      = 100
+)
+
+type tarpit struct {
+	clients  *clientBuckets
+	duration time.Duration
+	interval time.Duration
+	slots    chan struct{}
+}
+
+func newTarpit(c *Tarpit) (*tarpit, error) {
+	if c.Duration < 0 || c.Interval < 0 || c.Max < 0 {
+		return nil, errors.New("proxy: negative tarpit option")
+	}
+
+	clients, err := newClientBuckets(&RateLimit{
+		Rate:  c.Rate,
+		Burst: c.Burst,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tarpit{
+		clients:  clients,
+		duration: defaultTarpitDuration,
+		interval: defaultTarpitInterval,
+	}
+
+	if c.Duration != 0 {
+		t.duration = time.Duration(c.Duration)
+	}
+
+	if c.Interval != 0 {
+		t.interval = time.Duration(c.Interval)
+	}
+
+	max := c.Max
+
+	if max == 0 {
+		max = defaultTarpitMax
+	}
+
+	t.slots = make(chan struct{}, max)
+	return t, nil
+}
+
+// serve trickles a response to the client one byte at a time.
+func (t *tarpit) serve(w http.ResponseWriter, req *http.Request) {
+	select {
+	case t.slots <- struct{}{}:
+		defer func() { <-t.slots }()
+	default:
+		http.Error(w, http.StatusText(http.StatusTooManyRequests),
+			http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	deadline := time.NewTimer(t.duration)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := w.Write([]byte{' '}); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-deadline.C:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// withTarpit tarpits clients which exceed the per-client rate of t.
+func withTarpit(t *tarpit, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, _ := t.clients.take(clientIP(req)); !ok {
+			strike(req, "tarpit")
+			t.serve(w, req)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
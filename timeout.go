@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout describes a deadline for proxying each request of a route. Requests
+// which miss it are canceled and answered with 504 Gateway Timeout, with the
+// body of the route's error page, unless the response has already begun.
+type Timeout struct {
+	// Duration limits each request, from connecting to the backend to
+	// copying the whole response.
+	Duration Duration `json:"duration"`
+
+	// Exclude is optional. It lists path prefixes, such as "/events/",
+	// of streaming requests without a deadline. WebSocket upgrades and
+	// requests accepting only "text/event-stream" never have one.
+	Exclude []string `json:"exclude"`
+}
+
+func checkTimeout(c *Timeout) error {
+	if c.Duration <= 0 {
+		return errors.New("proxy: timeout duration must be positive")
+	}
+	return nil
+}
+
+// streaming reports whether req is a WebSocket upgrade or an event stream.
+func streaming(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		return true
+	}
+
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Accept"))
+	return mt == "text/event-stream"
+}
+
+// withTimeout cancels requests which are not done within the deadline.
+func withTimeout(c *Timeout, h http.Handler) http.Handler {
+	d := time.Duration(c.Duration)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if streaming(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		for _, prefix := range c.Exclude {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				h.ServeHTTP(w, req)
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// traceContext is the W3C trace context of a request.
+type traceContext struct {
+	traceID  string
+	parentID string
+	flags    string
+}
+
+type traceContextKey struct{}
+
+// traceOf returns the trace context of req, if any.
+func traceOf(req *http.Request) (traceContext, bool) {
+	tc, ok := req.Context().Value(traceContextKey{}).(traceContext)
+	return tc, ok
+}
+
+// sampled reports whether the caller may be recording the trace.
+func (tc traceContext) sampled() bool {
+	b, _ := hex.DecodeString(tc.flags)
+	return len(b) == 1 && b[0]&1 == 1
+}
+
+func (tc traceContext) String() string {
+	return "00-" + tc.traceID + "-" + tc.parentID + "-" + tc.flags
+}
+
+// isHex reports whether s is n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseTraceparent parses a traceparent header. Versions after 00 are parsed
+// as 00, ignoring any further fields.
+func parseTraceparent(s string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" ||
+		parts[0] == "00" && len(parts) != 4 {
+		return traceContext{}, false
+	}
+
+	if !isHex(parts[1], 32) || strings.Trim(parts[1], "0") == "" ||
+		!isHex(parts[2], 16) || strings.Trim(parts[2], "0") == "" ||
+		!isHex(parts[3], 2) {
+		return traceContext{}, false
+	}
+
+	return traceContext{
+		traceID:  parts[1],
+		parentID: parts[2],
+		flags:    parts[3],
+	}, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", 2*n-1) + "1"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// newTraceContext starts a trace, sampled so that backends record it.
+func newTraceContext() traceContext {
+	return traceContext{
+		traceID:  randomHex(16),
+		parentID: randomHex(8),
+		flags:    "01",
+	}
+}
+
+// withTraceContext passes W3C trace context headers on to backends, starting
+// a trace for requests without a valid traceparent. The trace ID is logged.
+// With a tracer, sampled requests are exported as spans, which backends see as
+// their parent.
+func withTraceContext(t *tracer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tc, ok := parseTraceparent(req.Header.Get("Traceparent"))
+		parent := tc.parentID
+
+		if !ok {
+			// tracestate is meaningless without its traceparent.
+			tc = newTraceContext()
+			parent = ""
+			req.Header.Del("Tracestate")
+		}
+
+		sampled := t != nil && tc.sampled()
+
+		if sampled && ok {
+			tc.parentID = randomHex(8)
+		}
+
+		req.Header.Set("Traceparent", tc.String())
+		setLogField(req, "trace_id", tc.traceID)
+
+		ctx := context.WithValue(req.Context(), traceContextKey{}, tc)
+		req = req.WithContext(ctx)
+
+		if sampled {
+			t.serve(tc, parent, w, req, h)
+		} else {
+			h.ServeHTTP(w, req)
+		}
+	})
+}
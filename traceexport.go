@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+)
+
+// otlpValue is an OTLP AnyValue, whose integers are strings in JSON.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	default:
+		return map[string]interface{}{"stringValue": v}
+	}
+}
+
+func otlpAttrs(attrs []spanAttr) []map[string]interface{} {
+	a := make([]map[string]interface{}, len(attrs))
+
+	for i, attr := range attrs {
+		a[i] = map[string]interface{}{
+			"key":   attr.key,
+			"value": otlpValue(attr.value),
+		}
+	}
+
+	return a
+}
+
+// encodeOTLP encodes spans as an OTLP ExportTraceServiceRequest in JSON.
+func encodeOTLP(service string, spans []*span) ([]byte, error) {
+	const (
+		kindServer  = 2
+		statusError = 2
+	)
+
+	out := make([]map[string]interface{}, len(spans))
+
+	for i, sp := range spans {
+		s := map[string]interface{}{
+			"traceId":           sp.traceID,
+			"spanId":            sp.id,
+			"name":              sp.name,
+			"kind":              kindServer,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(sp.attrs),
+		}
+
+		if sp.parentID != "" {
+			s["parentSpanId"] = sp.parentID
+		}
+
+		if sp.failed {
+			s["status"] = map[string]interface{}{"code": statusError}
+		}
+
+		out[i] = s
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs([]spanAttr{
+					{"service.name", service},
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": defaultServiceName},
+				"spans": out,
+			}},
+		}},
+	})
+}
+
+// encodeZipkin encodes spans for the Zipkin v2 API.
+func encodeZipkin(service string, spans []*span) ([]byte, error) {
+	out := make([]map[string]interface{}, len(spans))
+
+	for i, sp := range spans {
+		tags := make(map[string]string, len(sp.attrs)+1)
+		var remote map[string]interface{}
+
+		for _, attr := range sp.attrs {
+			switch v := attr.value.(type) {
+			case int64:
+				tags[attr.key] = strconv.FormatInt(v, 10)
+			case string:
+				tags[attr.key] = v
+			}
+		}
+
+		if ip := net.ParseIP(tags["client.address"]); ip.To4() != nil {
+			remote = map[string]interface{}{"ipv4": ip.String()}
+		} else if ip != nil {
+			remote = map[string]interface{}{"ipv6": ip.String()}
+		}
+
+		if sp.failed {
+			tags["error"] = tags["http.response.status_code"]
+		}
+
+		s := map[string]interface{}{
+			"traceId":       sp.traceID,
+			"id":            sp.id,
+			"name":          sp.name,
+			"kind":          "SERVER",
+			"timestamp":     sp.start.UnixMicro(),
+			"duration":      sp.end.Sub(sp.start).Microseconds(),
+			"localEndpoint": map[string]interface{}{"serviceName": service},
+			"tags":          tags,
+		}
+
+		if sp.parentID != "" {
+			s["parentId"] = sp.parentID
+		}
+
+		if remote != nil {
+			s["remoteEndpoint"] = remote
+		}
+
+		out[i] = s
+	}
+
+	return json.Marshal(out)
+}
+
+// thriftWriter writes the Thrift binary protocol.
+type thriftWriter struct {
+	bytes.Buffer
+}
+
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftList   = 15
+)
+
+func (w *thriftWriter) field(typ byte, id int16) {
+	w.WriteByte(typ)
+	_ = binary.Write(w, binary.BigEndian, id)
+}
+
+func (w *thriftWriter) stop() {
+	w.WriteByte(thriftStop)
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(thriftI32, id)
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(thriftI64, id)
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *thriftWriter) bool(id int16, v bool) {
+	w.field(thriftBool, id)
+
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *thriftWriter) string(id int16, s string) {
+	w.field(thriftString, id)
+	_ = binary.Write(w, binary.BigEndian, int32(len(s)))
+	w.WriteString(s)
+}
+
+func (w *thriftWriter) list(id int16, elem byte, n int) {
+	w.field(thriftList, id)
+	w.WriteByte(elem)
+	_ = binary.Write(w, binary.BigEndian, int32(n))
+}
+
+// jaegerTag writes a jaeger.thrift Tag.
+func (w *thriftWriter) jaegerTag(key string, v interface{}) {
+	const (
+		tagString = 0
+		tagBool   = 2
+		tagLong   = 3
+	)
+
+	w.string(1, key)
+
+	switch v := v.(type) {
+	case int64:
+		w.i32(2, tagLong)
+		w.i64(6, v)
+	case bool:
+		w.i32(2, tagBool)
+		w.bool(5, v)
+	case string:
+		w.i32(2, tagString)
+		w.string(3, v)
+	}
+
+	w.stop()
+}
+
+// hexID decodes a hex span ID, or the high and low halves of a trace ID.
+func hexID(s string) (high, low int64) {
+	b, _ := hex.DecodeString(s)
+
+	if len(b) == 16 {
+		high = int64(binary.BigEndian.Uint64(b))
+		b = b[8:]
+	}
+
+	if len(b) == 8 {
+		low = int64(binary.BigEndian.Uint64(b))
+	}
+
+	return high, low
+}
+
+// encodeJaeger encodes spans as a jaeger.thrift Batch.
+func encodeJaeger(service string, spans []*span) ([]byte, error) {
+	w := &thriftWriter{}
+
+	// Process.
+	w.field(thriftStruct, 1)
+	w.string(1, service)
+	w.stop()
+
+	w.list(2, thriftStruct, len(spans))
+
+	for _, sp := range spans {
+		high, low := hexID(sp.traceID)
+		_, id := hexID(sp.id)
+		_, parent := hexID(sp.parentID)
+
+		w.i64(1, low)
+		w.i64(2, high)
+		w.i64(3, id)
+		w.i64(4, parent)
+		w.string(5, sp.name)
+		w.i32(7, 1) // sampled
+		w.i64(8, sp.start.UnixMicro())
+		w.i64(9, sp.end.Sub(sp.start).Microseconds())
+
+		n := len(sp.attrs) + 1
+
+		if sp.failed {
+			n++
+		}
+
+		w.list(10, thriftStruct, n)
+		w.jaegerTag("span.kind", "server")
+
+		for _, attr := range sp.attrs {
+			w.jaegerTag(attr.key, attr.value)
+		}
+
+		if sp.failed {
+			w.jaegerTag("error", true)
+		}
+
+		w.stop()
+	}
+
+	w.stop()
+	return w.Bytes(), nil
+}
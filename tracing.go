@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+var droppedSpans = newCounterVec("http_proxy_trace_spans_dropped_total",
+	"Spans not exported, by reason.", "reason")
+
+// Tracing describes exporting a span for each sampled request to a tracing
+// collector.
+type Tracing struct {
+	// Exporter is optional. It is "otlp", the default, for OTLP over HTTP
+	// with JSON, "zipkin" for the Zipkin v2 API, or "jaeger" for Thrift
+	// over HTTP to a Jaeger collector.
+	Exporter string `json:"exporter"`
+
+	// Endpoint is the URL spans are sent to, such as
+	// "http://localhost:4318/v1/traces", "http://localhost:9411/api/v2/spans"
+	// or "http://localhost:14268/api/traces".
+	Endpoint string `json:"endpoint"`
+
+	// ServiceName is optional, defaulting to "http-proxy".
+	ServiceName string `json:"service_name"`
+
+	// Headers is optional. They are sent with each export, such as for
+	// authentication.
+	Headers map[string]string `json:"headers"`
+
+	// FlushInterval is optional. It is the longest spans wait to be sent,
+	// defaulting to 5s.
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+const (
+	defaultServiceName   = "http-proxy"
+	defaultFlushInterval = 5 * time.Second
+	traceQueue           = 2048
+	traceBatch           = 512
+	traceExportTimeout   = 10 * time.Second
+	traceReportInterval  = time.Minute
+)
+
+// span is a finished request served by the proxy.
+type span struct {
+	traceID, id, parentID string
+	name                  string
+	start, end            time.Time
+	attrs                 []spanAttr
+	failed                bool
+}
+
+// spanAttr is a span attribute, whose value is a string or int64.
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+// exporter encodes batches of spans for a collector.
+type exporter struct {
+	contentType string
+	encode      func(service string, spans []*span) ([]byte, error)
+}
+
+var exporters = map[string]exporter{
+	"otlp":   {"application/json", encodeOTLP},
+	"zipkin": {"application/json", encodeZipkin},
+	"jaeger": {"application/x-thrift", encodeJaeger},
+}
+
+type tracer struct {
+	s        *scope
+	exp      exporter
+	endpoint string
+	service  string
+	headers  map[string]string
+	interval time.Duration
+	client   *http.Client
+	spans    chan *span
+
+	// reported is when an export error was last reported, in Unix
+	// nanoseconds.
+	reported int64
+}
+
+func newTracer(s *scope, c *Tracing) (*tracer, error) {
+	name := c.Exporter
+
+	if name == "" {
+		name = "otlp"
+	}
+
+	exp, ok := exporters[name]
+
+	if !ok {
+		return nil, errors.New("proxy: unknown trace exporter " + name)
+	}
+
+	if u, err := url.Parse(c.Endpoint); err != nil || u.Host == "" ||
+		u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("proxy: invalid trace endpoint")
+	}
+
+	if c.FlushInterval < 0 {
+		return nil, errors.New("proxy: negative trace flush_interval")
+	}
+
+	t := &tracer{
+		s:        s,
+		exp:      exp,
+		endpoint: c.Endpoint,
+		service:  c.ServiceName,
+		headers:  c.Headers,
+		interval: time.Duration(c.FlushInterval),
+		client:   &http.Client{Timeout: traceExportTimeout},
+		spans:    make(chan *span, traceQueue),
+	}
+
+	if t.service == "" {
+		t.service = defaultServiceName
+	}
+
+	if t.interval == 0 {
+		t.interval = defaultFlushInterval
+	}
+
+	s.run(t.loop)
+	return t, nil
+}
+
+// record queues a span for export, dropping it if the queue is full.
+func (t *tracer) record(sp *span) {
+	select {
+	case t.spans <- sp:
+	default:
+		droppedSpans.inc("queue_full")
+	}
+}
+
+// loop sends spans in batches until the scope ends, then sends those left.
+func (t *tracer) loop() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var batch []*span
+
+	flush := func(ctx context.Context) {
+		if len(batch) != 0 {
+			t.export(ctx, batch)
+			batch = nil
+		}
+	}
+
+	for {
+		select {
+		case sp := <-t.spans:
+			if batch = append(batch, sp); len(batch) >= traceBatch {
+				flush(t.s.ctx)
+			}
+		case <-ticker.C:
+			flush(t.s.ctx)
+		case <-t.s.ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(),
+				traceExportTimeout)
+			defer cancel()
+
+			for len(t.spans) != 0 {
+				batch = append(batch, <-t.spans)
+			}
+
+			flush(ctx)
+			return
+		}
+	}
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) {
+	err := t.send(ctx, spans)
+
+	if err == nil {
+		return
+	}
+
+	droppedSpans.add(uint64(len(spans)), "export")
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&t.reported)
+
+	if t.s.ctx.Err() == nil && now-last > int64(traceReportInterval) &&
+		atomic.CompareAndSwapInt64(&t.reported, last, now) {
+		go t.s.report(err)
+	}
+}
+
+func (t *tracer) send(ctx context.Context, spans []*span) error {
+	b, err := t.exp.encode(t.service, spans)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint,
+		bytes.NewReader(b))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", t.exp.contentType)
+
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("proxy: trace export: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// serve serves req as the span tc.parentID, a child of parent unless "",
+// recording it once served.
+func (t *tracer) serve(tc traceContext, parent string, w http.ResponseWriter, req *http.Request, h http.Handler) {
+	rec := &responseRecorder{ResponseWriter: w}
+	start := time.Now()
+	h.ServeHTTP(rec, req)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	sp := &span{
+		traceID:  tc.traceID,
+		id:       tc.parentID,
+		parentID: parent,
+		name:     req.Method,
+		start:    start,
+		end:      time.Now(),
+		failed:   rec.status >= http.StatusInternalServerError,
+		attrs: []spanAttr{
+			{"http.request.method", req.Method},
+			{"url.path", req.URL.Path},
+			{"server.address", req.Host},
+			{"client.address", clientIP(req)},
+			{"http.response.status_code", int64(rec.status)},
+		},
+	}
+
+	if id := requestID(req); id != "" {
+		sp.attrs = append(sp.attrs, spanAttr{"http.request_id", id})
+	}
+
+	t.record(sp)
+}
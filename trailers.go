@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+type trailerKey struct{}
+
+// withTrailers keeps the trailer of requests as the server fills it in, for
+// the director. Copies of requests, such as those proxied, get copies of the
+// trailer taken before the body is read, which stay empty.
+func withTrailers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Trailer != nil {
+			ctx := context.WithValue(req.Context(), trailerKey{}, req.Trailer)
+			req = req.WithContext(ctx)
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// trailerBody copies the trailer of the client's request into that of the
+// proxied request once the body is read.
+type trailerBody struct {
+	io.ReadCloser
+	src, dst http.Header
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if err == io.EOF {
+		for k, v := range b.src {
+			b.dst[k] = v
+		}
+	}
+
+	return n, err
+}
+
+// forwardTrailers makes the proxied request req send the trailer of the
+// client's request.
+func forwardTrailers(req *http.Request) {
+	src, ok := req.Context().Value(trailerKey{}).(http.Header)
+
+	if !ok || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+
+	if req.Trailer == nil {
+		req.Trailer = make(http.Header, len(src))
+	}
+
+	req.Body = &trailerBody{ReadCloser: req.Body, src: src, dst: req.Trailer}
+}
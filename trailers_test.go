@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestTrailers(t *testing.T) {
+	got := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		got <- req.Trailer.Get("X-Checksum")
+	}))
+	defer backend.Close()
+
+	srv := serveProxy(t, ReverseProxy{Routes: []Route{{From: "/", To: backend.URL}}})
+
+	// A reader of unknown length makes the body chunked, as trailers
+	// require.
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, srv.URL, pr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Trailer = http.Header{"X-Checksum": nil}
+
+	go func() {
+		pw.Write([]byte("body"))
+		req.Trailer.Set("X-Checksum", "abc")
+		pw.Close()
+	}()
+
+	resp, err := srv.Client().Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if v := <-got; v != "abc" {
+		t.Fatalf("backend trailer X-Checksum = %q, want %q", v, "abc")
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	srv := serveProxy(t, ReverseProxy{Routes: []Route{{From: "/", To: backend.URL}}})
+	resp, err := srv.Client().Get(srv.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if _, ok := resp.Trailer["X-Checksum"]; !ok {
+		t.Fatalf("trailer X-Checksum not announced, have %v", resp.Trailer)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "body" {
+		t.Errorf("body = %q, want %q", b, "body")
+	}
+
+	if v := resp.Trailer.Get("X-Checksum"); v != "abc" {
+		t.Errorf("trailer X-Checksum = %q, want %q", v, "abc")
+	}
+}
+
+func TestForwardTrailersWithoutBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), trailerKey{},
+		http.Header{"X-A": {"b"}}))
+	forwardTrailers(req)
+
+	if req.Trailer != nil {
+		t.Errorf("trailer = %v, want none without a body", req.Trailer)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))
+	src := http.Header{}
+	req = req.WithContext(context.WithValue(req.Context(), trailerKey{}, src))
+	forwardTrailers(req)
+	src.Set("X-A", "b")
+	io.ReadAll(req.Body)
+
+	if v := req.Trailer.Get("X-A"); v != "b" {
+		t.Errorf("trailer X-A = %q, want %q", v, "b")
+	}
+}
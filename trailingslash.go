@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// checkTrailingSlash checks a Route.TrailingSlash mode.
+func checkTrailingSlash(mode string) error {
+	switch mode {
+	case "", "redirect", "rewrite", "same":
+		return nil
+	default:
+		return errors.New("proxy: unknown trailing_slash " + mode)
+	}
+}
+
+// handleRoute registers the handler of a route on the pattern and, if the
+// pattern ends in a slash, on the pattern without it as mode says. By
+// default, ServeMux redirects such requests to the pattern.
+func handleRoute(mux *http.ServeMux, pattern, mode string, handler http.Handler) error {
+	if err := handle(mux, pattern, handler); err != nil {
+		return err
+	}
+
+	i := strings.Index(pattern, "/")
+	bare := strings.TrimSuffix(pattern, "/")
+
+	if mode == "" || mode == "redirect" || i < 0 || len(bare) <= i {
+		return nil
+	}
+
+	if mode == "same" {
+		return handle(mux, bare, handler)
+	}
+
+	return handle(mux, bare, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := req.Clone(req.Context())
+		r.URL.Path += "/"
+
+		if r.URL.RawPath != "" {
+			r.URL.RawPath += "/"
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Transport describes the connections made to backends.
+type Transport struct {
+	// DisableKeepAlives is optional. If true, each request uses a new
+	// connection.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+
+	// DisableCompression is optional. If true, backends are not asked for
+	// gzip when the client did not ask for an encoding.
+	DisableCompression bool `json:"disable_compression"`
+
+	// DisableHTTP2 is optional. If true, HTTP/2 is not negotiated with
+	// HTTPS backends.
+	DisableHTTP2 bool `json:"disable_http2"`
+
+	// MaxResponseHeaderBytes is optional. It limits the size of backend
+	// response headers, defaulting to 10 MiB.
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes"`
+
+	// MaxIdleConns is optional. It is the most idle connections kept open
+	// to all backends of the route, defaulting to 100.
+	MaxIdleConns int `json:"max_idle_conns"`
+
+	// IdleConnTimeout is optional. Idle connections are closed after it,
+	// defaulting to 90s.
+	IdleConnTimeout Duration `json:"idle_conn_timeout"`
+
+	// MaxIdleConnsPerHost is optional. It is the most idle connections
+	// kept open to each backend, defaulting to 2.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+
+	// MaxConnsPerHost is optional. It limits the connections to each
+	// backend, including those in use, so that requests beyond it wait
+	// for a connection. It defaults to no limit.
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+
+	// DialTimeout is optional. It limits connecting to backends,
+	// defaulting to 30s.
+	DialTimeout Duration `json:"dial_timeout"`
+
+	// KeepAlive is optional. It describes the TCP keep-alive probes of
+	// backend connections.
+	KeepAlive *KeepAlive `json:"keep_alive"`
+
+	// TLSHandshakeTimeout is optional. It limits TLS handshakes with
+	// backends, defaulting to 10s.
+	TLSHandshakeTimeout Duration `json:"tls_handshake_timeout"`
+
+	// ResponseHeaderTimeout is optional. It limits the wait for backend
+	// response headers once a request is sent, defaulting to no limit.
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+
+	// ExpectContinueTimeout is optional. It limits the wait for a backend
+	// to answer "Expect: 100-continue" before the request body is sent
+	// anyway, defaulting to 1s.
+	ExpectContinueTimeout Duration `json:"expect_continue_timeout"`
+
+	// CAFile is optional. It is a PEM file of the CAs trusted to sign the
+	// certificates of HTTPS backends, instead of the system roots.
+	CAFile string `json:"ca_file"`
+
+	// InsecureSkipVerify is optional. If true, backend certificates are
+	// not verified at all, which is discouraged: prefer CAFile.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	// ServerName is optional. If specified, backend certificates must be
+	// valid for this name rather than the backend host.
+	ServerName string `json:"server_name"`
+
+	// SNI is optional. If specified, it is the server name sent to HTTPS
+	// backends instead of the backend host, such as when dialing by IP
+	// address. Certificates are verified against it unless ServerName is
+	// specified.
+	SNI string `json:"sni"`
+
+	// ClientCert and ClientKey are optional. If specified, they are the PEM
+	// files of the certificate presented to HTTPS backends, for mutual
+	// TLS.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+}
+
+// dialFunc matches the signature of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newTransport creates the upstream transport for a route. Each route gets
+// its own transport so that per-route dialing options do not leak into other
+// routes, and so that its connection pool and limits are its own.
+func newTransport(route Route, res *resolver) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if c := route.Transport; c != nil {
+		if c.MaxResponseHeaderBytes < 0 || c.MaxIdleConns < 0 ||
+			c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+			return nil, errors.New("proxy: negative transport limit")
+		}
+
+		if c.DialTimeout < 0 || c.TLSHandshakeTimeout < 0 ||
+			c.ResponseHeaderTimeout < 0 || c.ExpectContinueTimeout < 0 ||
+			c.IdleConnTimeout < 0 {
+			return nil, errors.New("proxy: negative transport timeout")
+		}
+
+		if c.DialTimeout != 0 {
+			d.Timeout = time.Duration(c.DialTimeout)
+		}
+
+		if c.KeepAlive != nil {
+			if err := checkKeepAlive(c.KeepAlive); err != nil {
+				return nil, err
+			}
+
+			d.KeepAliveConfig, d.KeepAlive = keepAliveConfig(c.KeepAlive,
+				d.KeepAlive)
+		}
+
+		if c.TLSHandshakeTimeout != 0 {
+			t.TLSHandshakeTimeout = time.Duration(c.TLSHandshakeTimeout)
+		}
+
+		if c.ExpectContinueTimeout != 0 {
+			t.ExpectContinueTimeout = time.Duration(c.ExpectContinueTimeout)
+		}
+
+		if c.MaxIdleConns != 0 {
+			t.MaxIdleConns = c.MaxIdleConns
+		}
+
+		if c.IdleConnTimeout != 0 {
+			t.IdleConnTimeout = time.Duration(c.IdleConnTimeout)
+		}
+
+		t.ResponseHeaderTimeout = time.Duration(c.ResponseHeaderTimeout)
+
+		t.DisableKeepAlives = c.DisableKeepAlives
+		t.DisableCompression = c.DisableCompression
+		t.MaxResponseHeaderBytes = c.MaxResponseHeaderBytes
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+		t.MaxConnsPerHost = c.MaxConnsPerHost
+
+		tlsConfig, err := upstreamTLS(c)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.TLSClientConfig = tlsConfig
+
+		if c.DisableHTTP2 {
+			t.ForceAttemptHTTP2 = false
+			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+	}
+
+	dial := res.dialer(d)
+
+	if route.SOCKS5 != nil {
+		if err := route.SOCKS5.check(); err != nil {
+			return nil, err
+		}
+
+		dial = route.SOCKS5.dialer(dial)
+	}
+
+	if route.ProxyProtocol != 0 {
+		if err := checkProxyProtocol(route.ProxyProtocol); err != nil {
+			return nil, err
+		}
+
+		dial = proxyProtocolDialer(dial, route.ProxyProtocol)
+		t.DisableKeepAlives = true
+	}
+
+	t.DialContext = dial
+
+	// Retire pooled connections to addresses which left DNS.
+	res.changed = t.CloseIdleConnections
+
+	switch {
+	case route.SOCKS5 != nil:
+		t.Proxy = nil
+	case route.UpstreamProxy == "":
+		t.Proxy = http.ProxyFromEnvironment
+	case route.UpstreamProxy == "direct":
+		t.Proxy = nil
+	default:
+		u, err := url.Parse(route.UpstreamProxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// target is a backend address within a pool.
+type target struct {
+	// Addr in the form "host:port".
+	Addr string
+
+	// Priority, lower is preferred. Targets of a higher priority are only
+	// used when no lower priority targets exist.
+	Priority int
+
+	// Weight relative to other targets of the same priority.
+	Weight int
+}
+
+// pool is a set of backend addresses which may change while serving.
+type pool struct {
+	mu      sync.RWMutex
+	targets []target
+
+	// slowStart is how long targets which join the pool take to reach
+	// their full share of requests, from the times in joined.
+	slowStart time.Duration
+	joined    map[string]time.Time
+
+	// backups are picked only while every target is down. Targets and
+	// backups are down for cooldown after requests to them fail, until
+	// the times in down.
+	backups  []target
+	cooldown time.Duration
+	down     map[string]time.Time
+}
+
+// slowStartMin is the least share of its weight a joining target gets.
+const slowStartMin = 0.1
+
+func (p *pool) setSlowStart(d time.Duration) {
+	p.mu.Lock()
+	p.slowStart = d
+	p.mu.Unlock()
+}
+
+func (p *pool) set(targets []target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.slowStart > 0 {
+		now := time.Now()
+		old := make(map[string]bool, len(p.targets))
+
+		for _, t := range p.targets {
+			old[t.Addr] = true
+		}
+
+		joined := make(map[string]time.Time)
+
+		for _, t := range targets {
+			if at, ok := p.joined[t.Addr]; ok && now.Sub(at) < p.slowStart {
+				joined[t.Addr] = at
+			} else if !old[t.Addr] {
+				joined[t.Addr] = now
+			}
+		}
+
+		p.joined = joined
+	}
+
+	p.targets = targets
+}
+
+// share returns the fraction of its weight t gets while slow starting.
+func (p *pool) share(t target, now time.Time) float64 {
+	at, ok := p.joined[t.Addr]
+
+	if !ok {
+		return 1
+	}
+
+	f := float64(now.Sub(at)) / float64(p.slowStart)
+
+	switch {
+	case f >= 1:
+		return 1
+	case f < slowStartMin:
+		return slowStartMin
+	}
+
+	return f
+}
+
+// setBackups sets the backups of the pool, and starts tracking which targets
+// are down.
+func (p *pool) setBackups(backups []target, cooldown time.Duration) {
+	p.mu.Lock()
+	p.backups, p.cooldown = backups, cooldown
+	p.down = make(map[string]time.Time)
+	p.mu.Unlock()
+}
+
+// markDown marks addr down, if the pool has backups.
+func (p *pool) markDown(addr string) {
+	p.mu.Lock()
+
+	if p.down != nil {
+		p.down[addr] = time.Now().Add(p.cooldown)
+	}
+
+	p.mu.Unlock()
+}
+
+// markUp marks addr up again. Targets which were down slow start again.
+func (p *pool) markUp(addr string) {
+	p.mu.RLock()
+	_, down := p.down[addr]
+	p.mu.RUnlock()
+
+	if !down {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, down = p.down[addr]; !down {
+		return
+	}
+
+	delete(p.down, addr)
+
+	if p.slowStart <= 0 {
+		return
+	}
+
+	for _, t := range p.targets {
+		if t.Addr == addr {
+			if p.joined == nil {
+				p.joined = make(map[string]time.Time)
+			}
+
+			p.joined[addr] = time.Now()
+			return
+		}
+	}
+}
+
+// up returns those of targets which are not down.
+func (p *pool) up(targets []target, now time.Time) []target {
+	if len(p.down) == 0 {
+		return targets
+	}
+
+	var up []target
+
+	for _, t := range targets {
+		if until, ok := p.down[t.Addr]; !ok || now.After(until) {
+			up = append(up, t)
+		}
+	}
+
+	return up
+}
+
+// pick chooses a target which is up, or else a backup which is up. If all are
+// down, targets are still tried before backups. A non-empty key, such as the
+// client IP address, is always given the same target while it is a candidate.
+func (p *pool) pick(key string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+
+	for _, targets := range [][]target{
+		p.up(p.targets, now), p.up(p.backups, now), p.targets, p.backups,
+	} {
+		if addr, ok := p.pickFrom(targets, key); ok {
+			return addr, true
+		}
+	}
+
+	return "", false
+}
+
+// pickFrom chooses among targets of the preferred priority, by weighted
+// random selection, or by hashing key if not empty.
+func (p *pool) pickFrom(targets []target, key string) (string, bool) {
+	if len(targets) == 0 {
+		return "", false
+	}
+
+	best := targets[0].Priority
+	total := 0
+
+	for _, t := range targets {
+		switch {
+		case t.Priority < best:
+			best, total = t.Priority, t.Weight
+		case t.Priority == best:
+			total += t.Weight
+		}
+	}
+
+	var candidates []target
+
+	for _, t := range targets {
+		if t.Priority == best {
+			candidates = append(candidates, t)
+		}
+	}
+
+	if key != "" {
+		return p.pickHash(candidates, total, key), true
+	}
+
+	if len(p.joined) != 0 {
+		return p.pickSlowStart(candidates, total), true
+	}
+
+	if total <= 0 {
+		return candidates[rand.Intn(len(candidates))].Addr, true
+	}
+
+	n := rand.Intn(total)
+
+	for _, t := range candidates {
+		if n -= t.Weight; n < 0 {
+			return t.Addr, true
+		}
+	}
+
+	return candidates[len(candidates)-1].Addr, true
+}
+
+// pickSlowStart chooses among the candidates with the weights of joining
+// targets reduced.
+func (p *pool) pickSlowStart(candidates []target, total int) string {
+	now := time.Now()
+	weights := make([]float64, len(candidates))
+	sum := 0.0
+
+	for i, t := range candidates {
+		w := 1.0
+
+		if total > 0 {
+			w = float64(t.Weight)
+		}
+
+		weights[i] = w * p.share(t, now)
+		sum += weights[i]
+	}
+
+	n := rand.Float64() * sum
+
+	for i, w := range weights {
+		if n -= w; n < 0 {
+			return candidates[i].Addr
+		}
+	}
+
+	return candidates[len(candidates)-1].Addr
+}
+
+// pickHash chooses among the candidates by weighted rendezvous hashing of
+// key, so that few keys move to other targets as the candidates change.
+func (p *pool) pickHash(candidates []target, total int, key string) string {
+	now := time.Now()
+	best, bestScore := candidates[0].Addr, math.Inf(-1)
+
+	for _, t := range candidates {
+		w := 1.0
+
+		if total > 0 {
+			w = float64(t.Weight)
+		}
+
+		if w *= p.share(t, now); w <= 0 {
+			continue
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(t.Addr))
+
+		// A uniform value in (0, 1), from the mixed hash.
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+
+		if score := -w / math.Log(u); score > bestScore {
+			best, bestScore = t.Addr, score
+		}
+	}
+
+	return best
+}
+
+// mix64 is the finalizer of SplitMix64, spreading similar hashes apart.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+type upstreamKey struct{}
+
+// upstreamPickKey holds the key by which withUpstream picked the target of a
+// request, for retries to pick alike.
+type upstreamPickKey struct{}
+
+// withUpstream picks a target from p for each request, responding with 503
+// Service Unavailable if the pool is empty. Requests whose target a rule has
+// chosen are left alone. If hashIP is true, the target is picked by the
+// client IP address.
+func withUpstream(p *pool, hashIP bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := req.Context().Value(upstreamKey{}).(string); ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		key := ""
+
+		if hashIP {
+			key = clientIP(req)
+		}
+
+		addr, ok := p.pick(key)
+
+		if !ok {
+			http.Error(w, "no upstream available",
+				http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), upstreamKey{}, addr)
+		ctx = context.WithValue(ctx, upstreamPickKey{}, key)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolSlowStartAfterDown(t *testing.T) {
+	p := &pool{}
+	p.set([]target{{Addr: "a:80", Weight: 1}, {Addr: "b:80", Weight: 1}})
+	p.setSlowStart(time.Minute)
+	p.setBackups(nil, time.Second)
+
+	if share := p.share(target{Addr: "a:80"}, time.Now()); share != 1 {
+		t.Fatalf("initial share %v, want 1", share)
+	}
+
+	p.markDown("a:80")
+	p.markUp("a:80")
+
+	if share := p.share(target{Addr: "a:80"}, time.Now()); share != slowStartMin {
+		t.Errorf("share after coming back up %v, want %v", share, slowStartMin)
+	}
+
+	if share := p.share(target{Addr: "b:80"}, time.Now()); share != 1 {
+		t.Errorf("share of the other target %v, want 1", share)
+	}
+
+	// Targets which were not down keep their share.
+	p.markUp("b:80")
+
+	if share := p.share(target{Addr: "b:80"}, time.Now()); share != 1 {
+		t.Errorf("share after markUp while up %v, want 1", share)
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import "strconv"
+
+var timeBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5,
+	1, 2.5, 5, 10}
+
+var (
+	upstreamConns = newCounterVec("http_proxy_upstream_connections_total",
+		"Connections used for backend requests, by whether they were "+
+			"reused.", "route", "reused")
+	upstreamDNSTime = newHistogramVec("http_proxy_upstream_dns_seconds",
+		"Time resolving backend hostnames for new connections.",
+		timeBuckets, "route")
+	upstreamConnectTime = newHistogramVec("http_proxy_upstream_connect_seconds",
+		"Time connecting to backends.", timeBuckets, "route")
+	upstreamTLSTime = newHistogramVec("http_proxy_upstream_tls_seconds",
+		"Time of TLS handshakes with backends.", timeBuckets, "route")
+	upstreamTTFBTime = newHistogramVec("http_proxy_upstream_ttfb_seconds",
+		"Time from sending backend requests to their first response "+
+			"byte.", timeBuckets, "route")
+)
+
+// observe records the metrics of the attempt timed by rt. Phases which did not
+// happen, such as connecting over a reused connection, are not observed.
+func (rt *requestTiming) observe(route string, ok bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.got {
+		upstreamConns.inc(route, strconv.FormatBool(rt.reused))
+	}
+
+	if rt.dns != 0 {
+		upstreamDNSTime.observe(rt.dns.Seconds(), route)
+	}
+
+	if rt.connect != 0 {
+		upstreamConnectTime.observe(rt.connect.Seconds(), route)
+	}
+
+	if rt.tls != 0 {
+		upstreamTLSTime.observe(rt.tls.Seconds(), route)
+	}
+
+	if ok && rt.ttfb != 0 {
+		upstreamTTFBTime.observe(rt.ttfb.Seconds(), route)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// upstreamTLS returns the TLS configuration of connections to HTTPS backends,
+// or nil for the defaults.
+func upstreamTLS(c *Transport) (*tls.Config, error) {
+	if c.CAFile == "" && !c.InsecureSkipVerify && c.ServerName == "" &&
+		c.SNI == "" && c.ClientCert == "" && c.ClientKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.SNI,
+	}
+
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, errors.New("proxy: client_cert requires client_key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("proxy: no certificates in " + c.CAFile)
+		}
+	}
+
+	if c.ServerName != "" && !c.InsecureSkipVerify {
+		// Verify against the pinned name rather than the one dialed.
+		roots, name := config.RootCAs, c.ServerName
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("proxy: backend sent no certificate")
+			}
+
+			opts := x509.VerifyOptions{
+				DNSName:       name,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+
+	return config, nil
+}
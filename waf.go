@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var wafMatches = newCounterVec("http_proxy_waf_matches_total",
+	"Requests matching WAF rules.", "route", "rule")
+
+// WAF describes a web application firewall, which scores requests against
+// rules and acts on those reaching a threshold.
+type WAF struct {
+	// Rules is optional. They are evaluated after the starter rules, if
+	// any.
+	Rules []WAFRule `json:"rules"`
+
+	// Starter is optional. If true, a starter set of rules covering common
+	// injection attacks and scanners is used.
+	Starter bool `json:"starter"`
+
+	// Threshold is optional. Requests whose rules score at least this are
+	// acted on. It defaults to 5.
+	Threshold int `json:"threshold"`
+
+	// Action is optional. It is "block" to reject requests with 403
+	// Forbidden, the default, or "log" to only record the matched rules in
+	// the access log.
+	Action string `json:"action"`
+
+	// MaxBody is optional. It limits the bytes of request bodies which are
+	// inspected. It defaults to 64 KiB.
+	MaxBody int64 `json:"max_body"`
+}
+
+// WAFRule describes a pattern of malicious requests.
+type WAFRule struct {
+	// ID names the rule in logs and metrics.
+	ID string `json:"id"`
+
+	// Target is the part of the request matched: "method", "path" (the
+	// unescaped path), "uri" (the raw request URI), "query" (the unescaped
+	// query), "headers" (each header as "Name: value"), "header:Name" (the
+	// values of one header), or "body".
+	Target string `json:"target"`
+
+	// Match is a regular expression.
+	Match string `json:"match"`
+
+	// Score is optional. It defaults to the threshold, so that a match
+	// alone is acted on.
+	Score int `json:"score"`
+}
+
+var wafStarter = []WAFRule{
+	{ID: "sqli-union", Target: "query",
+		Match: `(?i)\bunion\b[\s/*+]+(all[\s/*+]+)?select\b`},
+	{ID: "sqli-union-body", Target: "body",
+		Match: `(?i)\bunion\b[\s/*+]+(all[\s/*+]+)?select\b`},
+	{ID: "sqli-tautology", Target: "query",
+		Match: `(?i)['"]\s*or\s+['"]?\w+['"]?\s*=\s*['"]?\w+`},
+	{ID: "sqli-stacked", Target: "query",
+		Match: `(?i);\s*(drop|delete|insert|update|alter)\s+\w`},
+	{ID: "xss-script", Target: "query", Match: `(?i)<\s*script\b`},
+	{ID: "xss-script-body", Target: "body", Match: `(?i)<\s*script\b`},
+	{ID: "xss-handler", Target: "query",
+		Match: `(?i)\bon(load|error|mouseover|focus)\s*=`},
+	{ID: "xss-uri", Target: "query", Match: `(?i)javascript\s*:`},
+	{ID: "traversal", Target: "uri",
+		Match: `(?i)(\.\.[/\\]|%2e%2e(%2f|%5c|/|\\)|\.\.%2f|\.\.%5c)`},
+	{ID: "traversal-files", Target: "path",
+		Match: `(?i)/(etc/passwd|proc/self/|win\.ini)`},
+	{ID: "cmd-injection", Target: "query",
+		Match: `(?i)(;|\|\|?|&&|\$\(|` + "`" + `)\s*(cat|wget|curl|nc|sh|bash|id|uname)\b`},
+	{ID: "scanner", Target: "header:User-Agent",
+		Match: `(?i)(sqlmap|nikto|nmap|masscan|acunetix|nessus|wpscan|dirbuster|zgrab)`},
+}
+
+type wafRule struct {
+	id     string
+	target string
+	header string
+	re     *regexp.Regexp
+	score  int
+}
+
+type waf struct {
+	route     string
+	rules     []wafRule
+	threshold int
+	block     bool
+	body      bool
+	maxBody   int64
+}
+
+func newWAF(c *WAF, route string) (*waf, error) {
+	w := &waf{
+		route:     route,
+		threshold: c.Threshold,
+		maxBody:   c.MaxBody,
+	}
+
+	if w.threshold <= 0 {
+		w.threshold = 5
+	}
+
+	if w.maxBody <= 0 {
+		w.maxBody = 64 << 10
+	}
+
+	switch c.Action {
+	case "", "block":
+		w.block = true
+	case "log":
+	default:
+		return nil, errors.New("proxy: waf action invalid")
+	}
+
+	rules := c.Rules
+
+	if c.Starter {
+		rules = append(append([]WAFRule(nil), wafStarter...), rules...)
+	}
+
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Match)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rule := wafRule{id: r.ID, target: r.Target, re: re, score: r.Score}
+
+		if rule.score == 0 {
+			rule.score = w.threshold
+		}
+
+		switch {
+		case strings.HasPrefix(r.Target, "header:"):
+			rule.target = "header"
+			rule.header = http.CanonicalHeaderKey(r.Target[len("header:"):])
+		case r.Target == "body":
+			w.body = true
+		case r.Target == "method", r.Target == "path", r.Target == "uri",
+			r.Target == "query", r.Target == "headers":
+		default:
+			return nil, errors.New("proxy: waf rule target invalid")
+		}
+
+		w.rules = append(w.rules, rule)
+	}
+
+	return w, nil
+}
+
+// unescape returns s unescaped, or s if it is malformed.
+func unescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+func (w *waf) match(r *wafRule, req *http.Request, body []byte) bool {
+	switch r.target {
+	case "method":
+		return r.re.MatchString(req.Method)
+	case "path":
+		return r.re.MatchString(req.URL.Path)
+	case "uri":
+		return r.re.MatchString(req.RequestURI)
+	case "query":
+		return r.re.MatchString(unescape(req.URL.RawQuery))
+	case "headers":
+		for k, vs := range req.Header {
+			for _, v := range vs {
+				if r.re.MatchString(k + ": " + v) {
+					return true
+				}
+			}
+		}
+	case "header":
+		for _, v := range req.Header[r.header] {
+			if r.re.MatchString(v) {
+				return true
+			}
+		}
+	case "body":
+		return r.re.Match(body) || r.re.MatchString(unescape(string(body)))
+	}
+	return false
+}
+
+// inspect returns the IDs of the rules matching req, and whether their
+// score reaches the threshold.
+func (w *waf) inspect(req *http.Request) ([]string, bool, error) {
+	var body []byte
+
+	if w.body && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, w.maxBody))
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	}
+
+	var ids []string
+	score := 0
+
+	for i := range w.rules {
+		if w.match(&w.rules[i], req, body) {
+			ids = append(ids, w.rules[i].id)
+			score += w.rules[i].score
+			wafMatches.inc(w.route, w.rules[i].id)
+		}
+	}
+
+	return ids, score >= w.threshold, nil
+}
+
+// withWAF inspects requests against the rules of w, rejecting those reaching
+// its threshold with 403 Forbidden if it blocks.
+func withWAF(w *waf, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ids, hit, err := w.inspect(req)
+
+		if err != nil {
+			http.Error(rw, http.StatusText(http.StatusBadRequest),
+				http.StatusBadRequest)
+			return
+		}
+
+		if len(ids) != 0 {
+			setLogField(req, "waf", ids)
+		}
+
+		if hit && w.block {
+			strike(req, "waf")
+			http.Error(rw, http.StatusText(http.StatusForbidden),
+				http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,1380 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// A WebAssembly interpreter for sandboxed filters. It supports the 1.0 core
+// specification with multi-value blocks, sign extension, saturating
+// conversions and bulk memory copy and fill. Imports are limited to host
+// functions, and modules are trusted to be valid: malformed code traps rather
+// than being rejected up front.
+
+const (
+	wasmI32 = 0x7f
+	wasmI64 = 0x7e
+	wasmF32 = 0x7d
+	wasmF64 = 0x7c
+
+	wasmPageSize  = 1 << 16
+	wasmMaxPages  = 1 << 16
+	wasmStackSize = 1 << 16
+	wasmMaxDepth  = 1 << 10
+)
+
+type wasmFuncType struct {
+	params, results []byte
+}
+
+type wasmImport struct {
+	module, name string
+	typ          uint32
+}
+
+type wasmInstr struct {
+	op   byte
+	sub  byte
+	a, b uint32
+	v    uint64
+}
+
+type wasmFunc struct {
+	typ    uint32
+	locals int
+	code   []wasmInstr
+	tables [][]uint32
+}
+
+type wasmConst struct {
+	op byte
+	v  uint64
+}
+
+type wasmGlobal struct {
+	mut  bool
+	init wasmConst
+}
+
+type wasmElem struct {
+	offset wasmConst
+	funcs  []uint32
+}
+
+type wasmData struct {
+	offset wasmConst
+	init   []byte
+}
+
+type wasmExport struct {
+	kind byte
+	idx  uint32
+}
+
+type wasmModule struct {
+	types   []wasmFuncType
+	imports []wasmImport
+	funcs   []wasmFunc
+
+	hasTable           bool
+	tableMin, tableMax uint32
+	elems              []wasmElem
+
+	hasMem         bool
+	memMin, memMax uint32
+	data           []wasmData
+
+	globals []wasmGlobal
+	exports map[string]wasmExport
+	start   int64
+}
+
+// wasmError is raised by panics while parsing and executing modules.
+type wasmError string
+
+func (e wasmError) Error() string {
+	return "proxy: wasm: " + string(e)
+}
+
+func wasmFail(format string, args ...interface{}) {
+	panic(wasmError(fmt.Sprintf(format, args...)))
+}
+
+// wasmRecover turns a panic into *err, including runtime errors raised by
+// misbehaving code.
+func wasmRecover(err *error) {
+	switch r := recover().(type) {
+	case nil:
+	case wasmError:
+		*err = r
+	case error:
+		*err = wasmError("trap: " + r.Error())
+	default:
+		panic(r)
+	}
+}
+
+type wasmReader struct {
+	b   []byte
+	off int
+}
+
+func (r *wasmReader) eof() bool {
+	return r.off >= len(r.b)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.off >= len(r.b) {
+		wasmFail("unexpected end of module")
+	}
+
+	c := r.b[r.off]
+	r.off++
+	return c
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if uint64(r.off)+uint64(n) > uint64(len(r.b)) {
+		wasmFail("unexpected end of module")
+	}
+
+	b := r.b[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b
+}
+
+func (r *wasmReader) u64() uint64 {
+	var v uint64
+
+	for shift := uint(0); ; shift += 7 {
+		c := r.byte()
+
+		if shift >= 64 {
+			wasmFail("integer too long")
+		}
+
+		v |= uint64(c&0x7f) << shift
+
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *wasmReader) u32() uint32 {
+	v := r.u64()
+
+	if v > math.MaxUint32 {
+		wasmFail("integer too large")
+	}
+
+	return uint32(v)
+}
+
+func (r *wasmReader) s64() int64 {
+	var v int64
+	shift := uint(0)
+
+	for {
+		c := r.byte()
+
+		if shift >= 64 {
+			wasmFail("integer too long")
+		}
+
+		v |= int64(c&0x7f) << shift
+		shift += 7
+
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+
+			return v
+		}
+	}
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+func (r *wasmReader) valtype() byte {
+	t := r.byte()
+
+	switch t {
+	case wasmI32, wasmI64, wasmF32, wasmF64:
+		return t
+	}
+
+	wasmFail("unsupported value type 0x%x", t)
+	return 0
+}
+
+func (r *wasmReader) limits() (uint32, uint32) {
+	switch r.byte() {
+	case 0:
+		return r.u32(), math.MaxUint32
+	case 1:
+		return r.u32(), r.u32()
+	}
+
+	wasmFail("unsupported limits")
+	return 0, 0
+}
+
+// constExpr reads a constant initializer expression.
+func (r *wasmReader) constExpr() wasmConst {
+	c := wasmConst{op: r.byte()}
+
+	switch c.op {
+	case 0x41:
+		c.v = uint64(uint32(r.s64()))
+	case 0x42:
+		c.v = uint64(r.s64())
+	case 0x43:
+		c.v = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+	case 0x44:
+		c.v = binary.LittleEndian.Uint64(r.bytes(8))
+	case 0x23:
+		c.v = uint64(r.u32())
+	default:
+		wasmFail("unsupported constant expression")
+	}
+
+	if r.byte() != 0x0b {
+		wasmFail("unsupported constant expression")
+	}
+
+	return c
+}
+
+// parseWasm parses a binary WebAssembly module.
+func parseWasm(b []byte) (m *wasmModule, err error) {
+	defer wasmRecover(&err)
+
+	r := &wasmReader{b: b}
+
+	if string(r.bytes(4)) != "\x00asm" ||
+		binary.LittleEndian.Uint32(r.bytes(4)) != 1 {
+		return nil, wasmError("not a version 1 module")
+	}
+
+	m = &wasmModule{exports: make(map[string]wasmExport), start: -1}
+	var funcTypes []uint32
+
+	for !r.eof() {
+		id := r.byte()
+		s := &wasmReader{b: r.bytes(r.u32())}
+
+		switch id {
+		case 0:
+			// Custom section.
+		case 1:
+			for n := s.u32(); n > 0; n-- {
+				if s.byte() != 0x60 {
+					wasmFail("malformed function type")
+				}
+
+				var t wasmFuncType
+
+				for k := s.u32(); k > 0; k-- {
+					t.params = append(t.params, s.valtype())
+				}
+
+				for k := s.u32(); k > 0; k-- {
+					t.results = append(t.results, s.valtype())
+				}
+
+				m.types = append(m.types, t)
+			}
+		case 2:
+			for n := s.u32(); n > 0; n-- {
+				imp := wasmImport{module: s.name(), name: s.name()}
+
+				if s.byte() != 0 {
+					wasmFail("import %s.%s: only functions may be imported",
+						imp.module, imp.name)
+				}
+
+				imp.typ = s.u32()
+				m.imports = append(m.imports, imp)
+			}
+		case 3:
+			for n := s.u32(); n > 0; n-- {
+				funcTypes = append(funcTypes, s.u32())
+			}
+		case 4:
+			if s.u32() != 1 || s.byte() != 0x70 {
+				wasmFail("unsupported table")
+			}
+
+			m.hasTable = true
+			m.tableMin, m.tableMax = s.limits()
+		case 5:
+			if s.u32() != 1 {
+				wasmFail("unsupported memories")
+			}
+
+			m.hasMem = true
+			m.memMin, m.memMax = s.limits()
+		case 6:
+			for n := s.u32(); n > 0; n-- {
+				s.valtype()
+				g := wasmGlobal{mut: s.byte() == 1}
+				g.init = s.constExpr()
+				m.globals = append(m.globals, g)
+			}
+		case 7:
+			for n := s.u32(); n > 0; n-- {
+				name := s.name()
+				m.exports[name] = wasmExport{kind: s.byte(), idx: s.u32()}
+			}
+		case 8:
+			m.start = int64(s.u32())
+		case 9:
+			for n := s.u32(); n > 0; n-- {
+				if s.u32() != 0 {
+					wasmFail("unsupported element segment")
+				}
+
+				e := wasmElem{offset: s.constExpr()}
+
+				for k := s.u32(); k > 0; k-- {
+					e.funcs = append(e.funcs, s.u32())
+				}
+
+				m.elems = append(m.elems, e)
+			}
+		case 10:
+			n := s.u32()
+
+			if int(n) != len(funcTypes) {
+				wasmFail("function and code counts differ")
+			}
+
+			for i := uint32(0); i < n; i++ {
+				body := &wasmReader{b: s.bytes(s.u32())}
+				f := wasmFunc{typ: funcTypes[i]}
+
+				for k := body.u32(); k > 0; k-- {
+					count := body.u32()
+					body.valtype()
+
+					if f.locals += int(count); f.locals > wasmStackSize {
+						wasmFail("too many locals")
+					}
+				}
+
+				compileWasm(&f, body)
+				m.funcs = append(m.funcs, f)
+			}
+		case 11:
+			for n := s.u32(); n > 0; n-- {
+				if s.u32() != 0 {
+					wasmFail("unsupported data segment")
+				}
+
+				d := wasmData{offset: s.constExpr()}
+				d.init = s.bytes(s.u32())
+				m.data = append(m.data, d)
+			}
+		case 12:
+			// Data count, for bulk memory.
+		default:
+			wasmFail("unknown section %d", id)
+		}
+	}
+
+	for _, t := range funcTypes {
+		if int(t) >= len(m.types) {
+			wasmFail("unknown type")
+		}
+	}
+
+	for _, imp := range m.imports {
+		if int(imp.typ) >= len(m.types) {
+			wasmFail("unknown type")
+		}
+	}
+
+	return m, nil
+}
+
+// compileWasm decodes the body of f, resolving the targets of structured
+// control instructions.
+func compileWasm(f *wasmFunc, r *wasmReader) {
+	var open []int
+
+	for {
+		in := wasmInstr{op: r.byte()}
+		pc := len(f.code)
+
+		switch op := in.op; {
+		case op == 0x02 || op == 0x03 || op == 0x04:
+			in.v = blockType(r)
+			open = append(open, pc)
+		case op == 0x05:
+			if len(open) == 0 || f.code[open[len(open)-1]].op != 0x04 {
+				wasmFail("else outside if")
+			}
+
+			f.code[open[len(open)-1]].b = uint32(pc)
+		case op == 0x0b:
+			if len(open) == 0 {
+				f.code = append(f.code, in)
+
+				if !r.eof() {
+					wasmFail("code after end of function")
+				}
+
+				return
+			}
+
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			f.code[start].a = uint32(pc)
+
+			if b := f.code[start].b; f.code[start].op == 0x04 && b != 0 {
+				f.code[b].a = uint32(pc)
+			}
+		case op == 0x0c || op == 0x0d:
+			in.a = r.u32()
+		case op == 0x0e:
+			targets := make([]uint32, r.u32()+1)
+
+			for i := range targets {
+				targets[i] = r.u32()
+			}
+
+			in.a = uint32(len(f.tables))
+			f.tables = append(f.tables, targets)
+		case op == 0x10:
+			in.a = r.u32()
+		case op == 0x11:
+			in.a = r.u32()
+
+			if r.byte() != 0 {
+				wasmFail("unsupported table")
+			}
+		case op == 0x1c:
+			if r.u32() != 1 {
+				wasmFail("malformed select")
+			}
+
+			r.valtype()
+			in.op = 0x1b
+		case op >= 0x20 && op <= 0x24:
+			in.a = r.u32()
+		case op >= 0x28 && op <= 0x3e:
+			r.u32()
+			in.v = uint64(r.u32())
+		case op == 0x3f || op == 0x40:
+			if r.byte() != 0 {
+				wasmFail("unsupported memory")
+			}
+		case op == 0x41:
+			in.v = uint64(uint32(r.s64()))
+		case op == 0x42:
+			in.v = uint64(r.s64())
+		case op == 0x43:
+			in.v = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+		case op == 0x44:
+			in.v = binary.LittleEndian.Uint64(r.bytes(8))
+		case op == 0xfc:
+			in.sub = byte(r.u32())
+
+			switch in.sub {
+			case 0, 1, 2, 3, 4, 5, 6, 7:
+			case 10:
+				r.byte()
+				r.byte()
+			case 11:
+				r.byte()
+			default:
+				wasmFail("unsupported instruction 0xfc %d", in.sub)
+			}
+		case op <= 0x01 || op == 0x0f || op == 0x1a || op == 0x1b ||
+			op >= 0x45 && op <= 0xc4:
+		default:
+			wasmFail("unsupported instruction 0x%x", op)
+		}
+
+		f.code = append(f.code, in)
+	}
+}
+
+// blockType returns the parameter and result counts of a block type, packed
+// as params<<32 | results. Type indexes are resolved when executed.
+func blockType(r *wasmReader) uint64 {
+	switch c := r.b[r.off]; c {
+	case 0x40:
+		r.off++
+		return 0
+	case wasmI32, wasmI64, wasmF32, wasmF64:
+		r.off++
+		return 1
+	}
+
+	idx := r.s64()
+
+	if idx < 0 {
+		wasmFail("malformed block type")
+	}
+
+	return 1<<63 | uint64(idx)
+}
+
+// wasmHost is a host function imported by modules. It returns at most one
+// result.
+type wasmHost func(in *wasmInstance, args []uint64) uint64
+
+type wasmLabel struct {
+	height int
+	arity  int
+	cont   int
+}
+
+// wasmInstance is a module instantiated with its own memory and globals. It
+// must not be used concurrently.
+type wasmInstance struct {
+	m       *wasmModule
+	hosts   []wasmHost
+	mem     []byte
+	memMax  uint32
+	globals []uint64
+	table   []int64
+
+	stack  []uint64
+	sp     int
+	labels []wasmLabel
+	depth  int
+	fuel   int64
+
+	// data is for use by host functions.
+	data interface{}
+}
+
+// instantiate creates an instance of m, resolving imports from hosts by
+// module and name. Memory is limited to maxPages.
+func (m *wasmModule) instantiate(hosts map[string]wasmHost, maxPages uint32, fuel int64) (in *wasmInstance, err error) {
+	defer wasmRecover(&err)
+
+	in = &wasmInstance{
+		m:      m,
+		stack:  make([]uint64, wasmStackSize),
+		memMax: maxPages,
+		fuel:   fuel,
+	}
+
+	for _, imp := range m.imports {
+		h, ok := hosts[imp.module+"."+imp.name]
+
+		if !ok {
+			return nil, wasmError("unknown import " + imp.module + "." +
+				imp.name)
+		}
+
+		in.hosts = append(in.hosts, h)
+	}
+
+	if m.hasMem {
+		if m.memMax < in.memMax {
+			in.memMax = m.memMax
+		}
+
+		if m.memMin > in.memMax {
+			return nil, wasmError("memory exceeds limit")
+		}
+
+		in.mem = make([]byte, int(m.memMin)*wasmPageSize)
+	}
+
+	for _, g := range m.globals {
+		in.globals = append(in.globals, in.constant(g.init))
+	}
+
+	if m.hasTable {
+		in.table = make([]int64, m.tableMin)
+
+		for i := range in.table {
+			in.table[i] = -1
+		}
+	}
+
+	for _, e := range m.elems {
+		off := in.constant(e.offset)
+
+		if off+uint64(len(e.funcs)) > uint64(len(in.table)) {
+			return nil, wasmError("element segment out of bounds")
+		}
+
+		for i, f := range e.funcs {
+			in.table[off+uint64(i)] = int64(f)
+		}
+	}
+
+	for _, d := range m.data {
+		off := in.constant(d.offset)
+
+		if off+uint64(len(d.init)) > uint64(len(in.mem)) {
+			return nil, wasmError("data segment out of bounds")
+		}
+
+		copy(in.mem[off:], d.init)
+	}
+
+	if m.start >= 0 {
+		in.call(uint32(m.start))
+	}
+
+	return in, nil
+}
+
+func (in *wasmInstance) constant(c wasmConst) uint64 {
+	if c.op == 0x23 {
+		return in.globals[c.v]
+	}
+	return c.v
+}
+
+// invoke calls the exported function with fuel, the instruction budget.
+func (in *wasmInstance) invoke(name string, fuel int64, args ...uint64) (results []uint64, err error) {
+	e, ok := in.m.exports[name]
+
+	if !ok || e.kind != 0 {
+		return nil, wasmError("no exported function " + name)
+	}
+
+	defer wasmRecover(&err)
+
+	in.sp, in.labels, in.depth, in.fuel = 0, in.labels[:0], 0, fuel
+	t := in.funcType(e.idx)
+
+	if len(args) != len(t.params) {
+		return nil, wasmError("wrong argument count for " + name)
+	}
+
+	in.sp = copy(in.stack, args)
+	in.call(e.idx)
+	return append([]uint64(nil), in.stack[:len(t.results)]...), nil
+}
+
+// exported reports whether the module exports the function.
+func (m *wasmModule) exported(name string) bool {
+	e, ok := m.exports[name]
+	return ok && e.kind == 0
+}
+
+func (in *wasmInstance) funcType(idx uint32) *wasmFuncType {
+	if n := uint32(len(in.m.imports)); idx < n {
+		return &in.m.types[in.m.imports[idx].typ]
+	} else if idx-n >= uint32(len(in.m.funcs)) {
+		wasmFail("unknown function %d", idx)
+	}
+
+	return &in.m.types[in.m.funcs[idx-uint32(len(in.m.imports))].typ]
+}
+
+// bytes returns the memory at [ptr, ptr+n), trapping if out of bounds.
+func (in *wasmInstance) bytes(ptr, n uint64) []byte {
+	if ptr+n > uint64(len(in.mem)) {
+		wasmFail("trap: out of bounds memory access")
+	}
+	return in.mem[ptr : ptr+n]
+}
+
+func (in *wasmInstance) push(v uint64) {
+	in.stack[in.sp] = v
+	in.sp++
+}
+
+func (in *wasmInstance) pop() uint64 {
+	in.sp--
+	return in.stack[in.sp]
+}
+
+func (in *wasmInstance) call(idx uint32) {
+	t := in.funcType(idx)
+
+	if n := uint32(len(in.m.imports)); idx < n {
+		args := in.stack[in.sp-len(t.params) : in.sp]
+		v := in.hosts[idx](in, args)
+		in.sp -= len(t.params)
+
+		if len(t.results) != 0 {
+			in.push(v)
+		}
+
+		return
+	}
+
+	if in.depth++; in.depth > wasmMaxDepth {
+		wasmFail("trap: call stack exhausted")
+	}
+
+	f := &in.m.funcs[idx-uint32(len(in.m.imports))]
+	base := in.sp - len(t.params)
+
+	for i := 0; i < f.locals; i++ {
+		in.push(0)
+	}
+
+	in.labels = append(in.labels, wasmLabel{height: base,
+		arity: len(t.results)})
+	in.exec(f, base)
+	in.depth--
+}
+
+// blockArity returns the parameter and result counts of a block type.
+func (in *wasmInstance) blockArity(v uint64) (int, int) {
+	if v&(1<<63) == 0 {
+		return 0, int(v)
+	}
+
+	t := &in.m.types[v&^(1<<63)]
+	return len(t.params), len(t.results)
+}
+
+// branch unwinds to the label at index target, returning whether it is the
+// label of the function.
+func (in *wasmInstance) branch(target int) int {
+	l := in.labels[target]
+	copy(in.stack[l.height:], in.stack[in.sp-l.arity:in.sp])
+	in.sp = l.height + l.arity
+	in.labels = in.labels[:target]
+	return l.cont
+}
+
+func (in *wasmInstance) exec(f *wasmFunc, base int) {
+	fn := len(in.labels) - 1
+	code := f.code
+	s := in.stack
+	pc := 0
+
+	for {
+		c := &code[pc]
+
+		if in.fuel--; in.fuel < 0 {
+			wasmFail("trap: fuel exhausted")
+		}
+
+		sp := in.sp
+
+		switch c.op {
+		case 0x00:
+			wasmFail("trap: unreachable")
+		case 0x01:
+		case 0x02, 0x03:
+			params, results := in.blockArity(c.v)
+			l := wasmLabel{height: sp - params, arity: results,
+				cont: int(c.a) + 1}
+
+			if c.op == 0x03 {
+				l.arity, l.cont = params, pc
+			}
+
+			in.labels = append(in.labels, l)
+		case 0x04:
+			in.sp--
+			params, results := in.blockArity(c.v)
+			l := wasmLabel{height: in.sp - params, arity: results,
+				cont: int(c.a) + 1}
+
+			if s[in.sp] != 0 {
+				in.labels = append(in.labels, l)
+			} else if c.b != 0 {
+				in.labels = append(in.labels, l)
+				pc = int(c.b)
+			} else {
+				pc = int(c.a) + 1
+				continue
+			}
+		case 0x05:
+			in.labels = in.labels[:len(in.labels)-1]
+			pc = int(c.a) + 1
+			continue
+		case 0x0b:
+			if len(in.labels)-1 == fn {
+				in.branch(fn)
+				return
+			}
+
+			in.labels = in.labels[:len(in.labels)-1]
+		case 0x0c:
+			target := len(in.labels) - 1 - int(c.a)
+
+			if pc = in.branch(target); target == fn {
+				return
+			}
+
+			continue
+		case 0x0d:
+			in.sp--
+
+			if s[in.sp] != 0 {
+				target := len(in.labels) - 1 - int(c.a)
+
+				if pc = in.branch(target); target == fn {
+					return
+				}
+
+				continue
+			}
+		case 0x0e:
+			in.sp--
+			targets := f.tables[c.a]
+			i := s[in.sp]
+
+			if i >= uint64(len(targets)-1) {
+				i = uint64(len(targets) - 1)
+			}
+
+			target := len(in.labels) - 1 - int(targets[i])
+
+			if pc = in.branch(target); target == fn {
+				return
+			}
+
+			continue
+		case 0x0f:
+			in.branch(fn)
+			return
+		case 0x10:
+			in.call(c.a)
+			s = in.stack
+		case 0x11:
+			in.sp--
+			i := s[in.sp]
+
+			if i >= uint64(len(in.table)) || in.table[i] < 0 {
+				wasmFail("trap: undefined table element")
+			}
+
+			want := &in.m.types[c.a]
+			got := in.funcType(uint32(in.table[i]))
+
+			if string(want.params) != string(got.params) ||
+				string(want.results) != string(got.results) {
+				wasmFail("trap: indirect call type mismatch")
+			}
+
+			in.call(uint32(in.table[i]))
+		case 0x1a:
+			in.sp--
+		case 0x1b:
+			in.sp -= 2
+
+			if s[sp-1] == 0 {
+				s[sp-3] = s[sp-2]
+			}
+		case 0x20:
+			in.push(s[base+int(c.a)])
+		case 0x21:
+			in.sp--
+			s[base+int(c.a)] = s[in.sp]
+		case 0x22:
+			s[base+int(c.a)] = s[sp-1]
+		case 0x23:
+			in.push(in.globals[c.a])
+		case 0x24:
+			in.sp--
+			in.globals[c.a] = s[in.sp]
+		case 0x3f:
+			in.push(uint64(len(in.mem) / wasmPageSize))
+		case 0x40:
+			pages := uint64(len(in.mem) / wasmPageSize)
+			n := uint64(uint32(s[sp-1]))
+
+			if pages+n > uint64(in.memMax) || pages+n > wasmMaxPages {
+				s[sp-1] = uint64(math.MaxUint32)
+			} else {
+				in.mem = append(in.mem, make([]byte, n*wasmPageSize)...)
+				s[sp-1] = pages
+			}
+		case 0x41, 0x42, 0x43, 0x44:
+			in.push(c.v)
+		case 0xfc:
+			in.misc(c)
+		default:
+			if c.op >= 0x28 && c.op <= 0x3e {
+				in.memory(c)
+			} else {
+				in.numeric(c.op)
+			}
+		}
+
+		pc++
+	}
+}
+
+// memory executes a load or store.
+func (in *wasmInstance) memory(c *wasmInstr) {
+	s := in.stack
+
+	if c.op <= 0x35 {
+		sp := in.sp - 1
+		addr := uint64(uint32(s[sp])) + c.v
+		var v uint64
+
+		switch c.op {
+		case 0x28, 0x2a:
+			v = uint64(binary.LittleEndian.Uint32(in.bytes(addr, 4)))
+		case 0x29, 0x2b:
+			v = binary.LittleEndian.Uint64(in.bytes(addr, 8))
+		case 0x2c:
+			v = uint64(uint32(int32(int8(in.bytes(addr, 1)[0]))))
+		case 0x2d, 0x31:
+			v = uint64(in.bytes(addr, 1)[0])
+		case 0x2e:
+			v = uint64(uint32(int32(int16(binary.LittleEndian.Uint16(in.bytes(addr, 2))))))
+		case 0x2f, 0x33:
+			v = uint64(binary.LittleEndian.Uint16(in.bytes(addr, 2)))
+		case 0x30:
+			v = uint64(int64(int8(in.bytes(addr, 1)[0])))
+		case 0x32:
+			v = uint64(int64(int16(binary.LittleEndian.Uint16(in.bytes(addr, 2)))))
+		case 0x34:
+			v = uint64(int64(int32(binary.LittleEndian.Uint32(in.bytes(addr, 4)))))
+		case 0x35:
+			v = uint64(binary.LittleEndian.Uint32(in.bytes(addr, 4)))
+		}
+
+		s[sp] = v
+		return
+	}
+
+	in.sp -= 2
+	addr := uint64(uint32(s[in.sp])) + c.v
+	v := s[in.sp+1]
+
+	switch c.op {
+	case 0x36, 0x38, 0x3e:
+		binary.LittleEndian.PutUint32(in.bytes(addr, 4), uint32(v))
+	case 0x37, 0x39:
+		binary.LittleEndian.PutUint64(in.bytes(addr, 8), v)
+	case 0x3a, 0x3c:
+		in.bytes(addr, 1)[0] = byte(v)
+	case 0x3b, 0x3d:
+		binary.LittleEndian.PutUint16(in.bytes(addr, 2), uint16(v))
+	}
+}
+
+// misc executes the 0xfc prefixed instructions.
+func (in *wasmInstance) misc(c *wasmInstr) {
+	s := in.stack
+	sp := in.sp
+
+	switch c.sub {
+	case 10:
+		in.sp -= 3
+		dst, src, n := uint64(uint32(s[sp-3])), uint64(uint32(s[sp-2])),
+			uint64(uint32(s[sp-1]))
+		copy(in.bytes(dst, n), in.bytes(src, n))
+	case 11:
+		in.sp -= 3
+		dst, v, n := uint64(uint32(s[sp-3])), byte(s[sp-2]),
+			uint64(uint32(s[sp-1]))
+		b := in.bytes(dst, n)
+
+		for i := range b {
+			b[i] = v
+		}
+	default:
+		// Saturating truncation.
+		var f float64
+
+		if c.sub == 0 || c.sub == 1 || c.sub == 4 || c.sub == 5 {
+			f = float64(math.Float32frombits(uint32(s[sp-1])))
+		} else {
+			f = math.Float64frombits(s[sp-1])
+		}
+
+		var v uint64
+
+		switch c.sub {
+		case 0, 2:
+			v = uint64(uint32(int32(satTrunc(f, math.MinInt32, math.MaxInt32))))
+		case 1, 3:
+			v = uint64(uint32(satTruncU(f, math.MaxUint32)))
+		case 4, 6:
+			v = uint64(satTrunc(f, math.MinInt64, math.MaxInt64))
+		case 5, 7:
+			v = satTruncU(f, math.MaxUint64)
+		}
+
+		s[sp-1] = v
+	}
+}
+
+func satTrunc(f float64, lo, hi int64) int64 {
+	switch {
+	case f != f:
+		return 0
+	case f <= float64(lo):
+		return lo
+	case f >= float64(hi):
+		return hi
+	}
+	return int64(f)
+}
+
+func satTruncU(f float64, hi uint64) uint64 {
+	switch {
+	case f != f || f <= 0:
+		return 0
+	case f >= float64(hi):
+		return hi
+	}
+	return uint64(f)
+}
+
+// trunc truncates f towards zero, trapping unless lo <= f < hi afterwards.
+func trunc(f, lo, hi float64) float64 {
+	if f != f {
+		wasmFail("trap: invalid conversion to integer")
+	}
+
+	if t := math.Trunc(f); t >= lo && t < hi {
+		return t
+	}
+
+	wasmFail("trap: integer overflow")
+	return 0
+}
+
+func f32(v uint64) float32  { return math.Float32frombits(uint32(v)) }
+func f64(v uint64) float64  { return math.Float64frombits(v) }
+func pf32(f float32) uint64 { return uint64(math.Float32bits(f)) }
+func pf64(f float64) uint64 { return math.Float64bits(f) }
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// numeric executes the comparison, arithmetic and conversion instructions.
+func (in *wasmInstance) numeric(op byte) {
+	s := in.stack
+	sp := in.sp
+
+	// Unary instructions replace the top of the stack.
+	x := s[sp-1]
+	r, unary := uint64(0), true
+
+	switch op {
+	case 0x45:
+		r = b2u(uint32(x) == 0)
+	case 0x50:
+		r = b2u(x == 0)
+	case 0x67:
+		r = uint64(bits.LeadingZeros32(uint32(x)))
+	case 0x68:
+		r = uint64(bits.TrailingZeros32(uint32(x)))
+	case 0x69:
+		r = uint64(bits.OnesCount32(uint32(x)))
+	case 0x79:
+		r = uint64(bits.LeadingZeros64(x))
+	case 0x7a:
+		r = uint64(bits.TrailingZeros64(x))
+	case 0x7b:
+		r = uint64(bits.OnesCount64(x))
+	case 0x8b:
+		r = x & 0x7fffffff
+	case 0x8c:
+		r = (x ^ 0x80000000) & math.MaxUint32
+	case 0x8d:
+		r = pf32(float32(math.Ceil(float64(f32(x)))))
+	case 0x8e:
+		r = pf32(float32(math.Floor(float64(f32(x)))))
+	case 0x8f:
+		r = pf32(float32(math.Trunc(float64(f32(x)))))
+	case 0x90:
+		r = pf32(float32(math.RoundToEven(float64(f32(x)))))
+	case 0x91:
+		r = pf32(float32(math.Sqrt(float64(f32(x)))))
+	case 0x99:
+		r = x &^ (1 << 63)
+	case 0x9a:
+		r = x ^ 1<<63
+	case 0x9b:
+		r = pf64(math.Ceil(f64(x)))
+	case 0x9c:
+		r = pf64(math.Floor(f64(x)))
+	case 0x9d:
+		r = pf64(math.Trunc(f64(x)))
+	case 0x9e:
+		r = pf64(math.RoundToEven(f64(x)))
+	case 0x9f:
+		r = pf64(math.Sqrt(f64(x)))
+	case 0xa7:
+		r = uint64(uint32(x))
+	case 0xa8:
+		r = uint64(uint32(int32(trunc(float64(f32(x)), -1<<31, 1<<31))))
+	case 0xa9:
+		r = uint64(uint32(trunc(float64(f32(x)), 0, 1<<32)))
+	case 0xaa:
+		r = uint64(uint32(int32(trunc(f64(x), -1<<31, 1<<31))))
+	case 0xab:
+		r = uint64(uint32(trunc(f64(x), 0, 1<<32)))
+	case 0xac:
+		r = uint64(int64(int32(uint32(x))))
+	case 0xad:
+		r = uint64(uint32(x))
+	case 0xae:
+		r = uint64(int64(trunc(float64(f32(x)), -1<<63, 1<<63)))
+	case 0xaf:
+		r = uint64(trunc(float64(f32(x)), 0, 1<<64))
+	case 0xb0:
+		r = uint64(int64(trunc(f64(x), -1<<63, 1<<63)))
+	case 0xb1:
+		r = uint64(trunc(f64(x), 0, 1<<64))
+	case 0xb2:
+		r = pf32(float32(int32(uint32(x))))
+	case 0xb3:
+		r = pf32(float32(uint32(x)))
+	case 0xb4:
+		r = pf32(float32(int64(x)))
+	case 0xb5:
+		r = pf32(float32(x))
+	case 0xb6:
+		r = pf32(float32(f64(x)))
+	case 0xb7:
+		r = pf64(float64(int32(uint32(x))))
+	case 0xb8:
+		r = pf64(float64(uint32(x)))
+	case 0xb9:
+		r = pf64(float64(int64(x)))
+	case 0xba:
+		r = pf64(float64(x))
+	case 0xbb:
+		r = pf64(float64(f32(x)))
+	case 0xbc, 0xbd, 0xbe, 0xbf:
+		r = x
+	case 0xc0:
+		r = uint64(uint32(int32(int8(x))))
+	case 0xc1:
+		r = uint64(uint32(int32(int16(x))))
+	case 0xc2:
+		r = uint64(int64(int8(x)))
+	case 0xc3:
+		r = uint64(int64(int16(x)))
+	case 0xc4:
+		r = uint64(int64(int32(x)))
+	default:
+		unary = false
+	}
+
+	if unary {
+		s[sp-1] = r
+		return
+	}
+
+	// Binary instructions replace the top two.
+	a, b := s[sp-2], x
+	a32, b32 := uint32(a), uint32(b)
+
+	switch op {
+	case 0x46:
+		r = b2u(a32 == b32)
+	case 0x47:
+		r = b2u(a32 != b32)
+	case 0x48:
+		r = b2u(int32(a32) < int32(b32))
+	case 0x49:
+		r = b2u(a32 < b32)
+	case 0x4a:
+		r = b2u(int32(a32) > int32(b32))
+	case 0x4b:
+		r = b2u(a32 > b32)
+	case 0x4c:
+		r = b2u(int32(a32) <= int32(b32))
+	case 0x4d:
+		r = b2u(a32 <= b32)
+	case 0x4e:
+		r = b2u(int32(a32) >= int32(b32))
+	case 0x4f:
+		r = b2u(a32 >= b32)
+	case 0x51:
+		r = b2u(a == b)
+	case 0x52:
+		r = b2u(a != b)
+	case 0x53:
+		r = b2u(int64(a) < int64(b))
+	case 0x54:
+		r = b2u(a < b)
+	case 0x55:
+		r = b2u(int64(a) > int64(b))
+	case 0x56:
+		r = b2u(a > b)
+	case 0x57:
+		r = b2u(int64(a) <= int64(b))
+	case 0x58:
+		r = b2u(a <= b)
+	case 0x59:
+		r = b2u(int64(a) >= int64(b))
+	case 0x5a:
+		r = b2u(a >= b)
+	case 0x5b:
+		r = b2u(f32(a) == f32(b))
+	case 0x5c:
+		r = b2u(f32(a) != f32(b))
+	case 0x5d:
+		r = b2u(f32(a) < f32(b))
+	case 0x5e:
+		r = b2u(f32(a) > f32(b))
+	case 0x5f:
+		r = b2u(f32(a) <= f32(b))
+	case 0x60:
+		r = b2u(f32(a) >= f32(b))
+	case 0x61:
+		r = b2u(f64(a) == f64(b))
+	case 0x62:
+		r = b2u(f64(a) != f64(b))
+	case 0x63:
+		r = b2u(f64(a) < f64(b))
+	case 0x64:
+		r = b2u(f64(a) > f64(b))
+	case 0x65:
+		r = b2u(f64(a) <= f64(b))
+	case 0x66:
+		r = b2u(f64(a) >= f64(b))
+	case 0x6a:
+		r = uint64(a32 + b32)
+	case 0x6b:
+		r = uint64(a32 - b32)
+	case 0x6c:
+		r = uint64(a32 * b32)
+	case 0x6d:
+		if b32 == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		if int32(a32) == math.MinInt32 && int32(b32) == -1 {
+			wasmFail("trap: integer overflow")
+		}
+
+		r = uint64(uint32(int32(a32) / int32(b32)))
+	case 0x6e:
+		if b32 == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		r = uint64(a32 / b32)
+	case 0x6f:
+		if b32 == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		r = uint64(uint32(int32(a32) % int32(b32)))
+	case 0x70:
+		if b32 == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		r = uint64(a32 % b32)
+	case 0x71:
+		r = uint64(a32 & b32)
+	case 0x72:
+		r = uint64(a32 | b32)
+	case 0x73:
+		r = uint64(a32 ^ b32)
+	case 0x74:
+		r = uint64(a32 << (b32 & 31))
+	case 0x75:
+		r = uint64(uint32(int32(a32) >> (b32 & 31)))
+	case 0x76:
+		r = uint64(a32 >> (b32 & 31))
+	case 0x77:
+		r = uint64(bits.RotateLeft32(a32, int(b32&31)))
+	case 0x78:
+		r = uint64(bits.RotateLeft32(a32, -int(b32&31)))
+	case 0x7c:
+		r = a + b
+	case 0x7d:
+		r = a - b
+	case 0x7e:
+		r = a * b
+	case 0x7f:
+		if b == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		if int64(a) == math.MinInt64 && int64(b) == -1 {
+			wasmFail("trap: integer overflow")
+		}
+
+		r = uint64(int64(a) / int64(b))
+	case 0x80:
+		if b == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		r = a / b
+	case 0x81:
+		if b == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		r = uint64(int64(a) % int64(b))
+	case 0x82:
+		if b == 0 {
+			wasmFail("trap: integer divide by zero")
+		}
+
+		r = a % b
+	case 0x83:
+		r = a & b
+	case 0x84:
+		r = a | b
+	case 0x85:
+		r = a ^ b
+	case 0x86:
+		r = a << (b & 63)
+	case 0x87:
+		r = uint64(int64(a) >> (b & 63))
+	case 0x88:
+		r = a >> (b & 63)
+	case 0x89:
+		r = bits.RotateLeft64(a, int(b&63))
+	case 0x8a:
+		r = bits.RotateLeft64(a, -int(b&63))
+	case 0x92:
+		r = pf32(f32(a) + f32(b))
+	case 0x93:
+		r = pf32(f32(a) - f32(b))
+	case 0x94:
+		r = pf32(f32(a) * f32(b))
+	case 0x95:
+		r = pf32(f32(a) / f32(b))
+	case 0x96:
+		r = pf32(float32(math.Min(float64(f32(a)), float64(f32(b)))))
+	case 0x97:
+		r = pf32(float32(math.Max(float64(f32(a)), float64(f32(b)))))
+	case 0x98:
+		r = a&0x7fffffff | b&0x80000000
+	case 0xa0:
+		r = pf64(f64(a) + f64(b))
+	case 0xa1:
+		r = pf64(f64(a) - f64(b))
+	case 0xa2:
+		r = pf64(f64(a) * f64(b))
+	case 0xa3:
+		r = pf64(f64(a) / f64(b))
+	case 0xa4:
+		r = pf64(math.Min(f64(a), f64(b)))
+	case 0xa5:
+		r = pf64(math.Max(f64(a), f64(b)))
+	case 0xa6:
+		r = a&^(1<<63) | b&(1<<63)
+	default:
+		wasmFail("unsupported instruction 0x%x", op)
+	}
+
+	in.sp--
+	s[sp-2] = r
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helpers assembling binary modules.
+
+func wasmULEB(v uint64) []byte {
+	var b []byte
+
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+
+		if v == 0 {
+			return append(b, c)
+		}
+
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmSLEB(v int64) []byte {
+	var b []byte
+
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+
+		if v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmCat(parts ...[]byte) []byte {
+	var b []byte
+
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+func wasmVec(items ...[]byte) []byte {
+	return wasmCat(wasmULEB(uint64(len(items))), wasmCat(items...))
+}
+
+func wasmName(s string) []byte {
+	return wasmCat(wasmULEB(uint64(len(s))), []byte(s))
+}
+
+func wasmSection(id byte, items ...[]byte) []byte {
+	body := wasmVec(items...)
+	return wasmCat([]byte{id}, wasmULEB(uint64(len(body))), body)
+}
+
+func wasmModuleBytes(sections ...[]byte) []byte {
+	return wasmCat([]byte("\x00asm\x01\x00\x00\x00"), wasmCat(sections...))
+}
+
+// wasmFuncSig is a function type of parameter and result value types.
+func wasmFuncSig(params, results []byte) []byte {
+	return wasmCat([]byte{0x60}, wasmULEB(uint64(len(params))), params,
+		wasmULEB(uint64(len(results))), results)
+}
+
+// wasmBody is a function body with locals, as count and type pairs, and code
+// not including the final end.
+func wasmBody(locals [][2]byte, code ...[]byte) []byte {
+	var decls [][]byte
+
+	for _, l := range locals {
+		decls = append(decls, []byte{l[0], l[1]})
+	}
+
+	body := wasmCat(wasmVec(decls...), wasmCat(code...), []byte{0x0b})
+	return wasmCat(wasmULEB(uint64(len(body))), body)
+}
+
+func wasmExportFunc(name string, idx uint64) []byte {
+	return wasmCat(wasmName(name), []byte{0x00}, wasmULEB(idx))
+}
+
+func wasmConstI32(v int32) []byte {
+	return wasmCat([]byte{0x41}, wasmSLEB(int64(v)))
+}
+
+func wasmConstI64(v int64) []byte {
+	return wasmCat([]byte{0x42}, wasmSLEB(v))
+}
+
+// wasmTestModule is a module of arithmetic, control flow and memory
+// functions.
+func wasmTestModule() []byte {
+	i32 := []byte{wasmI32}
+	i64 := []byte{wasmI64}
+
+	return wasmModuleBytes(
+		wasmSection(1,
+			wasmFuncSig(i64, i64),
+			wasmFuncSig(i32, i32),
+			wasmFuncSig(nil, nil),
+			wasmFuncSig([]byte{wasmI32, wasmI32}, i32)),
+		wasmSection(3, []byte{0}, []byte{1}, []byte{2}, []byte{1},
+			[]byte{3}, []byte{1}),
+		wasmSection(5, []byte{0x00, 1}),
+		wasmSection(7,
+			wasmExportFunc("fact", 0),
+			wasmExportFunc("fib", 1),
+			wasmExportFunc("spin", 2),
+			wasmExportFunc("load", 3),
+			wasmExportFunc("div", 4),
+			wasmExportFunc("extend8", 5)),
+		wasmSection(10,
+			// fact(n): acc = 1; while n != 0 { acc *= n; n-- }
+			wasmBody([][2]byte{{1, wasmI64}},
+				wasmConstI64(1), []byte{0x21, 1},
+				[]byte{0x02, 0x40, 0x03, 0x40},
+				[]byte{0x20, 0, 0x50, 0x0d, 1},
+				[]byte{0x20, 1, 0x20, 0, 0x7e, 0x21, 1},
+				[]byte{0x20, 0}, wasmConstI64(1), []byte{0x7d, 0x21, 0},
+				[]byte{0x0c, 0, 0x0b, 0x0b},
+				[]byte{0x20, 1}),
+			// fib(n): n < 2 ? n : fib(n-1) + fib(n-2)
+			wasmBody(nil,
+				[]byte{0x20, 0}, wasmConstI32(2), []byte{0x49},
+				[]byte{0x04, wasmI32, 0x20, 0, 0x05},
+				[]byte{0x20, 0}, wasmConstI32(1), []byte{0x6b, 0x10, 1},
+				[]byte{0x20, 0}, wasmConstI32(2), []byte{0x6b, 0x10, 1},
+				[]byte{0x6a, 0x0b}),
+			// spin(): loops forever.
+			wasmBody(nil, []byte{0x03, 0x40, 0x0c, 0, 0x0b}),
+			// load(p): the i32 at p.
+			wasmBody(nil, []byte{0x20, 0, 0x28, 2, 0}),
+			// div(a, b): a / b, unsigned.
+			wasmBody(nil, []byte{0x20, 0, 0x20, 1, 0x6e}),
+			// extend8(v): v sign-extended from 8 bits.
+			wasmBody(nil, []byte{0x20, 0, 0xc0})),
+		wasmSection(11,
+			wasmCat([]byte{0}, wasmConstI32(8), []byte{0x0b},
+				wasmName("\x2a\x00\x00\x00"))))
+}
+
+func TestWASMInterpreter(t *testing.T) {
+	m, err := parseWasm(wasmTestModule())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := m.instantiate(nil, 1, 1000)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []uint64
+		want uint64
+		trap bool
+	}{
+		{"fact", []uint64{0}, 1, false},
+		{"fact", []uint64{20}, 2432902008176640000, false},
+		{"fib", []uint64{20}, 6765, false},
+		{"load", []uint64{8}, 42, false},
+		{"load", []uint64{0}, 0, false},
+		{"load", []uint64{wasmPageSize - 2}, 0, true},
+		{"div", []uint64{7, 2}, 3, false},
+		{"div", []uint64{7, 0}, 0, true},
+		{"extend8", []uint64{0x80}, 0xffffff80, false},
+		{"spin", nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		results, err := in.invoke(tt.name, 1000000, tt.args...)
+
+		if tt.trap {
+			if err == nil {
+				t.Errorf("%s%v did not trap", tt.name, tt.args)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s%v: %v", tt.name, tt.args, err)
+			continue
+		}
+
+		got := results[0]
+
+		// Only fact returns i64.
+		if tt.name != "fact" {
+			got = uint64(uint32(got))
+		}
+
+		if got != tt.want {
+			t.Errorf("%s%v = %d, want %d", tt.name, tt.args, got, tt.want)
+		}
+	}
+
+	if _, err := parseWasm([]byte("\x00asm\x02\x00\x00\x00")); err == nil {
+		t.Error("parsed a module of an unknown version")
+	}
+
+	if _, err := m.instantiate(nil, 0, 1000); err == nil {
+		t.Error("instantiated a module over the memory limit")
+	}
+}
+
+// wasmFilterModule is a filter which sets the request header X-Wasm: yes,
+// then responds with status, or passes the request on if status is zero.
+func wasmFilterModule(status int32) []byte {
+	i32 := byte(wasmI32)
+	set := wasmFuncSig([]byte{i32, i32, i32, i32, i32}, nil)
+
+	return wasmModuleBytes(
+		wasmSection(1, set, wasmFuncSig(nil, []byte{i32})),
+		wasmSection(2, wasmCat(wasmName("proxy"), wasmName("set"),
+			[]byte{0x00, 0})),
+		wasmSection(3, []byte{1}),
+		wasmSection(5, []byte{0x00, 1}),
+		wasmSection(7,
+			wasmCat(wasmName("memory"), []byte{0x02, 0}),
+			wasmExportFunc("on_request", 1)),
+		wasmSection(10,
+			wasmBody(nil,
+				wasmConstI32(wasmKindRequestHeader), wasmConstI32(0), wasmConstI32(6),
+				wasmConstI32(16), wasmConstI32(3), []byte{0x10, 0},
+				wasmConstI32(status))),
+		wasmSection(11,
+			wasmCat([]byte{0}, wasmConstI32(0), []byte{0x0b}, wasmName("X-Wasm")),
+			wasmCat([]byte{0}, wasmConstI32(16), []byte{0x0b}, wasmName("yes"))))
+}
+
+func TestWASMFilter(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		status int32
+		want   int
+	}{
+		{0, http.StatusOK},
+		{http.StatusForbidden, http.StatusForbidden},
+		{42, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, "filter.wasm")
+
+		if err := os.WriteFile(path, wasmFilterModule(tt.status), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := newWASMFilter(&WASM{Path: path})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var header string
+		h := withWASM(f, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			header = req.Header.Get("X-Wasm")
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != tt.want {
+			t.Errorf("status %d: responded %d, want %d", tt.status, w.Code,
+				tt.want)
+		}
+
+		if tt.want == http.StatusOK && header != "yes" {
+			t.Errorf("backend saw X-Wasm %q, want %q", header, "yes")
+		}
+	}
+
+	path := filepath.Join(dir, "empty.wasm")
+
+	if err := os.WriteFile(path, wasmModuleBytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newWASMFilter(&WASM{Path: path}); err == nil ||
+		!strings.Contains(err.Error(), "on_request") {
+		t.Errorf("module without on_request: error %v", err)
+	}
+
+	path = filepath.Join(dir, "filter.wasm")
+
+	for _, c := range []WASM{
+		{Fuel: -1},
+		{MaxMemory: -1},
+		{MaxMemory: 1},
+		{MaxMemory: wasmPageSize - 1},
+	} {
+		c.Path = path
+
+		if _, err := newWASMFilter(&c); err == nil {
+			t.Errorf("fuel %d, max memory %d: accepted", c.Fuel, c.MaxMemory)
+		}
+	}
+}
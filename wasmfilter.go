@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// WASM describes a WebAssembly filter run on the requests of a route, in an
+// instance isolated from the proxy.
+//
+// Modules export their memory as "memory" and a function on_request() i32,
+// which returns 0 to pass the request on or a status to respond with. They may
+// also export on_response(status i32) i32, called before the response headers
+// are sent, which returns 0 or a status replacing the backend's. Modules may
+// import these functions from module "proxy":
+//
+//	get(kind, name_ptr, name_len, buf_ptr, buf_len i32) i32
+//	set(kind, name_ptr, name_len, value_ptr, value_len i32)
+//	log(ptr, len i32)
+//
+// get copies a value into the buffer if it fits, returning its length, or -1
+// if absent. set changes a value, deleting it if value_len is -1. log records
+// a message in the access log. The kinds are 0 method, 1 path, 2 query, 3
+// host, 4 client IP, 5 request header and 6 response header. Names are used
+// only for headers, and only the path, query and headers may be set.
+type WASM struct {
+	// Path is the WebAssembly module file.
+	Path string `json:"path"`
+
+	// Fuel is optional. It is the most instructions run by each call into
+	// the module, defaulting to 10000000.
+	Fuel int64 `json:"fuel"`
+
+	// MaxMemory is optional. It is the most memory of each instance, in
+	// bytes, defaulting to 16 MiB. It is rounded down to whole 64 KiB
+	// pages, so must be at least one page.
+	MaxMemory int `json:"max_memory"`
+}
+
+const (
+	defaultWASMFuel      = 10000000
+	defaultWASMMaxMemory = 16 << 20
+)
+
+const (
+	wasmKindMethod = iota
+	wasmKindPath
+	wasmKindQuery
+	wasmKindHost
+	wasmKindIP
+	wasmKindRequestHeader
+	wasmKindResponseHeader
+)
+
+type wasmFilter struct {
+	path     string
+	m        *wasmModule
+	fuel     int64
+	maxPages uint32
+
+	mu   sync.Mutex
+	free []*wasmInstance
+}
+
+// wasmCall is the request an instance is filtering.
+type wasmCall struct {
+	w   http.ResponseWriter
+	req *http.Request
+}
+
+var wasmHosts = map[string]wasmHost{
+	"proxy.get": func(in *wasmInstance, args []uint64) uint64 {
+		c := in.data.(*wasmCall)
+		name := string(in.bytes(args[1], args[2]))
+		v, ok := c.get(uint32(args[0]), name)
+
+		if !ok {
+			return uint64(uint32(0xffffffff))
+		}
+
+		if uint64(len(v)) <= args[4] {
+			copy(in.bytes(args[3], args[4]), v)
+		}
+
+		return uint64(len(v))
+	},
+	"proxy.set": func(in *wasmInstance, args []uint64) uint64 {
+		c := in.data.(*wasmCall)
+		name := string(in.bytes(args[1], args[2]))
+
+		if int32(args[4]) == -1 {
+			c.del(uint32(args[0]), name)
+		} else {
+			c.set(uint32(args[0]), name, string(in.bytes(args[3], args[4])))
+		}
+
+		return 0
+	},
+	"proxy.log": func(in *wasmInstance, args []uint64) uint64 {
+		c := in.data.(*wasmCall)
+		setLogField(c.req, "wasm_log", string(in.bytes(args[0], args[1])))
+		return 0
+	},
+}
+
+func (c *wasmCall) get(kind uint32, name string) (string, bool) {
+	switch kind {
+	case wasmKindMethod:
+		return c.req.Method, true
+	case wasmKindPath:
+		return c.req.URL.Path, true
+	case wasmKindQuery:
+		return c.req.URL.RawQuery, true
+	case wasmKindHost:
+		return c.req.Host, true
+	case wasmKindIP:
+		return clientIP(c.req), true
+	case wasmKindRequestHeader:
+		v, ok := c.req.Header[http.CanonicalHeaderKey(name)]
+
+		if !ok || len(v) == 0 {
+			return "", false
+		}
+
+		return v[0], true
+	case wasmKindResponseHeader:
+		v, ok := c.w.Header()[http.CanonicalHeaderKey(name)]
+
+		if !ok || len(v) == 0 {
+			return "", false
+		}
+
+		return v[0], true
+	}
+
+	wasmFail("trap: unknown kind %d", kind)
+	return "", false
+}
+
+func (c *wasmCall) set(kind uint32, name, value string) {
+	switch kind {
+	case wasmKindPath:
+		c.req.URL.Path = value
+		c.req.URL.RawPath = ""
+	case wasmKindQuery:
+		c.req.URL.RawQuery = value
+	case wasmKindRequestHeader:
+		c.req.Header.Set(name, value)
+	case wasmKindResponseHeader:
+		c.w.Header().Set(name, value)
+	default:
+		wasmFail("trap: kind %d may not be set", kind)
+	}
+}
+
+func (c *wasmCall) del(kind uint32, name string) {
+	switch kind {
+	case wasmKindQuery:
+		c.req.URL.RawQuery = ""
+	case wasmKindRequestHeader:
+		c.req.Header.Del(name)
+	case wasmKindResponseHeader:
+		c.w.Header().Del(name)
+	default:
+		wasmFail("trap: kind %d may not be deleted", kind)
+	}
+}
+
+func newWASMFilter(c *WASM) (*wasmFilter, error) {
+	if c.Fuel < 0 || c.MaxMemory < 0 {
+		return nil, errors.New("proxy: negative wasm limit")
+	}
+
+	if c.MaxMemory != 0 && c.MaxMemory < wasmPageSize {
+		return nil, errors.New("proxy: wasm max_memory is below one 64 KiB page")
+	}
+
+	b, err := os.ReadFile(c.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := parseWasm(b)
+
+	if err != nil {
+		return nil, errors.New("proxy: " + c.Path + ": " + err.Error())
+	}
+
+	if !m.exported("on_request") {
+		return nil, errors.New("proxy: " + c.Path +
+			": on_request is not exported")
+	}
+
+	f := &wasmFilter{
+		path:     c.Path,
+		m:        m,
+		fuel:     c.Fuel,
+		maxPages: uint32(c.MaxMemory / wasmPageSize),
+	}
+
+	if f.fuel == 0 {
+		f.fuel = defaultWASMFuel
+	}
+
+	if c.MaxMemory == 0 {
+		f.maxPages = defaultWASMMaxMemory / wasmPageSize
+	}
+
+	// Instantiate once up front so that broken modules fail early.
+	in, err := f.instantiate()
+
+	if err != nil {
+		return nil, errors.New("proxy: " + c.Path + ": " + err.Error())
+	}
+
+	f.free = append(f.free, in)
+	return f, nil
+}
+
+func (f *wasmFilter) instantiate() (*wasmInstance, error) {
+	in, err := f.m.instantiate(wasmHosts, f.maxPages, f.fuel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.m.exported("_initialize") {
+		if _, err := in.invoke("_initialize", f.fuel); err != nil {
+			return nil, err
+		}
+	}
+
+	return in, nil
+}
+
+func (f *wasmFilter) get() (*wasmInstance, error) {
+	f.mu.Lock()
+
+	if n := len(f.free); n != 0 {
+		in := f.free[n-1]
+		f.free = f.free[:n-1]
+		f.mu.Unlock()
+		return in, nil
+	}
+
+	f.mu.Unlock()
+	return f.instantiate()
+}
+
+func (f *wasmFilter) put(in *wasmInstance) {
+	in.data = nil
+	f.mu.Lock()
+	f.free = append(f.free, in)
+	f.mu.Unlock()
+}
+
+// call invokes the exported function, returning the instance to the pool
+// unless it trapped.
+func (f *wasmFilter) call(c *wasmCall, name string, args ...uint64) (uint32, error) {
+	in, err := f.get()
+
+	if err != nil {
+		return 0, err
+	}
+
+	in.data = c
+	results, err := in.invoke(name, f.fuel, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	f.put(in)
+
+	if len(results) != 1 {
+		return 0, errors.New("proxy: wasm: " + name + " must return i32")
+	}
+
+	if s := uint32(results[0]); s != 0 && (s < 100 || s > 999) {
+		return 0, errors.New("proxy: wasm: " + name + " returned an invalid status")
+	}
+
+	return uint32(results[0]), nil
+}
+
+// wasmWriter runs on_response before the response headers are sent.
+type wasmWriter struct {
+	http.ResponseWriter
+	f     *wasmFilter
+	c     *wasmCall
+	wrote bool
+}
+
+func (w *wasmWriter) WriteHeader(status int) {
+	if w.wrote || status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.wrote = true
+	s, err := w.f.call(w.c, "on_response", uint64(uint32(status)))
+
+	switch {
+	case err != nil:
+		setLogField(w.c.req, "wasm", err.Error())
+		status = http.StatusInternalServerError
+	case s != 0:
+		status = int(s)
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *wasmWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *wasmWriter) Flush() {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *wasmWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withWASM filters requests, and their responses, through the module.
+// Requests are answered with 500 Internal Server Error if the module traps,
+// and the trap is logged.
+func withWASM(f *wasmFilter, h http.Handler) http.Handler {
+	onResponse := f.m.exported("on_response")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := &wasmCall{w: w, req: req}
+		status, err := f.call(c, "on_request")
+
+		if err != nil {
+			setLogField(req, "wasm", err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+
+		if status != 0 {
+			http.Error(w, http.StatusText(int(status)), int(status))
+			return
+		}
+
+		if onResponse {
+			w = &wasmWriter{ResponseWriter: w, f: f, c: c}
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
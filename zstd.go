@@ -0,0 +1,568 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// zstdWriter compresses to the Zstandard format (RFC 8878). Literals are
+// Huffman coded and sequences use the predefined FSE distributions, which
+// trades some ratio for a small encoder.
+type zstdWriter struct {
+	w       io.Writer
+	m       *matcher
+	buf     []byte
+	started bool
+	err     error
+
+	seqs []lzSeq
+	lits []byte
+	out  []byte
+}
+
+// Predefined distributions of literal lengths, match lengths and offsets.
+var (
+	zstdLLNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}
+	zstdMLNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}
+	zstdOFNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	zstdLL = newFSETable(zstdLLNorm, 6)
+	zstdML = newFSETable(zstdMLNorm, 6)
+	zstdOF = newFSETable(zstdOFNorm, 5)
+)
+
+// Baselines and extra bits of literal length and match length codes 16 and
+// up, and 32 and up, respectively.
+var (
+	zstdLLBase = []uint32{16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256,
+		512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLLBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16}
+	zstdMLBase = []uint32{35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131,
+		259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = []uint8{1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16}
+)
+
+// fseTable is an FSE encoding table.
+type fseTable struct {
+	log     uint
+	states  []uint16
+	symbols []fseSymbol
+}
+
+type fseSymbol struct {
+	deltaBits  int32
+	deltaState int32
+}
+
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	spread := make([]int, size)
+	high := size - 1
+
+	for s, n := range norm {
+		if n == -1 {
+			spread[high] = s
+			high--
+		}
+	}
+
+	pos, step := 0, size>>1+size>>3+3
+
+	for s, n := range norm {
+		for i := int16(0); i < n; i++ {
+			spread[pos] = s
+			pos = (pos + step) & (size - 1)
+
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	cumul := make([]int, len(norm)+1)
+
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+
+	if cumul[len(norm)] != size {
+		panic("proxy: invalid FSE distribution")
+	}
+
+	t := &fseTable{
+		log:     log,
+		states:  make([]uint16, size),
+		symbols: make([]fseSymbol, len(norm)),
+	}
+
+	next := append([]int(nil), cumul...)
+
+	for u, s := range spread {
+		t.states[next[s]] = uint16(size + u)
+		next[s]++
+	}
+
+	total := int32(0)
+
+	for s, n := range norm {
+		switch {
+		case n == 0:
+		case n == -1 || n == 1:
+			t.symbols[s] = fseSymbol{
+				deltaBits:  int32(log)<<16 - int32(size),
+				deltaState: total - 1,
+			}
+			total++
+		default:
+			maxBits := int32(log) - int32(highBit(uint32(n-1)))
+			t.symbols[s] = fseSymbol{
+				deltaBits:  maxBits<<16 - int32(n)<<maxBits,
+				deltaState: total - int32(n),
+			}
+			total += int32(n)
+		}
+	}
+
+	return t
+}
+
+// fseState is the state of an FSE encoder.
+type fseState struct {
+	t     *fseTable
+	value uint32
+}
+
+func (st *fseState) init(t *fseTable, s int) {
+	sym := t.symbols[s]
+	bits := uint32(sym.deltaBits+1<<15) >> 16
+	v := bits<<16 - uint32(sym.deltaBits)
+	st.t = t
+	st.value = uint32(t.states[int32(v>>bits)+sym.deltaState])
+}
+
+func (st *fseState) encode(b *bitWriter, s int) {
+	sym := st.t.symbols[s]
+	bits := (st.value + uint32(sym.deltaBits)) >> 16
+	b.write(uint64(st.value), uint(bits))
+	st.value = uint32(st.t.states[int32(st.value>>bits)+sym.deltaState])
+}
+
+func (st *fseState) flush(b *bitWriter) {
+	b.write(uint64(st.value), st.t.log)
+}
+
+func zstdLLCode(v uint32) (code int, extra uint32, bits uint8) {
+	if v < 16 {
+		return int(v), 0, 0
+	}
+
+	i := len(zstdLLBase) - 1
+
+	for zstdLLBase[i] > v {
+		i--
+	}
+
+	return 16 + i, v - zstdLLBase[i], zstdLLBits[i]
+}
+
+func zstdMLCode(v uint32) (code int, extra uint32, bits uint8) {
+	if v < 35 {
+		return int(v - 3), 0, 0
+	}
+
+	i := len(zstdMLBase) - 1
+
+	for zstdMLBase[i] > v {
+		i--
+	}
+
+	return 32 + i, v - zstdMLBase[i], zstdMLBits[i]
+}
+
+// newZstdWriter returns a writer compressing at level, from 1 to 19.
+func newZstdWriter(w io.Writer, level int) *zstdWriter {
+	depth := 1 << uint((level+1)/2)
+
+	if depth > 512 {
+		depth = 512
+	}
+
+	return &zstdWriter{w: w, m: newMatcher(depth, level >= 6)}
+}
+
+func (z *zstdWriter) Reset(w io.Writer) {
+	z.w = w
+	z.m.reset()
+	z.buf = z.buf[:0]
+	z.started = false
+	z.err = nil
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		k := lzBlockSize - len(z.buf)
+
+		if k > len(p) {
+			k = len(p)
+		}
+
+		z.buf = append(z.buf, p[:k]...)
+		p = p[k:]
+
+		if len(z.buf) == lzBlockSize {
+			if err := z.block(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Flush writes the buffered input as a block.
+func (z *zstdWriter) Flush() error {
+	if z.err != nil || len(z.buf) == 0 {
+		return z.err
+	}
+	return z.block(false)
+}
+
+// Close writes the last block, ending the frame.
+func (z *zstdWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+
+	err := z.block(true)
+	z.err = errors.New("proxy: zstd writer closed")
+	return err
+}
+
+func (z *zstdWriter) block(last bool) error {
+	out := z.out[:0]
+
+	if !z.started {
+		// Magic number, then a frame header with no content size,
+		// checksum or dictionary, and a window of 256 KiB.
+		out = append(out, 0x28, 0xb5, 0x2f, 0xfd, 0x00, 8<<3)
+		z.started = true
+	}
+
+	data := z.buf
+	hdr := len(out)
+	out = append(out, 0, 0, 0)
+
+	var typ uint32
+
+	if len(data) > 0 {
+		typ = 2
+		out = z.compress(out, data)
+
+		if len(out)-hdr-3 >= len(data) {
+			typ = 0
+			out = append(out[:hdr+3], data...)
+		}
+	}
+
+	v := uint32(len(out)-hdr-3)<<3 | typ<<1
+
+	if last {
+		v |= 1
+	}
+
+	out[hdr], out[hdr+1], out[hdr+2] = byte(v), byte(v>>8), byte(v>>16)
+
+	z.out = out
+	z.buf = z.buf[:0]
+
+	if _, err := z.w.Write(out); err != nil {
+		z.err = err
+		return err
+	}
+
+	return nil
+}
+
+// compress appends the literals and sequences sections of data.
+func (z *zstdWriter) compress(out, data []byte) []byte {
+	seqs, _ := z.m.parse(data, z.seqs[:0])
+	z.seqs = seqs
+
+	lits := z.lits[:0]
+	p := 0
+
+	for _, s := range seqs {
+		lits = append(lits, data[p:p+s.lit]...)
+		p += s.lit + s.length
+	}
+
+	lits = append(lits, data[p:]...)
+	z.lits = lits
+
+	out = zstdLiterals(out, lits)
+
+	switch n := len(seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		n -= 0x7f00
+		out = append(out, 0xff, byte(n), byte(n>>8))
+	}
+
+	if len(seqs) == 0 {
+		return out
+	}
+
+	// All three codes use the predefined distributions.
+	out = append(out, 0)
+
+	type coded struct {
+		ll, ml, of       int
+		llx, mlx, ofx    uint32
+		llb, mlb, ofbits uint8
+	}
+
+	codes := make([]coded, len(seqs))
+
+	for i, s := range seqs {
+		c := &codes[i]
+		c.ll, c.llx, c.llb = zstdLLCode(uint32(s.lit))
+		c.ml, c.mlx, c.mlb = zstdMLCode(uint32(s.length))
+
+		// Offsets are never coded as repeats.
+		ov := uint32(s.offset + 3)
+		c.ofbits = uint8(highBit(ov))
+		c.of = int(c.ofbits)
+		c.ofx = ov - 1<<c.ofbits
+	}
+
+	b := bitWriter{out: out}
+	var ll, ml, of fseState
+
+	c := &codes[len(codes)-1]
+	ml.init(zstdML, c.ml)
+	of.init(zstdOF, c.of)
+	ll.init(zstdLL, c.ll)
+	b.write(uint64(c.llx), uint(c.llb))
+	b.write(uint64(c.mlx), uint(c.mlb))
+	b.write(uint64(c.ofx), uint(c.ofbits))
+
+	for i := len(codes) - 2; i >= 0; i-- {
+		c := &codes[i]
+		of.encode(&b, c.of)
+		ml.encode(&b, c.ml)
+		ll.encode(&b, c.ll)
+		b.write(uint64(c.llx), uint(c.llb))
+		b.write(uint64(c.mlx), uint(c.mlb))
+		b.write(uint64(c.ofx), uint(c.ofbits))
+	}
+
+	ml.flush(&b)
+	of.flush(&b)
+	ll.flush(&b)
+	b.write(1, 1)
+	b.align()
+
+	return b.out
+}
+
+// zstdLiterals appends the literals section, Huffman coded when that is
+// smaller.
+func zstdLiterals(out, lits []byte) []byte {
+	if enc := zstdHuffman(lits); enc != nil && len(enc) < len(lits) {
+		return append(out, enc...)
+	}
+
+	switch n := len(lits); {
+	case n < 32:
+		out = append(out, byte(n<<3))
+	case n < 4096:
+		out = append(out, byte(n<<4|1<<2), byte(n>>4))
+	default:
+		out = append(out, byte(n<<4|3<<2), byte(n>>4), byte(n>>12))
+	}
+
+	return append(out, lits...)
+}
+
+// zstdHuffman returns the Huffman coded literals section of lits, or nil if
+// they cannot be described directly, which requires symbols below 128.
+func zstdHuffman(lits []byte) []byte {
+	if len(lits) < 64 {
+		return nil
+	}
+
+	counts := make([]uint32, 256)
+	maxSym := 0
+
+	for _, c := range lits {
+		counts[c]++
+
+		if int(c) > maxSym {
+			maxSym = int(c)
+		}
+	}
+
+	if maxSym >= 128 {
+		return nil
+	}
+
+	lengths := huffmanLengths(counts[:maxSym+1], 11, nil)
+	used := 0
+	maxLen := uint8(0)
+
+	for _, l := range lengths {
+		if l != 0 {
+			used++
+		}
+
+		if l > maxLen {
+			maxLen = l
+		}
+	}
+
+	if used < 2 {
+		return nil
+	}
+
+	// Weights are implied for the last symbol, which must be used.
+	var weights []byte
+
+	for _, l := range lengths[:maxSym] {
+		w := byte(0)
+
+		if l != 0 {
+			w = maxLen + 1 - l
+		}
+
+		weights = append(weights, w)
+	}
+
+	tree := []byte{byte(127 + len(weights))}
+
+	for i := 0; i < len(weights); i += 2 {
+		v := weights[i] << 4
+
+		if i+1 < len(weights) {
+			v |= weights[i+1]
+		}
+
+		tree = append(tree, v)
+	}
+
+	// Unlike in deflate, longer codes take the smaller values. The
+	// decoder reads codes most significant bit first, from the end of
+	// each stream, so they are written in reverse order of symbols.
+	var count, start [12]uint16
+
+	for _, l := range lengths {
+		count[l]++
+	}
+
+	for l := maxLen - 1; l > 0; l-- {
+		start[l] = (start[l+1] + count[l+1]) >> 1
+	}
+
+	msb := make([]uint16, len(lengths))
+
+	for s, l := range lengths {
+		if l != 0 {
+			msb[s] = start[l]
+			start[l]++
+		}
+	}
+
+	stream := func(part []byte) []byte {
+		b := bitWriter{}
+
+		for i := len(part) - 1; i >= 0; i-- {
+			s := part[i]
+			b.write(uint64(msb[s]), uint(lengths[s]))
+		}
+
+		b.write(1, 1)
+		b.align()
+		return b.out
+	}
+
+	var body []byte
+	single := len(lits) < 1024
+
+	if single {
+		body = stream(lits)
+	} else {
+		seg := (len(lits) + 3) / 4
+		var parts [4][]byte
+
+		for i := range parts {
+			lo, hi := i*seg, (i+1)*seg
+
+			if hi > len(lits) {
+				hi = len(lits)
+			}
+
+			if lo > hi {
+				lo = hi
+			}
+
+			parts[i] = stream(lits[lo:hi])
+		}
+
+		body = make([]byte, 6)
+
+		for i := 0; i < 3; i++ {
+			binary.LittleEndian.PutUint16(body[2*i:], uint16(len(parts[i])))
+		}
+
+		for _, p := range parts {
+			body = append(body, p...)
+		}
+	}
+
+	regen, comp := len(lits), len(tree)+len(body)
+
+	var hdr []byte
+
+	switch {
+	case single && regen < 1024 && comp < 1024:
+		// Size format 0: one stream, 10-bit sizes.
+		v := uint32(2) | uint32(regen)<<4 | uint32(comp)<<14
+		hdr = []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+	case single:
+		return nil
+	case regen < 1<<10 && comp < 1<<10:
+		v := uint32(2) | 1<<2 | uint32(regen)<<4 | uint32(comp)<<14
+		hdr = []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+	case regen < 1<<14 && comp < 1<<14:
+		v := uint64(2) | 2<<2 | uint64(regen)<<4 | uint64(comp)<<18
+		hdr = []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+	case regen < 1<<18 && comp < 1<<18:
+		v := uint64(2) | 3<<2 | uint64(regen)<<4 | uint64(comp)<<22
+		hdr = []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24),
+			byte(v >> 32)}
+	default:
+		return nil
+	}
+
+	return append(append(hdr, tree...), body...)
+}
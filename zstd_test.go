@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+)
+
+// TestZstdWriter checks round trips through the reference decoder, if it is
+// installed.
+func TestZstdWriter(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+
+	if err != nil {
+		t.Skip("zstd not installed")
+	}
+
+	for name, in := range compressInputs() {
+		for _, level := range []int{1, 3, 19} {
+			var buf bytes.Buffer
+			z := newZstdWriter(&buf, level)
+
+			// Flush midway, as for streamed responses.
+			half := len(in) / 2
+
+			if _, err := z.Write(in[:half]); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := z.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := z.Write(in[half:]); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := z.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var stderr bytes.Buffer
+			cmd := exec.Command(zstd, "-d", "-c", "-q")
+			cmd.Stdin = bytes.NewReader(buf.Bytes())
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+
+			if err != nil {
+				t.Errorf("%s, level %d: %v: %s", name, level, err, stderr.Bytes())
+				continue
+			}
+
+			if !bytes.Equal(out, in) {
+				t.Errorf("%s, level %d: round trip differs", name, level)
+			}
+
+			if name == "text" && buf.Len() > len(in)/20 {
+				t.Errorf("%s, level %d: compressed to %d of %d bytes",
+					name, level, buf.Len(), len(in))
+			}
+		}
+	}
+}
+
+func TestZstdWriterReset(t *testing.T) {
+	var a, b bytes.Buffer
+	z := newZstdWriter(&a, 3)
+	z.Write([]byte("first response"))
+	z.Close()
+	n := a.Len()
+
+	z.Reset(&b)
+	z.Write([]byte("first response"))
+	z.Close()
+
+	if a.Len() != n || !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("after reset, output differs: %x, want %x", b.Bytes(), a.Bytes())
+	}
+}